@@ -13,4 +13,8 @@ popd
 
 pushd $script_dir/src/bench
 go build -o init_social.out
-popd
\ No newline at end of file
+popd
+
+pushd $script_dir/src/admin
+go build -o admin.out
+popd
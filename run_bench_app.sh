@@ -0,0 +1,20 @@
+#!/bin/bash
+# Deploys the app for the benchmark clients of src/bench and src/client, which
+# send no login tokens. The deployment uses weaver_bench.toml, a copy of
+# weaver.toml with disable_auth and benchmark_mode set, so that requests act
+# for the users they name and password hashes are cheap, and with a random
+# token_secret if none is set. Never expose it to real users.
+script_dir="$(dirname "$0")"
+
+pushd $script_dir/src/server
+token_secret="$(head -c 32 /dev/urandom | od -An -tx1 | tr -d ' \n')"
+sed -e 's/^disable_auth = false$/disable_auth = true/' \
+    -e 's/^benchmark_mode = false$/benchmark_mode = true/' \
+    -e "s/^token_secret = \"\"$/token_secret = \"$token_secret\"/" \
+    weaver.toml > weaver_bench.toml
+if ! grep -q '^disable_auth = true$' weaver_bench.toml; then
+    echo "weaver_bench.toml: cannot set disable_auth = true" >&2
+    exit 1
+fi
+weaver multi deploy weaver_bench.toml
+popd
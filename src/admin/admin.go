@@ -0,0 +1,245 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"SocialNetwork/shared/api"
+	"SocialNetwork/shared/common"
+)
+
+const MAX_REPORTED_PROBLEMS = 20
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  admin backup  [-addr URL] [-token TOKEN] -file FILE   dump the storage of a deployment to FILE
+  admin restore [-addr URL] [-token TOKEN] -file FILE   load FILE into a deployment
+  admin check   -file FILE                              check the consistency of FILE
+  admin stats   [-addr URL]                            print the size of the storage maps
+  admin unlock  [-addr URL] [-token TOKEN] -user NAME   lift the lockout of NAME after failed logins
+
+-addr defaults to the admin listener, or to the api listener for stats.
+-token defaults to $SN_ADMIN_TOKEN and must match admin_token in weaver.toml.
+`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	addr := flags.String("addr", "", "address of the admin listener, or of the api listener for stats")
+	token := flags.String("token", os.Getenv("SN_ADMIN_TOKEN"), "admin token of the deployment")
+	filename := flags.String("file", "", "storage dump file")
+	force := flags.Bool("force", false, "restore even if the dump is inconsistent")
+	username := flags.String("user", "", "username to unlock")
+	flags.Parse(os.Args[2:])
+	if *addr == "" {
+		*addr = "http://localhost:" + api.ADMIN_PORT
+		if os.Args[1] == "stats" {
+			*addr = "http://localhost:" + api.BASE_PORT
+		}
+	}
+	switch os.Args[1] {
+	case "stats":
+	case "unlock":
+		if *username == "" {
+			usage()
+		}
+	default:
+		if *filename == "" {
+			usage()
+		}
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		err = backup(*addr, *token, *filename)
+	case "restore":
+		err = restore(*addr, *token, *filename, *force)
+	case "check":
+		var file *api.StorageDumpFile
+		file, err = readDump(*filename)
+		if err == nil && !check(&file.Dump) {
+			os.Exit(1)
+		}
+	case "stats":
+		err = stats(*addr)
+	case "unlock":
+		err = api.UnlockUser(*addr, *token, *username)
+		if err == nil {
+			fmt.Printf("[Admin] Unlocked %s\n", *username)
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Println("[Admin] Error:", err)
+		os.Exit(1)
+	}
+}
+
+func backup(addr, token, filename string) error {
+	dump, err := api.ExportStorage(addr, token)
+	if err != nil {
+		return err
+	}
+	printCounts("Exported", &dump)
+	check(&dump)
+
+	// Write to a temporary file first so that a failed backup does not
+	// clobber an existing one.
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = api.WriteStorageDump(f, &api.StorageDumpFile{
+		Format:    api.STORAGE_DUMP_FORMAT,
+		Version:   api.STORAGE_DUMP_VERSION,
+		CreatedAt: time.Now().UnixMilli(),
+		Dump:      dump,
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	fmt.Printf("[Admin] Wrote %s\n", filename)
+	return nil
+}
+
+func restore(addr, token, filename string, force bool) error {
+	file, err := readDump(filename)
+	if err != nil {
+		return err
+	}
+	if !check(&file.Dump) && !force {
+		return fmt.Errorf("%s is inconsistent; pass -force to restore it anyway", filename)
+	}
+	if err := api.ImportStorage(addr, token, &file.Dump); err != nil {
+		return err
+	}
+
+	// Read everything back to make sure that it all landed.
+	loaded, err := api.ExportStorage(addr, token)
+	if err != nil {
+		return err
+	}
+	printCounts("Restored", &loaded)
+	if missing := countMissing(&file.Dump, &loaded); missing > 0 {
+		return fmt.Errorf("%d keys of %s are missing after the restore", missing, filename)
+	}
+	check(&loaded)
+	return nil
+}
+
+func stats(addr string) error {
+	report, err := api.GetStorageStats(addr)
+	if err != nil {
+		return err
+	}
+	for _, replica := range report.Replicas {
+		fmt.Printf("%s (%s)\n", replica.Replica, replica.Role)
+		printMapStats(replica.Maps)
+	}
+	fmt.Println("total")
+	printMapStats(report.Total)
+	return nil
+}
+
+func printMapStats(maps []common.StorageMapStats) {
+	for _, m := range maps {
+		fmt.Printf("  %-16s %10d entries %12d items %14d bytes\n", m.Map, m.Entries, m.Items, m.Bytes)
+	}
+}
+
+func readDump(filename string) (*api.StorageDumpFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file, err := api.ReadStorageDump(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	fmt.Printf("[Admin] %s: version %d, created at %s\n",
+		filename, file.Version, time.UnixMilli(file.CreatedAt).Format(time.RFC3339))
+	printCounts("Read", &file.Dump)
+	return file, nil
+}
+
+// check prints the inconsistencies of dump and reports whether there are
+// none.
+func check(dump *common.StorageDump) bool {
+	problems := api.CheckStorageDump(dump)
+	for i, problem := range problems {
+		if i == MAX_REPORTED_PROBLEMS {
+			fmt.Printf("[Admin] ... and %d more\n", len(problems)-i)
+			break
+		}
+		fmt.Println("[Admin] Inconsistent:", problem)
+	}
+	if len(problems) == 0 {
+		fmt.Println("[Admin] Timelines, posts, follow, block, mute and follow request edges and user ids are consistent")
+	}
+	return len(problems) == 0
+}
+
+func printCounts(what string, dump *common.StorageDump) {
+	fmt.Printf("[Admin] %s %d profiles, %d posts, %d media, %d short urls, "+
+		"%d follower lists, %d followee lists, %d user timelines, %d home timelines, %d user ids, "+
+		"%d block lists, %d mute lists, %d follow request lists\n",
+		what, len(dump.UserProfiles), len(dump.Posts), len(dump.MediaData), len(dump.ShortUrls),
+		len(dump.Followers), len(dump.Followees), len(dump.UserTimelines), len(dump.HomeTimelines),
+		len(dump.UserIds), len(dump.Blocked), len(dump.Muted), len(dump.Requested))
+}
+
+// countMissing returns the number of keys of want that are not in got. Empty
+// follow, block, mute and follow request lists and timelines are not restored and are not
+// counted.
+func countMissing(want, got *common.StorageDump) int {
+	return missingKeys(want.UserProfiles, got.UserProfiles, nil) +
+		missingKeys(want.Posts, got.Posts, nil) +
+		missingKeys(want.MediaData, got.MediaData, nil) +
+		missingKeys(want.ShortUrls, got.ShortUrls, nil) +
+		missingKeys(want.Followers, got.Followers, func(l []int64) int { return len(l) }) +
+		missingKeys(want.Followees, got.Followees, func(l []int64) int { return len(l) }) +
+		missingKeys(want.UserTimelines, got.UserTimelines, func(l []common.TimelineEntry) int { return len(l) }) +
+		missingKeys(want.HomeTimelines, got.HomeTimelines, func(l []common.TimelineEntry) int { return len(l) }) +
+		missingKeys(want.UserIds, got.UserIds, nil) +
+		missingKeys(want.Blocked, got.Blocked, func(l []int64) int { return len(l) }) +
+		missingKeys(want.Blockers, got.Blockers, func(l []int64) int { return len(l) }) +
+		missingKeys(want.Muted, got.Muted, func(l []int64) int { return len(l) }) +
+		missingKeys(want.Muters, got.Muters, func(l []int64) int { return len(l) }) +
+		missingKeys(want.Requested, got.Requested, func(l []int64) int { return len(l) }) +
+		missingKeys(want.Requesters, got.Requesters, func(l []int64) int { return len(l) })
+}
+
+// missingKeys returns the number of keys of want that are not in got, skipping
+// the values for which size returns zero if size is not nil.
+func missingKeys[K comparable, V any](want, got map[K]V, size func(V) int) int {
+	missing := 0
+	for k, v := range want {
+		if size != nil && size(v) == 0 {
+			continue
+		}
+		if _, ok := got[k]; !ok {
+			missing++
+		}
+	}
+	return missing
+}
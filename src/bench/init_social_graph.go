@@ -232,6 +232,8 @@ func compose(addr string, nodes int) {
 	wg.Wait()
 }
 
+// The requests carry no login tokens, so the app must be deployed with
+// disable_auth = true, e.g. with run_bench_app.sh.
 func main() {
 	addr := "http://localhost:49555"
 	filepath := "./social-graph/socfb-Reed98/socfb-Reed98.mtx"
@@ -287,6 +287,9 @@ func setupTestUsers(client *SingleThreadClient, numUsers int) error {
 	}
 	return nil
 }
+
+// The requests carry no login tokens, so the app must be deployed with
+// disable_auth = true, e.g. with run_bench_app.sh.
 func main() {
 	client := &SingleThreadClient{}
 	client.Init()
@@ -8,6 +8,8 @@ require (
 	github.com/google/btree v1.1.2
 	go.opentelemetry.io/otel v1.19.0
 	go.opentelemetry.io/otel/trace v1.19.0
+	golang.org/x/crypto v0.17.0
+	modernc.org/sqlite v1.24.0
 )
 
 replace github.com/ServiceWeaver/weaver => github.com/hjzccc/weaver v0.0.0-20250410210437-8c1c5251e184
@@ -51,7 +53,6 @@ require (
 	modernc.org/mathutil v1.5.0 // indirect
 	modernc.org/memory v1.5.0 // indirect
 	modernc.org/opt v0.1.3 // indirect
-	modernc.org/sqlite v1.24.0 // indirect
 	modernc.org/strutil v1.1.3 // indirect
 	modernc.org/token v1.0.1 // indirect
 )
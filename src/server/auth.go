@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The endpoints that act on behalf of a user require the access token issued
+// by /login or /refresh, sent as "Authorization: Bearer <token>", and only act
+// for the user of the token: a request that names another user id or username
+// is refused. Reads of public data need no token, except that the user
+// timeline of a private user is only read with the token of the user or of a
+// follower; see follow_requests.go. Setting disable_auth skips
+// the checks, e.g. for benchmark clients that do not log in; /logout always
+// needs a token, since it names the session to end.
+//
+// The admin endpoints are only served on the admin listener, which is not
+// public, and require admin_token as their bearer token whether or not
+// disable_auth is set. They refuse every request while admin_token is empty.
+
+const (
+	AUTH_HEADER   = "Authorization"
+	BEARER_PREFIX = "Bearer "
+)
+
+type appConfig struct {
+	DisableAuth bool `toml:"disable_auth"`
+	// Each client address may try /login LoginIpMaxAttempts times per
+	// LoginIpWindowSec; 0 means the default. See login_throttle.go.
+	LoginIpMaxAttempts int `toml:"login_ip_max_attempts"`
+	LoginIpWindowSec   int `toml:"login_ip_window_sec"`
+	// AdminToken is the bearer token of the admin endpoints.
+	AdminToken string `toml:"admin_token"`
+}
+
+type authenticator struct {
+	backend  BackendServicer
+	disabled bool
+}
+
+// any_user is the user check of the endpoints that any signed in user may
+// call.
+func any_user(Creator) bool {
+	return true
+}
+
+// reader returns the user id of the token of a request that reads the data of
+// owner, or 0 if the request has no token. It writes an error response and
+// returns false if the token is not valid. With auth disabled, requests read
+// as the owner.
+func (a *authenticator) reader(w http.ResponseWriter, r *http.Request, owner int64) (int64, bool) {
+	if a.disabled {
+		return owner, true
+	}
+	token, found := bearer_token(r)
+	if !found {
+		return 0, true
+	}
+	user, err := a.backend.Authenticate(context.Background(), token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return 0, false
+	}
+	return user.UserId, true
+}
+
+// bearer_token returns the token of the Authorization header of the request.
+func bearer_token(r *http.Request) (string, bool) {
+	token, found := strings.CutPrefix(r.Header.Get(AUTH_HEADER), BEARER_PREFIX)
+	return token, found && token != ""
+}
+
+// authorize_admin checks that the request carries the admin token. It writes
+// an error response and returns false if it does not.
+func authorize_admin(w http.ResponseWriter, r *http.Request, admin_token string) bool {
+	if admin_token == "" {
+		http.Error(w, "admin endpoints are disabled until admin_token is set", http.StatusForbidden)
+		return false
+	}
+	token, found := bearer_token(r)
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(admin_token)) != 1 {
+		log.Default().Printf("%s: request from %s without the admin token\n", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "missing or wrong admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// authorize authenticates the request and checks that its token is for the
+// user that is_user expects. It writes an error response and returns false
+// when either fails.
+func (a *authenticator) authorize(w http.ResponseWriter, r *http.Request, is_user func(Creator) bool) bool {
+	if a.disabled {
+		return true
+	}
+	token, found := bearer_token(r)
+	if !found {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return false
+	}
+	user, err := a.backend.Authenticate(context.Background(), token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if !is_user(user) {
+		log.Default().Printf("%s: token of user %d used for another user\n", r.URL.Path, user.UserId)
+		http.Error(w, "token is for another user", http.StatusForbidden)
+		return false
+	}
+	return true
+}
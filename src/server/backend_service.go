@@ -12,19 +12,60 @@ import (
 type BackendServicer interface {
 	RemovePosts(context.Context, int64, int, int) error
 	CompostPost(context.Context, string, int64, string, []int64, []string, PostType) error
-	Login(context.Context, string, string) (string, error)
+	Login(context.Context, string, string) (AuthTokens, error)
+	// Authenticate returns the user of an access token issued by Login or
+	// Refresh.
+	Authenticate(context.Context, string) (Creator, error)
+	Refresh(context.Context, string) (AuthTokens, error)
+	Logout(context.Context, string, bool) error
+	// UnlockUser lifts the lockout of a username after failed logins.
+	UnlockUser(context.Context, string) error
 	RegisterUser(context.Context, string, string, string, string) error
 	RegisterUserWithId(context.Context, string, string, string, string, int64) error
-	ReadUserTimeline(context.Context, int64, int, int) ([]Post, error)
+	// ReadUserTimeline and ReadUserTimelinePage take the id of the reader,
+	// or 0 for an anonymous reader, before the id of the user.
+	ReadUserTimeline(context.Context, int64, int64, int, int) ([]Post, error)
+	ReadUserTimelinePage(context.Context, int64, int64, string, TimelineDirection, int, int) (TimelinePage, error)
 	GetFollowers(context.Context, int64) ([]int64, error)
 	Unfollow(context.Context, int64, int64) error
 	UnfollowWithUsername(context.Context, string, string) error
-	Follow(context.Context, int64, int64) error
-	FollowWithUsername(context.Context, string, string) error
+	// Follow and FollowWithUsername report whether the follow is a pending
+	// request to a private user.
+	Follow(context.Context, int64, int64) (bool, error)
+	FollowWithUsername(context.Context, string, string) (bool, error)
 	GetFollowees(context.Context, int64) ([]int64, error)
+	Block(context.Context, int64, int64) error
+	Unblock(context.Context, int64, int64) error
+	Mute(context.Context, int64, int64) error
+	Unmute(context.Context, int64, int64) error
+	GetBlocked(context.Context, int64) ([]int64, error)
+	GetMuted(context.Context, int64) ([]int64, error)
+	ApproveFollower(context.Context, int64, int64) error
+	RejectFollower(context.Context, int64, int64) error
+	GetFollowRequests(context.Context, int64) ([]int64, error)
+	GetFollowCounts(context.Context, int64) (int, int, error)
+	GetFollowersPage(context.Context, int64, string, int) (UserIdPage, error)
+	GetFolloweesPage(context.Context, int64, string, int) (UserIdPage, error)
+	IsFollowing(context.Context, int64, int64) (bool, error)
+	// GetUserInfos returns the profiles of the user ids that exist.
+	GetUserInfos(context.Context, []int64) (map[int64]UserInfo, error)
+	GetProfile(context.Context, int64) (UserInfo, bool, error)
+	UpdateProfile(context.Context, int64, string, string, string, string) error
+	ChangePassword(context.Context, int64, string, string) error
+	DeleteUser(context.Context, int64) error
+	SetPrivate(context.Context, int64, bool) error
+	SearchUsers(context.Context, string, UserSearchMode, string, int) (UserSearchPage, error)
 	ReadHomeTimeline(context.Context, int64, int, int) ([]Post, error)
+	ReadHomeTimelinePage(context.Context, int64, string, TimelineDirection, int, int) (TimelinePage, error)
 	UploadMedia(context.Context, string, string) error
 	GetMedia(context.Context, string) (string, error)
+	// ExportStorage and ImportStorage back up and restore all the data.
+	ExportStorage(context.Context) (StorageDump, error)
+	ImportStorage(context.Context, StorageDump) error
+	GetStorageStats(context.Context) (StorageStatsReport, error)
+	// SweepExpired removes the expired entries now rather than at the next
+	// periodic sweep, and returns the number of expired posts.
+	SweepExpired(context.Context) (int, error)
 }
 
 type BackendService struct {
@@ -40,14 +81,53 @@ type BackendService struct {
 	uniqueIdService     weaver.Ref[IUniqueIdService]
 	mediaStorageService weaver.Ref[MediaStorageServicer]
 	mediaService        weaver.Ref[IMediaService]
+	storage             weaver.Ref[IStorage]
+	expiryService       weaver.Ref[IExpiryService]
+	transactionService  weaver.Ref[ITransactionService]
 }
 
-func (bs *BackendService) Login(ctx context.Context, username string, password string) (string, error) {
-	variant, err := bs.userService.Get().Login(ctx, username, password)
-	if err != nil {
-		panic(err)
-	}
-	return variant, nil
+func (bs *BackendService) Login(ctx context.Context, username string, password string) (AuthTokens, error) {
+	return bs.userService.Get().Login(ctx, username, password)
+}
+
+func (bs *BackendService) Authenticate(ctx context.Context, token string) (Creator, error) {
+	return bs.userService.Get().VerifyToken(ctx, token)
+}
+
+func (bs *BackendService) Refresh(ctx context.Context, refreshToken string) (AuthTokens, error) {
+	return bs.userService.Get().Refresh(ctx, refreshToken)
+}
+
+func (bs *BackendService) Logout(ctx context.Context, accessToken string, allSessions bool) error {
+	return bs.userService.Get().Logout(ctx, accessToken, allSessions)
+}
+
+func (bs *BackendService) UnlockUser(ctx context.Context, username string) error {
+	return bs.userService.Get().UnlockUser(ctx, username)
+}
+
+func (bs *BackendService) GetProfile(ctx context.Context, user_id int64) (UserInfo, bool, error) {
+	return bs.userService.Get().GetUserInfo(ctx, user_id)
+}
+
+func (bs *BackendService) UpdateProfile(ctx context.Context, user_id int64, first_name, last_name, bio, avatar string) error {
+	return bs.userService.Get().UpdateProfile(ctx, user_id, first_name, last_name, bio, avatar)
+}
+
+func (bs *BackendService) ChangePassword(ctx context.Context, user_id int64, old_password, new_password string) error {
+	return bs.userService.Get().ChangePassword(ctx, user_id, old_password, new_password)
+}
+
+func (bs *BackendService) DeleteUser(ctx context.Context, user_id int64) error {
+	return bs.userService.Get().DeleteUser(ctx, user_id)
+}
+
+func (bs *BackendService) SetPrivate(ctx context.Context, user_id int64, private bool) error {
+	return bs.userService.Get().SetPrivate(ctx, user_id, private)
+}
+
+func (bs *BackendService) SearchUsers(ctx context.Context, query string, mode UserSearchMode, cursor string, limit int) (UserSearchPage, error) {
+	return bs.userService.Get().SearchUsers(ctx, query, mode, cursor, limit)
 }
 
 func (bs *BackendService) RegisterUser(
@@ -58,8 +138,7 @@ func (bs *BackendService) RegisterUser(
 	password string,
 ) error {
 	// run UserService
-	bs.userService.Get().RegisterUser(ctx, first_name, last_name, username, password)
-	return nil
+	return bs.userService.Get().RegisterUser(ctx, first_name, last_name, username, password)
 }
 
 func (bs *BackendService) RegisterUserWithId(
@@ -71,24 +150,21 @@ func (bs *BackendService) RegisterUserWithId(
 	user_id int64,
 ) error {
 	// run UserService
-	bs.userService.Get().RegisterUserWithId(ctx, first_name, last_name, username, password, user_id)
-	return nil
+	return bs.userService.Get().RegisterUserWithId(ctx, first_name, last_name, username, password, user_id)
 }
 
+// RemovePosts removes each post together with its timeline entries and short
+// urls in one transaction, so that no timeline is left with a removed post.
 func (bs *BackendService) RemovePosts(ctx context.Context, user_id int64, start, top int) error {
 	// run UserTimelineService
 	// run SocialGraphService
-	// run PostStorageService
-	// run HomeTimelineService
-	// run UrlShortenService
+	// run TransactionService
 	utls := bs.userTimelineService.Get()
 	sgs := bs.socialGraphService.Get()
-	pss := bs.postStorageService.Get()
-	htls := bs.homeTimelineService.Get()
-	uss := bs.urlShortenService.Get()
+	ts := bs.transactionService.Get()
 
 	posts_fu := common.AsyncExec(func() interface{} {
-		r, _ := utls.ReadUserTimeline(ctx, user_id, start, top)
+		r, _ := utls.ReadUserTimeline(ctx, user_id, user_id, start, top)
 		return r
 	})
 
@@ -100,58 +176,47 @@ func (bs *BackendService) RemovePosts(ctx context.Context, user_id int64, start,
 	posts := posts_fu.Await().([]Post)
 	followers := followers_fu.Await().([]int64)
 
-	remove_posts_fus := make([]common.Future, 0)
-	remove_from_timeline_fus := make([]common.Future, 0)
-	remove_short_url_fus := make([]common.Future, 0)
+	remove_posts_fus := make([]common.Future, 0, len(posts))
 
 	for _, post := range posts {
+		mutations := removePostMutations(user_id, post, followers)
 		remove_posts_fus = append(remove_posts_fus, common.AsyncExec(func() interface{} {
-			result, _ := pss.RemovePost(ctx, post.Post_id)
-			return result
+			_, err := ts.Commit(ctx, StorageTransaction{Mutations: mutations})
+			return err
 		}).(common.Future))
+	}
 
-		remove_from_timeline_fus = append(remove_from_timeline_fus, common.AsyncExec(func() interface{} {
-			utls.RemovePost(ctx, user_id, post.Post_id, post.Timestamp)
-			return nil
-		}).(common.Future))
-
-		for _, mention := range post.User_mentions {
-			remove_short_url_fus = append(remove_short_url_fus, common.AsyncExec(func() interface{} {
-				htls.RemovePost(ctx, mention.UserId, post.Post_id, post.Timestamp)
-				return nil
-			}).(common.Future))
-		}
-
-		for _, user_id := range followers {
-			remove_from_timeline_fus = append(remove_from_timeline_fus, common.AsyncExec(func() interface{} {
-				utls.RemovePost(ctx, user_id, post.Post_id, post.Timestamp)
-				return nil
-			}).(common.Future))
-		}
-
-		shortened_urls := make([]string, 0)
-		for _, url := range post.Urls {
-			shortened_urls = append(shortened_urls, url.ShortenedUrl)
+	var err error
+	for _, fu := range remove_posts_fus {
+		if e, _ := fu.Await().(error); e != nil && err == nil {
+			err = e
 		}
-
-		remove_short_url_fus = append(remove_short_url_fus, common.AsyncExec(func() interface{} {
-			uss.RemoveUrls(ctx, shortened_urls)
-			return nil
-		}).(common.Future))
 	}
+	return err
+}
 
-	// This blocking call is not necessary in the original code
-	for _, fu := range remove_posts_fus {
-		fu.Await()
+// removePostMutations returns the mutations that remove the post of the user
+// together with its entries in the user timeline, in the home timelines of
+// the followers and of the mentioned users, and its short urls. The post
+// itself comes first, so that the transaction is ordered with any other one
+// on the post.
+func removePostMutations(user_id int64, post Post, followers []int64) []StorageMutation {
+	mutations := []StorageMutation{
+		{Op: OP_REMOVE_POST, IntKey: post.Post_id},
+		{Op: OP_REMOVE_POST_TIMELINE, IntKey: user_id, IntVal: post.Post_id, Timestamp: post.Timestamp, Kind: USER_TIMELINE},
 	}
-	for _, fu := range remove_from_timeline_fus {
-		fu.Await()
+	home_timeline_ids := make([]int64, 0, len(followers)+len(post.User_mentions))
+	home_timeline_ids = append(home_timeline_ids, followers...)
+	for _, mention := range post.User_mentions {
+		home_timeline_ids = append(home_timeline_ids, mention.UserId)
 	}
-	for _, fu := range remove_short_url_fus {
-		fu.Await()
+	for _, id := range home_timeline_ids {
+		mutations = append(mutations, StorageMutation{Op: OP_REMOVE_POST_TIMELINE, IntKey: id, IntVal: post.Post_id, Timestamp: post.Timestamp, Kind: HOME_TIMELINE})
 	}
-
-	return nil
+	for _, url := range post.Urls {
+		mutations = append(mutations, StorageMutation{Op: OP_REMOVE_SHORTEN_URL, StrKey: url.ShortenedUrl})
+	}
+	return mutations
 }
 
 func (bs *BackendService) CompostPost(
@@ -179,7 +244,7 @@ func (bs *BackendService) CompostPost(
 	post_storage_service := bs.postStorageService.Get()
 
 	text_fu := common.AsyncExec(func() interface{} {
-		r, _ := text_service.ComposeText(ctx, text)
+		r, _ := text_service.ComposeText(ctx, user_id, text)
 		return r
 	})
 	unique_id_fu := common.AsyncExec(func() interface{} {
@@ -237,12 +302,25 @@ func (bs *BackendService) CompostPost(
 
 func (bs *BackendService) ReadUserTimeline(
 	ctx context.Context,
+	reader_id int64,
 	user_id int64,
 	start, stop int,
 ) ([]Post, error) {
 	// run ReadUserTimelineService
 	utls := bs.userTimelineService.Get()
-	return utls.ReadUserTimeline(ctx, user_id, start, stop)
+	return utls.ReadUserTimeline(ctx, reader_id, user_id, start, stop)
+}
+
+func (bs *BackendService) ReadUserTimelinePage(
+	ctx context.Context,
+	reader_id int64,
+	user_id int64,
+	cursor string,
+	direction TimelineDirection,
+	start, stop int,
+) (TimelinePage, error) {
+	utls := bs.userTimelineService.Get()
+	return utls.ReadUserTimelinePage(ctx, reader_id, user_id, cursor, direction, start, stop)
 }
 
 func (bs *BackendService) GetFollowers(ctx context.Context, user_id int64) ([]int64, error) {
@@ -262,16 +340,14 @@ func (bs *BackendService) UnfollowWithUsername(ctx context.Context, user_usernam
 	return nil
 }
 
-func (bs *BackendService) Follow(ctx context.Context, user_id int64, followee_id int64) error {
+func (bs *BackendService) Follow(ctx context.Context, user_id int64, followee_id int64) (bool, error) {
 	sgs := bs.socialGraphService.Get()
-	sgs.Follow(ctx, user_id, followee_id)
-	return nil
+	return sgs.Follow(ctx, user_id, followee_id)
 }
 
-func (bs *BackendService) FollowWithUsername(ctx context.Context, user_username string, followee_username string) error {
+func (bs *BackendService) FollowWithUsername(ctx context.Context, user_username string, followee_username string) (bool, error) {
 	sgs := bs.socialGraphService.Get()
-	sgs.FollowWithUsername(ctx, user_username, followee_username)
-	return nil
+	return sgs.FollowWithUsername(ctx, user_username, followee_username)
 }
 
 func (bs *BackendService) GetFollowees(ctx context.Context, user_id int64) ([]int64, error) {
@@ -279,11 +355,79 @@ func (bs *BackendService) GetFollowees(ctx context.Context, user_id int64) ([]in
 	return sgs.GetFollowees(ctx, user_id)
 }
 
+func (bs *BackendService) Block(ctx context.Context, user_id int64, blocked_id int64) error {
+	return bs.socialGraphService.Get().Block(ctx, user_id, blocked_id)
+}
+
+func (bs *BackendService) Unblock(ctx context.Context, user_id int64, blocked_id int64) error {
+	return bs.socialGraphService.Get().Unblock(ctx, user_id, blocked_id)
+}
+
+func (bs *BackendService) Mute(ctx context.Context, user_id int64, muted_id int64) error {
+	return bs.socialGraphService.Get().Mute(ctx, user_id, muted_id)
+}
+
+func (bs *BackendService) Unmute(ctx context.Context, user_id int64, muted_id int64) error {
+	return bs.socialGraphService.Get().Unmute(ctx, user_id, muted_id)
+}
+
+func (bs *BackendService) GetBlocked(ctx context.Context, user_id int64) ([]int64, error) {
+	return bs.socialGraphService.Get().GetBlocked(ctx, user_id)
+}
+
+func (bs *BackendService) GetMuted(ctx context.Context, user_id int64) ([]int64, error) {
+	return bs.socialGraphService.Get().GetMuted(ctx, user_id)
+}
+
+func (bs *BackendService) ApproveFollower(ctx context.Context, user_id int64, follower_id int64) error {
+	return bs.socialGraphService.Get().ApproveFollower(ctx, user_id, follower_id)
+}
+
+func (bs *BackendService) RejectFollower(ctx context.Context, user_id int64, follower_id int64) error {
+	return bs.socialGraphService.Get().RejectFollower(ctx, user_id, follower_id)
+}
+
+func (bs *BackendService) GetFollowRequests(ctx context.Context, user_id int64) ([]int64, error) {
+	return bs.socialGraphService.Get().GetFollowRequests(ctx, user_id)
+}
+
+func (bs *BackendService) GetFollowCounts(ctx context.Context, user_id int64) (int, int, error) {
+	return bs.socialGraphService.Get().GetFollowCounts(ctx, user_id)
+}
+
+func (bs *BackendService) GetFollowersPage(ctx context.Context, user_id int64, cursor string, limit int) (UserIdPage, error) {
+	return bs.socialGraphService.Get().GetFollowersPage(ctx, user_id, cursor, limit)
+}
+
+func (bs *BackendService) GetFolloweesPage(ctx context.Context, user_id int64, cursor string, limit int) (UserIdPage, error) {
+	return bs.socialGraphService.Get().GetFolloweesPage(ctx, user_id, cursor, limit)
+}
+
+func (bs *BackendService) IsFollowing(ctx context.Context, follower_id int64, followee_id int64) (bool, error) {
+	return bs.socialGraphService.Get().IsFollowing(ctx, follower_id, followee_id)
+}
+
+func (bs *BackendService) GetUserInfos(ctx context.Context, user_ids []int64) (map[int64]UserInfo, error) {
+	us := bs.userService.Get()
+	return us.GetUserInfos(ctx, user_ids)
+}
+
 func (bs *BackendService) ReadHomeTimeline(ctx context.Context, user_id int64, start int, stop int) ([]Post, error) {
 	htls := bs.homeTimelineService.Get()
 	return htls.ReadHomeTimeline(ctx, user_id, start, stop)
 }
 
+func (bs *BackendService) ReadHomeTimelinePage(
+	ctx context.Context,
+	user_id int64,
+	cursor string,
+	direction TimelineDirection,
+	start, stop int,
+) (TimelinePage, error) {
+	htls := bs.homeTimelineService.Get()
+	return htls.ReadHomeTimelinePage(ctx, user_id, cursor, direction, start, stop)
+}
+
 func (bs *BackendService) UploadMedia(ctx context.Context, filename string, data string) error {
 	mss := bs.mediaStorageService.Get()
 	mss.UploadMedia(ctx, filename, data)
@@ -294,3 +438,19 @@ func (bs *BackendService) GetMedia(ctx context.Context, filename string) (string
 	mss := bs.mediaStorageService.Get()
 	return mss.GetMedia(ctx, filename)
 }
+
+func (bs *BackendService) ExportStorage(ctx context.Context) (StorageDump, error) {
+	return exportStorage(ctx, bs.storage.Get())
+}
+
+func (bs *BackendService) ImportStorage(ctx context.Context, dump StorageDump) error {
+	return importStorage(ctx, bs.storage.Get(), dump)
+}
+
+func (bs *BackendService) GetStorageStats(ctx context.Context) (StorageStatsReport, error) {
+	return collectStorageStats(ctx, bs.storage.Get())
+}
+
+func (bs *BackendService) SweepExpired(ctx context.Context) (int, error) {
+	return bs.expiryService.Get().SweepExpired(ctx)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ServiceWeaver/weaver"
+)
+
+// Blocking and muting.
+//
+// A user blocks or mutes another by user id. Like a follow relationship, each
+// relation is kept as an edge on the shard of the user and a reverse edge on
+// the shard of the other user, changed in one transaction.
+//
+// Blocking removes the follow relationships between the two users in both
+// directions, and until it is lifted neither of them can follow the other,
+// mention the other in a post or get the posts of the other in their home
+// timeline. Muting only hides the posts of the muted user from the home
+// timeline of the muter, who keeps following them.
+//
+// Posts are filtered both when they are written to home timelines and when
+// home timelines are read, so that the posts delivered before a block or mute,
+// or while it was being added, are hidden as well and show again once it is
+// lifted. Follow checks the block edges of the follower in the transaction
+// that adds the follow edges, so a follow racing with a block is either
+// refused or removed by it.
+
+// RelationKind selects one of the block, mute and follow request edges of a
+// user: the users they block, mute or asked to follow, or the users blocking,
+// muting or asking to follow them. Follow requests are described in
+// follow_requests.go.
+type RelationKind int
+
+const (
+	RELATION_BLOCKED RelationKind = iota
+	RELATION_BLOCKERS
+	RELATION_MUTED
+	RELATION_MUTERS
+	RELATION_REQUESTED
+	RELATION_REQUESTERS
+
+	RELATION_KIND_COUNT = iota
+)
+
+func (k RelationKind) String() string {
+	return [...]string{"blocked", "blockers", "muted", "muters", "requested", "requesters"}[k]
+}
+
+// reverse returns the kind of the edges on the other side of the relation.
+func (k RelationKind) reverse() RelationKind {
+	return [...]RelationKind{
+		RELATION_BLOCKERS, RELATION_BLOCKED, RELATION_MUTERS, RELATION_MUTED, RELATION_REQUESTERS, RELATION_REQUESTED,
+	}[k]
+}
+
+type SocialGraphErrorCode int
+
+const (
+	SELF_RELATION SocialGraphErrorCode = iota + 1
+	UNKNOWN_USER
+	BLOCKED
+	REQUEST_NOT_FOUND
+	PRIVATE_ACCOUNT
+	INVALID_CURSOR
+)
+
+func (sgec SocialGraphErrorCode) String() string {
+	return [...]string{"SELF RELATION", "UNKNOWN USER", "BLOCKED", "REQUEST NOT FOUND", "PRIVATE ACCOUNT", "INVALID CURSOR"}[sgec-1]
+}
+
+// SocialGraphError is returned when a relationship cannot be added or a follow
+// request approved, when the timeline of a private user is read by someone
+// else than their followers, or when a follower list is read with an invalid
+// cursor. Its fields are exported so that it keeps its code across components.
+type SocialGraphError struct {
+	weaver.AutoMarshal
+	Code   SocialGraphErrorCode
+	Detail string
+}
+
+func NewSocialGraphError(code SocialGraphErrorCode, detail string) *SocialGraphError {
+	return &SocialGraphError{Code: code, Detail: detail}
+}
+
+func (se *SocialGraphError) Error() string {
+	return fmt.Sprintf("Social graph error. code: %d, err: %v: %s", se.Code, se.Code, se.Detail)
+}
+
+// relationMutation returns the mutation that puts or removes the edge of the
+// kind from userId to otherId.
+func relationMutation(put bool, kind RelationKind, userId int64, otherId int64) StorageMutation {
+	op := OP_REMOVE_RELATION
+	if put {
+		op = OP_PUT_RELATION
+	}
+	return StorageMutation{Op: op, IntKey: userId, IntVal: otherId, Relation: kind}
+}
+
+// relationMutations returns the mutations that put or remove both edges of a
+// relation of the kind from userId to otherId.
+func relationMutations(put bool, kind RelationKind, userId int64, otherId int64) []StorageMutation {
+	return []StorageMutation{
+		relationMutation(put, kind, userId, otherId),
+		relationMutation(put, kind.reverse(), otherId, userId),
+	}
+}
+
+// notBlockedPreconditions are the preconditions, in the bucket of userId, that
+// neither user blocks the other.
+func notBlockedPreconditions(userId int64, otherId int64) []StoragePrecondition {
+	return []StoragePrecondition{
+		{Cond: COND_ABSENT, Map: relationMap(RELATION_BLOCKED), IntKey: userId, IntVal: otherId},
+		{Cond: COND_ABSENT, Map: relationMap(RELATION_BLOCKERS), IntKey: userId, IntVal: otherId},
+	}
+}
+
+// relatedUsers returns the users related to the user by any of the kinds.
+func relatedUsers(ctx context.Context, storage IStorage, userId int64, kinds ...RelationKind) (map[int64]bool, error) {
+	related := make(map[int64]bool)
+	for _, kind := range kinds {
+		ids, _, err := storage.GetRelations(ctx, userId, kind)
+		if err != nil {
+			return nil, err
+		}
+		for id := range ids {
+			related[id] = true
+		}
+	}
+	return related, nil
+}
+
+// checkRelation returns a SocialGraphError if the user cannot block or mute
+// the other user.
+func (s *SocialGraphService) checkRelation(ctx context.Context, userId int64, otherId int64) error {
+	if userId == otherId {
+		return NewSocialGraphError(SELF_RELATION, fmt.Sprintf("user id %d", userId))
+	}
+	_, exist, err := s.storage.Get().GetUsername(ctx, otherId)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return NewSocialGraphError(UNKNOWN_USER, fmt.Sprintf("user id %d", otherId))
+	}
+	return nil
+}
+
+// Block adds the block edges together with the removal of the follow edges of
+// the user on their shard, so that it is ordered with the follows of the user,
+// and then removes the follow edges of the other user, whose follows check
+// the reverse block edge from then on.
+func (s *SocialGraphService) Block(ctx context.Context, userId int64, blockedId int64) error {
+	if err := s.checkRelation(ctx, userId, blockedId); err != nil {
+		return err
+	}
+	ts := s.transaction_service.Get()
+	mutations := relationMutations(true, RELATION_BLOCKED, userId, blockedId)
+	mutations = append(mutations, unfollowMutations(userId, blockedId)...)
+	if _, err := ts.Commit(ctx, StorageTransaction{Mutations: mutations}); err != nil {
+		return err
+	}
+	_, err := ts.Commit(ctx, StorageTransaction{Mutations: unfollowMutations(blockedId, userId)})
+	return err
+}
+
+func (s *SocialGraphService) Unblock(ctx context.Context, userId int64, blockedId int64) error {
+	_, err := s.transaction_service.Get().Commit(ctx, StorageTransaction{
+		Mutations: relationMutations(false, RELATION_BLOCKED, userId, blockedId),
+	})
+	return err
+}
+
+func (s *SocialGraphService) Mute(ctx context.Context, userId int64, mutedId int64) error {
+	if err := s.checkRelation(ctx, userId, mutedId); err != nil {
+		return err
+	}
+	_, err := s.transaction_service.Get().Commit(ctx, StorageTransaction{
+		Mutations: relationMutations(true, RELATION_MUTED, userId, mutedId),
+	})
+	return err
+}
+
+func (s *SocialGraphService) Unmute(ctx context.Context, userId int64, mutedId int64) error {
+	_, err := s.transaction_service.Get().Commit(ctx, StorageTransaction{
+		Mutations: relationMutations(false, RELATION_MUTED, userId, mutedId),
+	})
+	return err
+}
+
+func (s *SocialGraphService) GetBlocked(ctx context.Context, userId int64) ([]int64, error) {
+	blocked, _, err := s.storage.Get().GetRelations(ctx, userId, RELATION_BLOCKED)
+	return map_to_list(blocked), err
+}
+
+func (s *SocialGraphService) GetMuted(ctx context.Context, userId int64) ([]int64, error) {
+	muted, _, err := s.storage.Get().GetRelations(ctx, userId, RELATION_MUTED)
+	return map_to_list(muted), err
+}
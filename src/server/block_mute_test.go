@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// registerUsers registers the usernames with user ids 1, 2, ... in order.
+func registerUsers(t *testing.T, us UserServicer, usernames ...string) {
+	t.Helper()
+	for i, username := range usernames {
+		if err := us.RegisterUserWithId(context.Background(), "First", "Last", username, "password1", int64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func socialGraphErrorCode(err error) SocialGraphErrorCode {
+	var socialGraphErr *SocialGraphError
+	if errors.As(err, &socialGraphErr) {
+		return socialGraphErr.Code
+	}
+	return 0
+}
+
+func sortedList(ids []int64) []int64 {
+	sorted := append([]int64{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// Blocking removes the follows both ways and refuses new ones until it is
+// lifted.
+func TestBlockUnfollows(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer, sgs ISocialGraphService) {
+		const alice, bob, carol = int64(1), int64(2), int64(3)
+		registerUsers(t, us, "alice", "bob", "carol")
+		for _, f := range [][2]int64{{alice, bob}, {bob, alice}, {carol, alice}} {
+			if _, err := sgs.Follow(ctx, f[0], f[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := sgs.Block(ctx, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+		followers, err := sgs.GetFollowers(ctx, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []int64{carol}; !reflect.DeepEqual(followers, want) {
+			t.Errorf("followers of alice = %v, want %v", followers, want)
+		}
+		for _, userId := range []int64{alice, bob} {
+			if followees, err := sgs.GetFollowees(ctx, userId); err != nil || len(followees) != 0 {
+				t.Errorf("followees of user %d = %v, %v; want none", userId, followees, err)
+			}
+		}
+		for _, f := range [][2]int64{{alice, bob}, {bob, alice}} {
+			if _, err := sgs.Follow(ctx, f[0], f[1]); socialGraphErrorCode(err) != BLOCKED {
+				t.Errorf("user %d following user %d = %v, want BLOCKED", f[0], f[1], err)
+			}
+		}
+		if err := sgs.Block(ctx, alice, alice); socialGraphErrorCode(err) != SELF_RELATION {
+			t.Errorf("alice blocking alice = %v, want SELF_RELATION", err)
+		}
+		if err := sgs.Mute(ctx, alice, 99); socialGraphErrorCode(err) != UNKNOWN_USER {
+			t.Errorf("alice muting an unknown user = %v, want UNKNOWN_USER", err)
+		}
+		if blocked, err := sgs.GetBlocked(ctx, alice); err != nil || !reflect.DeepEqual(blocked, []int64{bob}) {
+			t.Errorf("GetBlocked(alice) = %v, %v; want [%d]", blocked, err, bob)
+		}
+
+		if err := sgs.Unblock(ctx, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sgs.Follow(ctx, bob, alice); err != nil {
+			t.Errorf("bob following alice after the block was lifted: %v", err)
+		}
+	})
+}
+
+// Users that block each other cannot mention each other.
+func TestBlockFiltersMentions(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer, sgs ISocialGraphService, ums IUserMentionService) {
+		const alice, bob, carol = int64(1), int64(2), int64(3)
+		registerUsers(t, us, "alice", "bob", "carol")
+		if err := sgs.Block(ctx, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+		// Muting does not prevent mentions.
+		if err := sgs.Mute(ctx, carol, alice); err != nil {
+			t.Fatal(err)
+		}
+		mentioned := func(userId int64, usernames ...string) []int64 {
+			t.Helper()
+			mentions, err := ums.ComposeUserMentions(ctx, userId, usernames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int64, 0, len(mentions))
+			for _, m := range mentions {
+				ids = append(ids, m.UserId)
+			}
+			return sortedList(ids)
+		}
+		if got, want := mentioned(alice, "@bob", "@carol", "@nobody"), []int64{carol}; !reflect.DeepEqual(got, want) {
+			t.Errorf("alice mentioned %v, want %v", got, want)
+		}
+		if got, want := mentioned(bob, "@alice", "@carol"), []int64{carol}; !reflect.DeepEqual(got, want) {
+			t.Errorf("bob mentioned %v, want %v", got, want)
+		}
+	})
+}
+
+// Posts are kept out of home timelines across blocks and mutes when they are
+// delivered, and hidden when they are read if they were delivered before.
+func TestBlockAndMuteFilterHomeTimelines(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer, sgs ISocialGraphService, hts IHomeTimelineService, posts PostStorageServicer, storage IStorage) {
+		const alice, bob, carol, dave = int64(1), int64(2), int64(3), int64(4)
+		registerUsers(t, us, "alice", "bob", "carol", "dave")
+		for _, follower := range []int64{bob, carol, dave} {
+			if _, err := sgs.Follow(ctx, follower, alice); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Post 10 of alice reaches bob, carol and dave before any block or
+		// mute.
+		post := func(postId, timestamp int64) {
+			t.Helper()
+			if err := posts.StorePost(ctx, Post{Post_id: postId, Creator: Creator{UserId: alice}, Timestamp: timestamp}); err != nil {
+				t.Fatal(err)
+			}
+			if err := hts.WriteHomeTimeline(ctx, postId, alice, timestamp, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		post(10, 100)
+		if err := sgs.Mute(ctx, carol, alice); err != nil {
+			t.Fatal(err)
+		}
+		if err := sgs.Block(ctx, dave, alice); err != nil {
+			t.Fatal(err)
+		}
+		// bob follows alice again after a block that alice lifted.
+		if err := sgs.Block(ctx, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+		if err := sgs.Unblock(ctx, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sgs.Follow(ctx, bob, alice); err != nil {
+			t.Fatal(err)
+		}
+		post(11, 101)
+
+		// Post 11 reaches only bob, as carol mutes alice and dave blocks alice.
+		for _, tc := range []struct {
+			userId    int64
+			delivered []int64
+		}{{bob, []int64{11, 10}}, {carol, []int64{10}}, {dave, []int64{10}}} {
+			if got := timelinePostIds(t, storage, tc.userId, HOME_TIMELINE); !reflect.DeepEqual(got, tc.delivered) {
+				t.Errorf("home timeline of user %d holds %v, want %v", tc.userId, got, tc.delivered)
+			}
+		}
+		read := func(userId int64) []int64 {
+			t.Helper()
+			page, err := hts.ReadHomeTimelinePage(ctx, userId, "", TIMELINE_OLDER, 0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pagePostIds(page)
+		}
+		for _, tc := range []struct {
+			userId int64
+			want   []int64
+		}{{bob, []int64{11, 10}}, {carol, []int64{}}, {dave, []int64{}}} {
+			if got := read(tc.userId); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("user %d read %v, want %v", tc.userId, got, tc.want)
+			}
+		}
+
+		// The posts delivered before show again once the mute is lifted.
+		if err := sgs.Unmute(ctx, carol, alice); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := read(carol), []int64{10}; !reflect.DeepEqual(got, want) {
+			t.Errorf("carol read %v after unmuting alice, want %v", got, want)
+		}
+		if posts, err := hts.ReadHomeTimeline(ctx, dave, 0, 10); err != nil || len(posts) != 0 {
+			t.Errorf("ReadHomeTimeline(dave) = %v, %v; want no post", posts, err)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ServiceWeaver/weaver"
+	"github.com/ServiceWeaver/weaver/metrics"
+)
+
+const DEFAULT_SWEEP_INTERVAL_SEC = 60
+
+var expiredPostsRemoved = metrics.NewCounter(
+	"sn_expired_posts_removed",
+	"Number of expired posts removed from the timelines of their creator, followers and mentioned users",
+)
+
+// ttlConfig is the time to live of the entries a service puts in Storage.
+type ttlConfig struct {
+	// TtlSec is zero, the default, for entries that never expire.
+	TtlSec int `toml:"ttl_sec"`
+}
+
+func (cfg *ttlConfig) ttl() time.Duration {
+	return time.Duration(cfg.TtlSec) * time.Second
+}
+
+type expiryConfig struct {
+	// SweepIntervalSec is how often expired entries are removed.
+	SweepIntervalSec int `toml:"sweep_interval_sec"`
+}
+
+type IExpiryService interface {
+	// SweepExpired removes the expired entries of every routing bucket, and
+	// the expired posts together with their timeline entries. It returns the
+	// number of expired posts.
+	SweepExpired(context.Context) (int, error)
+}
+
+// ExpiryService periodically sweeps the entries of Storage whose time to
+// live ran out. Storage removes them from its maps, except posts, which
+// ExpiryService removes together with their timeline entries in one
+// transaction, as BackendService.RemovePosts does.
+type ExpiryService struct {
+	weaver.Implements[IExpiryService]
+	weaver.WithConfig[expiryConfig]
+
+	storage            weaver.Ref[IStorage]
+	socialGraphService weaver.Ref[ISocialGraphService]
+	transactionService weaver.Ref[ITransactionService]
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (es *ExpiryService) Init(context.Context) error {
+	interval := time.Duration(es.Config().SweepIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = DEFAULT_SWEEP_INTERVAL_SEC * time.Second
+	}
+	es.done = make(chan struct{})
+	es.wg.Add(1)
+	go func() {
+		defer es.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-es.done:
+				return
+			case <-ticker.C:
+			}
+			if _, err := es.SweepExpired(context.Background()); err != nil {
+				fmt.Printf("[ExpiryService] sweep failed: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (es *ExpiryService) Shutdown(context.Context) error {
+	close(es.done)
+	es.wg.Wait()
+	return nil
+}
+
+func (es *ExpiryService) SweepExpired(ctx context.Context) (int, error) {
+	storage := es.storage.Get()
+	var mu sync.Mutex
+	posts := make([]Post, 0)
+	err := forEachRoutingBucket(func(bucket int) error {
+		expired, err := storage.ExpireBucket(ctx, bucket)
+		mu.Lock()
+		defer mu.Unlock()
+		posts = append(posts, expired...)
+		return err
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(posts))
+	for _, post := range posts {
+		wg.Add(1)
+		go func(post Post) {
+			defer wg.Done()
+			errs <- es.removePost(ctx, post)
+		}(post)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		if err == nil {
+			err = e
+		}
+	}
+	return len(posts), err
+}
+
+// removePost removes an expired post together with its entries in the user
+// timeline of its creator, in the home timelines of its creator's followers
+// and of the users it mentions, and its short urls. Followers gained since
+// the post was composed never had it, and removing it from their timelines
+// is a no-op.
+func (es *ExpiryService) removePost(ctx context.Context, post Post) error {
+	userId := post.Creator.UserId
+	followers, err := es.socialGraphService.Get().GetFollowers(ctx, userId)
+	if err != nil {
+		return err
+	}
+	_, err = es.transactionService.Get().Commit(ctx, StorageTransaction{Mutations: removePostMutations(userId, post, followers)})
+	if err == nil {
+		storageExpiredEntries.Get(storageMapLabels{Map: MAP_POSTS.String()}).Inc()
+		expiredPostsRemoved.Inc()
+	}
+	return err
+}
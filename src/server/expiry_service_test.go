@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func timelinePostIds(t *testing.T, storage IStorage, userId int64, kind TimelineKind) []int64 {
+	t.Helper()
+	entries, err := storage.GetPostTimeline(context.Background(), userId, kind, TimelineEntry{}, TIMELINE_OLDER, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postIds := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		postIds = append(postIds, e.PostId)
+	}
+	return postIds
+}
+
+// An expired post stays in Storage until the sweep removes it together with
+// its timeline entries and short urls.
+func TestSweepExpiredPosts(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, es IExpiryService, sgs ISocialGraphService, storage IStorage) {
+		const author, follower, mentioned = int64(1), int64(2), int64(3)
+		if _, err := sgs.Follow(ctx, follower, author); err != nil {
+			t.Fatal(err)
+		}
+		expired := Post{
+			Post_id:       10,
+			Creator:       Creator{UserId: author},
+			Timestamp:     100,
+			User_mentions: []UserMention{{UserId: mentioned}},
+			Urls:          []Url{{ShortenedUrl: "short", ExpandedUrl: "long"}},
+		}
+		kept := Post{Post_id: 11, Creator: Creator{UserId: author}, Timestamp: 101}
+		for _, post := range []struct {
+			post Post
+			ttl  time.Duration
+		}{{expired, time.Millisecond}, {kept, 0}} {
+			if err := storage.PutPost(ctx, post.post.Post_id, post.post, post.ttl); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.PutPostTimeline(ctx, author, USER_TIMELINE, post.post.Post_id, post.post.Timestamp); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.PutPostTimelines(ctx, []int64{follower, mentioned}, HOME_TIMELINE, post.post.Post_id, post.post.Timestamp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := storage.PutShortenUrl(ctx, "short", "long", 0); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		// Storage alone hides the post but leaves it to the sweep.
+		bucket := intRoutingBucket(expired.Post_id)
+		for i := 0; i < 2; i++ {
+			posts, err := storage.ExpireBucket(ctx, bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(posts) != 1 || posts[0].Post_id != expired.Post_id {
+				t.Fatalf("ExpireBucket #%d = %v, want post %d", i+1, posts, expired.Post_id)
+			}
+		}
+		if _, ok, _ := storage.GetPost(ctx, expired.Post_id); ok {
+			t.Error("GetPost returned an expired post")
+		}
+
+		n, err := es.SweepExpired(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("SweepExpired = %d, want 1", n)
+		}
+		if posts, err := storage.ExpireBucket(ctx, bucket); err != nil || len(posts) != 0 {
+			t.Errorf("ExpireBucket after the sweep = %v, %v; want no post", posts, err)
+		}
+		for _, tl := range []struct {
+			userId int64
+			kind   TimelineKind
+		}{{author, USER_TIMELINE}, {follower, HOME_TIMELINE}, {mentioned, HOME_TIMELINE}} {
+			if got := timelinePostIds(t, storage, tl.userId, tl.kind); len(got) != 1 || got[0] != kept.Post_id {
+				t.Errorf("%v timeline of user %d = %v, want [%d]", tl.kind, tl.userId, got, kept.Post_id)
+			}
+		}
+		if _, ok, _ := storage.GetShortenUrl(ctx, "short"); ok {
+			t.Error("the short url of the expired post is left")
+		}
+		if _, ok, _ := storage.GetPost(ctx, kept.Post_id); !ok {
+			t.Error("the post without a time to live was removed")
+		}
+	})
+}
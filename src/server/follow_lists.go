@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/ServiceWeaver/weaver"
+)
+
+// Follow counts and paginated follower lists.
+//
+// The followers and followees of a user live on the shard of the user and are
+// read without copying their whole set: both backends keep the number of
+// edges of each user, and list them in increasing user id order so that a
+// page starts after the last user id of the previous one. A cursor is that
+// user id, so it stays valid as users follow and unfollow. Whether a user
+// follows another is read from the single followee edge.
+
+const (
+	DEFAULT_FOLLOW_PAGE_LIMIT = 100
+	MAX_FOLLOW_PAGE_LIMIT     = 1000
+)
+
+// UserIdPage is a page of followers or followees in increasing user id
+// order. Next is the cursor to pass to read the next page, or empty if this
+// is the last one.
+type UserIdPage struct {
+	weaver.AutoMarshal
+	UserIds []int64
+	Next    string
+}
+
+// followCursor encodes the last user id of a page as an opaque string handed
+// out to clients.
+func followCursor(userId int64) string {
+	return base64.RawURLEncoding.EncodeToString(binary.BigEndian.AppendUint64(nil, uint64(userId)))
+}
+
+// parseFollowCursor decodes a cursor returned by followCursor into the user
+// id that the page starts after. The empty cursor stands for the start of the
+// list.
+func parseFollowCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return math.MinInt64, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) != 8 {
+		return 0, NewSocialGraphError(INVALID_CURSOR, fmt.Sprintf("invalid cursor %q", cursor))
+	}
+	return int64(binary.BigEndian.Uint64(buf)), nil
+}
+
+func (s *SocialGraphService) GetFollowCounts(ctx context.Context, userId int64) (int, int, error) {
+	return s.storage.Get().GetFollowCounts(ctx, userId)
+}
+
+func (s *SocialGraphService) GetFollowersPage(ctx context.Context, userId int64, cursor string, limit int) (UserIdPage, error) {
+	return readFollowPage(ctx, s.storage.Get().GetFollowersPage, userId, cursor, limit)
+}
+
+func (s *SocialGraphService) GetFolloweesPage(ctx context.Context, userId int64, cursor string, limit int) (UserIdPage, error) {
+	return readFollowPage(ctx, s.storage.Get().GetFolloweesPage, userId, cursor, limit)
+}
+
+func (s *SocialGraphService) IsFollowing(ctx context.Context, followerId int64, followeeId int64) (bool, error) {
+	return s.storage.Get().HasFollowee(ctx, followerId, followeeId)
+}
+
+// readFollowPage reads a page with read, one of the paged storage reads. It
+// asks for one more user than the limit to know whether there are more.
+func readFollowPage(ctx context.Context, read func(context.Context, int64, int64, int) ([]int64, error), userId int64, cursor string, limit int) (UserIdPage, error) {
+	if limit <= 0 {
+		limit = DEFAULT_FOLLOW_PAGE_LIMIT
+	} else if limit > MAX_FOLLOW_PAGE_LIMIT {
+		limit = MAX_FOLLOW_PAGE_LIMIT
+	}
+	after, err := parseFollowCursor(cursor)
+	if err != nil {
+		return UserIdPage{}, err
+	}
+	ids, err := read(ctx, userId, after, limit+1)
+	if err != nil {
+		return UserIdPage{}, err
+	}
+	page := UserIdPage{UserIds: ids}
+	if len(ids) > limit {
+		page.UserIds = ids[:limit]
+		page.Next = followCursor(ids[limit-1])
+	}
+	return page, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// Counts follow the edges, and the pages of follower lists resume after their
+// cursor while users follow and unfollow.
+func TestFollowListPages(t *testing.T) {
+	ctx := context.Background()
+	const user = int64(1)
+	for _, backend := range []string{MEMORY_BACKEND, SQLITE_BACKEND} {
+		t.Run(backend, func(t *testing.T) {
+			timelineRunner(t, backend).Test(t, func(t *testing.T, sgs ISocialGraphService) {
+				follow := func(followerId, followeeId int64) {
+					t.Helper()
+					if _, err := sgs.Follow(ctx, followerId, followeeId); err != nil {
+						t.Fatal(err)
+					}
+				}
+				for _, followerId := range []int64{7, 3, 5, 2, 6, 4} {
+					follow(followerId, user)
+				}
+				// Following again adds no edge.
+				follow(3, user)
+				follow(user, 5)
+				follow(user, 9)
+
+				counts := func(userId int64) [2]int {
+					t.Helper()
+					followers, followees, err := sgs.GetFollowCounts(ctx, userId)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return [2]int{followers, followees}
+				}
+				if got, want := counts(user), [2]int{6, 2}; got != want {
+					t.Errorf("follow counts of user %d = %v, want %v", user, got, want)
+				}
+				if got, want := counts(5), [2]int{1, 1}; got != want {
+					t.Errorf("follow counts of user 5 = %v, want %v", got, want)
+				}
+				for _, tc := range []struct {
+					followerId, followeeId int64
+					want                   bool
+				}{{3, user, true}, {user, 3, false}, {user, 9, true}, {9, user, false}} {
+					if got, err := sgs.IsFollowing(ctx, tc.followerId, tc.followeeId); err != nil || got != tc.want {
+						t.Errorf("IsFollowing(%d, %d) = %v, %v; want %v", tc.followerId, tc.followeeId, got, err, tc.want)
+					}
+				}
+
+				page := func(read func(context.Context, int64, string, int) (UserIdPage, error), cursor string, limit int) UserIdPage {
+					t.Helper()
+					page, err := read(ctx, user, cursor, limit)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return page
+				}
+				first := page(sgs.GetFollowersPage, "", 3)
+				if want := []int64{2, 3, 4}; !reflect.DeepEqual(first.UserIds, want) || first.Next == "" {
+					t.Fatalf("first page = %v, next %q; want %v and a cursor", first.UserIds, first.Next, want)
+				}
+				// Users before and after the cursor come and go.
+				if err := sgs.Unfollow(ctx, 3, user); err != nil {
+					t.Fatal(err)
+				}
+				if err := sgs.Unfollow(ctx, 5, user); err != nil {
+					t.Fatal(err)
+				}
+				follow(1000, user)
+				second := page(sgs.GetFollowersPage, first.Next, 3)
+				if want := []int64{6, 7, 1000}; !reflect.DeepEqual(second.UserIds, want) || second.Next != "" {
+					t.Errorf("second page = %v, next %q; want %v and no cursor", second.UserIds, second.Next, want)
+				}
+				if got, want := page(sgs.GetFollowersPage, "", 0).UserIds, []int64{2, 4, 6, 7, 1000}; !reflect.DeepEqual(got, want) {
+					t.Errorf("page of the default limit = %v, want %v", got, want)
+				}
+				if got, want := counts(user), [2]int{5, 2}; got != want {
+					t.Errorf("follow counts of user %d after the unfollows = %v, want %v", user, got, want)
+				}
+				followees := page(sgs.GetFolloweesPage, "", 1)
+				if want := []int64{5}; !reflect.DeepEqual(followees.UserIds, want) {
+					t.Errorf("followees page = %v, want %v", followees.UserIds, want)
+				}
+				if got, want := page(sgs.GetFolloweesPage, followees.Next, 1).UserIds, []int64{9}; !reflect.DeepEqual(got, want) {
+					t.Errorf("second followees page = %v, want %v", got, want)
+				}
+
+				if _, err := sgs.GetFollowersPage(ctx, user, "not a cursor!", 3); socialGraphErrorCode(err) != INVALID_CURSOR {
+					t.Errorf("GetFollowersPage with an invalid cursor = %v, want INVALID_CURSOR", err)
+				}
+			})
+		})
+	}
+}
+
+func TestParseFollowCursor(t *testing.T) {
+	for _, userId := range []int64{-5, 0, 1, 1 << 40} {
+		if got, err := parseFollowCursor(followCursor(userId)); err != nil || got != userId {
+			t.Errorf("parseFollowCursor(followCursor(%d)) = %d, %v", userId, got, err)
+		}
+	}
+	for _, cursor := range []string{"AAAA", "!!", followCursor(1) + "A"} {
+		if _, err := parseFollowCursor(cursor); socialGraphErrorCode(err) != INVALID_CURSOR {
+			t.Errorf("parseFollowCursor(%q) = %v, want INVALID_CURSOR", cursor, err)
+		}
+	}
+}
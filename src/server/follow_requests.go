@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Private accounts and follow requests.
+//
+// A user may set their profile private, in which case a follow of them is
+// kept as a pending request until they approve or reject it. Like a follow
+// relationship, a request is an edge on the shard of the requester and a
+// reverse edge on the shard of the followee, of the RELATION_REQUESTED and
+// RELATION_REQUESTERS kinds. Approving a request replaces its edges with the
+// follow edges in one transaction, which checks on the shard of the requester
+// that the request is still pending and that neither user blocks the other.
+// Unfollowing withdraws a pending request, so blocking removes the requests
+// between the two users as well. Setting a private profile public approves
+// the pending requests.
+//
+// The user timeline of a private user can only be read by the user and their
+// followers. Posts of private users are delivered to the home timelines of
+// their followers as before.
+
+// followMutations returns the mutations that add both edges of a follow
+// relationship and remove a pending request of it. They start with the
+// followee edge like unfollowMutations.
+func followMutations(followerId int64, followeeId int64) []StorageMutation {
+	return append([]StorageMutation{
+		{Op: OP_PUT_FOLLOWEE, IntKey: followerId, IntVal: followeeId},
+		{Op: OP_PUT_FOLLOWER, IntKey: followeeId, IntVal: followerId},
+	}, relationMutations(false, RELATION_REQUESTED, followerId, followeeId)...)
+}
+
+// approveFollowRequest turns the pending request of followerId to follow
+// followeeId into a follow relationship. It returns false if there is no such
+// request or either user blocks the other.
+func approveFollowRequest(ctx context.Context, ts ITransactionService, followerId int64, followeeId int64) (bool, error) {
+	return ts.Commit(ctx, StorageTransaction{
+		Preconditions: append([]StoragePrecondition{
+			{Cond: COND_EXISTS, Map: relationMap(RELATION_REQUESTED), IntKey: followerId, IntVal: followeeId},
+		}, notBlockedPreconditions(followerId, followeeId)...),
+		Mutations: followMutations(followerId, followeeId),
+	})
+}
+
+// requestFollow adds a request of followerId to follow followeeId, unless
+// followerId already follows them. It reports whether the request is pending.
+func (s *SocialGraphService) requestFollow(ctx context.Context, followerId int64, followeeId int64) (bool, error) {
+	ok, err := s.transaction_service.Get().Commit(ctx, StorageTransaction{
+		Preconditions: append(notBlockedPreconditions(followerId, followeeId), StoragePrecondition{
+			Cond: COND_ABSENT, Map: MAP_FOLLOWEES, IntKey: followerId, IntVal: followeeId,
+		}),
+		Mutations: relationMutations(true, RELATION_REQUESTED, followerId, followeeId),
+	})
+	if err != nil || ok {
+		return ok, err
+	}
+	following, err := s.storage.Get().HasFollowee(ctx, followerId, followeeId)
+	if err != nil || following {
+		return false, err
+	}
+	return false, NewSocialGraphError(BLOCKED, fmt.Sprintf("user %d cannot follow user %d", followerId, followeeId))
+}
+
+// ApproveFollower and RejectFollower fail with REQUEST_NOT_FOUND if the
+// follower has no pending request to follow the user.
+func (s *SocialGraphService) ApproveFollower(ctx context.Context, userId int64, followerId int64) error {
+	ok, err := approveFollowRequest(ctx, s.transaction_service.Get(), followerId, userId)
+	if err == nil && !ok {
+		err = NewSocialGraphError(REQUEST_NOT_FOUND, fmt.Sprintf("user %d did not ask to follow user %d", followerId, userId))
+	}
+	return err
+}
+
+func (s *SocialGraphService) RejectFollower(ctx context.Context, userId int64, followerId int64) error {
+	ok, err := s.transaction_service.Get().Commit(ctx, StorageTransaction{
+		Preconditions: []StoragePrecondition{
+			{Cond: COND_EXISTS, Map: relationMap(RELATION_REQUESTED), IntKey: followerId, IntVal: userId},
+		},
+		Mutations: relationMutations(false, RELATION_REQUESTED, followerId, userId),
+	})
+	if err == nil && !ok {
+		err = NewSocialGraphError(REQUEST_NOT_FOUND, fmt.Sprintf("user %d did not ask to follow user %d", followerId, userId))
+	}
+	return err
+}
+
+func (s *SocialGraphService) GetFollowRequests(ctx context.Context, userId int64) ([]int64, error) {
+	requesters, _, err := s.storage.Get().GetRelations(ctx, userId, RELATION_REQUESTERS)
+	return map_to_list(requesters), err
+}
+
+// SetPrivate approves the pending requests of the user once their profile is
+// public. Requests added while it is being set public are approved by the
+// next call, or by following again.
+func (us *UserService) SetPrivate(ctx context.Context, userId int64, private bool) error {
+	err := us.updateProfile(ctx, userId, func(profile *UserProfile) error {
+		profile.Private = private
+		return nil
+	})
+	if err != nil || private {
+		return err
+	}
+	requesters, _, err := us.storage.Get().GetRelations(ctx, userId, RELATION_REQUESTERS)
+	if err != nil {
+		return err
+	}
+	ts := us.transactionService.Get()
+	for requesterId := range requesters {
+		if _, err := approveFollowRequest(ctx, ts, requesterId, userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReader returns a PRIVATE_ACCOUNT error if the user is private and the
+// reader, 0 for an anonymous reader, is neither the user nor a follower of
+// them.
+func (uts *UserTimelineService) checkReader(ctx context.Context, readerId int64, userId int64) error {
+	if readerId == userId {
+		return nil
+	}
+	info, exist, err := uts.userService.Get().GetUserInfo(ctx, userId)
+	if err != nil || !exist || !info.Private {
+		return err
+	}
+	if readerId != 0 {
+		following, err := uts.storage.Get().HasFollowee(ctx, readerId, userId)
+		if err != nil || following {
+			return err
+		}
+	}
+	return NewSocialGraphError(PRIVATE_ACCOUNT, fmt.Sprintf("user %d cannot read the timeline of user %d", readerId, userId))
+}
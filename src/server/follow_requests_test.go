@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// Follows of a private user wait for their approval, and are approved
+// together once the user is public again.
+func TestFollowRequests(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer, sgs ISocialGraphService) {
+		const alice, bob, carol, dave, erin = int64(1), int64(2), int64(3), int64(4), int64(5)
+		registerUsers(t, us, "alice", "bob", "carol", "dave", "erin")
+		if err := us.SetPrivate(ctx, alice, true); err != nil {
+			t.Fatal(err)
+		}
+		for _, follower := range []int64{bob, carol, dave, erin} {
+			pending, err := sgs.Follow(ctx, follower, alice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pending {
+				t.Errorf("follow of user %d is not pending", follower)
+			}
+		}
+		requests := func() []int64 {
+			t.Helper()
+			requests, err := sgs.GetFollowRequests(ctx, alice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sortedList(requests)
+		}
+		followers := func() []int64 {
+			t.Helper()
+			followers, err := sgs.GetFollowers(ctx, alice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sortedList(followers)
+		}
+		if got, want := requests(), []int64{bob, carol, dave, erin}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("requests = %v, want %v", got, want)
+		}
+		if got := followers(); len(got) != 0 {
+			t.Fatalf("followers before any approval = %v", got)
+		}
+
+		if err := sgs.ApproveFollower(ctx, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+		if err := sgs.RejectFollower(ctx, alice, carol); err != nil {
+			t.Fatal(err)
+		}
+		// Unfollowing withdraws the request.
+		if err := sgs.Unfollow(ctx, dave, alice); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []func(context.Context, int64, int64) error{sgs.ApproveFollower, sgs.RejectFollower} {
+			for _, follower := range []int64{bob, carol, dave} {
+				if err := f(ctx, alice, follower); socialGraphErrorCode(err) != REQUEST_NOT_FOUND {
+					t.Errorf("answering the request of user %d again = %v, want REQUEST_NOT_FOUND", follower, err)
+				}
+			}
+		}
+		if got, want := requests(), []int64{erin}; !reflect.DeepEqual(got, want) {
+			t.Errorf("requests = %v, want %v", got, want)
+		}
+		if got, want := followers(), []int64{bob}; !reflect.DeepEqual(got, want) {
+			t.Errorf("followers = %v, want %v", got, want)
+		}
+
+		// Setting the profile public approves the pending requests, and
+		// follows are no longer pending.
+		if err := us.SetPrivate(ctx, alice, false); err != nil {
+			t.Fatal(err)
+		}
+		if got := requests(); len(got) != 0 {
+			t.Errorf("requests after going public = %v", got)
+		}
+		pending, err := sgs.Follow(ctx, carol, alice)
+		if err != nil || pending {
+			t.Errorf("follow of a public user = %v, %v; want not pending", pending, err)
+		}
+		if got, want := followers(), []int64{bob, carol, erin}; !reflect.DeepEqual(got, want) {
+			t.Errorf("followers after going public = %v, want %v", got, want)
+		}
+	})
+}
+
+// Blocking withdraws the requests between the two users.
+func TestBlockRemovesFollowRequests(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer, sgs ISocialGraphService) {
+		const alice, bob = int64(1), int64(2)
+		registerUsers(t, us, "alice", "bob")
+		if err := us.SetPrivate(ctx, alice, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sgs.Follow(ctx, bob, alice); err != nil {
+			t.Fatal(err)
+		}
+		if err := sgs.Block(ctx, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+		if requests, err := sgs.GetFollowRequests(ctx, alice); err != nil || len(requests) != 0 {
+			t.Errorf("requests after the block = %v, %v; want none", requests, err)
+		}
+		if err := sgs.ApproveFollower(ctx, alice, bob); socialGraphErrorCode(err) != REQUEST_NOT_FOUND {
+			t.Errorf("approving a blocked user = %v, want REQUEST_NOT_FOUND", err)
+		}
+	})
+}
+
+// The user timeline of a private user is read only by the user and their
+// followers.
+func TestPrivateUserTimeline(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer, sgs ISocialGraphService, uts IUserTimelineService, posts PostStorageServicer) {
+		const anonymous, alice, bob, carol = int64(0), int64(1), int64(2), int64(3)
+		registerUsers(t, us, "alice", "bob", "carol")
+		if err := posts.StorePost(ctx, Post{Post_id: 10, Creator: Creator{UserId: alice}, Timestamp: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if err := uts.WriteUserTimeline(ctx, 10, alice, 100); err != nil {
+			t.Fatal(err)
+		}
+		if err := us.SetPrivate(ctx, alice, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sgs.Follow(ctx, bob, alice); err != nil {
+			t.Fatal(err)
+		}
+		check := func(readers map[int64]bool) {
+			t.Helper()
+			for readerId, allowed := range readers {
+				posts, err := uts.ReadUserTimeline(ctx, readerId, alice, 0, 10)
+				if allowed && (err != nil || len(posts) != 1) {
+					t.Errorf("user %d read %d posts, %v; want 1", readerId, len(posts), err)
+				}
+				if !allowed && socialGraphErrorCode(err) != PRIVATE_ACCOUNT {
+					t.Errorf("user %d read %d posts, %v; want PRIVATE_ACCOUNT", readerId, len(posts), err)
+				}
+			}
+		}
+		check(map[int64]bool{alice: true, bob: false, carol: false, anonymous: false})
+
+		if err := sgs.ApproveFollower(ctx, alice, bob); err != nil {
+			t.Fatal(err)
+		}
+		check(map[int64]bool{alice: true, bob: true, carol: false, anonymous: false})
+		if _, err := uts.ReadUserTimelinePage(ctx, carol, alice, "", TIMELINE_NEWER, 0, 10); socialGraphErrorCode(err) != PRIVATE_ACCOUNT {
+			t.Errorf("carol read a page of alice: %v, want PRIVATE_ACCOUNT", err)
+		}
+
+		if err := us.SetPrivate(ctx, alice, false); err != nil {
+			t.Fatal(err)
+		}
+		check(map[int64]bool{alice: true, bob: true, carol: true, anonymous: true})
+	})
+}
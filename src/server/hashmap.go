@@ -2,48 +2,178 @@ package main
 
 import (
 	"fmt"
+	"hash/maphash"
+	"math/bits"
 	"sync"
+	"unsafe"
+)
+
+const (
+	// HASHMAP_SEGMENTS is the number of segments of a HashMap created with
+	// NewHashMap.
+	HASHMAP_SEGMENTS = 64
+	// HASHMAP_CACHE_LINE is the size of a segment, so that each segment
+	// fills a cache line of its own.
+	HASHMAP_CACHE_LINE = 64
 )
 
 // HashMap represents a thread-safe hash table with generic types for keys (K) and values (V).
+// Keys are spread over segments with a lock each, so that operations on keys
+// in different segments do not contend.
 type HashMap[K comparable, V any] struct {
+	seed maphash.Seed
+	// shift selects the top bits of a hash as the segment index. Storage
+	// routes int keys by the low bits of the same hash, so that all the keys
+	// of a Storage replica would share a few segments if those were used.
+	shift    uint
+	segments []hashMapSegment[K, V]
+}
+
+type hashMapSegment[K comparable, V any] struct {
 	mu      sync.Mutex
 	buckets map[K]V
+	// Keep segments on separate cache lines.
+	_ [HASHMAP_CACHE_LINE - unsafe.Sizeof(sync.Mutex{}) - unsafe.Sizeof(map[K]V(nil))]byte
 }
 
+// The segment size does not depend on K and V; both of these fail to
+// compile unless it is HASHMAP_CACHE_LINE.
+var (
+	_ [HASHMAP_CACHE_LINE - unsafe.Sizeof(hashMapSegment[int64, int64]{})]byte
+	_ [unsafe.Sizeof(hashMapSegment[int64, int64]{}) - HASHMAP_CACHE_LINE]byte
+)
+
 // NewHashMap creates a new instance of HashMap.
 func NewHashMap[K comparable, V any]() *HashMap[K, V] {
-	return &HashMap[K, V]{
-		buckets: make(map[K]V),
+	return NewHashMapWithSegments[K, V](HASHMAP_SEGMENTS)
+}
+
+// NewHashMapWithSegments creates a HashMap with the given number of segments,
+// which must be a power of two. Small maps that are only used under another
+// lock, such as the follower sets of a user, should use a single segment.
+func NewHashMapWithSegments[K comparable, V any](segments int) *HashMap[K, V] {
+	if segments <= 0 || segments&(segments-1) != 0 {
+		panic(fmt.Sprintf("HashMap segments must be a power of two, got %d", segments))
+	}
+	h := &HashMap[K, V]{
+		seed:     maphash.MakeSeed(),
+		shift:    uint(64 - bits.TrailingZeros(uint(segments))),
+		segments: make([]hashMapSegment[K, V], segments),
+	}
+	for i := range h.segments {
+		h.segments[i].buckets = make(map[K]V)
+	}
+	return h
+}
+
+// segment returns the segment holding key.
+func (h *HashMap[K, V]) segment(key K) *hashMapSegment[K, V] {
+	if len(h.segments) == 1 {
+		return &h.segments[0]
+	}
+	var hash uint64
+	switch k := any(key).(type) {
+	case int64:
+		hash = mixHash(uint64(k))
+	case int:
+		hash = mixHash(uint64(k))
+	case string:
+		hash = maphash.String(h.seed, k)
+	default:
+		hash = maphash.String(h.seed, fmt.Sprint(k))
+	}
+	return &h.segments[hash>>h.shift]
+}
+
+// mixHash spreads sequential integer keys over all segments (splitmix64).
+func mixHash(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// lockAll locks every segment in order, which gives a consistent view of the
+// whole table until unlockAll.
+func (h *HashMap[K, V]) lockAll() {
+	for i := range h.segments {
+		h.segments[i].mu.Lock()
+	}
+}
+
+func (h *HashMap[K, V]) unlockAll() {
+	for i := range h.segments {
+		h.segments[i].mu.Unlock()
 	}
 }
 
 // Put inserts or updates a value in the hash table with the given key.
 func (h *HashMap[K, V]) Put(key K, value V) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.buckets[key] = value
+	s := h.segment(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[key] = value
 }
 
 // Get retrieves a value from the hash table by key.
 // It returns the value and a boolean indicating whether the key exists in the hash table.
 func (h *HashMap[K, V]) Get(key K) (V, bool) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	value, exists := h.buckets[key]
+	s := h.segment(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, exists := s.buckets[key]
 	return value, exists
 }
 
+// Swap inserts or updates a value and returns the previous one, if any.
+func (h *HashMap[K, V]) Swap(key K, value V) (V, bool) {
+	s := h.segment(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, loaded := s.buckets[key]
+	s.buckets[key] = value
+	return previous, loaded
+}
+
 // Delete removes a key-value pair from the hash table.
 func (h *HashMap[K, V]) Delete(key K) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	delete(h.buckets, key)
+	s := h.segment(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets, key)
+}
+
+// LoadAndDelete removes a key-value pair and returns the removed value, if
+// any.
+func (h *HashMap[K, V]) LoadAndDelete(key K) (V, bool) {
+	s := h.segment(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, loaded := s.buckets[key]
+	delete(s.buckets, key)
+	return value, loaded
+}
+
+// Clear removes all key-value pairs from the hash table.
+func (h *HashMap[K, V]) Clear() {
+	h.lockAll()
+	defer h.unlockAll()
+	for i := range h.segments {
+		h.segments[i].buckets = make(map[K]V)
+	}
 }
 
 // Size returns the number of key-value pairs in the hash table.
 func (h *HashMap[K, V]) Size() int {
-	return len(h.buckets)
+	h.lockAll()
+	defer h.unlockAll()
+	size := 0
+	for i := range h.segments {
+		size += len(h.segments[i].buckets)
+	}
+	return size
 }
 
 // Convert to regular maps
@@ -51,15 +181,42 @@ func (h *HashMap[K, V]) Clone() map[K]V {
 	if h == nil {
 		return nil
 	}
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	newMap := make(map[K]V)
-	for k, v := range h.buckets {
-		newMap[k] = v
+	h.lockAll()
+	defer h.unlockAll()
+	size := 0
+	for i := range h.segments {
+		size += len(h.segments[i].buckets)
+	}
+	newMap := make(map[K]V, size)
+	for i := range h.segments {
+		for k, v := range h.segments[i].buckets {
+			newMap[k] = v
+		}
 	}
 	return newMap
 }
 
+// Range calls f for every key-value pair until f returns false. Each segment
+// is locked while its pairs are visited, so f sees every value in a state
+// where no other operation is running on it, but pairs in different
+// segments may be visited at different times. f must not call h.
+func (h *HashMap[K, V]) Range(f func(K, V) bool) {
+	if h == nil {
+		return
+	}
+	for i := range h.segments {
+		s := &h.segments[i]
+		s.mu.Lock()
+		for k, v := range s.buckets {
+			if !f(k, v) {
+				s.mu.Unlock()
+				return
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
 // ApplyWithDefault applies a function to the value associated with the given key in the hash table.
 // If the key exists, the applyFn function is called with the key, value, and additional arguments.
 // If the key does not exist, the assignDefault function is called with the key to assign a default value,
@@ -70,15 +227,16 @@ func (h *HashMap[K, V]) ApplyWithDefault(
 	assignDefault func(K) V,
 	args ...interface{},
 ) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	val, exist := h.buckets[key]
+	s := h.segment(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, exist := s.buckets[key]
 	if exist {
 		applyFn(key, val, args...)
 	} else {
 		defaultVal := assignDefault(key)
 		applyFn(key, defaultVal, args...)
-		h.buckets[key] = defaultVal
+		s.buckets[key] = defaultVal
 	}
 }
 
@@ -89,9 +247,10 @@ func (h *HashMap[K, V]) Apply(
 	applyFn func(K, V, ...interface{}),
 	args ...interface{},
 ) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	val, exist := h.buckets[key]
+	s := h.segment(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, exist := s.buckets[key]
 	if exist {
 		applyFn(key, val, args...)
 	}
@@ -103,9 +262,10 @@ func ApplyWithReturn[K comparable, V any, R any](
 	applyFn func(K, V, ...interface{}) R,
 	args ...interface{},
 ) (R, error) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	val, exist := h.buckets[key]
+	s := h.segment(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, exist := s.buckets[key]
 	if exist {
 		return applyFn(key, val, args...), nil
 	} else {
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+const HASHMAP_BENCH_KEYS = 1 << 16
+
+var hashMapBenchParallelism = []int{1, 4, 16}
+
+// benchmarkHashMap runs op from b.SetParallelism(p) goroutines per CPU on a
+// map with one segment and with HASHMAP_SEGMENTS segments, so that the gain
+// of striping shows as contention grows.
+func benchmarkHashMap(b *testing.B, op func(h *HashMap[int64, int64], key int64)) {
+	for _, segments := range []int{1, HASHMAP_SEGMENTS} {
+		for _, p := range hashMapBenchParallelism {
+			b.Run(fmt.Sprintf("segments=%d/parallelism=%d", segments, p), func(b *testing.B) {
+				h := NewHashMapWithSegments[int64, int64](segments)
+				for key := int64(0); key < HASHMAP_BENCH_KEYS; key++ {
+					h.Put(key, key)
+				}
+				var next atomic.Int64
+				b.SetParallelism(p)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					// Each goroutine walks the keys from its own offset.
+					key := next.Add(HASHMAP_BENCH_KEYS / 64)
+					for pb.Next() {
+						op(h, key%HASHMAP_BENCH_KEYS)
+						key++
+					}
+				})
+			})
+		}
+	}
+}
+
+func BenchmarkHashMapLoad(b *testing.B) {
+	benchmarkHashMap(b, func(h *HashMap[int64, int64], key int64) { h.Get(key) })
+}
+
+func BenchmarkHashMapStore(b *testing.B) {
+	benchmarkHashMap(b, func(h *HashMap[int64, int64], key int64) { h.Put(key, key) })
+}
+
+func TestHashMapSegments(t *testing.T) {
+	for _, segments := range []int{1, 2, HASHMAP_SEGMENTS} {
+		h := NewHashMapWithSegments[int64, int64](segments)
+		for key := int64(0); key < 1000; key++ {
+			h.Put(key, key)
+		}
+		if h.Size() != 1000 {
+			t.Fatalf("%d segments: size %d, want 1000", segments, h.Size())
+		}
+		for key := int64(0); key < 1000; key++ {
+			if v, ok := h.Get(key); !ok || v != key {
+				t.Fatalf("%d segments: key %d maps to %d, %v", segments, key, v, ok)
+			}
+		}
+	}
+}
+
+// The keys that Storage routes to one bucket, and so to one replica, are
+// still spread over all the segments.
+func TestHashMapSpreadsKeysOfOneRoutingBucket(t *testing.T) {
+	h := NewHashMap[int64, int64]()
+	for key := int64(0); key < 100*HASHMAP_SEGMENTS*STORAGE_ROUTING_BUCKETS; key++ {
+		if intRoutingBucket(key) == 0 {
+			h.Put(key, key)
+		}
+	}
+	used := 0
+	for i := range h.segments {
+		if len(h.segments[i].buckets) > 0 {
+			used++
+		}
+	}
+	if used != HASHMAP_SEGMENTS {
+		t.Fatalf("the keys of one routing bucket use %d segments out of %d", used, HASHMAP_SEGMENTS)
+	}
+}
@@ -2,15 +2,16 @@ package main
 
 import (
 	"context"
-	"sync"
 
 	"github.com/ServiceWeaver/weaver"
 )
 
 type IHomeTimelineService interface {
 	ReadHomeTimeline(context.Context, int64, int, int) ([]Post, error)
+	ReadHomeTimelinePage(context.Context, int64, string, TimelineDirection, int, int) (TimelinePage, error)
 	WriteHomeTimeline(context.Context, int64, int64, int64, []int64) error
 	RemovePost(context.Context, int64, int64, int64) error
+	RemovePostFromTimelines(context.Context, []int64, int64, int64) error
 }
 
 type HomeTimelineService struct {
@@ -21,35 +22,67 @@ type HomeTimelineService struct {
 	storage            weaver.Ref[IStorage]
 }
 
+// ReadHomeTimeline returns the posts from start to stop counted from the
+// newest one.
 func (hts *HomeTimelineService) ReadHomeTimeline(ctx context.Context, userId int64, start int, stop int) ([]Post, error) {
-	if stop <= start || start < 0 {
-		return make([]Post, 0), nil
-	}
+	page, err := hts.ReadHomeTimelinePage(ctx, userId, "", TIMELINE_OLDER, start, stop)
+	return page.Posts, err
+}
+
+// ReadHomeTimelinePage returns the posts older or newer than cursor, from
+// start to stop counted from the cursor. An empty cursor starts at the newest
+// post when going older and at the oldest post when going newer. The posts of
+// users that the user blocks or mutes, or that block the user, are left out
+// of the page, so it may hold fewer posts than asked for; see block_mute.go.
+func (hts *HomeTimelineService) ReadHomeTimelinePage(ctx context.Context, userId int64, cursor string, direction TimelineDirection, start int, stop int) (TimelinePage, error) {
 	storage := hts.storage.Get()
 	postStorageService := hts.postStorageService.Get()
-
-	postIds, _ := storage.GetPostTimeline(ctx, userId, start, stop)
-	return postStorageService.ReadPosts(ctx, postIds)
+	page, err := readTimelinePage(ctx, storage, postStorageService, userId, HOME_TIMELINE, cursor, direction, start, stop)
+	if err != nil || len(page.Posts) == 0 {
+		return page, err
+	}
+	hidden, err := relatedUsers(ctx, storage, userId, RELATION_BLOCKED, RELATION_BLOCKERS, RELATION_MUTED)
+	if err != nil {
+		return page, err
+	}
+	posts := page.Posts[:0]
+	for _, post := range page.Posts {
+		if !hidden[post.Creator.UserId] {
+			posts = append(posts, post)
+		}
+	}
+	page.Posts = posts
+	return page, nil
 }
 
+// WriteHomeTimeline adds the post to the home timelines of the followers of
+// the user, except those that block or mute the user or that the user blocks.
 func (hts *HomeTimelineService) WriteHomeTimeline(ctx context.Context, postId int64, userId int64, timestamp int64, userMentionIds []int64) error {
 	storage := hts.storage.Get()
 	socialGraphService := hts.socialGraphService.Get()
 	ids, _ := socialGraphService.GetFollowers(ctx, userId)
-	var wg sync.WaitGroup
+	hidden, err := relatedUsers(ctx, storage, userId, RELATION_BLOCKERS, RELATION_BLOCKED, RELATION_MUTERS)
+	if err != nil {
+		return err
+	}
+	followers := make([]int64, 0, len(ids))
 	for _, id := range ids {
-		wg.Add(1)
-		go func(ctx context.Context, id, postId, timestamp int64) {
-			defer wg.Done()
-			storage.PutPostTimeline(ctx, id, postId, timestamp)
-		}(ctx, id, postId, timestamp)
+		if !hidden[id] {
+			followers = append(followers, id)
+		}
 	}
-	wg.Wait()
-	return nil
+	return putPostTimelinesBatched(ctx, storage, followers, HOME_TIMELINE, postId, timestamp)
 }
 
 func (hts *HomeTimelineService) RemovePost(ctx context.Context, userId int64, postId int64, timestamp int64) error {
 	storage := hts.storage.Get()
-	storage.RemovePostTimeline(ctx, userId, postId, timestamp)
+	storage.RemovePostTimeline(ctx, userId, HOME_TIMELINE, postId, timestamp)
 	return nil
 }
+
+// RemovePostFromTimelines removes the post from the home timelines of all
+// given users.
+func (hts *HomeTimelineService) RemovePostFromTimelines(ctx context.Context, userIds []int64, postId int64, timestamp int64) error {
+	storage := hts.storage.Get()
+	return removePostTimelinesBatched(ctx, storage, userIds, HOME_TIMELINE, postId, timestamp)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ServiceWeaver/weaver"
+)
+
+// Failed logins are counted per username in Storage. After each failure the
+// next attempt is refused for a delay that doubles with every failure, from
+// login_delay_base_ms up to login_delay_max_ms, and lockout_threshold failures
+// within lockout_window_sec lock the account for lockout_duration_sec.
+//
+// Each attempt is reserved before the password is verified: one transaction
+// checks the lockout and the delay and counts the attempt as a failure, so
+// that concurrent attempts are refused like consecutive ones and a refused
+// attempt tells nothing about the password. An attempt that cannot be
+// reserved fails. A successful login or an admin unlock clears the failures.
+// Unknown usernames are not counted.
+//
+// Attempts are also throttled per client address at /login; see
+// login_throttle.go.
+
+const (
+	DEFAULT_LOCKOUT_THRESHOLD    = 5
+	DEFAULT_LOCKOUT_WINDOW_SEC   = 15 * 60
+	DEFAULT_LOCKOUT_DURATION_SEC = 15 * 60
+	DEFAULT_LOGIN_DELAY_BASE_MS  = 1000
+	DEFAULT_LOGIN_DELAY_MAX_MS   = 30 * 1000
+
+	// LOGIN_RESERVE_ATTEMPTS bounds the retries of reserving an attempt while
+	// concurrent attempts of the same username are reserved.
+	LOGIN_RESERVE_ATTEMPTS = 3
+)
+
+// LoginFailures is the entry of the failed logins of a username in Storage.
+// The times are in unix milliseconds.
+type LoginFailures struct {
+	weaver.AutoMarshal
+	// Count is the number of failures since FirstAt.
+	Count       int
+	FirstAt     int64
+	LastAt      int64
+	LockedUntil int64
+}
+
+func (c *userConfig) lockoutThreshold() int {
+	if c.LockoutThreshold > 0 {
+		return c.LockoutThreshold
+	}
+	return DEFAULT_LOCKOUT_THRESHOLD
+}
+
+func (c *userConfig) lockoutWindow() time.Duration {
+	if c.LockoutWindowSec > 0 {
+		return time.Duration(c.LockoutWindowSec) * time.Second
+	}
+	return DEFAULT_LOCKOUT_WINDOW_SEC * time.Second
+}
+
+func (c *userConfig) lockoutDuration() time.Duration {
+	if c.LockoutDurationSec > 0 {
+		return time.Duration(c.LockoutDurationSec) * time.Second
+	}
+	return DEFAULT_LOCKOUT_DURATION_SEC * time.Second
+}
+
+// loginDelay returns how long after the last of count failures the next
+// attempt is refused.
+func (c *userConfig) loginDelay(count int) time.Duration {
+	base := time.Duration(DEFAULT_LOGIN_DELAY_BASE_MS) * time.Millisecond
+	if c.LoginDelayBaseMs > 0 {
+		base = time.Duration(c.LoginDelayBaseMs) * time.Millisecond
+	}
+	max := time.Duration(DEFAULT_LOGIN_DELAY_MAX_MS) * time.Millisecond
+	if c.LoginDelayMaxMs > 0 {
+		max = time.Duration(c.LoginDelayMaxMs) * time.Millisecond
+	}
+	delay := base
+	for i := 1; i < count && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// retryAfterSec rounds the wait until the unix time in milliseconds up to
+// whole seconds.
+func retryAfterSec(until, now int64) int64 {
+	return (until - now + 999) / 1000
+}
+
+// reserveLoginAttempt counts an attempt to log in as the username as a
+// failure, and locks it if the failures within the window reach the
+// threshold. It returns a LogError if the username is locked or if its last
+// failure is too recent, and an error if the attempt cannot be counted.
+func (us *UserService) reserveLoginAttempt(ctx context.Context, username string) error {
+	cfg := us.Config()
+	storage := us.storage.Get()
+	for attempt := 0; attempt < LOGIN_RESERVE_ATTEMPTS; attempt++ {
+		old, exist, err := storage.GetLoginFailures(ctx, username)
+		if err != nil {
+			return err
+		}
+		now := nowMillis()
+		if exist && old.LockedUntil > now {
+			return NewLogError(ACCOUNT_LOCKED, retryAfterSec(old.LockedUntil, now))
+		}
+		if next := old.LastAt + cfg.loginDelay(old.Count).Milliseconds(); exist && next > now {
+			return NewLogError(LOGIN_THROTTLED, retryAfterSec(next, now))
+		}
+
+		failures := old
+		if !exist || now-old.FirstAt >= cfg.lockoutWindow().Milliseconds() {
+			failures = LoginFailures{FirstAt: now, LockedUntil: old.LockedUntil}
+		}
+		failures.Count++
+		failures.LastAt = now
+		if failures.Count >= cfg.lockoutThreshold() {
+			failures.LockedUntil = now + cfg.lockoutDuration().Milliseconds()
+		}
+		// The entry is kept as long as it can refuse an attempt or add to a
+		// later failure.
+		expiresAt := failures.FirstAt + cfg.lockoutWindow().Milliseconds()
+		if next := failures.LastAt + cfg.loginDelay(failures.Count).Milliseconds(); next > expiresAt {
+			expiresAt = next
+		}
+		if failures.LockedUntil > expiresAt {
+			expiresAt = failures.LockedUntil
+		}
+
+		// The precondition fails if a concurrent attempt was reserved since
+		// old was read; the next read then refuses this one.
+		precondition := StoragePrecondition{Cond: COND_ABSENT, Map: MAP_LOGIN_FAILURES, StrKey: username}
+		if exist {
+			precondition = StoragePrecondition{Cond: COND_EQUALS, Map: MAP_LOGIN_FAILURES, StrKey: username, LoginFailures: old}
+		}
+		ok, err := storage.Transact(ctx, stringRoutingBucket(username), StorageTransaction{
+			Preconditions: []StoragePrecondition{precondition},
+			Mutations: []StorageMutation{
+				{Op: OP_PUT_LOGIN_FAILURES, StrKey: username, LoginFailures: failures, ExpiresAt: expiresAt},
+			},
+		})
+		if err != nil || ok {
+			return err
+		}
+	}
+	return fmt.Errorf("login attempt of %s: too many concurrent attempts", username)
+}
+
+// clearLoginFailures forgets the failed logins of the username.
+func (us *UserService) clearLoginFailures(ctx context.Context, username string) error {
+	_, err := us.storage.Get().Transact(ctx, stringRoutingBucket(username), StorageTransaction{
+		Mutations: []StorageMutation{
+			{Op: OP_REMOVE_LOGIN_FAILURES, StrKey: username},
+		},
+	})
+	return err
+}
+
+func (us *UserService) UnlockUser(ctx context.Context, username string) error {
+	_, exist, err := us.storage.Get().GetUserProfile(ctx, username)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return NewLogError(NOT_REGISTERED, 0)
+	}
+	return us.clearLoginFailures(ctx, username)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ServiceWeaver/weaver/weavertest"
+)
+
+// The login delay is 1ms so that only the lockout refuses attempts.
+const TEST_LOCKOUT_CONFIG = `
+lockout_threshold = 3
+lockout_window_sec = 60
+lockout_duration_sec = 60
+login_delay_base_ms = 1
+login_delay_max_ms = 1
+`
+
+func loginErrorCode(err error) LogErrorCode {
+	var logErr *LogError
+	if errors.As(err, &logErr) {
+		return logErr.Code
+	}
+	return 0
+}
+
+func TestLoginLockout(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name     string
+		failures int
+		// want is the code of the login with the right password after the
+		// failures, or zero if it succeeds.
+		want LogErrorCode
+	}{
+		{"no failure", 0, 0},
+		{"below the threshold", 2, 0},
+		{"at the threshold", 3, ACCOUNT_LOCKED},
+		{"past the threshold", 4, ACCOUNT_LOCKED},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			userServiceRunner(TEST_LOCKOUT_CONFIG).Test(t, func(t *testing.T, us UserServicer) {
+				registerAndLogin(t, us)
+				for i := 1; i <= tc.failures; i++ {
+					time.Sleep(2 * time.Millisecond)
+					_, err := us.Login(ctx, "alice", "wrong-password")
+					want := WRONG_PASSWORD
+					if i > 3 {
+						want = ACCOUNT_LOCKED
+					}
+					if code := loginErrorCode(err); code != want {
+						t.Fatalf("failure %d: got %v, want code %v", i, err, want)
+					}
+				}
+
+				time.Sleep(2 * time.Millisecond)
+				_, err := us.Login(ctx, "alice", "password1")
+				if code := loginErrorCode(err); code != tc.want || (tc.want == 0 && err != nil) {
+					t.Fatalf("login after %d failures: got %v, want code %v", tc.failures, err, tc.want)
+				}
+				if tc.want == ACCOUNT_LOCKED {
+					var logErr *LogError
+					errors.As(err, &logErr)
+					if logErr.RetryAfterSec <= 0 || logErr.RetryAfterSec > 60 {
+						t.Errorf("locked for %d seconds, want at most 60", logErr.RetryAfterSec)
+					}
+				}
+			})
+		})
+	}
+}
+
+// TEST_THREADED_HASH_CONFIG hashes passwords with several threads, which
+// yield while the hash is computed, so that concurrent logins interleave even
+// on a single CPU.
+const TEST_THREADED_HASH_CONFIG = `
+["SocialNetwork/server/UserServicer"]
+token_secret = "test-only-token-secret-of-32-bytes"
+argon2_time = 1
+argon2_memory_kib = 256
+argon2_threads = 4
+`
+
+// Concurrent wrong guesses are refused like consecutive ones: no more of them
+// are verified than the delay or the lockout lets through.
+func TestConcurrentLoginGuesses(t *testing.T) {
+	ctx := context.Background()
+	const guesses = 20
+	for _, tc := range []struct {
+		name   string
+		config string
+		// maxVerified is the number of guesses whose password may be checked.
+		maxVerified int
+		want        LogErrorCode
+	}{
+		{
+			name: "delay",
+			config: `
+login_delay_base_ms = 60000
+login_delay_max_ms = 60000
+`,
+			maxVerified: 1,
+			want:        LOGIN_THROTTLED,
+		},
+		{"lockout", TEST_LOCKOUT_CONFIG, 3, ACCOUNT_LOCKED},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := weavertest.Local
+			runner.Config = TEST_THREADED_HASH_CONFIG + tc.config
+			runner.Test(t, func(t *testing.T, us UserServicer) {
+				registerAndLogin(t, us)
+				var wg sync.WaitGroup
+				errs := make([]error, guesses)
+				for i := range errs {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						_, errs[i] = us.Login(ctx, "alice", "wrong-password")
+					}(i)
+				}
+				wg.Wait()
+
+				verified := 0
+				for _, err := range errs {
+					switch loginErrorCode(err) {
+					case WRONG_PASSWORD:
+						verified++
+					case LOGIN_THROTTLED, ACCOUNT_LOCKED:
+					default:
+						if err == nil {
+							t.Fatal("a wrong guess logged in")
+						}
+					}
+				}
+				if verified == 0 || verified > tc.maxVerified {
+					t.Errorf("%d of %d concurrent guesses were verified, want 1 to %d", verified, guesses, tc.maxVerified)
+				}
+				if verified == tc.maxVerified {
+					time.Sleep(2 * time.Millisecond)
+					if _, err := us.Login(ctx, "alice", "password1"); loginErrorCode(err) != tc.want {
+						t.Errorf("login after the guesses: got %v, want code %v", err, tc.want)
+					}
+				}
+			})
+		})
+	}
+}
+
+// A successful login clears the failures, so that they do not add up to a
+// lockout.
+func TestLoginClearsFailures(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner(TEST_LOCKOUT_CONFIG).Test(t, func(t *testing.T, us UserServicer) {
+		registerAndLogin(t, us)
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 2; i++ {
+				time.Sleep(2 * time.Millisecond)
+				if _, err := us.Login(ctx, "alice", "wrong-password"); loginErrorCode(err) != WRONG_PASSWORD {
+					t.Fatalf("round %d: got %v, want code %v", round, err, WRONG_PASSWORD)
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+			if _, err := us.Login(ctx, "alice", "password1"); err != nil {
+				t.Fatalf("round %d: %v", round, err)
+			}
+		}
+	})
+}
+
+func TestUnlockUser(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name     string
+		username string
+		locked   bool
+		want     LogErrorCode
+	}{
+		{"locked user", "alice", true, 0},
+		{"user without failures", "alice", false, 0},
+		{"unknown user", "bob", false, NOT_REGISTERED},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			userServiceRunner(TEST_LOCKOUT_CONFIG).Test(t, func(t *testing.T, us UserServicer) {
+				registerAndLogin(t, us)
+				if tc.locked {
+					for i := 0; i < 3; i++ {
+						time.Sleep(2 * time.Millisecond)
+						us.Login(ctx, "alice", "wrong-password")
+					}
+					if _, err := us.Login(ctx, "alice", "password1"); loginErrorCode(err) != ACCOUNT_LOCKED {
+						t.Fatalf("login before the unlock: got %v, want code %v", err, ACCOUNT_LOCKED)
+					}
+				}
+
+				err := us.UnlockUser(ctx, tc.username)
+				if code := loginErrorCode(err); code != tc.want || (tc.want == 0 && err != nil) {
+					t.Fatalf("UnlockUser(%s): got %v, want code %v", tc.username, err, tc.want)
+				}
+				if tc.want != 0 {
+					return
+				}
+				// The failures before the unlock no longer count.
+				for i := 1; i <= 2; i++ {
+					time.Sleep(2 * time.Millisecond)
+					if _, err := us.Login(ctx, tc.username, "wrong-password"); loginErrorCode(err) != WRONG_PASSWORD {
+						t.Fatalf("failure %d after the unlock: got %v, want code %v", i, err, WRONG_PASSWORD)
+					}
+				}
+				time.Sleep(2 * time.Millisecond)
+				if _, err := us.Login(ctx, tc.username, "password1"); err != nil {
+					t.Errorf("login after the unlock: %v", err)
+				}
+			})
+		})
+	}
+}
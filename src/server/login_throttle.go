@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Logins are throttled per client address at /login, on top of the per
+// username delays and lockout of login_lockout.go: each address may try
+// login_ip_max_attempts times per window of login_ip_window_sec, successful
+// or not, and gets 429 past that. The counts are kept in the memory of each
+// process serving the api listener.
+
+const (
+	DEFAULT_LOGIN_IP_MAX_ATTEMPTS = 30
+	DEFAULT_LOGIN_IP_WINDOW_SEC   = 60
+)
+
+func (c *appConfig) loginIpMaxAttempts() int {
+	if c.LoginIpMaxAttempts > 0 {
+		return c.LoginIpMaxAttempts
+	}
+	return DEFAULT_LOGIN_IP_MAX_ATTEMPTS
+}
+
+func (c *appConfig) loginIpWindow() time.Duration {
+	if c.LoginIpWindowSec > 0 {
+		return time.Duration(c.LoginIpWindowSec) * time.Second
+	}
+	return DEFAULT_LOGIN_IP_WINDOW_SEC * time.Second
+}
+
+// loginWindow counts the attempts of an address since start.
+type loginWindow struct {
+	start    time.Time
+	attempts int
+}
+
+type loginThrottle struct {
+	maxAttempts int
+	window      time.Duration
+
+	mu        sync.Mutex
+	windows   map[string]*loginWindow
+	lastSweep time.Time
+}
+
+func newLoginThrottle(maxAttempts int, window time.Duration) *loginThrottle {
+	return &loginThrottle{
+		maxAttempts: maxAttempts,
+		window:      window,
+		windows:     map[string]*loginWindow{},
+		lastSweep:   time.Now(),
+	}
+}
+
+// allow counts an attempt of the address and reports whether it may go on,
+// or else how long until the address may try again.
+func (lt *loginThrottle) allow(addr string, now time.Time) (bool, time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	// Forget the windows that ended, at most once per window.
+	if now.Sub(lt.lastSweep) >= lt.window {
+		for a, w := range lt.windows {
+			if now.Sub(w.start) >= lt.window {
+				delete(lt.windows, a)
+			}
+		}
+		lt.lastSweep = now
+	}
+
+	w, ok := lt.windows[addr]
+	if !ok || now.Sub(w.start) >= lt.window {
+		w = &loginWindow{start: now}
+		lt.windows[addr] = w
+	}
+	if w.attempts >= lt.maxAttempts {
+		return false, w.start.Add(lt.window).Sub(now)
+	}
+	w.attempts++
+	return true, 0
+}
+
+// client_addr returns the address of the client of r, without its port.
+func client_addr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
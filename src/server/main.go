@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"SocialNetwork/shared/common"
 
@@ -21,9 +25,12 @@ func main() {
 
 type app struct {
 	weaver.Implements[weaver.Main]
+	weaver.WithConfig[appConfig]
 	backend_service weaver.Ref[BackendServicer]
 
 	api_listener weaver.Listener `weaver:"apilistener"`
+	// admin_listener serves the admin endpoints only; see auth.go.
+	admin_listener weaver.Listener `weaver:"adminlistener"`
 }
 
 func reg_listener_action(
@@ -40,6 +47,23 @@ func reg_listener_action(
 	}()
 }
 
+// reg_admin_action registers an admin endpoint on admin_mux, which only the
+// admin listener serves. Requests without the admin token are refused before
+// action runs.
+func reg_admin_action(
+	admin_mux *http.ServeMux,
+	admin_token string,
+	endpoint string,
+	action func(http.ResponseWriter, *http.Request),
+) {
+	admin_mux.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
+		if !authorize_admin(w, r, admin_token) {
+			return
+		}
+		action(w, r)
+	})
+}
+
 func decode_request_body(r *http.Request, action func(*codegen.Decoder)) error {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -58,10 +82,154 @@ func encode_response_body(w http.ResponseWriter, action func(*codegen.Encoder))
 	w.Write(enc.Data())
 }
 
+// encode_timeline_page writes the posts of the page followed by the cursors
+// of the next older and newer pages.
+func encode_timeline_page(enc *codegen.Encoder, page TimelinePage) {
+	enc.Int(len(page.Posts))
+	for _, post := range page.Posts {
+		enc.Int64(post.Post_id)
+		enc.Int64(post.Creator.UserId)
+		enc.String(post.Creator.Username)
+		enc.Int64(post.Req_id)
+		enc.String(post.Text)
+		enc.Int64(post.Timestamp)
+		enc.Int(int(post.Post_type))
+
+		enc.Int(len(post.User_mentions))
+		enc.Int(len(post.Media))
+		enc.Int(len(post.Urls))
+		for _, user_mention := range post.User_mentions {
+			enc.Int64(user_mention.UserId)
+			enc.String(user_mention.Username)
+		}
+		for _, media := range post.Media {
+			enc.Int64(media.MediaId)
+			enc.String(media.MediaType)
+		}
+		for _, url := range post.Urls {
+			enc.String(url.ShortenedUrl) // send only shortened url, check if it is correct
+		}
+	}
+	enc.String(page.Older)
+	enc.String(page.Newer)
+}
+
+// encode_user_ids writes the user ids, each followed by its username if
+// with_usernames is set. Users without a profile get an empty username.
+func encode_user_ids(enc *codegen.Encoder, user_ids []int64, usernames map[int64]string, with_usernames bool) {
+	enc.Int(len(user_ids))
+	for _, user_id := range user_ids {
+		enc.Int64(user_id)
+		if with_usernames {
+			enc.String(usernames[user_id])
+		}
+	}
+}
+
+func get_usernames(backend BackendServicer, user_ids []int64) (map[int64]string, error) {
+	infos, err := backend.GetUserInfos(context.Background(), user_ids)
+	if err != nil {
+		return nil, err
+	}
+	usernames := make(map[int64]string, len(infos))
+	for user_id, info := range infos {
+		usernames[user_id] = info.Username
+	}
+	return usernames, nil
+}
+
+// register_error_status returns the status of a failed registration: 409 if
+// the username or user id is taken, 400 if the request is invalid.
+func register_error_status(err error) int {
+	var register_err *RegisterError
+	if !errors.As(err, &register_err) {
+		return http.StatusInternalServerError
+	}
+	switch register_err.Code {
+	case USERNAME_TAKEN, USER_ID_TAKEN:
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// profile_error_status returns the status of a failed profile change: 404 if
+// the user has no profile, 403 if the old password does not match, 409 if the
+// profile kept changing, and 400 if the request is invalid.
+func profile_error_status(err error) int {
+	var profile_err *ProfileError
+	if !errors.As(err, &profile_err) {
+		return http.StatusInternalServerError
+	}
+	switch profile_err.Code {
+	case PROFILE_NOT_FOUND:
+		return http.StatusNotFound
+	case OLD_PASSWORD_MISMATCH:
+		return http.StatusForbidden
+	case PROFILE_CONFLICT:
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// search_error_status returns the status of a failed user search: 400 if the
+// request is invalid, 503 if the search index is still loading.
+func search_error_status(err error) int {
+	var search_err *UserSearchError
+	if !errors.As(err, &search_err) {
+		return http.StatusInternalServerError
+	}
+	if search_err.Code == SEARCH_NOT_READY {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// social_graph_error_status returns the status of a failed follow, block,
+// mute, answer to a follow request or follower list read, or of a refused
+// read of a private timeline: 403 if one of the users blocks the other or the
+// timeline is private, 404 if the other user or the follow request does not
+// exist, and 400 if the request or cursor is invalid.
+func social_graph_error_status(err error) int {
+	var social_graph_err *SocialGraphError
+	if !errors.As(err, &social_graph_err) {
+		return http.StatusInternalServerError
+	}
+	switch social_graph_err.Code {
+	case BLOCKED, PRIVATE_ACCOUNT:
+		return http.StatusForbidden
+	case UNKNOWN_USER, REQUEST_NOT_FOUND:
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// login_error_status returns the status of a failed login: 429 with a
+// Retry-After header if the username is locked or throttled, and 401
+// otherwise.
+func login_error_status(w http.ResponseWriter, err error) int {
+	var log_err *LogError
+	if !errors.As(err, &log_err) {
+		return http.StatusInternalServerError
+	}
+	switch log_err.Code {
+	case ACCOUNT_LOCKED, LOGIN_THROTTLED:
+		w.Header().Set("Retry-After", strconv.FormatInt(log_err.RetryAfterSec, 10))
+		return http.StatusTooManyRequests
+	}
+	return http.StatusUnauthorized
+}
+
 // serve is called by weaver.Run and contains the body of the application.
 func serve(ctx context.Context, app *app) error {
 	var backend = app.backend_service.Get()
 	err_collector := make(chan error)
+	auth := &authenticator{backend: backend, disabled: app.Config().DisableAuth}
+	if auth.disabled {
+		fmt.Printf("auth is disabled, requests act for the users they name\n")
+	}
+	login_throttle := newLoginThrottle(app.Config().loginIpMaxAttempts(), app.Config().loginIpWindow())
+	admin_mux := http.NewServeMux()
+	admin_token := app.Config().AdminToken
 
 	reg_listener_action(app.api_listener, common.REMOVE_POSTS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
 		var user_id int64
@@ -73,6 +241,9 @@ func serve(ctx context.Context, app *app) error {
 			start = dec.Int()
 			stop = dec.Int()
 		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == user_id }) {
+			return
+		}
 
 		err := backend.RemovePosts(context.Background(), user_id, start, stop)
 		if err != nil {
@@ -97,6 +268,11 @@ func serve(ctx context.Context, app *app) error {
 			media_types = common.Decode_slice_string(dec)
 			post_type = (PostType)(dec.Int())
 		})
+		if !auth.authorize(w, r, func(user Creator) bool {
+			return user.UserId == user_id && user.Username == username
+		}) {
+			return
+		}
 
 		err := backend.CompostPost(
 			context.Background(),
@@ -113,23 +289,74 @@ func serve(ctx context.Context, app *app) error {
 		var username string
 		var password string
 
+		if ok, wait := login_throttle.allow(client_addr(r), time.Now()); !ok {
+			retry_after := int64((wait + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.FormatInt(retry_after, 10))
+			http.Error(w, "too many login attempts", http.StatusTooManyRequests)
+			return
+		}
+
 		decode_request_body(r, func(dec *codegen.Decoder) {
 			username = dec.String()
 			password = dec.String()
 		})
 
-		token, err := backend.Login(context.Background(), username, password)
+		tokens, err := backend.Login(context.Background(), username, password)
 		if err != nil {
-			log.Default().Println(err) // never triggered
-		} else {
-			encode_response_body(w, func(enc *codegen.Encoder) {
-				enc.String(token)
-			})
+			log.Default().Println(err)
+			http.Error(w, err.Error(), login_error_status(w, err))
+			return
 		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			enc.String(tokens.AccessToken)
+			enc.String(tokens.RefreshToken)
+		})
 
 		fmt.Fprintf(w, "login\n")
 	}, err_collector)
 
+	reg_listener_action(app.api_listener, common.REFRESH_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var refresh_token string
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			refresh_token = dec.String()
+		})
+
+		tokens, err := backend.Refresh(context.Background(), refresh_token)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			enc.String(tokens.AccessToken)
+			enc.String(tokens.RefreshToken)
+		})
+
+		fmt.Fprintf(w, "refresh\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.LOGOUT_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var all_sessions bool
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			all_sessions = dec.Bool()
+		})
+
+		token, found := bearer_token(r)
+		if !found {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		if err := backend.Logout(context.Background(), token, all_sessions); err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprintf(w, "logout\n")
+	}, err_collector)
+
 	reg_listener_action(app.api_listener, common.REGISTER_USER_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
 		var first_name string
 		var last_name string
@@ -145,7 +372,9 @@ func serve(ctx context.Context, app *app) error {
 
 		err := backend.RegisterUser(context.Background(), first_name, last_name, username, password)
 		if err != nil {
-			log.Default().Println(err) // never triggered
+			log.Default().Println(err)
+			http.Error(w, err.Error(), register_error_status(err))
+			return
 		}
 
 		fmt.Fprintf(w, "register_user\n")
@@ -168,53 +397,199 @@ func serve(ctx context.Context, app *app) error {
 
 		err := backend.RegisterUserWithId(context.Background(), first_name, last_name, username, password, user_id)
 		if err != nil {
-			log.Default().Println(err) // never triggered
+			log.Default().Println(err)
+			http.Error(w, err.Error(), register_error_status(err))
+			return
 		}
 
 		fmt.Fprintf(w, "register_user_with_id\n")
 	}, err_collector)
 
+	reg_listener_action(app.api_listener, common.GET_PROFILE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+		})
+
+		info, exist, err := backend.GetProfile(context.Background(), user_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exist {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			enc.Int64(info.UserId)
+			enc.String(info.Username)
+			enc.String(info.FirstName)
+			enc.String(info.LastName)
+			enc.String(info.Bio)
+			enc.String(info.Avatar)
+			enc.Int64(info.CreatedAt)
+			enc.Bool(info.Private)
+		})
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.SEARCH_USERS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var query string
+		var mode UserSearchMode
+		var cursor string
+		var limit int
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			query = dec.String()
+			mode = (UserSearchMode)(dec.Int())
+			cursor = dec.String()
+			limit = dec.Int()
+		})
+
+		page, err := backend.SearchUsers(context.Background(), query, mode, cursor, limit)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), search_error_status(err))
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			enc.Int(len(page.Users))
+			for _, info := range page.Users {
+				enc.Int64(info.UserId)
+				enc.String(info.Username)
+				enc.String(info.FirstName)
+				enc.String(info.LastName)
+				enc.String(info.Avatar)
+			}
+			enc.String(page.Next)
+		})
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.UPDATE_PROFILE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+		var first_name string
+		var last_name string
+		var bio string
+		var avatar string
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+			first_name = dec.String()
+			last_name = dec.String()
+			bio = dec.String()
+			avatar = dec.String()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == user_id }) {
+			return
+		}
+
+		err := backend.UpdateProfile(context.Background(), user_id, first_name, last_name, bio, avatar)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), profile_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "update_profile\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.SET_PRIVATE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+		var private bool
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+			private = dec.Bool()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == user_id }) {
+			return
+		}
+
+		err := backend.SetPrivate(context.Background(), user_id, private)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), profile_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "set_private\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.CHANGE_PASSWORD_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+		var old_password string
+		var new_password string
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+			old_password = dec.String()
+			new_password = dec.String()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == user_id }) {
+			return
+		}
+
+		err := backend.ChangePassword(context.Background(), user_id, old_password, new_password)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), profile_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "change_password\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.DELETE_USER_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == user_id }) {
+			return
+		}
+
+		err := backend.DeleteUser(context.Background(), user_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), profile_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "delete_user\n")
+	}, err_collector)
+
 	reg_listener_action(app.api_listener, common.READ_USER_TIMELINE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
 		var user_id int64
 		var start int
 		var stop int
+		var cursor string
+		var direction TimelineDirection
 
 		decode_request_body(r, func(dec *codegen.Decoder) {
 			user_id = dec.Int64()
 			start = dec.Int()
 			stop = dec.Int()
+			cursor = dec.String()
+			direction = (TimelineDirection)(dec.Int())
 		})
+		reader_id, ok := auth.reader(w, r, user_id)
+		if !ok {
+			return
+		}
 
-		posts, err := backend.ReadUserTimeline(context.Background(), user_id, start, stop)
+		page, err := backend.ReadUserTimelinePage(context.Background(), reader_id, user_id, cursor, direction, start, stop)
+		var social_graph_err *SocialGraphError
+		if errors.As(err, &social_graph_err) {
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
 		if err != nil {
 			log.Default().Println(err)
 		} else {
 			encode_response_body(w, func(enc *codegen.Encoder) {
-				enc.Int(len(posts)) // TODO: repeated code in read_home_timeline
-				for _, post := range posts {
-					enc.Int64(post.Post_id)
-					enc.Int64(post.Creator.UserId)
-					enc.String(post.Creator.Username)
-					enc.Int64(post.Req_id)
-					enc.String(post.Text)
-					enc.Int64(post.Timestamp)
-					enc.Int(int(post.Post_type))
-
-					enc.Int(len(post.User_mentions))
-					enc.Int(len(post.Media))
-					enc.Int(len(post.Urls))
-					for _, user_mention := range post.User_mentions {
-						enc.Int64(user_mention.UserId)
-						enc.String(user_mention.Username)
-					}
-					for _, media := range post.Media {
-						enc.Int64(media.MediaId)
-						enc.String(media.MediaType)
-					}
-					for _, url := range post.Urls {
-						enc.String(url.ShortenedUrl) // send only shortened url, check if it is correct
-					}
-				}
+				encode_timeline_page(enc, page)
 			})
 		}
 
@@ -223,20 +598,23 @@ func serve(ctx context.Context, app *app) error {
 
 	reg_listener_action(app.api_listener, common.GET_FOLLOWERS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
 		var user_id int64
+		var with_usernames bool
 
 		decode_request_body(r, func(dec *codegen.Decoder) {
 			user_id = dec.Int64()
+			with_usernames = dec.Bool()
 		})
 
 		followers, err := backend.GetFollowers(context.Background(), user_id)
+		var usernames map[int64]string
+		if err == nil && with_usernames {
+			usernames, err = get_usernames(backend, followers)
+		}
 		if err != nil {
 			log.Default().Println(err)
 		} else {
 			encode_response_body(w, func(enc *codegen.Encoder) {
-				enc.Int(len(followers))
-				for _, follower_id := range followers {
-					enc.Int64(follower_id)
-				}
+				encode_user_ids(enc, followers, usernames, with_usernames)
 			})
 		}
 
@@ -251,6 +629,9 @@ func serve(ctx context.Context, app *app) error {
 			id = dec.Int64()
 			followee_id = dec.Int64()
 		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == id }) {
+			return
+		}
 
 		err := backend.Unfollow(context.Background(), id, followee_id)
 		if err != nil {
@@ -268,6 +649,9 @@ func serve(ctx context.Context, app *app) error {
 			username = dec.String()
 			followee_username = dec.String()
 		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.Username == username }) {
+			return
+		}
 
 		err := backend.UnfollowWithUsername(context.Background(), username, followee_username)
 		if err != nil {
@@ -285,10 +669,18 @@ func serve(ctx context.Context, app *app) error {
 			id = dec.Int64()
 			followee_id = dec.Int64()
 		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == id }) {
+			return
+		}
 
-		err := backend.Follow(context.Background(), id, followee_id)
+		requested, err := backend.Follow(context.Background(), id, followee_id)
 		if err != nil {
-			log.Default().Println(err) // never triggered
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+		if requested {
+			w.WriteHeader(http.StatusAccepted)
 		}
 
 		fmt.Fprintf(w, "follow\n")
@@ -302,10 +694,18 @@ func serve(ctx context.Context, app *app) error {
 			username = dec.String()
 			followee_username = dec.String()
 		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.Username == username }) {
+			return
+		}
 
-		err := backend.FollowWithUsername(context.Background(), username, followee_username)
+		requested, err := backend.FollowWithUsername(context.Background(), username, followee_username)
 		if err != nil {
-			log.Default().Println(err) // never triggered
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+		if requested {
+			w.WriteHeader(http.StatusAccepted)
 		}
 
 		fmt.Fprintf(w, "follow_with_username\n")
@@ -313,67 +713,377 @@ func serve(ctx context.Context, app *app) error {
 
 	reg_listener_action(app.api_listener, common.GET_FOLLOWEES_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
 		var user_id int64
+		var with_usernames bool
 
 		decode_request_body(r, func(dec *codegen.Decoder) {
 			user_id = dec.Int64()
+			with_usernames = dec.Bool()
 		})
 
 		followees, err := backend.GetFollowees(context.Background(), user_id)
+		var usernames map[int64]string
+		if err == nil && with_usernames {
+			usernames, err = get_usernames(backend, followees)
+		}
 		if err != nil {
 			log.Default().Println(err)
 		} else {
 			encode_response_body(w, func(enc *codegen.Encoder) {
-				enc.Int(len(followees))
-				for _, followee_id := range followees {
-					enc.Int64(followee_id)
-				}
+				encode_user_ids(enc, followees, usernames, with_usernames)
 			})
 		}
 
 		fmt.Fprintf(w, "get_followees\n")
 	}, err_collector)
 
+	reg_listener_action(app.api_listener, common.GET_FOLLOW_COUNTS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+		})
+
+		followers, followees, err := backend.GetFollowCounts(context.Background(), user_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			enc.Int(followers)
+			enc.Int(followees)
+		})
+
+		fmt.Fprintf(w, "get_follow_counts\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.GET_FOLLOWERS_PAGE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+		var cursor string
+		var limit int
+		var with_usernames bool
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+			cursor = dec.String()
+			limit = dec.Int()
+			with_usernames = dec.Bool()
+		})
+
+		page, err := backend.GetFollowersPage(context.Background(), user_id, cursor, limit)
+		var usernames map[int64]string
+		if err == nil && with_usernames {
+			usernames, err = get_usernames(backend, page.UserIds)
+		}
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			encode_user_ids(enc, page.UserIds, usernames, with_usernames)
+			enc.String(page.Next)
+		})
+
+		fmt.Fprintf(w, "get_followers_page\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.GET_FOLLOWEES_PAGE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+		var cursor string
+		var limit int
+		var with_usernames bool
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+			cursor = dec.String()
+			limit = dec.Int()
+			with_usernames = dec.Bool()
+		})
+
+		page, err := backend.GetFolloweesPage(context.Background(), user_id, cursor, limit)
+		var usernames map[int64]string
+		if err == nil && with_usernames {
+			usernames, err = get_usernames(backend, page.UserIds)
+		}
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			encode_user_ids(enc, page.UserIds, usernames, with_usernames)
+			enc.String(page.Next)
+		})
+
+		fmt.Fprintf(w, "get_followees_page\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.IS_FOLLOWING_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+		var followee_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+			followee_id = dec.Int64()
+		})
+
+		following, err := backend.IsFollowing(context.Background(), user_id, followee_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			enc.Bool(following)
+		})
+
+		fmt.Fprintf(w, "is_following\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.BLOCK_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var id int64
+		var blocked_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			id = dec.Int64()
+			blocked_id = dec.Int64()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == id }) {
+			return
+		}
+
+		err := backend.Block(context.Background(), id, blocked_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "block\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.UNBLOCK_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var id int64
+		var blocked_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			id = dec.Int64()
+			blocked_id = dec.Int64()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == id }) {
+			return
+		}
+
+		err := backend.Unblock(context.Background(), id, blocked_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "unblock\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.MUTE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var id int64
+		var muted_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			id = dec.Int64()
+			muted_id = dec.Int64()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == id }) {
+			return
+		}
+
+		err := backend.Mute(context.Background(), id, muted_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "mute\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.UNMUTE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var id int64
+		var muted_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			id = dec.Int64()
+			muted_id = dec.Int64()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == id }) {
+			return
+		}
+
+		err := backend.Unmute(context.Background(), id, muted_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "unmute\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.GET_BLOCKED_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+		var with_usernames bool
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+			with_usernames = dec.Bool()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == user_id }) {
+			return
+		}
+
+		blocked, err := backend.GetBlocked(context.Background(), user_id)
+		var usernames map[int64]string
+		if err == nil && with_usernames {
+			usernames, err = get_usernames(backend, blocked)
+		}
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			encode_user_ids(enc, blocked, usernames, with_usernames)
+		})
+
+		fmt.Fprintf(w, "get_blocked\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.GET_MUTED_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+		var with_usernames bool
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+			with_usernames = dec.Bool()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == user_id }) {
+			return
+		}
+
+		muted, err := backend.GetMuted(context.Background(), user_id)
+		var usernames map[int64]string
+		if err == nil && with_usernames {
+			usernames, err = get_usernames(backend, muted)
+		}
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			encode_user_ids(enc, muted, usernames, with_usernames)
+		})
+
+		fmt.Fprintf(w, "get_muted\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.GET_FOLLOW_REQUESTS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var user_id int64
+		var with_usernames bool
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			user_id = dec.Int64()
+			with_usernames = dec.Bool()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == user_id }) {
+			return
+		}
+
+		requesters, err := backend.GetFollowRequests(context.Background(), user_id)
+		var usernames map[int64]string
+		if err == nil && with_usernames {
+			usernames, err = get_usernames(backend, requesters)
+		}
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encode_response_body(w, func(enc *codegen.Encoder) {
+			encode_user_ids(enc, requesters, usernames, with_usernames)
+		})
+
+		fmt.Fprintf(w, "get_follow_requests\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.APPROVE_FOLLOWER_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var id int64
+		var follower_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			id = dec.Int64()
+			follower_id = dec.Int64()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == id }) {
+			return
+		}
+
+		err := backend.ApproveFollower(context.Background(), id, follower_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "approve_follower\n")
+	}, err_collector)
+
+	reg_listener_action(app.api_listener, common.REJECT_FOLLOWER_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var id int64
+		var follower_id int64
+
+		decode_request_body(r, func(dec *codegen.Decoder) {
+			id = dec.Int64()
+			follower_id = dec.Int64()
+		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == id }) {
+			return
+		}
+
+		err := backend.RejectFollower(context.Background(), id, follower_id)
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), social_graph_error_status(err))
+			return
+		}
+
+		fmt.Fprintf(w, "reject_follower\n")
+	}, err_collector)
+
 	reg_listener_action(app.api_listener, common.READ_HOME_TIMELINE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
 		var user_id int64
 		var start int
 		var stop int
+		var cursor string
+		var direction TimelineDirection
 
 		decode_request_body(r, func(dec *codegen.Decoder) {
 			user_id = dec.Int64()
 			start = dec.Int()
 			stop = dec.Int()
+			cursor = dec.String()
+			direction = (TimelineDirection)(dec.Int())
 		})
+		if !auth.authorize(w, r, func(user Creator) bool { return user.UserId == user_id }) {
+			return
+		}
 
-		posts, err := backend.ReadHomeTimeline(context.Background(), user_id, start, stop)
+		page, err := backend.ReadHomeTimelinePage(context.Background(), user_id, cursor, direction, start, stop)
 		if err != nil {
 			log.Default().Println(err)
 		} else {
 			encode_response_body(w, func(enc *codegen.Encoder) {
-				enc.Int(len(posts)) // TODO: repeated code in read_user_timeline
-				for _, post := range posts {
-					enc.Int64(post.Post_id)
-					enc.Int64(post.Creator.UserId)
-					enc.String(post.Creator.Username)
-					enc.Int64(post.Req_id)
-					enc.String(post.Text)
-					enc.Int64(post.Timestamp)
-					enc.Int(int(post.Post_type))
-
-					enc.Int(len(post.User_mentions))
-					enc.Int(len(post.Media))
-					enc.Int(len(post.Urls))
-					for _, user_mention := range post.User_mentions {
-						enc.Int64(user_mention.UserId)
-						enc.String(user_mention.Username)
-					}
-					for _, media := range post.Media {
-						enc.Int64(media.MediaId)
-						enc.String(media.MediaType)
-					}
-					for _, url := range post.Urls {
-						enc.String(url.ShortenedUrl) // send only shortened url, check if it is correct
-					}
-				}
+				encode_timeline_page(enc, page)
 			})
 		}
 
@@ -388,6 +1098,9 @@ func serve(ctx context.Context, app *app) error {
 			filename = dec.String()
 			data = dec.String()
 		})
+		if !auth.authorize(w, r, any_user) {
+			return
+		}
 
 		err := backend.UploadMedia(context.Background(), filename, data)
 		if err != nil {
@@ -415,6 +1128,83 @@ func serve(ctx context.Context, app *app) error {
 		fmt.Fprintf(w, "get_media\n")
 	}, err_collector)
 
+	// The admin endpoints exchange JSON rather than the custom encoding, and
+	// report failures with an error status.
+	// The storage stats hold no user data and are served on the api listener
+	// without the admin token; the other admin endpoints are only served on
+	// the admin listener.
+	reg_listener_action(app.api_listener, common.STORAGE_STATS_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		report, err := backend.GetStorageStats(context.Background())
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}, err_collector)
+
+	reg_admin_action(admin_mux, admin_token, common.EXPORT_STORAGE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		dump, err := backend.ExportStorage(context.Background())
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dump)
+	})
+
+	reg_admin_action(admin_mux, admin_token, common.IMPORT_STORAGE_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var dump StorageDump
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&dump); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := backend.ImportStorage(context.Background(), dump); err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "import_storage\n")
+	})
+
+	reg_admin_action(admin_mux, admin_token, common.SWEEP_EXPIRED_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		posts, err := backend.SweepExpired(context.Background())
+		if err != nil {
+			log.Default().Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "sweep_expired %d\n", posts)
+	})
+
+	reg_admin_action(admin_mux, admin_token, common.UNLOCK_USER_ENDPOINT, func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Username string }
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := backend.UnlockUser(context.Background(), req.Username); err != nil {
+			log.Default().Println(err)
+			status := http.StatusInternalServerError
+			var log_err *LogError
+			if errors.As(err, &log_err) && log_err.Code == NOT_REGISTERED {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		fmt.Fprintf(w, "unlock_user\n")
+	})
+
+	go func() {
+		fmt.Printf("admin endpoints available on %v\n", app.admin_listener)
+		err_collector <- http.Serve(app.admin_listener, admin_mux)
+	}()
+
 	for err := range err_collector {
 		log.Fatal(err)
 		return err
@@ -15,12 +15,13 @@ type MediaStorageServicer interface {
 
 type MediaStorageService struct {
 	weaver.Implements[MediaStorageServicer]
+	weaver.WithConfig[ttlConfig]
 	storage weaver.Ref[IStorage]
 }
 
 func (m *MediaStorageService) UploadMedia(ctx context.Context, filename string, data string) error {
 	storage := m.storage.Get()
-	storage.PutMediaData(ctx, filename, data)
+	storage.PutMediaData(ctx, filename, data, m.Config().ttl())
 	return nil
 }
 
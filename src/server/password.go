@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Passwords are hashed with argon2id and stored in UserProfile.PasswordHashed
+// in the PHC string format, which records the version and cost of the hash
+// along with its salt:
+//
+//	$argon2id$v=19$m=<memory KiB>,t=<time>,p=<threads>$<salt>$<hash>
+//
+// Hashes whose cost differs from the configured one are replaced on the next
+// successful login. Profiles registered before passwords were hashed hold a
+// legacy hash that does not depend on the password, so their password cannot
+// be checked and they cannot log in.
+
+const (
+	PASSWORD_HASH_ALGORITHM = "argon2id"
+	PASSWORD_SALT_LEN       = 16
+	PASSWORD_KEY_LEN        = 32
+
+	PASSWORD_MIN_LEN = 8
+	// PASSWORD_MAX_LEN, in bytes, bounds the work of hashing a password.
+	PASSWORD_MAX_LEN = 128
+
+	// The default cost follows the second recommended option of RFC 9106.
+	DEFAULT_ARGON2_TIME       = 3
+	DEFAULT_ARGON2_MEMORY_KIB = 64 * 1024
+	DEFAULT_ARGON2_THREADS    = 4
+
+	// The benchmark cost makes hashing negligible in load tests. It must not
+	// be used for real accounts.
+	BENCHMARK_ARGON2_TIME       = 1
+	BENCHMARK_ARGON2_MEMORY_KIB = 64
+	BENCHMARK_ARGON2_THREADS    = 1
+)
+
+var (
+	errLegacyPasswordHash  = errors.New("password: legacy hash cannot be verified")
+	errInvalidPasswordHash = errors.New("password: invalid hash")
+)
+
+// passwordCost holds the argon2id parameters.
+type passwordCost struct {
+	Time      uint32
+	MemoryKiB uint32
+	Threads   uint8
+}
+
+func validatePassword(password string) error {
+	if len(password) < PASSWORD_MIN_LEN || len(password) > PASSWORD_MAX_LEN {
+		return NewRegisterError(INVALID_PASSWORD,
+			fmt.Sprintf("must be %d to %d bytes long", PASSWORD_MIN_LEN, PASSWORD_MAX_LEN))
+	}
+	return nil
+}
+
+func hashPassword(password string, cost passwordCost) (string, error) {
+	salt := make([]byte, PASSWORD_SALT_LEN)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, cost.Time, cost.MemoryKiB, cost.Threads, PASSWORD_KEY_LEN)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		PASSWORD_HASH_ALGORITHM, argon2.Version, cost.MemoryKiB, cost.Time, cost.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword reports whether password matches the encoded hash, and
+// whether the hash should be replaced by one of the given cost.
+func verifyPassword(password, encoded string, cost passwordCost) (bool, bool, error) {
+	if !strings.HasPrefix(encoded, "$") {
+		return false, false, errLegacyPasswordHash
+	}
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 || fields[1] != PASSWORD_HASH_ALGORITHM {
+		return false, false, errInvalidPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, errInvalidPasswordHash
+	}
+	var stored passwordCost
+	_, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &stored.MemoryKiB, &stored.Time, &stored.Threads)
+	if err != nil || stored.Time == 0 || stored.Threads == 0 {
+		return false, false, errInvalidPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return false, false, errInvalidPasswordHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(want) == 0 {
+		return false, false, errInvalidPasswordHash
+	}
+	key := argon2.IDKey([]byte(password), salt, stored.Time, stored.MemoryKiB, stored.Threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(key, want) != 1 {
+		return false, false, nil
+	}
+	return true, stored != cost || len(want) != PASSWORD_KEY_LEN, nil
+}
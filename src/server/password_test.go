@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testPasswordCost = passwordCost{Time: BENCHMARK_ARGON2_TIME, MemoryKiB: BENCHMARK_ARGON2_MEMORY_KIB, Threads: BENCHMARK_ARGON2_THREADS}
+
+func mustHashPassword(t *testing.T, password string, cost passwordCost) string {
+	t.Helper()
+	hashed, err := hashPassword(password, cost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hashed
+}
+
+func TestVerifyPassword(t *testing.T) {
+	otherCost := testPasswordCost
+	otherCost.Time++
+	hashed := mustHashPassword(t, "password1", testPasswordCost)
+	for _, tc := range []struct {
+		name       string
+		password   string
+		encoded    string
+		wantAuth   bool
+		wantRehash bool
+		wantErr    error
+	}{
+		{name: "match", password: "password1", encoded: hashed, wantAuth: true},
+		{name: "mismatch", password: "password2", encoded: hashed},
+		{name: "other cost", password: "password1", encoded: mustHashPassword(t, "password1", otherCost), wantAuth: true, wantRehash: true},
+		{name: "other cost mismatch", password: "password2", encoded: mustHashPassword(t, "password1", otherCost)},
+		{name: "legacy", password: "password1", encoded: "5f4dcc3b5aa765d61d8327deb882cf99", wantErr: errLegacyPasswordHash},
+		{name: "other algorithm", password: "password1", encoded: strings.Replace(hashed, "argon2id", "argon2i", 1), wantErr: errInvalidPasswordHash},
+		{name: "other version", password: "password1", encoded: strings.Replace(hashed, "v=19", "v=16", 1), wantErr: errInvalidPasswordHash},
+		{name: "no threads", password: "password1", encoded: strings.Replace(hashed, ",p=1$", ",p=0$", 1), wantErr: errInvalidPasswordHash},
+		{name: "truncated", password: "password1", encoded: hashed[:strings.LastIndex(hashed, "$")], wantErr: errInvalidPasswordHash},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			auth, rehash, err := verifyPassword(tc.password, tc.encoded, testPasswordCost)
+			if !errors.Is(err, tc.wantErr) || (err == nil) != (tc.wantErr == nil) {
+				t.Fatalf("verifyPassword error = %v, want %v", err, tc.wantErr)
+			}
+			if auth != tc.wantAuth || rehash != tc.wantRehash {
+				t.Errorf("verifyPassword = %v, %v; want %v, %v", auth, rehash, tc.wantAuth, tc.wantRehash)
+			}
+		})
+	}
+}
+
+// A login replaces a hash of another cost with one of the configured cost,
+// and a legacy hash requires a password reset.
+func TestLoginRehashesPassword(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer, storage IStorage) {
+		registerAndLogin(t, us)
+		profile, _, err := storage.GetUserProfile(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherCost := testPasswordCost
+		otherCost.MemoryKiB *= 2
+		profile.PasswordHashed = mustHashPassword(t, "password1", otherCost)
+		if err := storage.PutUserProfile(ctx, "alice", profile); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := us.Login(ctx, "alice", "password1"); err != nil {
+			t.Fatal(err)
+		}
+		rehashed, _, err := storage.GetUserProfile(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rehashed.PasswordHashed == profile.PasswordHashed {
+			t.Fatal("the hash of another cost was kept")
+		}
+		if auth, rehash, err := verifyPassword("password1", rehashed.PasswordHashed, testPasswordCost); !auth || rehash || err != nil {
+			t.Errorf("verifyPassword of the new hash = %v, %v, %v; want a match of the configured cost", auth, rehash, err)
+		}
+		if _, err := us.Login(ctx, "alice", "password1"); err != nil {
+			t.Errorf("login with the new hash: %v", err)
+		}
+
+		rehashed.PasswordHashed = "5f4dcc3b5aa765d61d8327deb882cf99"
+		if err := storage.PutUserProfile(ctx, "alice", rehashed); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := us.Login(ctx, "alice", "password1"); loginErrorCode(err) != PASSWORD_RESET_REQUIRED {
+			t.Errorf("login with a legacy hash = %v, want PASSWORD_RESET_REQUIRED", err)
+		}
+	})
+}
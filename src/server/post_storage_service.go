@@ -16,12 +16,13 @@ type PostStorageServicer interface {
 
 type PostStorageService struct {
 	weaver.Implements[PostStorageServicer]
+	weaver.WithConfig[ttlConfig]
 	storage weaver.Ref[IStorage]
 }
 
 func (pss *PostStorageService) StorePost(ctx context.Context, post Post) error {
 	storage := pss.storage.Get()
-	storage.PutPost(ctx, post.Post_id, post)
+	storage.PutPost(ctx, post.Post_id, post, pss.Config().ttl())
 	return nil
 }
 
@@ -37,9 +38,13 @@ func (pss *PostStorageService) ReadPost(ctx context.Context, postId int64) (Post
 
 func (pss *PostStorageService) ReadPosts(ctx context.Context, postIds []int64) ([]Post, error) {
 	storage := pss.storage.Get()
-	posts := make([]Post, 0)
+	found, err := getPostsBatched(ctx, storage, postIds)
+	if err != nil {
+		return make([]Post, 0), err
+	}
+	posts := make([]Post, 0, len(postIds))
 	for _, postId := range postIds {
-		post, exist, _ := storage.GetPost(ctx, postId)
+		post, exist := found[postId]
 		if !exist {
 			fmt.Printf("Failed to find the post - post_id: %d\n", postId)
 			post = Post{}
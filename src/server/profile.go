@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ServiceWeaver/weaver"
+)
+
+// A user updates their profile and password, or deletes their account, by
+// user id. Updates replace the profile only if it did not change since it was
+// read, and are retried otherwise. Changing the password ends all the sessions
+// of the user, so they log in again with the new password.
+//
+// DeleteUser ends the sessions of the user first, so that they can no longer
+// post or follow, then removes their posts, their follow, block, mute and
+// follow request edges in both directions and their home timeline, and
+// finally their profile and user id. If it fails midway the profile is left
+// in place, so the user can log in again and retry. Edges and mentions added
+// by other users while the account is being deleted may be left behind.
+
+type ProfileErrorCode int
+
+const (
+	PROFILE_NOT_FOUND ProfileErrorCode = iota + 1
+	OLD_PASSWORD_MISMATCH
+	INVALID_PROFILE
+	PROFILE_CONFLICT
+)
+
+func (pec ProfileErrorCode) String() string {
+	return [...]string{"PROFILE NOT FOUND", "OLD PASSWORD MISMATCH", "INVALID PROFILE", "PROFILE CONFLICT"}[pec-1]
+}
+
+// ProfileError is returned when a profile cannot be read, changed or deleted
+// as asked. Its fields are exported so that it keeps its code across
+// components.
+type ProfileError struct {
+	weaver.AutoMarshal
+	Code   ProfileErrorCode
+	Detail string
+}
+
+func NewProfileError(code ProfileErrorCode, detail string) *ProfileError {
+	return &ProfileError{Code: code, Detail: detail}
+}
+
+func (pe *ProfileError) Error() string {
+	return fmt.Sprintf("Profile error. code: %d, err: %v: %s", pe.Code, pe.Code, pe.Detail)
+}
+
+const (
+	// BIO_MAX_LEN is in bytes.
+	BIO_MAX_LEN = 160
+	// PROFILE_UPDATE_ATTEMPTS bounds the retries of an update whose profile
+	// keeps changing.
+	PROFILE_UPDATE_ATTEMPTS = 3
+	// DELETE_USER_PAGE_LEN is the number of timeline entries read at a time
+	// while deleting a user.
+	DELETE_USER_PAGE_LEN = 256
+)
+
+// userProfile returns the username and profile of the user id.
+func (us *UserService) userProfile(ctx context.Context, userId int64) (string, UserProfile, error) {
+	storage := us.storage.Get()
+	username, exist, err := storage.GetUsername(ctx, userId)
+	if err != nil {
+		return "", UserProfile{}, err
+	}
+	var profile UserProfile
+	if exist {
+		profile, exist, err = storage.GetUserProfile(ctx, username)
+		if err != nil {
+			return "", UserProfile{}, err
+		}
+	}
+	if !exist || profile.UserId != userId {
+		return "", UserProfile{}, NewProfileError(PROFILE_NOT_FOUND, fmt.Sprintf("user id %d", userId))
+	}
+	return username, profile, nil
+}
+
+// updateProfile applies update to the profile of the user id and stores it,
+// unless the profile changed since it was read, in which case it starts over.
+func (us *UserService) updateProfile(ctx context.Context, userId int64, update func(*UserProfile) error) error {
+	storage := us.storage.Get()
+	for attempt := 0; attempt < PROFILE_UPDATE_ATTEMPTS; attempt++ {
+		username, profile, err := us.userProfile(ctx, userId)
+		if err != nil {
+			return err
+		}
+		updated := profile
+		if err := update(&updated); err != nil {
+			return err
+		}
+		ok, err := storage.Transact(ctx, stringRoutingBucket(username), StorageTransaction{
+			Preconditions: []StoragePrecondition{
+				{Cond: COND_EQUALS, Map: MAP_USER_PROFILES, StrKey: username, Profile: profile},
+			},
+			Mutations: []StorageMutation{
+				{Op: OP_PUT_USER_PROFILE, StrKey: username, Profile: updated},
+			},
+		})
+		if err != nil || ok {
+			return err
+		}
+	}
+	return NewProfileError(PROFILE_CONFLICT, fmt.Sprintf("user id %d", userId))
+}
+
+func (us *UserService) UpdateProfile(ctx context.Context, userId int64, firstName, lastName, bio, avatar string) error {
+	if len(bio) > BIO_MAX_LEN {
+		return NewProfileError(INVALID_PROFILE, fmt.Sprintf("bio is longer than %d bytes", BIO_MAX_LEN))
+	}
+	if avatar != "" {
+		_, exist, err := us.storage.Get().GetMediaData(ctx, avatar)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return NewProfileError(INVALID_PROFILE, fmt.Sprintf("avatar %s is not an uploaded media", avatar))
+		}
+	}
+	return us.updateProfile(ctx, userId, func(profile *UserProfile) error {
+		profile.FirstName = firstName
+		profile.LastName = lastName
+		profile.Bio = bio
+		profile.Avatar = avatar
+		return nil
+	})
+}
+
+func (us *UserService) ChangePassword(ctx context.Context, userId int64, oldPassword, newPassword string) error {
+	if err := validatePassword(newPassword); err != nil {
+		var registerErr *RegisterError
+		errors.As(err, &registerErr)
+		return NewProfileError(INVALID_PROFILE, "new password "+registerErr.Detail)
+	}
+	cost := us.Config().passwordCost()
+	err := us.updateProfile(ctx, userId, func(profile *UserProfile) error {
+		auth, _, err := verifyPassword(oldPassword, profile.PasswordHashed, cost)
+		if errors.Is(err, errLegacyPasswordHash) {
+			return NewProfileError(OLD_PASSWORD_MISMATCH, "the password must be reset")
+		} else if err != nil {
+			return fmt.Errorf("user id %d: %w", userId, err)
+		}
+		if !auth {
+			return NewProfileError(OLD_PASSWORD_MISMATCH, fmt.Sprintf("user id %d", userId))
+		}
+		hashed, err := hashPassword(newPassword, cost)
+		if err != nil {
+			return err
+		}
+		profile.PasswordHashed = hashed
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return us.revokeUser(ctx, userId)
+}
+
+func (us *UserService) DeleteUser(ctx context.Context, userId int64) error {
+	username, _, err := us.userProfile(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if err := us.revokeUser(ctx, userId); err != nil {
+		return err
+	}
+
+	storage := us.storage.Get()
+	followers, _, err := storage.GetFollowers(ctx, userId)
+	if err != nil {
+		return err
+	}
+	followees, _, err := storage.GetFollowees(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if err := us.removeUserPosts(ctx, userId, map_to_list(followers)); err != nil {
+		return fmt.Errorf("deleting the posts of user %d: %w", userId, err)
+	}
+
+	ts := us.transactionService.Get()
+	for followerId := range followers {
+		if _, err := ts.Commit(ctx, StorageTransaction{Mutations: unfollowMutations(followerId, userId)}); err != nil {
+			return fmt.Errorf("deleting the followers of user %d: %w", userId, err)
+		}
+	}
+	for followeeId := range followees {
+		if _, err := ts.Commit(ctx, StorageTransaction{Mutations: unfollowMutations(userId, followeeId)}); err != nil {
+			return fmt.Errorf("deleting the followees of user %d: %w", userId, err)
+		}
+	}
+	for kind := RelationKind(0); kind < RELATION_KIND_COUNT; kind++ {
+		related, _, err := storage.GetRelations(ctx, userId, kind)
+		if err != nil {
+			return err
+		}
+		for otherId := range related {
+			if _, err := ts.Commit(ctx, StorageTransaction{Mutations: relationMutations(false, kind, userId, otherId)}); err != nil {
+				return fmt.Errorf("deleting the %s users of user %d: %w", kind, userId, err)
+			}
+		}
+	}
+	if err := us.clearTimeline(ctx, userId, HOME_TIMELINE); err != nil {
+		return fmt.Errorf("deleting the home timeline of user %d: %w", userId, err)
+	}
+
+	_, err = ts.Commit(ctx, StorageTransaction{
+		Mutations: []StorageMutation{
+			{Op: OP_REMOVE_USER_PROFILE, StrKey: username},
+			{Op: OP_REMOVE_USER_ID, IntKey: userId},
+		},
+	})
+	return err
+}
+
+// removeUserPosts removes the posts of the user timeline, each in one
+// transaction as BackendService.RemovePosts does. The timeline entries of
+// posts that are already gone are removed on their own.
+func (us *UserService) removeUserPosts(ctx context.Context, userId int64, followers []int64) error {
+	storage := us.storage.Get()
+	ts := us.transactionService.Get()
+	return forEachTimelinePage(ctx, storage, userId, USER_TIMELINE, func(entries []TimelineEntry) error {
+		postIds := make([]int64, 0, len(entries))
+		for _, e := range entries {
+			postIds = append(postIds, e.PostId)
+		}
+		posts, err := getPostsBatched(ctx, storage, postIds)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			post, exist := posts[e.PostId]
+			if !exist {
+				if err := storage.RemovePostTimeline(ctx, userId, USER_TIMELINE, e.PostId, e.Timestamp); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := ts.Commit(ctx, StorageTransaction{Mutations: removePostMutations(userId, post, followers)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// clearTimeline removes the entries of a timeline of the user, a page per
+// transaction.
+func (us *UserService) clearTimeline(ctx context.Context, userId int64, kind TimelineKind) error {
+	storage := us.storage.Get()
+	return forEachTimelinePage(ctx, storage, userId, kind, func(entries []TimelineEntry) error {
+		mutations := make([]StorageMutation, 0, len(entries))
+		for _, e := range entries {
+			mutations = append(mutations, StorageMutation{Op: OP_REMOVE_POST_TIMELINE, IntKey: userId, IntVal: e.PostId, Timestamp: e.Timestamp, Kind: kind})
+		}
+		_, err := storage.Transact(ctx, intRoutingBucket(userId), StorageTransaction{Mutations: mutations})
+		return err
+	})
+}
+
+// forEachTimelinePage calls f on the entries of a timeline of the user, newest
+// first, DELETE_USER_PAGE_LEN at a time. f may remove the entries it is given.
+func forEachTimelinePage(ctx context.Context, storage IStorage, userId int64, kind TimelineKind, f func([]TimelineEntry) error) error {
+	var cursor TimelineEntry
+	for {
+		entries, err := storage.GetPostTimeline(ctx, userId, kind, cursor, TIMELINE_OLDER, 0, DELETE_USER_PAGE_LEN)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		if err := f(entries); err != nil {
+			return err
+		}
+		cursor = entries[len(entries)-1]
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ServiceWeaver/weaver/weavertest"
+)
+
+// failingStorage is a Storage whose GetRelations fails while failRelations
+// is set.
+type failingStorage struct {
+	*Storage
+	failRelations atomic.Bool
+}
+
+func (s *failingStorage) GetRelations(ctx context.Context, userId int64, kind RelationKind) (map[int64]bool, bool, error) {
+	if s.failRelations.Load() {
+		return nil, false, errors.New("storage unavailable")
+	}
+	return s.Storage.GetRelations(ctx, userId, kind)
+}
+
+// A deletion that fails midway keeps the profile so that it can be retried,
+// and the retry removes the posts, edges and timelines of the user.
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	storage := &failingStorage{Storage: &Storage{}}
+	if err := storage.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Shutdown(ctx)
+	runner := userServiceRunner("")
+	runner.Fakes = append(runner.Fakes, weavertest.Fake[IStorage](storage))
+	runner.Test(t, func(t *testing.T, us UserServicer, sgs ISocialGraphService) {
+		const alice, bob, carol, dave = int64(1), int64(2), int64(3), int64(4)
+		registerAndLogin(t, us)
+		for userId, username := range map[int64]string{bob: "bob", carol: "carol", dave: "dave"} {
+			if err := us.RegisterUserWithId(ctx, "First", "Last", username, "password1", userId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, f := range [][2]int64{{bob, alice}, {alice, carol}} {
+			if _, err := sgs.Follow(ctx, f[0], f[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sgs.Block(ctx, alice, dave); err != nil {
+			t.Fatal(err)
+		}
+		if err := sgs.Mute(ctx, carol, alice); err != nil {
+			t.Fatal(err)
+		}
+		// alice posted post 10, and carol post 20 that reached alice.
+		for _, p := range []struct {
+			post      Post
+			timelines map[TimelineKind][]int64
+		}{
+			{Post{Post_id: 10, Creator: Creator{UserId: alice}, Timestamp: 100}, map[TimelineKind][]int64{USER_TIMELINE: {alice}, HOME_TIMELINE: {bob}}},
+			{Post{Post_id: 20, Creator: Creator{UserId: carol}, Timestamp: 101}, map[TimelineKind][]int64{USER_TIMELINE: {carol}, HOME_TIMELINE: {alice}}},
+		} {
+			if err := storage.PutPost(ctx, p.post.Post_id, p.post, 0); err != nil {
+				t.Fatal(err)
+			}
+			for kind, userIds := range p.timelines {
+				if err := storage.PutPostTimelines(ctx, userIds, kind, p.post.Post_id, p.post.Timestamp); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		storage.failRelations.Store(true)
+		if err := us.DeleteUser(ctx, alice); err == nil {
+			t.Fatal("DeleteUser succeeded without the block and mute edges")
+		}
+		if _, exist, err := storage.GetUserProfile(ctx, "alice"); err != nil || !exist {
+			t.Fatalf("GetUserProfile(alice) after a failed deletion = %v, %v; want the profile", exist, err)
+		}
+		if _, err := us.Login(ctx, "alice", "password1"); err != nil {
+			t.Errorf("login after a failed deletion: %v", err)
+		}
+
+		storage.failRelations.Store(false)
+		if err := us.DeleteUser(ctx, alice); err != nil {
+			t.Fatal(err)
+		}
+		if _, exist, _ := storage.GetUserProfile(ctx, "alice"); exist {
+			t.Error("the profile is left")
+		}
+		if _, exist, _ := storage.GetUsername(ctx, alice); exist {
+			t.Error("the user id is left")
+		}
+		if _, exist, _ := storage.GetPost(ctx, 10); exist {
+			t.Error("the post is left")
+		}
+		if _, exist, _ := storage.GetPost(ctx, 20); !exist {
+			t.Error("the post of carol was removed")
+		}
+		for _, tl := range []struct {
+			userId int64
+			kind   TimelineKind
+			want   int
+		}{{alice, USER_TIMELINE, 0}, {alice, HOME_TIMELINE, 0}, {bob, HOME_TIMELINE, 0}, {carol, USER_TIMELINE, 1}} {
+			if got := timelinePostIds(t, storage, tl.userId, tl.kind); len(got) != tl.want {
+				t.Errorf("%v timeline of user %d = %v, want %d entries", tl.kind, tl.userId, got, tl.want)
+			}
+		}
+		for _, userId := range []int64{alice, bob, carol, dave} {
+			followers, _, _ := storage.GetFollowers(ctx, userId)
+			followees, _, _ := storage.GetFollowees(ctx, userId)
+			if followers[alice] || followees[alice] || userId == alice && (len(followers) != 0 || len(followees) != 0) {
+				t.Errorf("user %d follows %v and is followed by %v after alice was deleted", userId, followees, followers)
+			}
+			for kind := RelationKind(0); kind < RELATION_KIND_COUNT; kind++ {
+				related, _, _ := storage.GetRelations(ctx, userId, kind)
+				if related[alice] || userId == alice && len(related) != 0 {
+					t.Errorf("%v users of user %d = %v after alice was deleted", kind, userId, related)
+				}
+			}
+		}
+
+		var profileErr *ProfileError
+		if err := us.DeleteUser(ctx, alice); !errors.As(err, &profileErr) || profileErr.Code != PROFILE_NOT_FOUND {
+			t.Errorf("DeleteUser of a deleted user = %v, want PROFILE_NOT_FOUND", err)
+		}
+	})
+}
@@ -0,0 +1,910 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ServiceWeaver/weaver"
+)
+
+// Primary/backup replication of Storage.
+//
+// When enabled, every Storage replica holds a full copy of the data instead
+// of a routed partition. The replica holding an flock on
+// <replication_dir>/primary.lock is the primary; it applies all mutations in a
+// single order and keeps the most recent ones in a mutationLog. It advertises
+// itself in <replication_dir>/primary.json. Backups long-poll the primary for
+// new mutations over HTTP and keep trying to take the lock, which the kernel
+// releases when the primary process goes away. Replicas that are
+// not the primary forward writes, and by default reads, to the primary.
+//
+// Replication is asynchronous: a write is acknowledged once the primary has
+// applied it, so writes that no backup has pulled yet are lost on failover.
+//
+// Every replica persists, along with its data, the epoch and sequence of the
+// last commit it applied, so that a restarted replica resumes from there
+// instead of loading a snapshot. The primary forgets backups that have not
+// pulled for REPLICATION_BACKUP_EXPIRY.
+
+const (
+	REPLICATION_NONE           = "none"
+	REPLICATION_PRIMARY_BACKUP = "primary_backup"
+
+	PRIMARY_LOCK_FILE = "primary.lock"
+	PRIMARY_INFO_FILE = "primary.json"
+
+	DEFAULT_REPLICATION_ADDR     = "localhost:0"
+	DEFAULT_REPLICATION_LOG_SIZE = 100000
+	REPLICATION_PULL_BATCH       = 1000
+	REPLICATION_PULL_WAIT        = time.Second
+	REPLICATION_RETRY_INTERVAL   = 500 * time.Millisecond
+	REPLICATION_BACKUP_EXPIRY    = 30 * time.Second
+
+	REPLICATION_PULL_ENDPOINT     = "/replication/pull"
+	REPLICATION_SNAPSHOT_ENDPOINT = "/replication/snapshot"
+	REPLICATION_COMMIT_ENDPOINT   = "/replication/commit"
+	REPLICATION_READ_ENDPOINT     = "/replication/read"
+	REPLICATION_STATUS_ENDPOINT   = "/replication/status"
+)
+
+var errNoPrimary = errors.New("replication: no primary is available")
+
+type ReplicaRole int
+
+const (
+	ROLE_STANDALONE ReplicaRole = iota
+	ROLE_PRIMARY
+	ROLE_BACKUP
+)
+
+func (r ReplicaRole) String() string {
+	return [...]string{"STANDALONE", "PRIMARY", "BACKUP"}[r]
+}
+
+type BackupStatus struct {
+	weaver.AutoMarshal
+	Addr string
+	// Seq is the last mutation the backup has applied.
+	Seq uint64
+	// Lag is the number of mutations the backup is behind the primary.
+	Lag uint64
+	// LastSeen is the unix time in milliseconds of the last pull.
+	LastSeen int64
+}
+
+type ReplicationStatus struct {
+	weaver.AutoMarshal
+	Role    ReplicaRole
+	Addr    string
+	Primary string
+	Epoch   int64
+	// Seq is the last mutation applied by the replica.
+	Seq uint64
+	// Backups is only filled in by the primary.
+	Backups []BackupStatus
+}
+
+// replicationPosition identifies a commit: the epoch of the primary that
+// ordered it and its sequence.
+type replicationPosition struct {
+	Epoch int64
+	Seq   uint64
+}
+
+// primaryInfo is the content of primary.json.
+type primaryInfo struct {
+	Epoch int64
+	Addr  string
+	// StartSeq is the sequence the primary had when it was promoted. A
+	// backup that applied more than that from an earlier primary diverged.
+	StartSeq uint64
+}
+
+type pullResponse struct {
+	Epoch    int64
+	StartSeq uint64
+	// Resync is set when the requested mutations are no longer retained.
+	Resync  bool
+	Records []walRecord
+}
+
+type snapshotResponse struct {
+	Epoch    int64
+	StartSeq uint64
+	Seq      uint64
+	Snapshot *storageSnapshot
+}
+
+type commitResponse struct {
+	Changed bool
+	Err     string
+}
+
+type readRequest struct {
+	Method string
+	Args   []json.RawMessage
+}
+
+type readResponse struct {
+	Results []json.RawMessage
+	Err     string
+}
+
+type replicator struct {
+	storage        *Storage
+	dir            string
+	readFromBackup bool
+	logSize        int
+
+	listener net.Listener
+	server   *http.Server
+	addr     string
+	client   *http.Client
+
+	// mu orders commits on the primary and replicated applies on backups.
+	mu      sync.Mutex
+	role    ReplicaRole
+	seq     uint64
+	epoch   int64
+	primary primaryInfo
+	// synced is false until a backup has loaded a snapshot of the primary.
+	synced  bool
+	log     *mutationLog
+	backups map[string]*BackupStatus
+
+	lock *os.File
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startReplicator(s *Storage, cfg *storageConfig) (*replicator, error) {
+	if cfg.ReplicationDir == "" {
+		return nil, fmt.Errorf("replication needs a replication_dir")
+	}
+	if err := os.MkdirAll(cfg.ReplicationDir, 0o755); err != nil {
+		return nil, err
+	}
+	addr := cfg.ReplicationAddr
+	if addr == "" {
+		addr = DEFAULT_REPLICATION_ADDR
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := s.backend.position()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(cfg.ReplicationDir, PRIMARY_LOCK_FILE), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	r := &replicator{
+		storage:        s,
+		dir:            cfg.ReplicationDir,
+		readFromBackup: cfg.ReadFromBackup,
+		logSize:        cfg.ReplicationLogSize,
+		listener:       listener,
+		addr:           listener.Addr().String(),
+		client:         &http.Client{},
+		role:           ROLE_BACKUP,
+		seq:            pos.Seq,
+		epoch:          pos.Epoch,
+		synced:         pos != replicationPosition{},
+		backups:        make(map[string]*BackupStatus),
+		lock:           lock,
+		done:           make(chan struct{}),
+	}
+	if r.logSize <= 0 {
+		r.logSize = DEFAULT_REPLICATION_LOG_SIZE
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(REPLICATION_PULL_ENDPOINT, r.handlePull)
+	mux.HandleFunc(REPLICATION_SNAPSHOT_ENDPOINT, r.handleSnapshot)
+	mux.HandleFunc(REPLICATION_COMMIT_ENDPOINT, r.handleCommit)
+	mux.HandleFunc(REPLICATION_READ_ENDPOINT, r.handleRead)
+	mux.HandleFunc(REPLICATION_STATUS_ENDPOINT, r.handleStatus)
+	r.server = &http.Server{Handler: mux}
+	go r.server.Serve(listener)
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+		if err := r.promote(); err != nil {
+			r.stop()
+			return nil, err
+		}
+	} else if errors.Is(err, syscall.EWOULDBLOCK) {
+		// Forward to the current primary until the first pull.
+		r.primary, _ = r.readPrimaryInfo()
+		r.wg.Add(2)
+		go r.campaign()
+		go r.follow()
+	} else {
+		r.stop()
+		return nil, err
+	}
+	fmt.Printf("[Replication] %s started as %v at seq %d of epoch %d\n", r.addr, r.role, pos.Seq, pos.Epoch)
+	return r, nil
+}
+
+func (r *replicator) stop() {
+	close(r.done)
+	r.server.Close()
+	r.wg.Wait()
+	// Closing the lock file releases the lock.
+	r.lock.Close()
+}
+
+// campaign polls the primary lock until this replica holds it and promotes
+// it. A blocking flock could not be interrupted by stop.
+func (r *replicator) campaign() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-time.After(REPLICATION_RETRY_INTERVAL):
+		}
+		err := syscall.Flock(int(r.lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			continue
+		}
+		if err == nil {
+			err = r.promote()
+		}
+		if err != nil {
+			fmt.Printf("[Replication] %s cannot become primary: %v\n", r.addr, err)
+		}
+		return
+	}
+}
+
+// promote makes this replica the primary of a new epoch. Callers hold the
+// primary lock.
+func (r *replicator) promote() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prev, _ := r.readPrimaryInfo()
+	info := primaryInfo{Epoch: prev.Epoch + 1, Addr: r.addr, StartSeq: r.seq}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(r.dir, PRIMARY_INFO_FILE+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(r.dir, PRIMARY_INFO_FILE)); err != nil {
+		return err
+	}
+
+	r.role = ROLE_PRIMARY
+	r.epoch = info.Epoch
+	r.primary = info
+	r.synced = true
+	r.log = newRingLog[walRecord](r.logSize, r.seq)
+	fmt.Printf("[Replication] %s is primary of epoch %d from seq %d\n", r.addr, info.Epoch, info.StartSeq)
+	return nil
+}
+
+func (r *replicator) readPrimaryInfo() (primaryInfo, error) {
+	var info primaryInfo
+	data, err := os.ReadFile(filepath.Join(r.dir, PRIMARY_INFO_FILE))
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// follow pulls mutations from the primary until this replica is promoted.
+func (r *replicator) follow() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+		if r.isPrimary() {
+			return
+		}
+		if err := r.pullOnce(); err != nil {
+			select {
+			case <-r.done:
+				return
+			case <-time.After(REPLICATION_RETRY_INTERVAL):
+			}
+		}
+	}
+}
+
+func (r *replicator) pullOnce() error {
+	info, err := r.readPrimaryInfo()
+	if err != nil || info.Addr == r.addr {
+		return errNoPrimary
+	}
+	r.mu.Lock()
+	if r.role == ROLE_PRIMARY {
+		r.mu.Unlock()
+		return nil
+	}
+	r.primary = info
+	// Mutations applied beyond the point where the current primary took over
+	// were never seen by it, so this replica has to start over.
+	needSnapshot := !r.synced || (info.Epoch != r.epoch && r.seq > info.StartSeq)
+	from := r.seq + 1
+	r.mu.Unlock()
+
+	if needSnapshot {
+		return r.resync(info)
+	}
+
+	url := fmt.Sprintf("http://%s%s?from=%d&backup=%s", info.Addr, REPLICATION_PULL_ENDPOINT, from, r.addr)
+	var resp pullResponse
+	if err := r.get(url, &resp); err != nil {
+		return err
+	}
+	if resp.Epoch != info.Epoch {
+		// primary.json was stale; read it again.
+		return nil
+	}
+	if resp.Resync {
+		return r.resync(info)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role == ROLE_PRIMARY {
+		return nil
+	}
+	r.epoch = resp.Epoch
+	for _, rec := range resp.Records {
+		if rec.Seq != r.seq+1 {
+			continue
+		}
+		c := rec.storageCommit
+		c.Position = &replicationPosition{Epoch: resp.Epoch, Seq: rec.Seq}
+		if _, err := r.storage.commitLocal(c); err != nil {
+			return fmt.Errorf("replication: cannot apply seq %d: %w", rec.Seq, err)
+		}
+		r.seq = rec.Seq
+	}
+	return nil
+}
+
+// resync replaces the whole state with a snapshot of the primary.
+func (r *replicator) resync(info primaryInfo) error {
+	var resp snapshotResponse
+	if err := r.get(fmt.Sprintf("http://%s%s", info.Addr, REPLICATION_SNAPSHOT_ENDPOINT), &resp); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role == ROLE_PRIMARY {
+		return nil
+	}
+	resp.Snapshot.Position = replicationPosition{Epoch: resp.Epoch, Seq: resp.Seq}
+	if err := r.storage.restoreLocal(resp.Snapshot); err != nil {
+		return err
+	}
+	r.seq = resp.Seq
+	r.epoch = resp.Epoch
+	r.synced = true
+	fmt.Printf("[Replication] %s loaded snapshot of epoch %d at seq %d\n", r.addr, resp.Epoch, resp.Seq)
+	return nil
+}
+
+// snapshot copies the contents of the primary.
+func (r *replicator) snapshot() (*storageSnapshot, error) {
+	r.mu.Lock()
+	if r.role == ROLE_PRIMARY {
+		defer r.mu.Unlock()
+		return r.storage.backend.snapshot()
+	}
+	addr := r.primary.Addr
+	r.mu.Unlock()
+
+	if addr == "" {
+		return nil, errNoPrimary
+	}
+	var resp snapshotResponse
+	if err := r.get(fmt.Sprintf("http://%s%s", addr, REPLICATION_SNAPSHOT_ENDPOINT), &resp); err != nil {
+		return nil, err
+	}
+	return resp.Snapshot, nil
+}
+
+func (r *replicator) isPrimary() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role == ROLE_PRIMARY
+}
+
+// commit applies c on the primary, forwarding it there if needed.
+func (r *replicator) commit(c storageCommit) (bool, error) {
+	r.mu.Lock()
+	if r.role == ROLE_PRIMARY {
+		defer r.mu.Unlock()
+		c.Position = &replicationPosition{Epoch: r.epoch, Seq: r.seq + 1}
+		changed, err := r.storage.commitLocal(c)
+		if err != nil {
+			return false, err
+		}
+		r.seq++
+		r.log.append(r.seq, walRecord{Seq: r.seq, storageCommit: c})
+		return changed, nil
+	}
+	addr := r.primary.Addr
+	r.mu.Unlock()
+
+	if addr == "" {
+		return false, errNoPrimary
+	}
+	var resp commitResponse
+	if err := r.post(fmt.Sprintf("http://%s%s", addr, REPLICATION_COMMIT_ENDPOINT), c, &resp); err != nil {
+		return false, err
+	}
+	if resp.Err != "" {
+		return false, errors.New(resp.Err)
+	}
+	return resp.Changed, nil
+}
+
+// reader returns where reads are served from: the local backend on the
+// primary, or on a synced backup that may serve reads, and the primary
+// otherwise.
+func (r *replicator) reader() storageReader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role == ROLE_PRIMARY || (r.readFromBackup && r.synced) {
+		return r.storage.backend
+	}
+	return &remoteReader{r, r.primary.Addr}
+}
+
+func (r *replicator) status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := ReplicationStatus{
+		Role:    r.role,
+		Addr:    r.addr,
+		Primary: r.primary.Addr,
+		Epoch:   r.epoch,
+		Seq:     r.seq,
+		Backups: make([]BackupStatus, 0, len(r.backups)),
+	}
+	r.pruneBackups()
+	for _, backup := range r.backups {
+		b := *backup
+		if b.Seq < r.seq {
+			b.Lag = r.seq - b.Seq
+		}
+		status.Backups = append(status.Backups, b)
+	}
+	return status
+}
+
+// pruneBackups forgets the backups that stopped pulling. The caller holds
+// mu.
+func (r *replicator) pruneBackups() {
+	expired := time.Now().Add(-REPLICATION_BACKUP_EXPIRY).UnixMilli()
+	for addr, backup := range r.backups {
+		if backup.LastSeen < expired {
+			delete(r.backups, addr)
+		}
+	}
+}
+
+// clusterStatus returns the status as seen by the primary.
+func (r *replicator) clusterStatus() (ReplicationStatus, error) {
+	r.mu.Lock()
+	role, addr := r.role, r.primary.Addr
+	r.mu.Unlock()
+	if role == ROLE_PRIMARY {
+		return r.status(), nil
+	}
+	if addr == "" {
+		return r.status(), errNoPrimary
+	}
+	var status ReplicationStatus
+	err := r.get(fmt.Sprintf("http://%s%s", addr, REPLICATION_STATUS_ENDPOINT), &status)
+	return status, err
+}
+
+func (r *replicator) handlePull(w http.ResponseWriter, req *http.Request) {
+	from, err := strconv.ParseUint(req.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	if r.role != ROLE_PRIMARY {
+		r.mu.Unlock()
+		http.Error(w, errNoPrimary.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log := r.log
+	resp := pullResponse{Epoch: r.epoch, StartSeq: r.primary.StartSeq}
+	backup := req.URL.Query().Get("backup")
+	r.backups[backup] = &BackupStatus{Addr: backup, Seq: from - 1, LastSeen: time.Now().UnixMilli()}
+	r.pruneBackups()
+	r.mu.Unlock()
+
+	records, ok := log.read(from, REPLICATION_PULL_BATCH, REPLICATION_PULL_WAIT)
+	resp.Resync = !ok
+	resp.Records = records
+	writeJson(w, resp)
+}
+
+func (r *replicator) handleSnapshot(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	if r.role != ROLE_PRIMARY {
+		r.mu.Unlock()
+		http.Error(w, errNoPrimary.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	snap, err := r.storage.backend.snapshot()
+	resp := snapshotResponse{Epoch: r.epoch, StartSeq: r.primary.StartSeq, Seq: r.seq, Snapshot: snap}
+	r.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, resp)
+}
+
+func (r *replicator) handleCommit(w http.ResponseWriter, req *http.Request) {
+	var c storageCommit
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !r.isPrimary() {
+		http.Error(w, errNoPrimary.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var resp commitResponse
+	changed, err := r.commit(c)
+	resp.Changed = changed
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	writeJson(w, resp)
+}
+
+// handleRead calls a storageReader method on the local backend on behalf of
+// a replica that is not allowed to serve reads itself.
+func (r *replicator) handleRead(w http.ResponseWriter, req *http.Request) {
+	var read readRequest
+	if err := json.NewDecoder(req.Body).Decode(&read); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !r.isPrimary() {
+		http.Error(w, errNoPrimary.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if _, ok := reflect.TypeOf((*storageReader)(nil)).Elem().MethodByName(read.Method); !ok {
+		http.Error(w, "unknown read "+read.Method, http.StatusBadRequest)
+		return
+	}
+	method := reflect.ValueOf(r.storage.backend).MethodByName(read.Method)
+	if method.Type().NumIn() != len(read.Args) {
+		http.Error(w, "wrong number of arguments for "+read.Method, http.StatusBadRequest)
+		return
+	}
+	args := make([]reflect.Value, len(read.Args))
+	for i, raw := range read.Args {
+		arg := reflect.New(method.Type().In(i))
+		if err := json.Unmarshal(raw, arg.Interface()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		args[i] = arg.Elem()
+	}
+
+	// Every storageReader method returns its results followed by an error.
+	out := method.Call(args)
+	var resp readResponse
+	if err, _ := out[len(out)-1].Interface().(error); err != nil {
+		resp.Err = err.Error()
+	}
+	for _, v := range out[:len(out)-1] {
+		data, err := json.Marshal(v.Interface())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Results = append(resp.Results, data)
+	}
+	writeJson(w, resp)
+}
+
+func (r *replicator) handleStatus(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, r.status())
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("[Replication] cannot encode response: %v\n", err)
+	}
+}
+
+func (r *replicator) get(url string, out interface{}) error {
+	resp, err := r.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("replication: GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (r *replicator) post(url string, in interface{}, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("replication: POST %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// remoteReader serves reads from the primary.
+type remoteReader struct {
+	r    *replicator
+	addr string
+}
+
+// call invokes method on the primary's backend and decodes its results into
+// results, which must be pointers.
+func (rr *remoteReader) call(method string, args []interface{}, results ...interface{}) error {
+	if rr.addr == "" {
+		return errNoPrimary
+	}
+	req := readRequest{Method: method}
+	for _, arg := range args {
+		data, err := json.Marshal(arg)
+		if err != nil {
+			return err
+		}
+		req.Args = append(req.Args, data)
+	}
+	var resp readResponse
+	if err := rr.r.post(fmt.Sprintf("http://%s%s", rr.addr, REPLICATION_READ_ENDPOINT), req, &resp); err != nil {
+		return err
+	}
+	if resp.Err != "" {
+		return errors.New(resp.Err)
+	}
+	if len(resp.Results) != len(results) {
+		return fmt.Errorf("replication: %s returned %d results, want %d", method, len(resp.Results), len(results))
+	}
+	for i, data := range resp.Results {
+		if err := json.Unmarshal(data, results[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rr *remoteReader) GetUserProfile(key string) (UserProfile, bool, error) {
+	var v UserProfile
+	var e bool
+	err := rr.call("GetUserProfile", []interface{}{key}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetBucketProfiles(bucket int) ([]UserInfo, error) {
+	var v []UserInfo
+	err := rr.call("GetBucketProfiles", []interface{}{bucket}, &v)
+	return v, err
+}
+
+func (rr *remoteReader) GetUsername(key int64) (string, bool, error) {
+	var v string
+	var e bool
+	err := rr.call("GetUsername", []interface{}{key}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetPost(key int64) (Post, bool, error) {
+	var v Post
+	var e bool
+	err := rr.call("GetPost", []interface{}{key}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetMediaData(key string) (string, bool, error) {
+	var v string
+	var e bool
+	err := rr.call("GetMediaData", []interface{}{key}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetShortenUrl(key string) (string, bool, error) {
+	var v string
+	var e bool
+	err := rr.call("GetShortenUrl", []interface{}{key}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetSession(key string) (Session, bool, error) {
+	var v Session
+	var e bool
+	err := rr.call("GetSession", []interface{}{key}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetRevocation(key string) (int64, bool, error) {
+	var v int64
+	var e bool
+	err := rr.call("GetRevocation", []interface{}{key}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetLoginFailures(key string) (LoginFailures, bool, error) {
+	var v LoginFailures
+	var e bool
+	err := rr.call("GetLoginFailures", []interface{}{key}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetFollowers(userId int64) (map[int64]bool, bool, error) {
+	var v map[int64]bool
+	var e bool
+	err := rr.call("GetFollowers", []interface{}{userId}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetFollowees(userId int64) (map[int64]bool, bool, error) {
+	var v map[int64]bool
+	var e bool
+	err := rr.call("GetFollowees", []interface{}{userId}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetFollowCounts(userId int64) (int, int, error) {
+	var followers, followees int
+	err := rr.call("GetFollowCounts", []interface{}{userId}, &followers, &followees)
+	return followers, followees, err
+}
+
+func (rr *remoteReader) GetFollowersPage(userId int64, after int64, limit int) ([]int64, error) {
+	var v []int64
+	err := rr.call("GetFollowersPage", []interface{}{userId, after, limit}, &v)
+	return v, err
+}
+
+func (rr *remoteReader) GetFolloweesPage(userId int64, after int64, limit int) ([]int64, error) {
+	var v []int64
+	err := rr.call("GetFolloweesPage", []interface{}{userId, after, limit}, &v)
+	return v, err
+}
+
+func (rr *remoteReader) HasFollowee(userId int64, followeeId int64) (bool, error) {
+	var v bool
+	err := rr.call("HasFollowee", []interface{}{userId, followeeId}, &v)
+	return v, err
+}
+
+func (rr *remoteReader) GetRelations(userId int64, kind RelationKind) (map[int64]bool, bool, error) {
+	var v map[int64]bool
+	var e bool
+	err := rr.call("GetRelations", []interface{}{userId, kind}, &v, &e)
+	return v, e, err
+}
+
+func (rr *remoteReader) GetPostTimeline(userId int64, kind TimelineKind, cursor TimelineEntry, direction TimelineDirection, start int, stop int) ([]TimelineEntry, error) {
+	var v []TimelineEntry
+	err := rr.call("GetPostTimeline", []interface{}{userId, kind, cursor, direction, start, stop}, &v)
+	return v, err
+}
+
+func (rr *remoteReader) GetTxnIntents(bucket int) ([]StorageIntent, error) {
+	var v []StorageIntent
+	err := rr.call("GetTxnIntents", []interface{}{bucket}, &v)
+	return v, err
+}
+
+// ringLog retains the most recent records, numbered by consecutive
+// sequences, in a ring buffer. The replication log of the primary and the
+// change feeds are ringLogs.
+type ringLog[T any] struct {
+	mu   sync.Mutex
+	buf  []T
+	last uint64 // sequence of the newest record
+	// first is the sequence of the oldest retained record; the log is empty
+	// when first > last.
+	first uint64
+	// notify is closed and replaced on every append.
+	notify chan struct{}
+}
+
+// mutationLog retains the most recent mutations of the primary.
+type mutationLog = ringLog[walRecord]
+
+// newRingLog returns an empty log whose next record has sequence lastSeq+1.
+func newRingLog[T any](size int, lastSeq uint64) *ringLog[T] {
+	return &ringLog[T]{
+		buf:    make([]T, size),
+		last:   lastSeq,
+		first:  lastSeq + 1,
+		notify: make(chan struct{}),
+	}
+}
+
+// append adds the record with sequence seq, which must follow the newest
+// one.
+func (l *ringLog[T]) append(seq uint64, rec T) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := uint64(len(l.buf))
+	l.buf[seq%size] = rec
+	l.last = seq
+	if l.last-l.first+1 > size {
+		l.first = l.last - size + 1
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// bounds returns the sequences of the oldest retained and of the newest
+// records.
+func (l *ringLog[T]) bounds() (uint64, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.first, l.last
+}
+
+// read returns up to max records starting at sequence from, waiting up to
+// wait for one to be appended if there is none yet. It returns false if
+// records starting at from are no longer retained.
+func (l *ringLog[T]) read(from uint64, max int, wait time.Duration) ([]T, bool) {
+	l.mu.Lock()
+	if from > l.last {
+		notify := l.notify
+		l.mu.Unlock()
+		select {
+		case <-notify:
+		case <-time.After(wait):
+		}
+		l.mu.Lock()
+	}
+	defer l.mu.Unlock()
+	if from < l.first {
+		return nil, false
+	}
+	records := make([]T, 0)
+	size := uint64(len(l.buf))
+	for seq := from; seq <= l.last && len(records) < max; seq++ {
+		records = append(records, l.buf[seq%size])
+	}
+	return records, true
+}
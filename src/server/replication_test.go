@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func openReplica(t *testing.T, backend, dataDir, replicationDir string) *Storage {
+	t.Helper()
+	s := &Storage{}
+	s.Config().Backend = backend
+	s.Config().DataDir = dataDir
+	s.Config().FsyncPolicy = FSYNC_ALWAYS
+	s.Config().Replication = REPLICATION_PRIMARY_BACKUP
+	s.Config().ReplicationDir = replicationDir
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting until %s", what)
+}
+
+func caughtUp(backup, primary *Storage) func() bool {
+	return func() bool { return backup.replicator.status().Seq == primary.replicator.status().Seq }
+}
+
+func TestReplicationFailover(t *testing.T) {
+	for _, backend := range []string{MEMORY_BACKEND, SQLITE_BACKEND} {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			replicationDir := t.TempDir()
+			primary := openReplica(t, backend, t.TempDir(), replicationDir)
+			backup := openReplica(t, backend, t.TempDir(), replicationDir)
+			defer backup.Shutdown(ctx)
+			if !primary.replicator.isPrimary() || backup.replicator.isPrimary() {
+				t.Fatal("the first replica is not the only primary")
+			}
+
+			for postId := int64(1); postId <= 20; postId++ {
+				if err := primary.PutPost(ctx, postId, Post{Post_id: postId}, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			waitUntil(t, "the backup catches up", caughtUp(backup, primary))
+			primary.Shutdown(ctx)
+
+			waitUntil(t, "the backup takes over", backup.replicator.isPrimary)
+			for postId := int64(1); postId <= 20; postId++ {
+				if _, ok, err := backup.GetPost(ctx, postId); err != nil || !ok {
+					t.Fatalf("post %d after failover: %v, %v", postId, ok, err)
+				}
+			}
+			if err := backup.PutPost(ctx, 21, Post{Post_id: 21}, 0); err != nil {
+				t.Fatal(err)
+			}
+			if status := backup.replicator.status(); status.Epoch != 2 || status.Seq != 21 {
+				t.Fatalf("new primary at seq %d of epoch %d, want seq 21 of epoch 2", status.Seq, status.Epoch)
+			}
+		})
+	}
+}
+
+// A restarted replica resumes from the position persisted with its data.
+func TestReplicationPositionSurvivesRestart(t *testing.T) {
+	for _, backend := range []string{MEMORY_BACKEND, SQLITE_BACKEND} {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			replicationDir, backupDir := t.TempDir(), t.TempDir()
+			primary := openReplica(t, backend, t.TempDir(), replicationDir)
+			defer primary.Shutdown(ctx)
+			backup := openReplica(t, backend, backupDir, replicationDir)
+			for postId := int64(1); postId <= 5; postId++ {
+				if err := primary.PutPost(ctx, postId, Post{Post_id: postId}, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			waitUntil(t, "the backup catches up", caughtUp(backup, primary))
+			backup.Shutdown(ctx)
+
+			backup = openReplica(t, backend, backupDir, replicationDir)
+			defer backup.Shutdown(ctx)
+			backup.replicator.mu.Lock()
+			synced := backup.replicator.synced
+			backup.replicator.mu.Unlock()
+			status := backup.replicator.status()
+			if status.Seq != 5 || status.Epoch != 1 || !synced {
+				t.Fatalf("restarted backup at seq %d of epoch %d, want seq 5 of epoch 1", status.Seq, status.Epoch)
+			}
+			if err := primary.PutPost(ctx, 6, Post{Post_id: 6}, 0); err != nil {
+				t.Fatal(err)
+			}
+			waitUntil(t, "the restarted backup catches up", caughtUp(backup, primary))
+			if _, ok, err := backup.backend.GetPost(6); err != nil || !ok {
+				t.Fatalf("post 6 on the restarted backup: %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestReplicationForgetsStoppedBackups(t *testing.T) {
+	ctx := context.Background()
+	primary := openReplica(t, MEMORY_BACKEND, t.TempDir(), t.TempDir())
+	defer primary.Shutdown(ctx)
+	r := primary.replicator
+	r.mu.Lock()
+	r.backups["stopped:1"] = &BackupStatus{Addr: "stopped:1", LastSeen: time.Now().Add(-2 * REPLICATION_BACKUP_EXPIRY).UnixMilli()}
+	r.backups["pulling:1"] = &BackupStatus{Addr: "pulling:1", LastSeen: time.Now().UnixMilli()}
+	r.mu.Unlock()
+
+	backups := r.status().Backups
+	if len(backups) != 1 || backups[0].Addr != "pulling:1" {
+		t.Fatalf("backups %+v, want only pulling:1", backups)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ServiceWeaver/weaver"
+)
+
+// Login starts a session, which pairs a short-lived access token with a
+// refresh token. The access token is the bearer token of the endpoints that
+// act for a user; see token.go. The refresh token, "<session id>.<secret>",
+// is exchanged by Refresh for a new pair of tokens and can only be used once:
+// the session keeps the sha256 hash of its current secret, which Refresh
+// replaces. Sessions expire refresh_token_ttl_sec after they were last
+// refreshed.
+//
+// Logout ends the session of an access token: it removes the session and
+// revokes it, so that its access tokens are refused until they expire.
+// Logging out of all sessions revokes the user instead, which refuses the
+// sessions created until then and their access tokens. Revocations are kept
+// in Storage only as long as the tokens they revoke could still be valid.
+
+const (
+	DEFAULT_ACCESS_TOKEN_TTL_SEC  = 15 * 60
+	DEFAULT_REFRESH_TOKEN_TTL_SEC = 30 * 24 * 3600
+
+	// The lengths, in random bytes, of session ids and refresh secrets.
+	SESSION_ID_LEN     = 16
+	REFRESH_SECRET_LEN = 32
+
+	SESSION_REVOCATION_PREFIX = "session/"
+	USER_REVOCATION_PREFIX    = "user/"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("refresh token: invalid")
+	errRevokedToken        = errors.New("token: revoked")
+)
+
+// Session is the entry of a session in Storage, keyed by its id.
+type Session struct {
+	weaver.AutoMarshal
+	UserId   int64
+	Username string
+	// RefreshHash is the hex sha256 hash of the secret of the current
+	// refresh token.
+	RefreshHash string
+	// CreatedAt is in unix milliseconds.
+	CreatedAt int64
+}
+
+// AuthTokens are the tokens returned by Login and Refresh.
+type AuthTokens struct {
+	weaver.AutoMarshal
+	AccessToken  string
+	RefreshToken string
+}
+
+func sessionRevocationKey(sessionId string) string {
+	return SESSION_REVOCATION_PREFIX + sessionId
+}
+
+func userRevocationKey(userId int64) string {
+	return USER_REVOCATION_PREFIX + strconv.FormatInt(userId, 10)
+}
+
+// randomToken returns n random bytes encoded for use in urls.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *userConfig) accessTokenTtl() time.Duration {
+	if c.AccessTokenTtlSec > 0 {
+		return time.Duration(c.AccessTokenTtlSec) * time.Second
+	}
+	return DEFAULT_ACCESS_TOKEN_TTL_SEC * time.Second
+}
+
+func (c *userConfig) refreshTokenTtl() time.Duration {
+	if c.RefreshTokenTtlSec > 0 {
+		return time.Duration(c.RefreshTokenTtlSec) * time.Second
+	}
+	return DEFAULT_REFRESH_TOKEN_TTL_SEC * time.Second
+}
+
+// startSession stores a new session of the user and returns its tokens.
+func (us *UserService) startSession(ctx context.Context, creator Creator) (AuthTokens, error) {
+	sessionId, err := randomToken(SESSION_ID_LEN)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	secret, err := randomToken(REFRESH_SECRET_LEN)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	session := Session{
+		UserId:      creator.UserId,
+		Username:    creator.Username,
+		RefreshHash: hashRefreshSecret(secret),
+		CreatedAt:   nowMillis(),
+	}
+	_, err = us.storage.Get().Transact(ctx, stringRoutingBucket(sessionId), StorageTransaction{
+		Mutations: []StorageMutation{
+			{Op: OP_PUT_SESSION, StrKey: sessionId, Session: session, ExpiresAt: expiresAt(us.Config().refreshTokenTtl())},
+		},
+	})
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	return us.issueTokens(sessionId, secret, session)
+}
+
+func (us *UserService) issueTokens(sessionId, secret string, session Session) (AuthTokens, error) {
+	claims := tokenClaims{
+		Creator:        Creator{UserId: session.UserId, Username: session.Username},
+		SessionId:      sessionId,
+		SessionCreated: session.CreatedAt,
+	}
+	accessToken, err := signToken(claims, time.Now(), us.Config().accessTokenTtl(), us.secrets[0])
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	return AuthTokens{AccessToken: accessToken, RefreshToken: sessionId + "." + secret}, nil
+}
+
+// checkRevoked returns errRevokedToken if the session of the claims, or the
+// sessions of its user up to its creation, were revoked.
+func (us *UserService) checkRevoked(ctx context.Context, claims tokenClaims) error {
+	storage := us.storage.Get()
+	_, revoked, err := storage.GetRevocation(ctx, sessionRevocationKey(claims.SessionId))
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errRevokedToken
+	}
+	revokedAt, revoked, err := storage.GetRevocation(ctx, userRevocationKey(claims.UserId))
+	if err != nil {
+		return err
+	}
+	if revoked && claims.SessionCreated <= revokedAt {
+		return errRevokedToken
+	}
+	return nil
+}
+
+func (us *UserService) verifyToken(ctx context.Context, token string) (tokenClaims, error) {
+	claims, err := parseToken(token, time.Now(), us.secrets)
+	if err != nil {
+		return tokenClaims{}, err
+	}
+	if err := us.checkRevoked(ctx, claims); err != nil {
+		return tokenClaims{}, err
+	}
+	return claims, nil
+}
+
+func (us *UserService) VerifyToken(ctx context.Context, token string) (Creator, error) {
+	claims, err := us.verifyToken(ctx, token)
+	return claims.Creator, err
+}
+
+func (us *UserService) Refresh(ctx context.Context, refreshToken string) (AuthTokens, error) {
+	sessionId, secret, found := strings.Cut(refreshToken, ".")
+	if !found || sessionId == "" || secret == "" {
+		return AuthTokens{}, errInvalidRefreshToken
+	}
+	storage := us.storage.Get()
+	session, exists, err := storage.GetSession(ctx, sessionId)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	hash := hashRefreshSecret(secret)
+	if !exists || subtle.ConstantTimeCompare([]byte(hash), []byte(session.RefreshHash)) != 1 {
+		return AuthTokens{}, errInvalidRefreshToken
+	}
+	err = us.checkRevoked(ctx, tokenClaims{
+		Creator:        Creator{UserId: session.UserId, Username: session.Username},
+		SessionId:      sessionId,
+		SessionCreated: session.CreatedAt,
+	})
+	if err != nil {
+		return AuthTokens{}, err
+	}
+
+	// Rotate the secret, unless the session was refreshed or ended since it
+	// was read.
+	newSecret, err := randomToken(REFRESH_SECRET_LEN)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	refreshed := session
+	refreshed.RefreshHash = hashRefreshSecret(newSecret)
+	ok, err := storage.Transact(ctx, stringRoutingBucket(sessionId), StorageTransaction{
+		Preconditions: []StoragePrecondition{
+			{Cond: COND_EQUALS, Map: MAP_SESSIONS, StrKey: sessionId, Session: session},
+		},
+		Mutations: []StorageMutation{
+			{Op: OP_PUT_SESSION, StrKey: sessionId, Session: refreshed, ExpiresAt: expiresAt(us.Config().refreshTokenTtl())},
+		},
+	})
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	if !ok {
+		return AuthTokens{}, errInvalidRefreshToken
+	}
+	return us.issueTokens(sessionId, newSecret, refreshed)
+}
+
+func (us *UserService) Logout(ctx context.Context, accessToken string, allSessions bool) error {
+	claims, err := us.verifyToken(ctx, accessToken)
+	if err != nil {
+		return err
+	}
+	if allSessions {
+		return us.revokeUser(ctx, claims.UserId)
+	}
+	cfg := us.Config()
+	_, err = us.transactionService.Get().Commit(ctx, StorageTransaction{
+		Mutations: []StorageMutation{
+			{
+				Op:        OP_PUT_REVOCATION,
+				StrKey:    sessionRevocationKey(claims.SessionId),
+				IntVal:    nowMillis(),
+				ExpiresAt: expiresAt(cfg.accessTokenTtl() + TOKEN_CLOCK_SKEW),
+			},
+			{Op: OP_REMOVE_SESSION, StrKey: claims.SessionId},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("logout of session %s: %w", claims.SessionId, err)
+	}
+	return nil
+}
+
+// revokeUser ends all the sessions of the user created until now. The
+// revocation outlives these sessions, and the access tokens issued when they
+// were last refreshed.
+func (us *UserService) revokeUser(ctx context.Context, userId int64) error {
+	cfg := us.Config()
+	key := userRevocationKey(userId)
+	_, err := us.storage.Get().Transact(ctx, stringRoutingBucket(key), StorageTransaction{
+		Mutations: []StorageMutation{
+			{
+				Op:        OP_PUT_REVOCATION,
+				StrKey:    key,
+				IntVal:    nowMillis(),
+				ExpiresAt: expiresAt(cfg.refreshTokenTtl() + cfg.accessTokenTtl() + TOKEN_CLOCK_SKEW),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("logout of user %d: %w", userId, err)
+	}
+	return nil
+}
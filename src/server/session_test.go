@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ServiceWeaver/weaver/weavertest"
+)
+
+const TEST_USER_CONFIG = `
+["SocialNetwork/server/UserServicer"]
+benchmark_mode = true
+token_secret = "test-only-token-secret-of-32-bytes"
+`
+
+// userServiceRunner runs UserService and Storage in memory, with cheap
+// password hashes and the given extra config of UserServicer.
+func userServiceRunner(extra string) weavertest.Runner {
+	runner := weavertest.Local
+	runner.Config = TEST_USER_CONFIG + extra
+	return runner
+}
+
+// registerAndLogin registers alice and returns the tokens of a new session.
+func registerAndLogin(t *testing.T, us UserServicer) AuthTokens {
+	t.Helper()
+	ctx := context.Background()
+	if err := us.RegisterUserWithId(ctx, "Alice", "A", "alice", "password1", 1); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := us.Login(ctx, "alice", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestVerifyRevokedToken(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name        string
+		allSessions bool
+	}{
+		{"session", false},
+		{"all sessions", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			userServiceRunner("").Test(t, func(t *testing.T, us UserServicer) {
+				tokens := registerAndLogin(t, us)
+				other, err := us.Login(ctx, "alice", "password1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := us.VerifyToken(ctx, tokens.AccessToken); err != nil {
+					t.Fatal(err)
+				}
+				if err := us.Logout(ctx, tokens.AccessToken, tc.allSessions); err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := us.VerifyToken(ctx, tokens.AccessToken); !errors.Is(err, errRevokedToken) {
+					t.Errorf("VerifyToken of a logged out token: got %v, want %v", err, errRevokedToken)
+				}
+				_, err = us.VerifyToken(ctx, other.AccessToken)
+				if tc.allSessions && !errors.Is(err, errRevokedToken) {
+					t.Errorf("VerifyToken of another session: got %v, want %v", err, errRevokedToken)
+				} else if !tc.allSessions && err != nil {
+					t.Errorf("VerifyToken of another session: %v", err)
+				}
+				if _, err := us.Refresh(ctx, tokens.RefreshToken); err == nil {
+					t.Error("Refresh of a logged out session succeeded")
+				}
+
+				// Sessions started after a logout are not revoked.
+				time.Sleep(2 * time.Millisecond)
+				fresh, err := us.Login(ctx, "alice", "password1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := us.VerifyToken(ctx, fresh.AccessToken); err != nil {
+					t.Errorf("VerifyToken of a new session: %v", err)
+				}
+			})
+		})
+	}
+}
+
+// A refresh token can only be used once, while the one that replaced it
+// keeps working.
+func TestRefreshReplay(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer) {
+		tokens := registerAndLogin(t, us)
+		refreshed, err := us.Refresh(ctx, tokens.RefreshToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refreshed.RefreshToken == tokens.RefreshToken {
+			t.Fatal("Refresh returned the same refresh token")
+		}
+		if !strings.HasPrefix(refreshed.RefreshToken, strings.SplitN(tokens.RefreshToken, ".", 2)[0]+".") {
+			t.Errorf("Refresh started another session: %s", refreshed.RefreshToken)
+		}
+
+		if _, err := us.Refresh(ctx, tokens.RefreshToken); !errors.Is(err, errInvalidRefreshToken) {
+			t.Errorf("replayed Refresh: got %v, want %v", err, errInvalidRefreshToken)
+		}
+		again, err := us.Refresh(ctx, refreshed.RefreshToken)
+		if err != nil {
+			t.Fatalf("Refresh with the rotated token: %v", err)
+		}
+		if _, err := us.VerifyToken(ctx, again.AccessToken); err != nil {
+			t.Errorf("VerifyToken after Refresh: %v", err)
+		}
+		if _, err := us.Refresh(ctx, refreshed.RefreshToken); !errors.Is(err, errInvalidRefreshToken) {
+			t.Errorf("second replayed Refresh: got %v, want %v", err, errInvalidRefreshToken)
+		}
+	})
+}
@@ -12,16 +12,42 @@ import (
 type ISocialGraphService interface {
 	GetFollowers(context.Context, int64) ([]int64, error)
 	GetFollowees(context.Context, int64) ([]int64, error)
-	Follow(context.Context, int64, int64) error
+	// Follow and FollowWithUsername report whether the followee is private,
+	// in which case the follow is a pending request; see follow_requests.go.
+	Follow(context.Context, int64, int64) (bool, error)
 	Unfollow(context.Context, int64, int64) error
-	FollowWithUsername(context.Context, string, string) error
+	FollowWithUsername(context.Context, string, string) (bool, error)
 	UnfollowWithUsername(context.Context, string, string) error
+	// Block, Unblock, Mute and Unmute change the relation of the user to the
+	// other user; see block_mute.go. GetBlocked and GetMuted list the users
+	// that the user blocks or mutes.
+	Block(context.Context, int64, int64) error
+	Unblock(context.Context, int64, int64) error
+	Mute(context.Context, int64, int64) error
+	Unmute(context.Context, int64, int64) error
+	GetBlocked(context.Context, int64) ([]int64, error)
+	GetMuted(context.Context, int64) ([]int64, error)
+	// ApproveFollower and RejectFollower answer the pending request of the
+	// follower to follow the user, and GetFollowRequests lists the users with
+	// a pending request to follow the user.
+	ApproveFollower(context.Context, int64, int64) error
+	RejectFollower(context.Context, int64, int64) error
+	GetFollowRequests(context.Context, int64) ([]int64, error)
+	// GetFollowCounts returns the number of followers and followees of the
+	// user. GetFollowersPage and GetFolloweesPage list them a page at a time
+	// from a cursor, and IsFollowing reports whether the first user follows
+	// the second; see follow_lists.go.
+	GetFollowCounts(context.Context, int64) (int, int, error)
+	GetFollowersPage(context.Context, int64, string, int) (UserIdPage, error)
+	GetFolloweesPage(context.Context, int64, string, int) (UserIdPage, error)
+	IsFollowing(context.Context, int64, int64) (bool, error)
 }
 
 type SocialGraphService struct {
 	weaver.Implements[ISocialGraphService]
-	storage      weaver.Ref[IStorage]
-	user_service weaver.Ref[UserServicer]
+	storage             weaver.Ref[IStorage]
+	user_service        weaver.Ref[UserServicer]
+	transaction_service weaver.Ref[ITransactionService]
 }
 
 func map_to_list(m map[int64]bool) []int64 {
@@ -50,29 +76,59 @@ func (s *SocialGraphService) GetFollowees(ctx context.Context, userId int64) ([]
 	return map_to_list(followee_maps), nil
 }
 
-func (s *SocialGraphService) Follow(ctx context.Context, followerId int64, followeeId int64) error {
-	storage := s.storage.Get()
-	storage.Follow(ctx, followerId, followeeId)
-	return nil
+// Follow and Unfollow change the followee edge on the follower's shard and
+// the follower edge on the followee's shard in one transaction, so that the
+// two edges cannot diverge. Both start with the followee edge, so that
+// concurrent calls on the same users are ordered; see storage_txn.go. They do
+// not check whether the relationship already exists, so that repeating a
+// call repairs a relationship with a single edge. Follow fails with BLOCKED if
+// either user blocks the other. A follow of a private user who is not
+// followed yet adds a follow request instead.
+func (s *SocialGraphService) Follow(ctx context.Context, followerId int64, followeeId int64) (bool, error) {
+	if followerId != followeeId {
+		info, exist, err := s.user_service.Get().GetUserInfo(ctx, followeeId)
+		if err != nil {
+			return false, err
+		}
+		if exist && info.Private {
+			return s.requestFollow(ctx, followerId, followeeId)
+		}
+	}
+	ok, err := s.transaction_service.Get().Commit(ctx, StorageTransaction{
+		Preconditions: notBlockedPreconditions(followerId, followeeId),
+		Mutations:     followMutations(followerId, followeeId),
+	})
+	if err == nil && !ok {
+		err = NewSocialGraphError(BLOCKED, fmt.Sprintf("user %d cannot follow user %d", followerId, followeeId))
+	}
+	return false, err
 }
 
 func (s *SocialGraphService) Unfollow(ctx context.Context, followerId int64, followeeId int64) error {
-	storage := s.storage.Get()
-	storage.Unfollow(ctx, followerId, followeeId)
-	return nil
+	_, err := s.transaction_service.Get().Commit(ctx, StorageTransaction{
+		Mutations: unfollowMutations(followerId, followeeId),
+	})
+	return err
 }
 
-func (s *SocialGraphService) FollowWithUsername(ctx context.Context, followerUsername string, followeeUsername string) error {
+// unfollowMutations returns the mutations that remove both edges of a follow
+// relationship, and of a pending request of it.
+func unfollowMutations(followerId int64, followeeId int64) []StorageMutation {
+	return append([]StorageMutation{
+		{Op: OP_REMOVE_FOLLOWEE, IntKey: followerId, IntVal: followeeId},
+		{Op: OP_REMOVE_FOLLOWER, IntKey: followeeId, IntVal: followerId},
+	}, relationMutations(false, RELATION_REQUESTED, followerId, followeeId)...)
+}
+
+func (s *SocialGraphService) FollowWithUsername(ctx context.Context, followerUsername string, followeeUsername string) (bool, error) {
 	user_service := s.user_service.Get()
 	followerId, _ := user_service.GetUserId(ctx, followerUsername)
 	followeeId, _ := user_service.GetUserId(ctx, followeeUsername)
 	if followerId <= 0 || followeeId <= 0 {
 		fmt.Printf("Failed to find the user profile - followerUsername: %s, followeeUsername: %s\n", followerUsername, followeeUsername)
-		return nil
+		return false, nil
 	}
-	storage := s.storage.Get()
-	storage.Follow(ctx, followerId, followeeId)
-	return nil
+	return s.Follow(ctx, followerId, followeeId)
 }
 
 func (s *SocialGraphService) UnfollowWithUsername(ctx context.Context, followerUsername string, followeeUsername string) error {
@@ -94,7 +150,5 @@ func (s *SocialGraphService) UnfollowWithUsername(ctx context.Context, followerU
 		fmt.Printf("Failed to find the user profile - followerUsername: %s, followeeUsername: %s\n", followerUsername, followeeUsername)
 		return nil
 	}
-	storage := s.storage.Get()
-	storage.Unfollow(ctx, followerId, followeeId)
-	return nil
+	return s.Unfollow(ctx, followerId, followeeId)
 }
@@ -3,9 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/ServiceWeaver/weaver"
-	"github.com/google/btree"
 )
 
 type IStorage interface {
@@ -13,283 +18,787 @@ type IStorage interface {
 	// GetMap(context.Context, string, key) (HashMap, error)
 	PutUserProfile(context.Context, string, UserProfile) error
 	GetUserProfile(context.Context, string) (UserProfile, bool, error)
-
-	PutPost(context.Context, int64, Post) error
+	// GetUserProfiles returns the profiles of the usernames that exist.
+	GetUserProfiles(context.Context, []string) (map[string]UserProfile, error)
+	// GetBucketProfiles returns the public part of every profile of the
+	// routing bucket, without the password hashes; see user_search.go.
+	GetBucketProfiles(context.Context, int) ([]UserInfo, error)
+	// The user id index maps user ids to usernames. A profile and its index
+	// entry generally belong to different routing buckets, so UserService
+	// claims the user id before putting the profile; see claimUser.
+	GetUsername(context.Context, int64) (string, bool, error)
+	// GetUsernames returns the usernames of the user ids that are indexed.
+	GetUsernames(context.Context, []int64) (map[int64]string, error)
+
+	// The puts of posts, media and short urls take a time to live; zero
+	// means forever. Expired entries are no longer returned, and are removed
+	// by ExpireBucket; see storage_expiry.go.
+	PutPost(context.Context, int64, Post, time.Duration) error
 	GetPost(context.Context, int64) (Post, bool, error)
+	// GetPosts returns the posts of the ids that exist.
+	GetPosts(context.Context, []int64) (map[int64]Post, error)
 	RemovePost(context.Context, int64) (bool, error)
 
-	PutMediaData(context.Context, string, string) error
+	PutMediaData(context.Context, string, string, time.Duration) error
 	GetMediaData(context.Context, string) (string, bool, error)
 
-	PutShortenUrl(context.Context, string, string) error
+	PutShortenUrl(context.Context, string, string, time.Duration) error
 	GetShortenUrl(context.Context, string) (string, bool, error)
 	RemoveShortenUrl(context.Context, string) error
 
-	Follow(context.Context, int64, int64) error
-	Unfollow(context.Context, int64, int64) error
+	// Sessions are keyed by session id and revocations by revocation key;
+	// see session.go. Both are written with Transact and expire like posts,
+	// and neither is included in dumps.
+	GetSession(context.Context, string) (Session, bool, error)
+	// GetRevocation returns the time at which the key was revoked.
+	GetRevocation(context.Context, string) (int64, bool, error)
+	// GetLoginFailures returns the failed logins of the username; see
+	// login_lockout.go. They are written with Transact, expire like sessions
+	// and are not included in dumps.
+	GetLoginFailures(context.Context, string) (LoginFailures, bool, error)
+
+	// A follow relationship is stored as two edges that may live on different
+	// shards: the followee edge on the follower's shard and the follower edge
+	// on the followee's shard. SocialGraphService keeps them in sync.
+	PutFollowee(context.Context, int64, int64) error
+	RemoveFollowee(context.Context, int64, int64) error
+	PutFollower(context.Context, int64, int64) error
+	RemoveFollower(context.Context, int64, int64) error
 	GetFollowers(context.Context, int64) (map[int64]bool, bool, error)
 	GetFollowees(context.Context, int64) (map[int64]bool, bool, error)
-
-	PutPostTimeline(context.Context, int64, int64, int64) error
-	GetPostTimeline(context.Context, int64, int, int) ([]int64, error)
-	RemovePostTimeline(context.Context, int64, int64, int64) error
+	// GetFollowCounts returns the number of followers and followees of the
+	// user without reading their edges.
+	GetFollowCounts(context.Context, int64) (int, int, error)
+	// GetFollowersPage and GetFolloweesPage return at most limit followers or
+	// followees of the user with ids greater than the given one, in
+	// increasing order.
+	GetFollowersPage(context.Context, int64, int64, int) ([]int64, error)
+	GetFolloweesPage(context.Context, int64, int64, int) ([]int64, error)
+	// HasFollowee reports whether the first user follows the second, reading
+	// the followee edge on the shard of the first.
+	HasFollowee(context.Context, int64, int64) (bool, error)
+	// GetRelations returns the block, mute or follow request edges of the
+	// kind of the user. They are written with transactions in pairs like
+	// follow edges; see block_mute.go.
+	GetRelations(context.Context, int64, RelationKind) (map[int64]bool, bool, error)
+
+	// Every user has a timeline of each TimelineKind.
+	PutPostTimeline(context.Context, int64, TimelineKind, int64, int64) error
+	// GetPostTimeline returns the entries on the direction side of the cursor,
+	// newest first, skipping the start entries closest to the cursor and
+	// returning at most stop-start. A zero cursor reads from the newest end
+	// of the timeline when going older and from the oldest end when going
+	// newer.
+	GetPostTimeline(context.Context, int64, TimelineKind, TimelineEntry, TimelineDirection, int, int) ([]TimelineEntry, error)
+	RemovePostTimeline(context.Context, int64, TimelineKind, int64, int64) error
+	// PutPostTimelines and RemovePostTimelines add or remove one post in the
+	// timelines of many users.
+	PutPostTimelines(context.Context, []int64, TimelineKind, int64, int64) error
+	RemovePostTimelines(context.Context, []int64, TimelineKind, int64, int64) error
+
+	// GetReplicationStatus reports the primary's view of replication. It
+	// returns a STANDALONE status when replication is disabled.
+	GetReplicationStatus(context.Context) (ReplicationStatus, error)
+
+	// ExportBucket and ImportBucket copy the data of one routing bucket out
+	// of and into Storage; see storage_admin.go.
+	ExportBucket(context.Context, int) (StorageDump, error)
+	ImportBucket(context.Context, int, StorageDump) error
+	// GetStorageStats returns the size of the maps of the replica owning the
+	// routing bucket; see storage_stats.go.
+	GetStorageStats(context.Context, int) (StorageStats, error)
+	// ExpireBucket removes the expired entries of the routing bucket other
+	// than posts, and returns the expired posts, which ExpiryService removes
+	// together with their timeline entries.
+	ExpireBucket(context.Context, int) ([]Post, error)
+
+	// Transact applies the transaction atomically if its preconditions
+	// hold, and reports whether they did. All its keys must belong to the
+	// routing bucket; see storage_txn.go.
+	Transact(context.Context, int, StorageTransaction) (bool, error)
+	// GetTxnIntents returns the pending intents of the cross-bucket
+	// transactions whose home is the routing bucket.
+	GetTxnIntents(context.Context, int) ([]StorageIntent, error)
+
+	// ReadChanges returns up to max changes of the change feed of the
+	// routing bucket whose id is given, starting at the given sequence, or
+	// at the oldest retained change if it is zero. It waits for a change if
+	// there is none yet. See storage_changes.go.
+	ReadChanges(context.Context, int, string, uint64, int) (StorageChanges, error)
 }
 
-// Manually routing all request to the same replica.
-// But it's not guaranteed by the documentation.
+// StorageRouter routes every call on the key it reads or writes, so that each
+// Storage replica owns the partition of keys that weaver assigns to it.
+// Routing is affinity based: weaver may move keys between replicas when the
+// replica set changes.
+//
+// Keys are hashed into STORAGE_ROUTING_BUCKETS buckets and calls are routed
+// on the bucket, so that a batch call can cover every key of a bucket. The
+// batch calls must only be given keys of one bucket; see storage_batch.go.
 type StorageRouter struct{}
 
-const ROUTE_KEY string = "storage"
-
-func (StorageRouter) PutUserProfile(context.Context, string, UserProfile) string  { return ROUTE_KEY }
-func (StorageRouter) GetUserProfile(context.Context, string) string               { return ROUTE_KEY }
-func (StorageRouter) PutPost(context.Context, int64, Post) string                 { return ROUTE_KEY }
-func (StorageRouter) GetPost(context.Context, int64) string                       { return ROUTE_KEY }
-func (StorageRouter) RemovePost(context.Context, int64) string                    { return ROUTE_KEY }
-func (StorageRouter) PutMediaData(context.Context, string, string) string         { return ROUTE_KEY }
-func (StorageRouter) GetMediaData(context.Context, string) string                 { return ROUTE_KEY }
-func (StorageRouter) PutShortenUrl(context.Context, string, string) string        { return ROUTE_KEY }
-func (StorageRouter) GetShortenUrl(context.Context, string) string                { return ROUTE_KEY }
-func (StorageRouter) RemoveShortenUrl(context.Context, string) string             { return ROUTE_KEY }
-func (StorageRouter) Follow(context.Context, int64, int64) string                 { return ROUTE_KEY }
-func (StorageRouter) Unfollow(context.Context, int64, int64) string               { return ROUTE_KEY }
-func (StorageRouter) GetFollowers(context.Context, int64) string                  { return ROUTE_KEY }
-func (StorageRouter) GetFollowees(context.Context, int64) string                  { return ROUTE_KEY }
-func (StorageRouter) PutPostTimeline(context.Context, int64, int64, int64) string { return ROUTE_KEY }
-func (StorageRouter) GetPostTimeline(context.Context, int64, int, int) string     { return ROUTE_KEY }
-func (StorageRouter) RemovePostTimeline(context.Context, int64, int64, int64) string {
-	return ROUTE_KEY
-}
-
-//  PutUserProfile(_ context.Context, key string) string
-//  GetUserProfile(_ context.Context, key, value string) string
-//  PutPost(_ context.Context, key string) string
-//  GetPost(_ context.Context, key, value string) string
-//  RemovePost(_ context.Context, key string) string
-//  PutMediaData(_ context.Context, key, value string) string
-//  GetMediaData(_ context.Context, key string) string
-//  PutShortenUrl(_ context.Context, key, value string) string
-//  GetShortenUrl(_ context.Context, key string) string
-//  RemoveShortenUrl(_ context.Context, key, value string) string
-//  Follow(_ context.Context, key string) string
-//  Unfollow(_ context.Context, key, value string) string
-//  GetFollowers(_ context.Context, key string) string
-//  GetFollowees(_ context.Context, key, value string) string
-//  PutPostTimeline(_ context.Context, key string) string
-//  GetPostTimeline(_ context.Context, key, value string) string
-//  RemovePostTimeline(_ context.Context, key, value string) string
-
-// the hashtable needs to be manually managed so that it has only one instance and no replicas.
-// Later on, for distributed sharded hastable, we can have more replicas as shards.
+const STORAGE_ROUTING_BUCKETS = 64
+
+func intRoutingBucket(id int64) int {
+	return int(mixHash(uint64(id)) % STORAGE_ROUTING_BUCKETS)
+}
+
+func stringRoutingBucket(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % STORAGE_ROUTING_BUCKETS)
+}
+
+func intRoutingKey(id int64) string {
+	return strconv.Itoa(intRoutingBucket(id))
+}
+
+func stringRoutingKey(key string) string {
+	return strconv.Itoa(stringRoutingBucket(key))
+}
+
+func (StorageRouter) PutUserProfile(_ context.Context, username string, _ UserProfile) string {
+	return stringRoutingKey(username)
+}
+
+func (StorageRouter) GetUserProfile(_ context.Context, username string) string {
+	return stringRoutingKey(username)
+}
+
+func (StorageRouter) GetUserProfiles(_ context.Context, usernames []string) string {
+	if len(usernames) == 0 {
+		return ""
+	}
+	return stringRoutingKey(usernames[0])
+}
+
+func (StorageRouter) GetBucketProfiles(_ context.Context, bucket int) string {
+	return strconv.Itoa(bucket)
+}
+
+func (StorageRouter) GetUsername(_ context.Context, userId int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) GetUsernames(_ context.Context, userIds []int64) string {
+	if len(userIds) == 0 {
+		return ""
+	}
+	return intRoutingKey(userIds[0])
+}
+
+func (StorageRouter) PutPost(_ context.Context, postId int64, _ Post, _ time.Duration) string {
+	return intRoutingKey(postId)
+}
+
+func (StorageRouter) GetPost(_ context.Context, postId int64) string {
+	return intRoutingKey(postId)
+}
+
+func (StorageRouter) GetPosts(_ context.Context, postIds []int64) string {
+	if len(postIds) == 0 {
+		return ""
+	}
+	return intRoutingKey(postIds[0])
+}
+
+func (StorageRouter) RemovePost(_ context.Context, postId int64) string {
+	return intRoutingKey(postId)
+}
+
+func (StorageRouter) PutMediaData(_ context.Context, filename, _ string, _ time.Duration) string {
+	return stringRoutingKey(filename)
+}
+
+func (StorageRouter) GetMediaData(_ context.Context, filename string) string {
+	return stringRoutingKey(filename)
+}
+
+func (StorageRouter) PutShortenUrl(_ context.Context, shortUrl, _ string, _ time.Duration) string {
+	return stringRoutingKey(shortUrl)
+}
+
+func (StorageRouter) GetShortenUrl(_ context.Context, shortUrl string) string {
+	return stringRoutingKey(shortUrl)
+}
+
+func (StorageRouter) RemoveShortenUrl(_ context.Context, shortUrl string) string {
+	return stringRoutingKey(shortUrl)
+}
+
+func (StorageRouter) GetSession(_ context.Context, sessionId string) string {
+	return stringRoutingKey(sessionId)
+}
+
+func (StorageRouter) GetRevocation(_ context.Context, key string) string {
+	return stringRoutingKey(key)
+}
+
+func (StorageRouter) GetLoginFailures(_ context.Context, username string) string {
+	return stringRoutingKey(username)
+}
+
+func (StorageRouter) PutFollowee(_ context.Context, userId, _ int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) RemoveFollowee(_ context.Context, userId, _ int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) PutFollower(_ context.Context, userId, _ int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) RemoveFollower(_ context.Context, userId, _ int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) GetFollowers(_ context.Context, userId int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) GetFollowees(_ context.Context, userId int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) GetFollowCounts(_ context.Context, userId int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) GetFollowersPage(_ context.Context, userId, _ int64, _ int) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) GetFolloweesPage(_ context.Context, userId, _ int64, _ int) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) HasFollowee(_ context.Context, userId, _ int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) GetRelations(_ context.Context, userId int64, _ RelationKind) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) PutPostTimeline(_ context.Context, userId int64, _ TimelineKind, _, _ int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) GetPostTimeline(_ context.Context, userId int64, _ TimelineKind, _ TimelineEntry, _ TimelineDirection, _, _ int) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) RemovePostTimeline(_ context.Context, userId int64, _ TimelineKind, _, _ int64) string {
+	return intRoutingKey(userId)
+}
+
+func (StorageRouter) PutPostTimelines(_ context.Context, userIds []int64, _ TimelineKind, _, _ int64) string {
+	if len(userIds) == 0 {
+		return ""
+	}
+	return intRoutingKey(userIds[0])
+}
+
+func (StorageRouter) RemovePostTimelines(_ context.Context, userIds []int64, _ TimelineKind, _, _ int64) string {
+	if len(userIds) == 0 {
+		return ""
+	}
+	return intRoutingKey(userIds[0])
+}
+
+const (
+	MEMORY_BACKEND = "memory"
+	SQLITE_BACKEND = "sqlite"
+
+	SQLITE_FILENAME = "storage.db"
+)
+
+type storageConfig struct {
+	// Backend is "memory" (the default) or "sqlite".
+	Backend string `toml:"backend"`
+	// DataDir holds the write-ahead log and snapshots of the memory backend,
+	// or the database of the sqlite backend. Persistence of the memory
+	// backend is disabled when it is empty. Each routing bucket is persisted
+	// in a bucket-<n> subdirectory that the replica it is routed to locks; see
+	// storage_buckets.go. With replication, each replica persists all the
+	// data in a replica-<n> subdirectory that it locks for its lifetime.
+	DataDir string `toml:"data_dir"`
+	// FsyncPolicy is one of "always", "interval" or "never". For the sqlite
+	// backend it selects synchronous=FULL, NORMAL or OFF respectively.
+	FsyncPolicy         string `toml:"fsync_policy"`
+	FsyncIntervalMs     int    `toml:"fsync_interval_ms"`
+	SnapshotIntervalSec int    `toml:"snapshot_interval_sec"`
+
+	// MaxHomeTimelineLen and MaxUserTimelineLen bound the number of entries
+	// of each timeline; the oldest entries are evicted on PutPostTimeline.
+	// Zero means unbounded.
+	MaxHomeTimelineLen int `toml:"max_home_timeline_len"`
+	MaxUserTimelineLen int `toml:"max_user_timeline_len"`
+
+	// Replication is "none" (the default) or "primary_backup". With
+	// primary_backup every replica holds all the data; see replication.go.
+	Replication string `toml:"replication"`
+	// ReplicationDir is shared by all replicas and holds the primary lock.
+	ReplicationDir string `toml:"replication_dir"`
+	// ReplicationAddr is the address replicas listen on for each other.
+	ReplicationAddr string `toml:"replication_addr"`
+	// ReadFromBackup lets backups serve reads from their own, possibly stale,
+	// copy instead of forwarding them to the primary.
+	ReadFromBackup bool `toml:"read_from_backup"`
+	// ReplicationLogSize is the number of recent mutations the primary keeps
+	// for backups to catch up with. Backups that fall further behind reload a
+	// snapshot.
+	ReplicationLogSize int `toml:"replication_log_size"`
+
+	// StatsIntervalSec is how often the map sizes are published as metrics.
+	StatsIntervalSec int `toml:"stats_interval_sec"`
+
+	// ChangeFeedSize is the number of recent changes that the change feed of
+	// each routing bucket retains; see storage_changes.go.
+	ChangeFeedSize int `toml:"change_feed_size"`
+}
+
+func (cfg *storageConfig) maxTimelineLen(kind TimelineKind) int {
+	if kind == HOME_TIMELINE {
+		return cfg.MaxHomeTimelineLen
+	}
+	return cfg.MaxUserTimelineLen
+}
+
+// storageReader serves the read-only calls of Storage.
+type storageReader interface {
+	GetUserProfile(string) (UserProfile, bool, error)
+	GetBucketProfiles(int) ([]UserInfo, error)
+	GetUsername(int64) (string, bool, error)
+	GetPost(int64) (Post, bool, error)
+	GetMediaData(string) (string, bool, error)
+	GetShortenUrl(string) (string, bool, error)
+	GetSession(string) (Session, bool, error)
+	GetRevocation(string) (int64, bool, error)
+	GetLoginFailures(string) (LoginFailures, bool, error)
+	GetFollowers(int64) (map[int64]bool, bool, error)
+	GetFollowees(int64) (map[int64]bool, bool, error)
+	GetFollowCounts(int64) (int, int, error)
+	GetFollowersPage(int64, int64, int) ([]int64, error)
+	GetFolloweesPage(int64, int64, int) ([]int64, error)
+	HasFollowee(int64, int64) (bool, error)
+	GetRelations(int64, RelationKind) (map[int64]bool, bool, error)
+	GetPostTimeline(int64, TimelineKind, TimelineEntry, TimelineDirection, int, int) ([]TimelineEntry, error)
+	GetTxnIntents(int) ([]StorageIntent, error)
+}
+
+// storageBackend holds the data of one Storage replica. Mutations are applied
+// through apply so that they can be logged and replicated uniformly.
+type storageBackend interface {
+	storageReader
+
+	apply(StorageMutation) (bool, error)
+	// holds reports whether the precondition holds.
+	holds(StoragePrecondition) (bool, error)
+	// applyTransaction applies all the mutations of the transaction, or none
+	// of them if a precondition does not hold or it conflicts with a pending
+	// intent; see storage_txn.go.
+	applyTransaction(StorageTransaction) (bool, error)
+	// position returns the replication position of the contents, which
+	// setPosition records; see replication.go.
+	position() (replicationPosition, error)
+	setPosition(replicationPosition) error
+	// snapshot copies the whole contents and restore replaces them.
+	snapshot() (*storageSnapshot, error)
+	restore(*storageSnapshot) error
+	// stats returns the size of each map, in storageMap order.
+	stats() ([]StorageMapStats, error)
+	// expired returns the entries that expired at or before now, in unix
+	// milliseconds.
+	expired(now int64) (expiredEntries, error)
+	Close() error
+}
+
+// Storage holds one partition of the data; see StorageRouter. With
+// replication enabled it holds all of it instead.
 type Storage struct {
 	weaver.Implements[IStorage]
 	weaver.WithRouter[StorageRouter]
+	weaver.WithConfig[storageConfig]
 
-	// mu sync.Mutex
-	// data map[string]string
-	filenameToMediaDataMap   *HashMap[string, string]
-	usernameToUserProfileMap *HashMap[string, UserProfile]
-	postIdToPostMap          *HashMap[int64, Post]
-	shortToExtendedMap       *HashMap[string, string]
-	useridToFollowersMap     *HashMap[int64, *HashMap[int64, bool]]
-	useridToFolloweesMap     *HashMap[int64, *HashMap[int64, bool]]
+	backend storageBackend
 
-	useridToTimelineMap *HashMap[int64, *btree.BTree]
+	// buckets is the backend when the data is persisted without replication.
+	buckets *bucketBackend
+	// wal is nil unless the memory backend is persisted with replication.
+	wal            *WriteAheadLog
+	replicaDirLock *os.File
+	// replicator is nil unless replication is enabled.
+	replicator *replicator
+
+	feedsMu sync.Mutex
+	feeds   [STORAGE_ROUTING_BUCKETS]*changeFeed
+
+	name string
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 func (s *Storage) Init(context.Context) error {
-	s.filenameToMediaDataMap = NewHashMap[string, string]()
-	s.usernameToUserProfileMap = NewHashMap[string, UserProfile]()
-	s.postIdToPostMap = NewHashMap[int64, Post]()
-	s.shortToExtendedMap = NewHashMap[string, string]()
-	s.useridToFollowersMap = NewHashMap[int64, *HashMap[int64, bool]]()
-	s.useridToFolloweesMap = NewHashMap[int64, *HashMap[int64, bool]]()
-
-	s.useridToTimelineMap = NewHashMap[int64, *btree.BTree]()
+	cfg := s.Config()
+	if cfg.Backend != "" && cfg.Backend != MEMORY_BACKEND && cfg.Backend != SQLITE_BACKEND {
+		return fmt.Errorf("storage: unknown backend %q", cfg.Backend)
+	}
+
+	switch {
+	case cfg.DataDir == "":
+		if cfg.Backend == SQLITE_BACKEND {
+			return fmt.Errorf("storage: the sqlite backend needs a data_dir")
+		}
+		s.backend = newMemoryStorage()
+	case cfg.Replication == "" || cfg.Replication == REPLICATION_NONE:
+		buckets, err := openBucketBackend(cfg)
+		if err != nil {
+			return fmt.Errorf("storage: cannot open the routing buckets in %q: %w", cfg.DataDir, err)
+		}
+		s.backend, s.buckets = buckets, buckets
+	default:
+		dir, lock, err := claimReplicaDir(cfg.DataDir)
+		if err != nil {
+			return fmt.Errorf("storage: cannot claim a replica directory in %q: %w", cfg.DataDir, err)
+		}
+		backend, wal, err := openLocalBackend(cfg, dir)
+		if err != nil {
+			lock.Close()
+			return fmt.Errorf("storage: %w", err)
+		}
+		s.backend, s.wal, s.replicaDirLock = backend, wal, lock
+	}
+
+	switch cfg.Replication {
+	case "", REPLICATION_NONE:
+	case REPLICATION_PRIMARY_BACKUP:
+		r, err := startReplicator(s, cfg)
+		if err != nil {
+			s.closeLocal()
+			return fmt.Errorf("storage: cannot start replication: %w", err)
+		}
+		s.replicator = r
+	default:
+		s.closeLocal()
+		return fmt.Errorf("storage: unknown replication %q", cfg.Replication)
+	}
+
+	s.name = replicaName()
+	s.done = make(chan struct{})
+	statsInterval := time.Duration(cfg.StatsIntervalSec) * time.Second
+	if statsInterval <= 0 {
+		statsInterval = DEFAULT_STATS_INTERVAL_SEC * time.Second
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.statsLoop(statsInterval)
+	}()
 	return nil
 }
 
-func (s *Storage) PutUserProfile(_ context.Context, key string, val UserProfile) error {
-	s.usernameToUserProfileMap.Put(key, val)
-	return nil
+func (s *Storage) Shutdown(context.Context) error {
+	close(s.done)
+	s.wg.Wait()
+	if s.replicator != nil {
+		s.replicator.stop()
+	}
+	return s.closeLocal()
 }
 
-func (s *Storage) GetUserProfile(_ context.Context, key string) (UserProfile, bool, error) {
-	v, e := s.usernameToUserProfileMap.Get(key)
-	return v, e, nil
+func (s *Storage) closeLocal() error {
+	if s.replicaDirLock != nil {
+		defer s.replicaDirLock.Close()
+	}
+	if s.wal != nil {
+		if err := s.wal.Close(); err != nil {
+			return err
+		}
+	}
+	return s.backend.Close()
 }
 
-func (s *Storage) PutPost(_ context.Context, key int64, val Post) error {
-	s.postIdToPostMap.Put(key, val)
-	return nil
+// openLocalBackend opens the backend persisted in dir, along with its
+// write-ahead log if it is the memory backend.
+func openLocalBackend(cfg *storageConfig, dir string) (storageBackend, *WriteAheadLog, error) {
+	if cfg.Backend == SQLITE_BACKEND {
+		db, err := openSqliteStorage(filepath.Join(dir, SQLITE_FILENAME), cfg.FsyncPolicy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot open sqlite database in %q: %w", dir, err)
+		}
+		return db, nil, nil
+	}
+	mem := newMemoryStorage()
+	walCfg := *cfg
+	walCfg.DataDir = dir
+	wal, err := OpenWriteAheadLog(&walCfg, mem)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open write-ahead log in %q: %w", dir, err)
+	}
+	return mem, wal, nil
 }
 
-func (s *Storage) GetPost(_ context.Context, key int64) (Post, bool, error) {
-	v, e := s.postIdToPostMap.Get(key)
-	return v, e, nil
+// commit applies the mutation through the primary if replication is enabled
+// and locally otherwise.
+func (s *Storage) commit(m StorageMutation) (bool, error) {
+	return s.commitEntry(storageCommit{Mutation: m})
 }
 
-func (s *Storage) RemovePost(_ context.Context, key int64) (bool, error) {
-	_, exist := s.postIdToPostMap.Get(key)
-	if !exist {
-		return false, nil
+// commitEntry applies a mutation or transaction on the primary if
+// replication is enabled, and locally otherwise.
+func (s *Storage) commitEntry(c storageCommit) (bool, error) {
+	if s.replicator == nil {
+		return s.commitLocal(c)
 	}
-	s.postIdToPostMap.Delete(key)
-	return true, nil
+	return s.replicator.commit(c)
 }
 
-func (s *Storage) PutMediaData(_ context.Context, key string, val string) error {
-	s.filenameToMediaDataMap.Put(key, val)
-	return nil
+// commitLocal logs the mutation or transaction if persistence is enabled and
+// applies it, and publishes its changes; see storage_changes.go.
+func (s *Storage) commitLocal(c storageCommit) (bool, error) {
+	return s.publishChanges(c, func() (bool, error) {
+		if s.wal == nil {
+			return c.applyTo(s.backend)
+		}
+		return s.wal.Commit(c)
+	})
 }
 
-func (s *Storage) GetMediaData(_ context.Context, key string) (string, bool, error) {
-	v, e := s.filenameToMediaDataMap.Get(key)
-	return v, e, nil
-}
-
-func (s *Storage) Follow(_ context.Context, userId int64, followeeId int64) error {
-	// userId follows followeeId
-	followees, flag := s.useridToFolloweesMap.Get(userId)
-	if !flag {
-		newMap := NewHashMap[int64, bool]()
-		newMap.Put(followeeId, true)
-		followees = newMap
-	} else {
-		followees.Put(followeeId, true)
+// restoreLocal replaces the local contents and, if persistence is enabled,
+// snapshots them so that the log does not replay on top of the old ones.
+func (s *Storage) restoreLocal(snap *storageSnapshot) error {
+	if err := s.backend.restore(snap); err != nil {
+		return err
 	}
-	s.useridToFolloweesMap.Put(userId, followees)
-
-	followers, flag := s.useridToFollowersMap.Get(followeeId)
-	if !flag {
-		newMap := NewHashMap[int64, bool]()
-		newMap.Put(userId, true)
-		followers = newMap
-	} else {
-		followees.Put(userId, true)
+	if s.wal == nil {
+		return nil
 	}
-	s.useridToFollowersMap.Put(followeeId, followers)
-	return nil
+	return s.wal.Snapshot()
 }
 
-func (s *Storage) Unfollow(_ context.Context, userId int64, followeeId int64) error {
-	// userId unfollows followeeId
-	followees, flag1 := s.useridToFolloweesMap.Get(userId)
-	followers, flag2 := s.useridToFollowersMap.Get(followeeId)
-	if !flag1 || !flag2 {
-		fmt.Printf("Unfollow: userId %d or followeeId %d does not exist\n", userId, followeeId)
-		return nil
+// withBucket calls f with the backend that holds the routing bucket.
+func (s *Storage) withBucket(bucket int, f func(storageBackend) error) error {
+	if s.buckets == nil {
+		return f(s.backend)
 	}
+	return s.buckets.with(bucket, func(st *bucketStore) error { return f(st.backend) })
+}
 
-	if _, ok := followees.Get(followeeId); !ok {
-		fmt.Printf("Unfollow: userId %d does not follow followeeId %d\n", userId, followeeId)
-		return nil
+// reader returns where reads are served from.
+func (s *Storage) reader() storageReader {
+	if s.replicator == nil {
+		return s.backend
 	}
+	return s.replicator.reader()
+}
 
-	if _, ok := followers.Get(userId); !ok {
-		fmt.Printf("Unfollow: followeeId %d does not have userId %d as follower\n", followeeId, userId)
-		return nil
+func (s *Storage) PutUserProfile(_ context.Context, key string, val UserProfile) error {
+	_, err := s.commit(StorageMutation{Op: OP_PUT_USER_PROFILE, StrKey: key, Profile: val})
+	return err
+}
+
+func (s *Storage) GetUserProfile(_ context.Context, key string) (UserProfile, bool, error) {
+	return s.reader().GetUserProfile(key)
+}
+
+func (s *Storage) GetUserProfiles(_ context.Context, keys []string) (map[string]UserProfile, error) {
+	reader := s.reader()
+	profiles := make(map[string]UserProfile, len(keys))
+	for _, key := range keys {
+		profile, exist, err := reader.GetUserProfile(key)
+		if err != nil {
+			return nil, err
+		}
+		if exist {
+			profiles[key] = profile
+		}
 	}
+	return profiles, nil
+}
 
-	followees.Delete(followeeId)
-	followers.Delete(userId)
-	// delete(followees, followeeId)
-	// delete(followers, userId)
-	return nil
+func (s *Storage) GetBucketProfiles(_ context.Context, bucket int) ([]UserInfo, error) {
+	return s.reader().GetBucketProfiles(bucket)
 }
 
-func (s *Storage) GetFollowers(_ context.Context, userId int64) (map[int64]bool, bool, error) {
-	v, e := s.useridToFollowersMap.Get(userId)
-	if !e {
-		return nil, false, nil
+func (s *Storage) PutPost(_ context.Context, key int64, val Post, ttl time.Duration) error {
+	_, err := s.commit(StorageMutation{Op: OP_PUT_POST, IntKey: key, Post: val, ExpiresAt: expiresAt(ttl)})
+	return err
+}
+
+func (s *Storage) GetPost(_ context.Context, key int64) (Post, bool, error) {
+	return s.reader().GetPost(key)
+}
+
+func (s *Storage) GetUsername(_ context.Context, key int64) (string, bool, error) {
+	return s.reader().GetUsername(key)
+}
+
+func (s *Storage) GetUsernames(_ context.Context, keys []int64) (map[int64]string, error) {
+	reader := s.reader()
+	usernames := make(map[int64]string, len(keys))
+	for _, key := range keys {
+		username, exist, err := reader.GetUsername(key)
+		if err != nil {
+			return nil, err
+		}
+		if exist {
+			usernames[key] = username
+		}
 	}
-	return v.Clone(), e, nil
+	return usernames, nil
 }
 
-func (s *Storage) GetFollowees(_ context.Context, userId int64) (map[int64]bool, bool, error) {
-	v, e := s.useridToFolloweesMap.Get(userId)
-	if !e {
-		return nil, false, nil
+func (s *Storage) GetPosts(_ context.Context, keys []int64) (map[int64]Post, error) {
+	reader := s.reader()
+	posts := make(map[int64]Post, len(keys))
+	for _, key := range keys {
+		post, exist, err := reader.GetPost(key)
+		if err != nil {
+			return nil, err
+		}
+		if exist {
+			posts[key] = post
+		}
 	}
-	return v.Clone(), e, nil
+	return posts, nil
 }
 
-func (s *Storage) PutShortenUrl(_ context.Context, key string, val string) error {
-	s.shortToExtendedMap.Put(key, val)
-	return nil
+func (s *Storage) RemovePost(_ context.Context, key int64) (bool, error) {
+	_, exist, err := s.reader().GetPost(key)
+	if err != nil || !exist {
+		return false, err
+	}
+	return s.commit(StorageMutation{Op: OP_REMOVE_POST, IntKey: key})
+}
+
+func (s *Storage) PutMediaData(_ context.Context, key string, val string, ttl time.Duration) error {
+	_, err := s.commit(StorageMutation{Op: OP_PUT_MEDIA_DATA, StrKey: key, StrVal: val, ExpiresAt: expiresAt(ttl)})
+	return err
+}
+
+func (s *Storage) GetMediaData(_ context.Context, key string) (string, bool, error) {
+	return s.reader().GetMediaData(key)
+}
+
+func (s *Storage) PutFollowee(_ context.Context, userId int64, followeeId int64) error {
+	_, err := s.commit(StorageMutation{Op: OP_PUT_FOLLOWEE, IntKey: userId, IntVal: followeeId})
+	return err
+}
+
+func (s *Storage) RemoveFollowee(_ context.Context, userId int64, followeeId int64) error {
+	_, err := s.commit(StorageMutation{Op: OP_REMOVE_FOLLOWEE, IntKey: userId, IntVal: followeeId})
+	return err
+}
+
+func (s *Storage) PutFollower(_ context.Context, userId int64, followerId int64) error {
+	_, err := s.commit(StorageMutation{Op: OP_PUT_FOLLOWER, IntKey: userId, IntVal: followerId})
+	return err
+}
+
+func (s *Storage) RemoveFollower(_ context.Context, userId int64, followerId int64) error {
+	_, err := s.commit(StorageMutation{Op: OP_REMOVE_FOLLOWER, IntKey: userId, IntVal: followerId})
+	return err
+}
+
+func (s *Storage) GetFollowers(_ context.Context, userId int64) (map[int64]bool, bool, error) {
+	return s.reader().GetFollowers(userId)
+}
+
+func (s *Storage) GetFollowees(_ context.Context, userId int64) (map[int64]bool, bool, error) {
+	return s.reader().GetFollowees(userId)
+}
+
+func (s *Storage) GetFollowCounts(_ context.Context, userId int64) (int, int, error) {
+	return s.reader().GetFollowCounts(userId)
+}
+
+func (s *Storage) GetFollowersPage(_ context.Context, userId int64, after int64, limit int) ([]int64, error) {
+	return s.reader().GetFollowersPage(userId, after, limit)
+}
+
+func (s *Storage) GetFolloweesPage(_ context.Context, userId int64, after int64, limit int) ([]int64, error) {
+	return s.reader().GetFolloweesPage(userId, after, limit)
+}
+
+func (s *Storage) HasFollowee(_ context.Context, userId int64, followeeId int64) (bool, error) {
+	return s.reader().HasFollowee(userId, followeeId)
+}
+
+func (s *Storage) GetRelations(_ context.Context, userId int64, kind RelationKind) (map[int64]bool, bool, error) {
+	return s.reader().GetRelations(userId, kind)
+}
+
+func (s *Storage) PutShortenUrl(_ context.Context, key string, val string, ttl time.Duration) error {
+	_, err := s.commit(StorageMutation{Op: OP_PUT_SHORTEN_URL, StrKey: key, StrVal: val, ExpiresAt: expiresAt(ttl)})
+	return err
 }
 
 func (s *Storage) GetShortenUrl(_ context.Context, key string) (string, bool, error) {
-	v, e := s.shortToExtendedMap.Get(key)
-	return v, e, nil
+	return s.reader().GetShortenUrl(key)
 }
 
 func (s *Storage) RemoveShortenUrl(_ context.Context, key string) error {
-	s.shortToExtendedMap.Delete(key)
-	return nil
+	_, err := s.commit(StorageMutation{Op: OP_REMOVE_SHORTEN_URL, StrKey: key})
+	return err
 }
 
-type PostTimestampPair struct {
-	timestamp int64
-	postId    int64
+func (s *Storage) GetSession(_ context.Context, key string) (Session, bool, error) {
+	return s.reader().GetSession(key)
 }
 
-// Less implements btree.Item.
-func (p PostTimestampPair) Less(than btree.Item) bool {
-	other, ok := than.(PostTimestampPair)
-	if !ok {
-		return false
+func (s *Storage) GetRevocation(_ context.Context, key string) (int64, bool, error) {
+	return s.reader().GetRevocation(key)
+}
+
+func (s *Storage) GetLoginFailures(_ context.Context, username string) (LoginFailures, bool, error) {
+	return s.reader().GetLoginFailures(username)
+}
+
+func (s *Storage) PutPostTimeline(_ context.Context, userId int64, kind TimelineKind, postId int64, timestamp int64) error {
+	_, err := s.commit(StorageMutation{
+		Op:        OP_PUT_POST_TIMELINE,
+		IntKey:    userId,
+		IntVal:    postId,
+		Timestamp: timestamp,
+		Kind:      kind,
+		MaxLen:    s.Config().maxTimelineLen(kind),
+	})
+	return err
+}
+
+func (s *Storage) GetPostTimeline(_ context.Context, userId int64, kind TimelineKind, cursor TimelineEntry, direction TimelineDirection, start int, stop int) ([]TimelineEntry, error) {
+	return s.reader().GetPostTimeline(userId, kind, cursor, direction, start, stop)
+}
+
+func (s *Storage) RemovePostTimeline(_ context.Context, userId int64, kind TimelineKind, postId int64, timestamp int64) error {
+	_, err := s.commit(StorageMutation{Op: OP_REMOVE_POST_TIMELINE, IntKey: userId, IntVal: postId, Timestamp: timestamp, Kind: kind})
+	return err
+}
+
+func (s *Storage) PutPostTimelines(ctx context.Context, userIds []int64, kind TimelineKind, postId int64, timestamp int64) error {
+	for _, userId := range userIds {
+		if err := s.PutPostTimeline(ctx, userId, kind, postId, timestamp); err != nil {
+			return err
+		}
 	}
-	return p.timestamp < other.timestamp
-}
-
-func (s *Storage) PutPostTimeline(_ context.Context, userId int64, postId int64, timestamp int64) error {
-	s.useridToTimelineMap.ApplyWithDefault(
-		userId,
-		func(k int64, v *btree.BTree, args ...interface{}) {
-			timestamp := args[0].(int64)
-			postId := args[1].(int64)
-			v.ReplaceOrInsert(PostTimestampPair{timestamp, postId})
-		},
-		func(k int64) *btree.BTree {
-			return btree.New(2)
-		},
-		timestamp, postId,
-	)
 	return nil
 }
 
-func (s *Storage) GetPostTimeline(_ context.Context, userId int64, start int, stop int) ([]int64, error) {
-	return ApplyWithReturn(
-		s.useridToTimelineMap,
-		userId,
-		func(k int64, v *btree.BTree, args ...interface{}) []int64 {
-			start := args[0].(int)
-			stop := args[1].(int)
-			result := make([]int64, 0)
-			v.Ascend(func(item btree.Item) bool {
-				if start <= 0 {
-					result = append(result, item.(PostTimestampPair).postId)
-				}
-				start--
-				stop--
-				return stop > 0
-			})
-			return result
-		},
-		start, stop,
-	)
-}
-
-func (s *Storage) RemovePostTimeline(_ context.Context, userId int64, postId int64, timestamp int64) error {
-	s.useridToTimelineMap.Apply(
-		userId,
-		func(k int64, v *btree.BTree, args ...interface{}) {
-			timestamp := args[0].(int64)
-			postId := args[1].(int64)
-			v.Delete(PostTimestampPair{timestamp, postId})
-		},
-		timestamp, postId,
-	)
+func (s *Storage) RemovePostTimelines(ctx context.Context, userIds []int64, kind TimelineKind, postId int64, timestamp int64) error {
+	for _, userId := range userIds {
+		if err := s.RemovePostTimeline(ctx, userId, kind, postId, timestamp); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+func (s *Storage) GetReplicationStatus(context.Context) (ReplicationStatus, error) {
+	if s.replicator == nil {
+		return ReplicationStatus{Role: ROLE_STANDALONE}, nil
+	}
+	return s.replicator.clusterStatus()
+}
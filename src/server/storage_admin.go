@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// The admin calls of IStorage export and import the data of one routing
+// bucket, so that a whole deployment is covered by one call per bucket
+// whatever its number of replicas. Exports are not a point-in-time copy
+// across buckets; writes should be stopped while a backup is taken.
+// Sessions, revocations and login failures are not exported, so users log in
+// again after a restore.
+
+func (StorageRouter) ExportBucket(_ context.Context, bucket int) string {
+	return strconv.Itoa(bucket)
+}
+
+func (StorageRouter) ImportBucket(_ context.Context, bucket int, _ StorageDump) string {
+	return strconv.Itoa(bucket)
+}
+
+func (s *Storage) ExportBucket(_ context.Context, bucket int) (StorageDump, error) {
+	snap, err := s.bucketSnapshot(bucket)
+	if err != nil {
+		return StorageDump{}, err
+	}
+	return filterDump(StorageDump{
+		UserProfiles:  snap.UserProfiles,
+		Posts:         snap.Posts,
+		MediaData:     snap.MediaData,
+		ShortUrls:     snap.ShortUrls,
+		Followers:     snap.Followers,
+		Followees:     snap.Followees,
+		UserTimelines: snap.Timelines,
+		HomeTimelines: snap.HomeTimelines,
+		UserIds:       snap.UserIds,
+		Blocked:       snap.Blocked,
+		Blockers:      snap.Blockers,
+		Muted:         snap.Muted,
+		Muters:        snap.Muters,
+		Requested:     snap.Requested,
+		Requesters:    snap.Requesters,
+
+		PostExpiries:     snap.PostExpiries,
+		MediaExpiries:    snap.MediaExpiries,
+		ShortUrlExpiries: snap.ShortUrlExpiries,
+	}, bucket), nil
+}
+
+// ImportBucket adds the contents of dump on top of the current ones. Every
+// key of dump must belong to bucket. Timelines are trimmed to the configured
+// maximum length as they are loaded. Entries keep their expiry time, so
+// those that expired since the export are removed by the next sweep.
+func (s *Storage) ImportBucket(_ context.Context, bucket int, dump StorageDump) error {
+	if n := dumpSize(filterDump(dump, bucket)); n != dumpSize(dump) {
+		return fmt.Errorf("storage: %d keys of the dump do not belong to bucket %d", dumpSize(dump)-n, bucket)
+	}
+
+	mutations := make([]StorageMutation, 0, dumpSize(dump))
+	for username, profile := range dump.UserProfiles {
+		mutations = append(mutations, StorageMutation{Op: OP_PUT_USER_PROFILE, StrKey: username, Profile: profile})
+	}
+	for userId, username := range dump.UserIds {
+		mutations = append(mutations, StorageMutation{Op: OP_PUT_USER_ID, IntKey: userId, StrKey: username})
+	}
+	for postId, post := range dump.Posts {
+		mutations = append(mutations, StorageMutation{
+			Op:        OP_PUT_POST,
+			IntKey:    postId,
+			Post:      post,
+			ExpiresAt: dump.PostExpiries[postId],
+		})
+	}
+	for filename, data := range dump.MediaData {
+		mutations = append(mutations, StorageMutation{
+			Op:        OP_PUT_MEDIA_DATA,
+			StrKey:    filename,
+			StrVal:    data,
+			ExpiresAt: dump.MediaExpiries[filename],
+		})
+	}
+	for shortUrl, url := range dump.ShortUrls {
+		mutations = append(mutations, StorageMutation{
+			Op:        OP_PUT_SHORTEN_URL,
+			StrKey:    shortUrl,
+			StrVal:    url,
+			ExpiresAt: dump.ShortUrlExpiries[shortUrl],
+		})
+	}
+	for userId, followers := range dump.Followers {
+		for _, followerId := range followers {
+			mutations = append(mutations, StorageMutation{Op: OP_PUT_FOLLOWER, IntKey: userId, IntVal: followerId})
+		}
+	}
+	for userId, followees := range dump.Followees {
+		for _, followeeId := range followees {
+			mutations = append(mutations, StorageMutation{Op: OP_PUT_FOLLOWEE, IntKey: userId, IntVal: followeeId})
+		}
+	}
+	for kind := RelationKind(0); kind < RELATION_KIND_COUNT; kind++ {
+		for userId, ids := range *dump.relations(kind) {
+			for _, id := range ids {
+				mutations = append(mutations, relationMutation(true, kind, userId, id))
+			}
+		}
+	}
+	for _, kind := range []TimelineKind{USER_TIMELINE, HOME_TIMELINE} {
+		timelines := dump.UserTimelines
+		if kind == HOME_TIMELINE {
+			timelines = dump.HomeTimelines
+		}
+		maxLen := s.Config().maxTimelineLen(kind)
+		for userId, entries := range timelines {
+			for _, entry := range entries {
+				mutations = append(mutations, StorageMutation{
+					Op:        OP_PUT_POST_TIMELINE,
+					IntKey:    userId,
+					IntVal:    entry.PostId,
+					Timestamp: entry.Timestamp,
+					Kind:      kind,
+					MaxLen:    maxLen,
+				})
+			}
+		}
+	}
+
+	for _, m := range mutations {
+		if _, err := s.commit(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot copies the current contents, from the primary if replication is
+// enabled.
+func (s *Storage) snapshot() (*storageSnapshot, error) {
+	if s.replicator == nil {
+		return s.backend.snapshot()
+	}
+	return s.replicator.snapshot()
+}
+
+// bucketSnapshot copies the current contents of a store that holds the
+// routing bucket, possibly among others.
+func (s *Storage) bucketSnapshot(bucket int) (*storageSnapshot, error) {
+	if s.buckets == nil {
+		return s.snapshot()
+	}
+	var snap *storageSnapshot
+	err := s.withBucket(bucket, func(backend storageBackend) error {
+		var err error
+		snap, err = backend.snapshot()
+		return err
+	})
+	return snap, err
+}
+
+// filterDump returns the part of dump whose keys belong to bucket.
+func filterDump(dump StorageDump, bucket int) StorageDump {
+	inBucket := strconv.Itoa(bucket)
+	intKey := func(key int64) bool { return intRoutingKey(key) == inBucket }
+	stringKey := func(key string) bool { return stringRoutingKey(key) == inBucket }
+	return StorageDump{
+		UserProfiles:  filterMap(dump.UserProfiles, stringKey),
+		Posts:         filterMap(dump.Posts, intKey),
+		MediaData:     filterMap(dump.MediaData, stringKey),
+		ShortUrls:     filterMap(dump.ShortUrls, stringKey),
+		Followers:     filterMap(dump.Followers, intKey),
+		Followees:     filterMap(dump.Followees, intKey),
+		UserTimelines: filterMap(dump.UserTimelines, intKey),
+		HomeTimelines: filterMap(dump.HomeTimelines, intKey),
+		UserIds:       filterMap(dump.UserIds, intKey),
+		Blocked:       filterMap(dump.Blocked, intKey),
+		Blockers:      filterMap(dump.Blockers, intKey),
+		Muted:         filterMap(dump.Muted, intKey),
+		Muters:        filterMap(dump.Muters, intKey),
+		Requested:     filterMap(dump.Requested, intKey),
+		Requesters:    filterMap(dump.Requesters, intKey),
+
+		PostExpiries:     filterMap(dump.PostExpiries, intKey),
+		MediaExpiries:    filterMap(dump.MediaExpiries, stringKey),
+		ShortUrlExpiries: filterMap(dump.ShortUrlExpiries, stringKey),
+	}
+}
+
+func filterMap[K comparable, V any](m map[K]V, keep func(K) bool) map[K]V {
+	filtered := make(map[K]V)
+	for k, v := range m {
+		if keep(k) {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+// mergeDump adds the contents of from to dump.
+func mergeDump(dump *StorageDump, from StorageDump) {
+	mergeMap(&dump.UserProfiles, from.UserProfiles)
+	mergeMap(&dump.Posts, from.Posts)
+	mergeMap(&dump.MediaData, from.MediaData)
+	mergeMap(&dump.ShortUrls, from.ShortUrls)
+	mergeMap(&dump.Followers, from.Followers)
+	mergeMap(&dump.Followees, from.Followees)
+	mergeMap(&dump.UserTimelines, from.UserTimelines)
+	mergeMap(&dump.HomeTimelines, from.HomeTimelines)
+	mergeMap(&dump.UserIds, from.UserIds)
+	mergeMap(&dump.Blocked, from.Blocked)
+	mergeMap(&dump.Blockers, from.Blockers)
+	mergeMap(&dump.Muted, from.Muted)
+	mergeMap(&dump.Muters, from.Muters)
+	mergeMap(&dump.Requested, from.Requested)
+	mergeMap(&dump.Requesters, from.Requesters)
+	mergeMap(&dump.PostExpiries, from.PostExpiries)
+	mergeMap(&dump.MediaExpiries, from.MediaExpiries)
+	mergeMap(&dump.ShortUrlExpiries, from.ShortUrlExpiries)
+}
+
+func mergeMap[K comparable, V any](m *map[K]V, from map[K]V) {
+	if *m == nil {
+		*m = make(map[K]V, len(from))
+	}
+	for k, v := range from {
+		(*m)[k] = v
+	}
+}
+
+// dumpSize returns the number of keys of dump. The expiries are attributes of
+// keys counted elsewhere.
+func dumpSize(dump StorageDump) int {
+	return len(dump.UserProfiles) + len(dump.Posts) + len(dump.MediaData) + len(dump.ShortUrls) +
+		len(dump.Followers) + len(dump.Followees) + len(dump.UserTimelines) + len(dump.HomeTimelines) +
+		len(dump.UserIds) + len(dump.Blocked) + len(dump.Blockers) + len(dump.Muted) + len(dump.Muters) +
+		len(dump.Requested) + len(dump.Requesters)
+}
+
+// relations returns the field of dump holding the edges of the kind.
+func (dump *StorageDump) relations(kind RelationKind) *map[int64][]int64 {
+	return [...]*map[int64][]int64{
+		&dump.Blocked, &dump.Blockers, &dump.Muted, &dump.Muters, &dump.Requested, &dump.Requesters,
+	}[kind]
+}
+
+// forEachRoutingBucket calls f concurrently for every routing bucket and
+// returns the first error.
+func forEachRoutingBucket(f func(int) error) error {
+	buckets := make([]int, STORAGE_ROUTING_BUCKETS)
+	for i := range buckets {
+		buckets[i] = i
+	}
+	return forEachBucket(buckets, strconv.Itoa, func(batch []int) error {
+		return f(batch[0])
+	})
+}
+
+func exportStorage(ctx context.Context, storage IStorage) (StorageDump, error) {
+	var mu sync.Mutex
+	var dump StorageDump
+	err := forEachRoutingBucket(func(bucket int) error {
+		part, err := storage.ExportBucket(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		mergeDump(&dump, part)
+		return nil
+	})
+	return dump, err
+}
+
+func importStorage(ctx context.Context, storage IStorage, dump StorageDump) error {
+	if dump.UserIds == nil {
+		dump.UserIds = make(map[int64]string, len(dump.UserProfiles))
+		for username, profile := range dump.UserProfiles {
+			dump.UserIds[profile.UserId] = username
+		}
+	}
+	return forEachRoutingBucket(func(bucket int) error {
+		part := filterDump(dump, bucket)
+		if dumpSize(part) == 0 {
+			return nil
+		}
+		return storage.ImportBucket(ctx, bucket, part)
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// The batch calls of IStorage are routed on the bucket of their first key,
+// so callers split their keys by bucket with the helpers below and issue one
+// call per bucket concurrently. A batch costs at most STORAGE_ROUTING_BUCKETS
+// calls however many keys it has.
+
+// forEachBucket calls f concurrently with the keys of every routing bucket and
+// returns the first error.
+func forEachBucket[K comparable](keys []K, routingKey func(K) string, f func([]K) error) error {
+	buckets := make(map[string][]K)
+	for _, key := range keys {
+		bucket := routingKey(key)
+		buckets[bucket] = append(buckets[bucket], key)
+	}
+	errs := make(chan error, len(buckets))
+	for _, batch := range buckets {
+		go func(batch []K) {
+			errs <- f(batch)
+		}(batch)
+	}
+	var first error
+	for range buckets {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func getPostsBatched(ctx context.Context, storage IStorage, postIds []int64) (map[int64]Post, error) {
+	var mu sync.Mutex
+	posts := make(map[int64]Post, len(postIds))
+	err := forEachBucket(postIds, intRoutingKey, func(batch []int64) error {
+		found, err := storage.GetPosts(ctx, batch)
+		mu.Lock()
+		defer mu.Unlock()
+		for postId, post := range found {
+			posts[postId] = post
+		}
+		return err
+	})
+	return posts, err
+}
+
+func getUserProfilesBatched(ctx context.Context, storage IStorage, usernames []string) (map[string]UserProfile, error) {
+	var mu sync.Mutex
+	profiles := make(map[string]UserProfile, len(usernames))
+	err := forEachBucket(usernames, stringRoutingKey, func(batch []string) error {
+		found, err := storage.GetUserProfiles(ctx, batch)
+		mu.Lock()
+		defer mu.Unlock()
+		for username, profile := range found {
+			profiles[username] = profile
+		}
+		return err
+	})
+	return profiles, err
+}
+
+func getUsernamesBatched(ctx context.Context, storage IStorage, userIds []int64) (map[int64]string, error) {
+	var mu sync.Mutex
+	usernames := make(map[int64]string, len(userIds))
+	err := forEachBucket(userIds, intRoutingKey, func(batch []int64) error {
+		found, err := storage.GetUsernames(ctx, batch)
+		mu.Lock()
+		defer mu.Unlock()
+		for userId, username := range found {
+			usernames[userId] = username
+		}
+		return err
+	})
+	return usernames, err
+}
+
+func putPostTimelinesBatched(ctx context.Context, storage IStorage, userIds []int64, kind TimelineKind, postId int64, timestamp int64) error {
+	return forEachBucket(userIds, intRoutingKey, func(batch []int64) error {
+		return storage.PutPostTimelines(ctx, batch, kind, postId, timestamp)
+	})
+}
+
+func removePostTimelinesBatched(ctx context.Context, storage IStorage, userIds []int64, kind TimelineKind, postId int64, timestamp int64) error {
+	return forEachBucket(userIds, intRoutingKey, func(batch []int64) error {
+		return storage.RemovePostTimelines(ctx, batch, kind, postId, timestamp)
+	})
+}
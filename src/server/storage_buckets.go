@@ -0,0 +1,585 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Bucket directories.
+//
+// Without replication, the data of each routing bucket is persisted in its
+// own bucket-<n> subdirectory of data_dir, whichever replica it is routed
+// to. A replica opens a bucket on its first call and holds the lock of its
+// directory until it releases the bucket or shuts down, so data follows the
+// bucket when the replicas restart or weaver moves it to another replica.
+//
+// A replica that is routed a bucket held by another running replica marks
+// the bucket as wanted and waits up to BUCKET_LOCK_WAIT for its lock. The
+// holder releases a wanted bucket once no call has used it for
+// BUCKET_RELEASE_IDLE, which happens once weaver stops routing the bucket to
+// it. Calls that time out fail rather than read or write an empty bucket.
+//
+// The replica-<n> directories that replication persists into are never read
+// here, even when they share the data_dir.
+
+const (
+	BUCKET_DIR_PREFIX  = "bucket-"
+	BUCKET_WANTED_FILE = "WANTED"
+
+	BUCKET_LOCK_WAIT     = 10 * time.Second
+	BUCKET_LOCK_POLL     = 100 * time.Millisecond
+	BUCKET_RELEASE_IDLE  = time.Second
+	BUCKET_RELEASE_CHECK = time.Second
+)
+
+// bucketStore holds the data of one routing bucket while the replica holds
+// the lock of its directory.
+type bucketStore struct {
+	// mu is held for reading by every call on the store, and for writing
+	// while it is opened or released.
+	mu sync.RWMutex
+	// backend is nil while the replica does not hold the bucket.
+	backend storageBackend
+	// wal is nil unless the memory backend is used.
+	wal    *WriteAheadLog
+	lock   *os.File
+	opened time.Time
+	// lastUsed is in unix nanoseconds.
+	lastUsed atomic.Int64
+}
+
+// commit logs the commit if the memory backend is used and applies it.
+func (st *bucketStore) commit(c storageCommit) (bool, error) {
+	if st.wal == nil {
+		return c.applyTo(st.backend)
+	}
+	return st.wal.Commit(c)
+}
+
+// merge adds the entries of part to the store.
+func (st *bucketStore) merge(part *storageSnapshot) error {
+	snap, err := st.backend.snapshot()
+	if err != nil {
+		return err
+	}
+	mergeSnapshot(snap, part)
+	return st.restore(snap)
+}
+
+// restore replaces the contents of the store and, with the memory backend,
+// snapshots them so that the log does not replay on top of the old ones.
+func (st *bucketStore) restore(snap *storageSnapshot) error {
+	if err := st.backend.restore(snap); err != nil {
+		return err
+	}
+	if st.wal == nil {
+		return nil
+	}
+	return st.wal.Snapshot()
+}
+
+// close releases the bucket. The caller holds mu for writing.
+func (st *bucketStore) close() error {
+	defer st.lock.Close()
+	var err error
+	if st.wal != nil {
+		// Snapshot so that the next holder does not replay the whole log.
+		if err = st.wal.Snapshot(); err == nil {
+			err = st.wal.Close()
+		}
+	}
+	if closeErr := st.backend.Close(); err == nil {
+		err = closeErr
+	}
+	st.backend, st.wal, st.lock = nil, nil, nil
+	return err
+}
+
+// bucketBackend is the storageBackend of a replica that persists its data
+// in bucket directories. Its snapshot, stats and expired cover the buckets
+// the replica holds; restore opens every bucket.
+type bucketBackend struct {
+	cfg    *storageConfig
+	stores [STORAGE_ROUTING_BUCKETS]bucketStore
+	// opens counts the times each bucket was opened; see syncChangeFeed.
+	opens [STORAGE_ROUTING_BUCKETS]atomic.Uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func openBucketBackend(cfg *storageConfig) (*bucketBackend, error) {
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		return nil, err
+	}
+	b := &bucketBackend{cfg: cfg, done: make(chan struct{})}
+	b.wg.Add(1)
+	go b.releaseLoop()
+	return b, nil
+}
+
+func (b *bucketBackend) dir(bucket int) string {
+	return filepath.Join(b.cfg.DataDir, fmt.Sprintf("%s%d", BUCKET_DIR_PREFIX, bucket))
+}
+
+// with calls f with the store of the bucket, opening it first if needed.
+func (b *bucketBackend) with(bucket int, f func(*bucketStore) error) error {
+	if bucket < 0 || bucket >= STORAGE_ROUTING_BUCKETS {
+		return fmt.Errorf("storage: no routing bucket %d", bucket)
+	}
+	st := &b.stores[bucket]
+	for {
+		st.mu.RLock()
+		if st.backend != nil {
+			defer st.mu.RUnlock()
+			st.lastUsed.Store(time.Now().UnixNano())
+			return f(st)
+		}
+		st.mu.RUnlock()
+		if err := b.open(bucket); err != nil {
+			return err
+		}
+	}
+}
+
+// forEachOpen calls f with the store of every bucket the replica holds.
+func (b *bucketBackend) forEachOpen(f func(*bucketStore) error) error {
+	for bucket := range b.stores {
+		st := &b.stores[bucket]
+		st.mu.RLock()
+		var err error
+		if st.backend != nil {
+			err = f(st)
+		}
+		st.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open locks the directory of the bucket, waiting for the replica that holds
+// it to release it, and loads its data.
+func (b *bucketBackend) open(bucket int) error {
+	st := &b.stores[bucket]
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.backend != nil {
+		return nil
+	}
+
+	dir := b.dir(bucket)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	lock, err := lockDir(dir)
+	for deadline := time.Now().Add(BUCKET_LOCK_WAIT); errors.Is(err, syscall.EWOULDBLOCK); lock, err = lockDir(dir) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("storage: routing bucket %d is held by another replica", bucket)
+		}
+		if err := markWanted(dir); err != nil {
+			return err
+		}
+		time.Sleep(BUCKET_LOCK_POLL)
+	}
+	if err != nil {
+		return err
+	}
+
+	backend, wal, err := openLocalBackend(b.cfg, dir)
+	if err != nil {
+		lock.Close()
+		return fmt.Errorf("storage: cannot open routing bucket %d: %w", bucket, err)
+	}
+	st.backend, st.wal, st.lock = backend, wal, lock
+	st.opened = time.Now()
+	st.lastUsed.Store(st.opened.UnixNano())
+	b.opens[bucket].Add(1)
+	return nil
+}
+
+// markWanted tells the replica holding the bucket in dir to release it.
+func markWanted(dir string) error {
+	path := filepath.Join(dir, BUCKET_WANTED_FILE)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// releaseLoop releases the wanted buckets until done is closed.
+func (b *bucketBackend) releaseLoop() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(BUCKET_RELEASE_CHECK)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+		for bucket := range b.stores {
+			if err := b.releaseIfWanted(bucket); err != nil {
+				fmt.Printf("[Storage] cannot release routing bucket %d: %v\n", bucket, err)
+			}
+		}
+	}
+}
+
+// releaseIfWanted releases the bucket if another replica marked it as wanted
+// since it was opened and no call used it for BUCKET_RELEASE_IDLE.
+func (b *bucketBackend) releaseIfWanted(bucket int) error {
+	st := &b.stores[bucket]
+	st.mu.RLock()
+	held, opened := st.backend != nil, st.opened
+	st.mu.RUnlock()
+	if !held {
+		return nil
+	}
+	info, err := os.Stat(filepath.Join(b.dir(bucket), BUCKET_WANTED_FILE))
+	if err != nil || !info.ModTime().After(opened) {
+		return nil
+	}
+	if time.Since(time.Unix(0, st.lastUsed.Load())) < BUCKET_RELEASE_IDLE {
+		return nil
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.backend == nil || st.opened != opened {
+		return nil
+	}
+	if err := st.close(); err != nil {
+		return err
+	}
+	fmt.Printf("[Storage] released routing bucket %d to another replica\n", bucket)
+	return nil
+}
+
+func (b *bucketBackend) GetUserProfile(key string) (v UserProfile, ok bool, err error) {
+	err = b.with(stringRoutingBucket(key), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetUserProfile(key)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetBucketProfiles(bucket int) (v []UserInfo, err error) {
+	err = b.with(bucket, func(st *bucketStore) error {
+		v, err = st.backend.GetBucketProfiles(bucket)
+		return err
+	})
+	return v, err
+}
+
+func (b *bucketBackend) GetUsername(key int64) (v string, ok bool, err error) {
+	err = b.with(intRoutingBucket(key), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetUsername(key)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetPost(key int64) (v Post, ok bool, err error) {
+	err = b.with(intRoutingBucket(key), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetPost(key)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetMediaData(key string) (v string, ok bool, err error) {
+	err = b.with(stringRoutingBucket(key), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetMediaData(key)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetShortenUrl(key string) (v string, ok bool, err error) {
+	err = b.with(stringRoutingBucket(key), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetShortenUrl(key)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetSession(key string) (v Session, ok bool, err error) {
+	err = b.with(stringRoutingBucket(key), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetSession(key)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetRevocation(key string) (v int64, ok bool, err error) {
+	err = b.with(stringRoutingBucket(key), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetRevocation(key)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetLoginFailures(key string) (v LoginFailures, ok bool, err error) {
+	err = b.with(stringRoutingBucket(key), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetLoginFailures(key)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetFollowers(userId int64) (v map[int64]bool, ok bool, err error) {
+	err = b.with(intRoutingBucket(userId), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetFollowers(userId)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetFollowees(userId int64) (v map[int64]bool, ok bool, err error) {
+	err = b.with(intRoutingBucket(userId), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetFollowees(userId)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetFollowCounts(userId int64) (followers int, followees int, err error) {
+	err = b.with(intRoutingBucket(userId), func(st *bucketStore) error {
+		followers, followees, err = st.backend.GetFollowCounts(userId)
+		return err
+	})
+	return followers, followees, err
+}
+
+func (b *bucketBackend) GetFollowersPage(userId int64, after int64, limit int) (v []int64, err error) {
+	err = b.with(intRoutingBucket(userId), func(st *bucketStore) error {
+		v, err = st.backend.GetFollowersPage(userId, after, limit)
+		return err
+	})
+	return v, err
+}
+
+func (b *bucketBackend) GetFolloweesPage(userId int64, after int64, limit int) (v []int64, err error) {
+	err = b.with(intRoutingBucket(userId), func(st *bucketStore) error {
+		v, err = st.backend.GetFolloweesPage(userId, after, limit)
+		return err
+	})
+	return v, err
+}
+
+func (b *bucketBackend) HasFollowee(userId int64, followeeId int64) (v bool, err error) {
+	err = b.with(intRoutingBucket(userId), func(st *bucketStore) error {
+		v, err = st.backend.HasFollowee(userId, followeeId)
+		return err
+	})
+	return v, err
+}
+
+func (b *bucketBackend) GetRelations(userId int64, kind RelationKind) (v map[int64]bool, ok bool, err error) {
+	err = b.with(intRoutingBucket(userId), func(st *bucketStore) error {
+		v, ok, err = st.backend.GetRelations(userId, kind)
+		return err
+	})
+	return v, ok, err
+}
+
+func (b *bucketBackend) GetPostTimeline(userId int64, kind TimelineKind, cursor TimelineEntry, direction TimelineDirection, start int, stop int) (v []TimelineEntry, err error) {
+	err = b.with(intRoutingBucket(userId), func(st *bucketStore) error {
+		v, err = st.backend.GetPostTimeline(userId, kind, cursor, direction, start, stop)
+		return err
+	})
+	return v, err
+}
+
+func (b *bucketBackend) GetTxnIntents(bucket int) (v []StorageIntent, err error) {
+	err = b.with(bucket, func(st *bucketStore) error {
+		v, err = st.backend.GetTxnIntents(bucket)
+		return err
+	})
+	return v, err
+}
+
+func (b *bucketBackend) apply(m StorageMutation) (changed bool, err error) {
+	err = b.with(mutationBucket(m), func(st *bucketStore) error {
+		changed, err = st.commit(storageCommit{Mutation: m})
+		return err
+	})
+	return changed, err
+}
+
+func (b *bucketBackend) holds(p StoragePrecondition) (v bool, err error) {
+	err = b.with(p.bucket(), func(st *bucketStore) error {
+		v, err = st.backend.holds(p)
+		return err
+	})
+	return v, err
+}
+
+func (b *bucketBackend) applyTransaction(txn StorageTransaction) (changed bool, err error) {
+	err = b.with(txn.homeBucket(), func(st *bucketStore) error {
+		changed, err = st.commit(storageCommit{Txn: &txn})
+		return err
+	})
+	return changed, err
+}
+
+// position is unused, as replication keeps no bucket directories.
+func (b *bucketBackend) position() (replicationPosition, error) {
+	return replicationPosition{}, nil
+}
+
+func (b *bucketBackend) setPosition(replicationPosition) error {
+	return fmt.Errorf("storage: bucket directories are not replicated")
+}
+
+func (b *bucketBackend) snapshot() (*storageSnapshot, error) {
+	snap := &storageSnapshot{}
+	err := b.forEachOpen(func(st *bucketStore) error {
+		part, err := st.backend.snapshot()
+		if err != nil {
+			return err
+		}
+		mergeSnapshot(snap, part)
+		return nil
+	})
+	return snap, err
+}
+
+func (b *bucketBackend) restore(snap *storageSnapshot) error {
+	for bucket, part := range splitSnapshot(snap) {
+		if err := b.with(bucket, func(st *bucketStore) error { return st.restore(part) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bucketBackend) stats() ([]StorageMapStats, error) {
+	total := make([]StorageMapStats, STORAGE_MAP_COUNT)
+	for m := range total {
+		total[m].Map = storageMap(m).String()
+	}
+	err := b.forEachOpen(func(st *bucketStore) error {
+		stats, err := st.backend.stats()
+		for m, s := range stats {
+			total[m].Entries += s.Entries
+			total[m].Items += s.Items
+			total[m].Bytes += s.Bytes
+		}
+		return err
+	})
+	return total, err
+}
+
+func (b *bucketBackend) expired(now int64) (expiredEntries, error) {
+	all := expiredEntries{Posts: make(map[int64]Post)}
+	err := b.forEachOpen(func(st *bucketStore) error {
+		expired, err := st.backend.expired(now)
+		if err != nil {
+			return err
+		}
+		for postId, post := range expired.Posts {
+			all.Posts[postId] = post
+		}
+		all.Media = append(all.Media, expired.Media...)
+		all.ShortUrls = append(all.ShortUrls, expired.ShortUrls...)
+		all.Sessions = append(all.Sessions, expired.Sessions...)
+		all.Revocations = append(all.Revocations, expired.Revocations...)
+		all.LoginFailures = append(all.LoginFailures, expired.LoginFailures...)
+		return nil
+	})
+	return all, err
+}
+
+func (b *bucketBackend) Close() error {
+	close(b.done)
+	b.wg.Wait()
+	var err error
+	for bucket := range b.stores {
+		st := &b.stores[bucket]
+		st.mu.Lock()
+		if st.backend != nil {
+			if closeErr := st.close(); err == nil {
+				err = closeErr
+			}
+		}
+		st.mu.Unlock()
+	}
+	return err
+}
+
+// splitSnapshot returns the entries of snap of each routing bucket.
+func splitSnapshot(snap *storageSnapshot) [STORAGE_ROUTING_BUCKETS]*storageSnapshot {
+	var parts [STORAGE_ROUTING_BUCKETS]*storageSnapshot
+	for bucket := range parts {
+		parts[bucket] = &storageSnapshot{}
+	}
+	from := reflect.ValueOf(snap).Elem()
+	for i := 0; i < from.NumField(); i++ {
+		field := from.Field(i)
+		if field.Kind() != reflect.Map {
+			continue
+		}
+		for iter := field.MapRange(); iter.Next(); {
+			to := reflect.ValueOf(parts[snapshotEntryBucket(iter.Key(), iter.Value())]).Elem().Field(i)
+			if to.IsNil() {
+				to.Set(reflect.MakeMap(field.Type()))
+			}
+			to.SetMapIndex(iter.Key(), iter.Value())
+		}
+	}
+	return parts
+}
+
+// mergeSnapshot adds the entries of from to snap.
+func mergeSnapshot(snap *storageSnapshot, from *storageSnapshot) {
+	to, src := reflect.ValueOf(snap).Elem(), reflect.ValueOf(from).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Field(i)
+		if field.Kind() != reflect.Map || field.Len() == 0 {
+			continue
+		}
+		if to.Field(i).IsNil() {
+			to.Field(i).Set(reflect.MakeMap(field.Type()))
+		}
+		for iter := field.MapRange(); iter.Next(); {
+			to.Field(i).SetMapIndex(iter.Key(), iter.Value())
+		}
+	}
+}
+
+// snapshotLen returns the number of entries of snap.
+func snapshotLen(snap *storageSnapshot) int {
+	n := 0
+	v := reflect.ValueOf(snap).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.Map {
+			n += v.Field(i).Len()
+		}
+	}
+	return n
+}
+
+// snapshotEntryBucket returns the routing bucket of an entry of a snapshot
+// map: that of its key, or the home bucket of transaction intents.
+func snapshotEntryBucket(key, value reflect.Value) int {
+	if intent, ok := value.Interface().(StorageIntent); ok {
+		return intent.Bucket
+	}
+	if key.Kind() == reflect.String {
+		return stringRoutingBucket(key.String())
+	}
+	return intRoutingBucket(key.Int())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestStorage(t *testing.T, dataDir string) *Storage {
+	t.Helper()
+	s := &Storage{}
+	s.Config().DataDir = dataDir
+	s.Config().FsyncPolicy = FSYNC_ALWAYS
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func wantPost(t *testing.T, s *Storage, postId int64) {
+	t.Helper()
+	post, ok, err := s.GetPost(context.Background(), postId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || post.Post_id != postId {
+		t.Fatalf("post %d not found", postId)
+	}
+}
+
+// Data follows its bucket whichever replica opens the data_dir after a
+// restart.
+func TestBucketSurvivesReplicaRestart(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	a := openTestStorage(t, dataDir)
+	b := openTestStorage(t, dataDir)
+	if err := a.PutPost(ctx, 7, Post{Post_id: 7}, 0); err != nil {
+		t.Fatal(err)
+	}
+	a.Shutdown(ctx)
+	b.Shutdown(ctx)
+
+	// The replica that restarts first would have claimed the directory of a.
+	c := openTestStorage(t, dataDir)
+	defer c.Shutdown(ctx)
+	wantPost(t, c, 7)
+}
+
+// A bucket moved to another running replica is released to it.
+func TestBucketMovesToRunningReplica(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	a := openTestStorage(t, dataDir)
+	defer a.Shutdown(ctx)
+	b := openTestStorage(t, dataDir)
+	defer b.Shutdown(ctx)
+	if err := a.PutPost(ctx, 7, Post{Post_id: 7}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	wantPost(t, b, 7)
+	if err := b.PutPost(ctx, 8, Post{Post_id: 8}, 0); err != nil {
+		t.Fatal(err)
+	}
+	st := &a.buckets.stores[intRoutingBucket(7)]
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.backend != nil {
+		t.Fatal("the bucket is still held by the replica it moved from")
+	}
+}
+
+// Without replication, the replica-<n> directories that replication left in
+// the data_dir are not read.
+func TestReplicaDirIsIgnored(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	replicaDir := filepath.Join(dataDir, REPLICA_DIR_PREFIX+"0")
+	w, _ := openTestWal(t, replicaDir)
+	putPost(t, w, 7)
+	w.Close()
+
+	s := openTestStorage(t, dataDir)
+	defer s.Shutdown(ctx)
+	if _, ok, err := s.GetPost(ctx, 7); err != nil || ok {
+		t.Fatalf("GetPost(7) = %v, %v; want the post of the replica directory not to be read", ok, err)
+	}
+	entries, err := os.ReadDir(replicaDir)
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("the replica directory was changed: %v, %d entries", err, len(entries))
+	}
+}
+
+func TestSplitSnapshot(t *testing.T) {
+	snap := &storageSnapshot{
+		Posts:        map[int64]Post{1: {Post_id: 1}, 2: {Post_id: 2}},
+		UserProfiles: map[string]UserProfile{"alice": {}},
+		Intents:      map[string]StorageIntent{"txn": {Id: "txn", Bucket: 5}},
+	}
+	parts := splitSnapshot(snap)
+	total := 0
+	for bucket, part := range parts {
+		total += snapshotLen(part)
+		for postId := range part.Posts {
+			if intRoutingBucket(postId) != bucket {
+				t.Errorf("post %d split into bucket %d", postId, bucket)
+			}
+		}
+		for username := range part.UserProfiles {
+			if stringRoutingBucket(username) != bucket {
+				t.Errorf("profile %q split into bucket %d", username, bucket)
+			}
+		}
+	}
+	if total != snapshotLen(snap) {
+		t.Fatalf("split %d entries out of %d", total, snapshotLen(snap))
+	}
+	if _, ok := parts[5].Intents["txn"]; !ok {
+		t.Fatal("intent not split into its home bucket")
+	}
+
+	merged := &storageSnapshot{}
+	for _, part := range parts {
+		mergeSnapshot(merged, part)
+	}
+	if snapshotLen(merged) != snapshotLen(snap) {
+		t.Fatalf("merged %d entries out of %d", snapshotLen(merged), snapshotLen(snap))
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ServiceWeaver/weaver"
+	"github.com/ServiceWeaver/weaver/metrics"
+)
+
+// Change feeds.
+//
+// Every Storage replica publishes the changes it applies to the entries of
+// each routing bucket, in the order it applies them, to a change feed of the
+// bucket. A change carries the entry before and after it, as read from the
+// replica, so a mutation that leaves an entry as it was is not published.
+// Since expired entries are not read, entries that expire are published
+// neither when they expire nor when they are swept; timeline entries evicted
+// past the maximum length are not published either.
+//
+// Feeds are held in memory and retain the most recent change_feed_size
+// changes of each bucket. A subscriber reads a feed with ReadChanges and
+// resumes it from the sequence after the last change it handled. A feed gets
+// a new id whenever the replica that publishes it restarts, the bucket moves
+// to another replica, or changes could not be published. A subscriber that
+// gives an id other than the current one, or a sequence that is no longer
+// retained, fell behind and must reload the bucket, e.g. with ExportBucket,
+// before following the feed again from its last change.
+
+const (
+	DEFAULT_CHANGE_FEED_SIZE = 1000
+	CHANGE_FEED_READ_BATCH   = 1000
+	// CHANGE_FEED_POLL_WAIT is how long ReadChanges waits for a change when
+	// the subscriber is up to date.
+	CHANGE_FEED_POLL_WAIT = time.Second
+)
+
+// StorageValue is an entry of a Storage map. Exists is the only field of
+// follow edges and timeline entries.
+type StorageValue struct {
+	weaver.AutoMarshal
+	Exists  bool
+	Profile UserProfile
+	Post    Post
+	Session Session
+	// LoginFailures is the value of login failures.
+	LoginFailures LoginFailures
+	// Str is the data of media, the extended url of short urls and the
+	// username of user ids.
+	Str string
+	// Int is the revocation time of revocations.
+	Int int64
+}
+
+// StorageChange is one change of an entry. Entity is the name of the map of
+// the entry, as in StorageMapStats. Key is the username, filename, short url,
+// session id or revocation key of string keyed entries, the post or user id
+// of posts and user ids,
+// "<user id>/<other user id>" for follow edges and
+// "<user id>/<timestamp>/<post id>" for timeline entries.
+type StorageChange struct {
+	weaver.AutoMarshal
+	Seq uint64
+	// Time is in unix milliseconds.
+	Time   int64
+	Op     StorageOp
+	Entity string
+	Key    string
+	Before StorageValue
+	After  StorageValue
+}
+
+// StorageChanges is a part of the change feed of a routing bucket. First and
+// Last are the sequences of the oldest retained and of the newest changes;
+// the feed is empty when First > Last. FellBehind is set, and Changes empty,
+// when the requested changes cannot be returned; see above.
+type StorageChanges struct {
+	weaver.AutoMarshal
+	FeedId     string
+	First      uint64
+	Last       uint64
+	FellBehind bool
+	Changes    []StorageChange
+}
+
+var changeFeedFellBehind = metrics.NewCounter(
+	"sn_storage_change_feed_fell_behind",
+	"Number of change feed reads whose subscriber fell behind",
+)
+
+type changeFeed struct {
+	// mu is held from reading the entries before a commit until its changes
+	// are appended, so that changes are published in the order they are
+	// applied.
+	mu  sync.Mutex
+	id  string
+	seq uint64
+	log *ringLog[StorageChange]
+	// opens is the number of times the bucket was opened when the feed last
+	// checked; see syncChangeFeed.
+	opens uint64
+}
+
+func newChangeFeed(size int) *changeFeed {
+	return &changeFeed{id: newTxnId(), log: newRingLog[StorageChange](size, 0)}
+}
+
+// reset starts the feed over with a new id. The caller holds mu.
+func (f *changeFeed) reset() {
+	f.id = newTxnId()
+	f.seq = 0
+	f.log = newRingLog[StorageChange](len(f.log.buf), 0)
+}
+
+// changeFeed returns the feed of the routing bucket, creating it on first
+// use.
+func (s *Storage) changeFeed(bucket int) *changeFeed {
+	s.feedsMu.Lock()
+	defer s.feedsMu.Unlock()
+	if s.feeds[bucket] == nil {
+		size := s.Config().ChangeFeedSize
+		if size <= 0 {
+			size = DEFAULT_CHANGE_FEED_SIZE
+		}
+		s.feeds[bucket] = newChangeFeed(size)
+	}
+	return s.feeds[bucket]
+}
+
+// syncChangeFeed opens the bucket if its data is persisted in a bucket
+// directory, and resets its feed if the bucket was opened again since the
+// feed last checked, as the changes that other replicas made while they held
+// the bucket are missing from the feed. The caller holds feed.mu.
+func (s *Storage) syncChangeFeed(feed *changeFeed, bucket int) error {
+	if s.buckets == nil {
+		return nil
+	}
+	if err := s.buckets.with(bucket, func(*bucketStore) error { return nil }); err != nil {
+		return err
+	}
+	if opens := s.buckets.opens[bucket].Load(); opens != feed.opens {
+		feed.reset()
+		feed.opens = opens
+	}
+	return nil
+}
+
+// bucket returns the routing bucket that the commit changes. The keys of a
+// transaction all belong to one bucket.
+func (c storageCommit) bucket() int {
+	if c.Txn != nil {
+		return c.Txn.homeBucket()
+	}
+	return mutationBucket(c.Mutation)
+}
+
+// changedEntries returns the mutations of the commit that change an entry of
+// a map, one per entry.
+func (c storageCommit) changedEntries() []StorageMutation {
+	mutations := []StorageMutation{c.Mutation}
+	if c.Txn != nil {
+		mutations = c.Txn.Mutations
+	}
+	seen := make(map[string]bool)
+	entries := make([]StorageMutation, 0, len(mutations))
+	for _, m := range mutations {
+		sized, ok := mutationMap(m)
+		if !ok {
+			continue
+		}
+		item := storageItem(sized, m.StrKey, m.IntKey, m.IntVal)
+		if sized == MAP_USER_TIMELINES || sized == MAP_HOME_TIMELINES {
+			item = fmt.Sprintf("%s/%d", item, m.Timestamp)
+		}
+		if !seen[item] {
+			seen[item] = true
+			entries = append(entries, m)
+		}
+	}
+	return entries
+}
+
+func changeKey(sized storageMap, m StorageMutation) string {
+	switch sized {
+	case MAP_USER_PROFILES, MAP_MEDIA, MAP_SHORT_URLS, MAP_SESSIONS, MAP_REVOCATIONS, MAP_LOGIN_FAILURES:
+		return m.StrKey
+	case MAP_POSTS, MAP_USER_IDS:
+		return strconv.FormatInt(m.IntKey, 10)
+	case MAP_USER_TIMELINES, MAP_HOME_TIMELINES:
+		return fmt.Sprintf("%d/%d/%d", m.IntKey, m.Timestamp, m.IntVal)
+	}
+	return fmt.Sprintf("%d/%d", m.IntKey, m.IntVal)
+}
+
+// readEntry reads the entry that m changes from the local backend.
+func (s *Storage) readEntry(sized storageMap, m StorageMutation) (StorageValue, error) {
+	var v StorageValue
+	var err error
+	switch sized {
+	case MAP_USER_PROFILES:
+		v.Profile, v.Exists, err = s.backend.GetUserProfile(m.StrKey)
+	case MAP_POSTS:
+		v.Post, v.Exists, err = s.backend.GetPost(m.IntKey)
+	case MAP_MEDIA:
+		v.Str, v.Exists, err = s.backend.GetMediaData(m.StrKey)
+	case MAP_SHORT_URLS:
+		v.Str, v.Exists, err = s.backend.GetShortenUrl(m.StrKey)
+	case MAP_USER_IDS:
+		v.Str, v.Exists, err = s.backend.GetUsername(m.IntKey)
+	case MAP_SESSIONS:
+		v.Session, v.Exists, err = s.backend.GetSession(m.StrKey)
+	case MAP_REVOCATIONS:
+		v.Int, v.Exists, err = s.backend.GetRevocation(m.StrKey)
+	case MAP_LOGIN_FAILURES:
+		v.LoginFailures, v.Exists, err = s.backend.GetLoginFailures(m.StrKey)
+	default:
+		v.Exists, err = s.backend.holds(StoragePrecondition{
+			Cond:      COND_EXISTS,
+			Map:       sized,
+			IntKey:    m.IntKey,
+			IntVal:    m.IntVal,
+			Timestamp: m.Timestamp,
+		})
+	}
+	return v, err
+}
+
+func (s *Storage) readEntries(mutations []StorageMutation) ([]StorageValue, error) {
+	values := make([]StorageValue, len(mutations))
+	for i, m := range mutations {
+		sized, _ := mutationMap(m)
+		v, err := s.readEntry(sized, m)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// publishChanges applies the commit with apply and publishes the entries it
+// changed to the change feed of its bucket.
+func (s *Storage) publishChanges(c storageCommit, apply func() (bool, error)) (bool, error) {
+	feed := s.changeFeed(c.bucket())
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	if err := s.syncChangeFeed(feed, c.bucket()); err != nil {
+		return false, err
+	}
+
+	mutations := c.changedEntries()
+	before, err := s.readEntries(mutations)
+	if err != nil {
+		return false, err
+	}
+	changed, err := apply()
+	if err != nil {
+		return changed, err
+	}
+	after, err := s.readEntries(mutations)
+	if err != nil {
+		fmt.Printf("[Storage] cannot publish the changes of a %s commit, resetting the change feed of bucket %d: %v\n",
+			mutations[0].Op, c.bucket(), err)
+		feed.reset()
+		return changed, nil
+	}
+	now := nowMillis()
+	for i, m := range mutations {
+		if reflect.DeepEqual(before[i], after[i]) {
+			continue
+		}
+		sized, _ := mutationMap(m)
+		feed.seq++
+		feed.log.append(feed.seq, StorageChange{
+			Seq:    feed.seq,
+			Time:   now,
+			Op:     m.Op,
+			Entity: sized.String(),
+			Key:    changeKey(sized, m),
+			Before: before[i],
+			After:  after[i],
+		})
+	}
+	return changed, nil
+}
+
+func (StorageRouter) ReadChanges(_ context.Context, bucket int, _ string, _ uint64, _ int) string {
+	return strconv.Itoa(bucket)
+}
+
+func (s *Storage) ReadChanges(_ context.Context, bucket int, feedId string, from uint64, max int) (StorageChanges, error) {
+	if bucket < 0 || bucket >= STORAGE_ROUTING_BUCKETS {
+		return StorageChanges{}, fmt.Errorf("storage: no routing bucket %d", bucket)
+	}
+	if max <= 0 || max > CHANGE_FEED_READ_BATCH {
+		max = CHANGE_FEED_READ_BATCH
+	}
+	feed := s.changeFeed(bucket)
+	feed.mu.Lock()
+	err := s.syncChangeFeed(feed, bucket)
+	id, log := feed.id, feed.log
+	feed.mu.Unlock()
+	if err != nil {
+		return StorageChanges{}, err
+	}
+
+	changes := StorageChanges{FeedId: id}
+	first, _ := log.bounds()
+	if from == 0 {
+		from = first
+	}
+	if feedId != "" && feedId != id {
+		changes.FellBehind = true
+	} else if records, ok := log.read(from, max, CHANGE_FEED_POLL_WAIT); ok {
+		changes.Changes = records
+	} else {
+		changes.FellBehind = true
+	}
+	changes.First, changes.Last = log.bounds()
+	if changes.FellBehind {
+		changeFeedFellBehind.Add(1)
+	}
+	return changes, nil
+}
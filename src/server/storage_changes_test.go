@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type changeSummary struct {
+	Op     StorageOp
+	Entity string
+	Key    string
+	Before bool
+	After  bool
+}
+
+func summarizeChanges(changes []StorageChange) []changeSummary {
+	summaries := make([]changeSummary, 0, len(changes))
+	for _, c := range changes {
+		summaries = append(summaries, changeSummary{c.Op, c.Entity, c.Key, c.Before.Exists, c.After.Exists})
+	}
+	return summaries
+}
+
+// Changes are published in order, once per changed entry, and a subscriber
+// that falls behind the retained changes or follows another feed is told so.
+func TestChangeFeed(t *testing.T) {
+	ctx := context.Background()
+	configure := func(cfg *storageConfig) { cfg.ChangeFeedSize = 4 }
+	testEachBackend(t, configure, func(t *testing.T, s *Storage) {
+		const postId = 7
+		bucket := intRoutingBucket(postId)
+		if err := s.PutPost(ctx, postId, Post{Post_id: postId, Text: "first"}, 0); err != nil {
+			t.Fatal(err)
+		}
+		// Putting the same post again changes nothing.
+		if err := s.PutPost(ctx, postId, Post{Post_id: postId, Text: "first"}, 0); err != nil {
+			t.Fatal(err)
+		}
+		// The entries of a transaction are published once, as they are after
+		// the commit.
+		txn := StorageTransaction{Mutations: []StorageMutation{
+			{Op: OP_PUT_POST, IntKey: postId, Post: Post{Post_id: postId, Text: "second"}},
+			{Op: OP_PUT_POST, IntKey: postId, Post: Post{Post_id: postId, Text: "third"}},
+			{Op: OP_PUT_POST_TIMELINE, IntKey: postId, IntVal: postId, Timestamp: 100, Kind: USER_TIMELINE},
+		}}
+		if _, err := s.Transact(ctx, bucket, txn); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RemovePost(ctx, postId); err != nil {
+			t.Fatal(err)
+		}
+
+		changes, err := s.ReadChanges(ctx, bucket, "", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []changeSummary{
+			{OP_PUT_POST, "posts", "7", false, true},
+			{OP_PUT_POST, "posts", "7", true, true},
+			{OP_PUT_POST_TIMELINE, "user_timelines", "7/100/7", false, true},
+			{OP_REMOVE_POST, "posts", "7", true, false},
+		}
+		if got := summarizeChanges(changes.Changes); !reflect.DeepEqual(got, want) {
+			t.Fatalf("changes = %+v, want %+v", got, want)
+		}
+		if changes.First != 1 || changes.Last != 4 || changes.FellBehind {
+			t.Errorf("feed bounds = %d..%d, fell behind %v; want 1..4", changes.First, changes.Last, changes.FellBehind)
+		}
+		if got := changes.Changes[1]; got.Before.Post.Text != "first" || got.After.Post.Text != "third" {
+			t.Errorf("transaction changed the post from %q to %q, want first to third", got.Before.Post.Text, got.After.Post.Text)
+		}
+
+		// A subscriber that is up to date waits for the next change.
+		next := make(chan StorageChanges)
+		go func() {
+			changes, err := s.ReadChanges(ctx, bucket, changes.FeedId, 5, 0)
+			if err != nil {
+				t.Error(err)
+			}
+			next <- changes
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if err := s.PutPost(ctx, postId, Post{Post_id: postId, Text: "fourth"}, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-next; len(got.Changes) != 1 || got.Changes[0].Seq != 5 || got.Changes[0].After.Post.Text != "fourth" {
+			t.Errorf("waiting read = %+v, want the fourth post", got.Changes)
+		}
+
+		// The first change is no longer retained.
+		behind, err := s.ReadChanges(ctx, bucket, changes.FeedId, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !behind.FellBehind || len(behind.Changes) != 0 || behind.First != 2 {
+			t.Errorf("read of a dropped change = %+v, want fell behind from 2", behind)
+		}
+		other, err := s.ReadChanges(ctx, bucket, "another feed", 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !other.FellBehind || other.FeedId != changes.FeedId {
+			t.Errorf("read of another feed = %+v, want fell behind on %s", other, changes.FeedId)
+		}
+		if _, err := s.ReadChanges(ctx, STORAGE_ROUTING_BUCKETS, "", 0, 0); err == nil {
+			t.Error("ReadChanges accepted a bucket out of range")
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/ServiceWeaver/weaver/metrics"
+)
+
+// Posts, media and short urls may be put with a time to live. The mutation
+// logs the absolute expiry time, so that replays and replicas expire entries
+// at the same time. Expired entries are hidden from reads right away and are
+// removed when ExpiryService sweeps the routing buckets. Expired posts stay
+// until ExpiryService removes them in the transaction that removes their
+// timeline entries, so that a sweep that fails halfway finds them again.
+
+var storageExpiredEntries = metrics.NewCounterMap[storageMapLabels](
+	"sn_storage_expired_entries",
+	"Number of entries of each Storage map removed because their time to live ran out",
+)
+
+// expiredEntries lists the entries of a backend whose time to live ran out.
+type expiredEntries struct {
+	Posts     map[int64]Post
+	Media     []string
+	ShortUrls []string
+
+	Sessions      []string
+	Revocations   []string
+	LoginFailures []string
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
+
+// expiresAt returns the expiry time of an entry put now with the time to
+// live, or zero if it does not expire.
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return nowMillis() + ttl.Milliseconds()
+}
+
+func (StorageRouter) ExpireBucket(_ context.Context, bucket int) string {
+	return strconv.Itoa(bucket)
+}
+
+func (s *Storage) ExpireBucket(_ context.Context, bucket int) ([]Post, error) {
+	posts := make([]Post, 0)
+	var expired expiredEntries
+	err := s.withBucket(bucket, func(backend storageBackend) error {
+		var err error
+		expired, err = backend.expired(nowMillis())
+		return err
+	})
+	if err != nil {
+		return posts, err
+	}
+
+	inBucket := strconv.Itoa(bucket)
+	remove := func(sized storageMap, m StorageMutation) (bool, error) {
+		changed, err := s.commit(m)
+		if changed {
+			storageExpiredEntries.Get(storageMapLabels{Map: sized.String()}).Inc()
+		}
+		return changed, err
+	}
+	for postId, post := range expired.Posts {
+		if intRoutingKey(postId) == inBucket {
+			posts = append(posts, post)
+		}
+	}
+	for _, filename := range expired.Media {
+		if stringRoutingKey(filename) != inBucket {
+			continue
+		}
+		if _, err := remove(MAP_MEDIA, StorageMutation{Op: OP_REMOVE_MEDIA_DATA, StrKey: filename}); err != nil {
+			return posts, err
+		}
+	}
+	for _, shortUrl := range expired.ShortUrls {
+		if stringRoutingKey(shortUrl) != inBucket {
+			continue
+		}
+		if _, err := remove(MAP_SHORT_URLS, StorageMutation{Op: OP_REMOVE_SHORTEN_URL, StrKey: shortUrl}); err != nil {
+			return posts, err
+		}
+	}
+	for _, sessionId := range expired.Sessions {
+		if stringRoutingKey(sessionId) != inBucket {
+			continue
+		}
+		if _, err := remove(MAP_SESSIONS, StorageMutation{Op: OP_REMOVE_SESSION, StrKey: sessionId}); err != nil {
+			return posts, err
+		}
+	}
+	for _, key := range expired.Revocations {
+		if stringRoutingKey(key) != inBucket {
+			continue
+		}
+		if _, err := remove(MAP_REVOCATIONS, StorageMutation{Op: OP_REMOVE_REVOCATION, StrKey: key}); err != nil {
+			return posts, err
+		}
+	}
+	for _, username := range expired.LoginFailures {
+		if stringRoutingKey(username) != inBucket {
+			continue
+		}
+		if _, err := remove(MAP_LOGIN_FAILURES, StorageMutation{Op: OP_REMOVE_LOGIN_FAILURES, StrKey: username}); err != nil {
+			return posts, err
+		}
+	}
+	return posts, nil
+}
@@ -0,0 +1,916 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+// memoryStorage keeps all data in HashMaps. It can be made durable with a
+// WriteAheadLog.
+type memoryStorage struct {
+	filenameToMediaDataMap   *HashMap[string, string]
+	usernameToUserProfileMap *HashMap[string, UserProfile]
+	userIdToUsernameMap      *HashMap[int64, string]
+	postIdToPostMap          *HashMap[int64, Post]
+	shortToExtendedMap       *HashMap[string, string]
+	useridToFollowersMap     *HashMap[int64, *userSet]
+	useridToFolloweesMap     *HashMap[int64, *userSet]
+	sessionIdToSessionMap    *HashMap[string, Session]
+	revocationMap            *HashMap[string, int64]
+	loginFailuresMap         *HashMap[string, LoginFailures]
+	// relations holds the block, mute and follow request edges of each
+	// RelationKind.
+	relations [RELATION_KIND_COUNT]*HashMap[int64, *userSet]
+
+	useridToTimelineMap     *HashMap[int64, *btree.BTree]
+	useridToHomeTimelineMap *HashMap[int64, *btree.BTree]
+
+	// The expiries hold the expiry time of the entries put with a time to
+	// live.
+	postExpiries         *HashMap[int64, int64]
+	mediaExpiries        *HashMap[string, int64]
+	shortUrlExpiries     *HashMap[string, int64]
+	sessionExpiries      *HashMap[string, int64]
+	revocationExpiries   *HashMap[string, int64]
+	loginFailureExpiries *HashMap[string, int64]
+
+	// txnIntents holds the pending intents of cross-bucket transactions.
+	txnIntents *HashMap[string, StorageIntent]
+	// Mutations hold the lock of their routing bucket shared and
+	// transactions hold it exclusively.
+	bucketLocks [STORAGE_ROUTING_BUCKETS]sync.RWMutex
+
+	sizes storageSizes
+
+	posMu sync.Mutex
+	pos   replicationPosition
+}
+
+func newMemoryStorage() *memoryStorage {
+	s := &memoryStorage{
+		filenameToMediaDataMap:   NewHashMap[string, string](),
+		usernameToUserProfileMap: NewHashMap[string, UserProfile](),
+		userIdToUsernameMap:      NewHashMap[int64, string](),
+		postIdToPostMap:          NewHashMap[int64, Post](),
+		shortToExtendedMap:       NewHashMap[string, string](),
+		useridToFollowersMap:     NewHashMap[int64, *userSet](),
+		useridToFolloweesMap:     NewHashMap[int64, *userSet](),
+		sessionIdToSessionMap:    NewHashMap[string, Session](),
+		revocationMap:            NewHashMap[string, int64](),
+		loginFailuresMap:         NewHashMap[string, LoginFailures](),
+		useridToTimelineMap:      NewHashMap[int64, *btree.BTree](),
+		useridToHomeTimelineMap:  NewHashMap[int64, *btree.BTree](),
+		postExpiries:             NewHashMap[int64, int64](),
+		mediaExpiries:            NewHashMap[string, int64](),
+		shortUrlExpiries:         NewHashMap[string, int64](),
+		sessionExpiries:          NewHashMap[string, int64](),
+		revocationExpiries:       NewHashMap[string, int64](),
+		loginFailureExpiries:     NewHashMap[string, int64](),
+		txnIntents:               NewHashMap[string, StorageIntent](),
+	}
+	for kind := range s.relations {
+		s.relations[kind] = NewHashMap[int64, *userSet]()
+	}
+	return s
+}
+
+// userSet holds the followers, followees or related users of a user, sorted
+// so that they are listed in pages. It is only used under the lock of the
+// HashMap segment holding it.
+type userSet = btree.BTreeG[int64]
+
+// USER_SET_DEGREE is the btree degree of user sets.
+const USER_SET_DEGREE = 16
+
+func newUserSet() *userSet {
+	return btree.NewOrderedG[int64](USER_SET_DEGREE)
+}
+
+// userSetList returns the user ids of set in increasing order.
+func userSetList(set *userSet) []int64 {
+	ids := make([]int64, 0, set.Len())
+	set.Ascend(func(id int64) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+func isExpired[K comparable](expiries *HashMap[K, int64], key K) bool {
+	expiresAt, ok := expiries.Get(key)
+	return ok && expiresAt <= nowMillis()
+}
+
+func setExpiry[K comparable](expiries *HashMap[K, int64], key K, expiresAt int64) {
+	if expiresAt > 0 {
+		expiries.Put(key, expiresAt)
+	} else {
+		expiries.Delete(key)
+	}
+}
+
+// expiredKeys returns the keys that expired at or before now.
+func expiredKeys[K comparable](expiries *HashMap[K, int64], now int64) []K {
+	keys := make([]K, 0)
+	expiries.Range(func(key K, expiresAt int64) bool {
+		if expiresAt <= now {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+func (s *memoryStorage) timelines(kind TimelineKind) *HashMap[int64, *btree.BTree] {
+	if kind == HOME_TIMELINE {
+		return s.useridToHomeTimelineMap
+	}
+	return s.useridToTimelineMap
+}
+
+type PostTimestampPair struct {
+	timestamp int64
+	postId    int64
+}
+
+// Less implements btree.Item.
+func (p PostTimestampPair) Less(than btree.Item) bool {
+	other, ok := than.(PostTimestampPair)
+	if !ok {
+		return false
+	}
+	if p.timestamp != other.timestamp {
+		return p.timestamp < other.timestamp
+	}
+	return p.postId < other.postId
+}
+
+func (s *memoryStorage) GetUserProfile(key string) (UserProfile, bool, error) {
+	v, e := s.usernameToUserProfileMap.Get(key)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetBucketProfiles(bucket int) ([]UserInfo, error) {
+	users := make([]UserInfo, 0)
+	s.usernameToUserProfileMap.Range(func(username string, profile UserProfile) bool {
+		if stringRoutingBucket(username) == bucket {
+			users = append(users, userInfo(username, profile))
+		}
+		return true
+	})
+	return users, nil
+}
+
+func (s *memoryStorage) GetUsername(key int64) (string, bool, error) {
+	v, e := s.userIdToUsernameMap.Get(key)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetSession(key string) (Session, bool, error) {
+	if isExpired(s.sessionExpiries, key) {
+		return Session{}, false, nil
+	}
+	v, e := s.sessionIdToSessionMap.Get(key)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetRevocation(key string) (int64, bool, error) {
+	if isExpired(s.revocationExpiries, key) {
+		return 0, false, nil
+	}
+	v, e := s.revocationMap.Get(key)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetLoginFailures(key string) (LoginFailures, bool, error) {
+	if isExpired(s.loginFailureExpiries, key) {
+		return LoginFailures{}, false, nil
+	}
+	v, e := s.loginFailuresMap.Get(key)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetPost(key int64) (Post, bool, error) {
+	if isExpired(s.postExpiries, key) {
+		return Post{}, false, nil
+	}
+	v, e := s.postIdToPostMap.Get(key)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetMediaData(key string) (string, bool, error) {
+	if isExpired(s.mediaExpiries, key) {
+		return "", false, nil
+	}
+	v, e := s.filenameToMediaDataMap.Get(key)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetShortenUrl(key string) (string, bool, error) {
+	if isExpired(s.shortUrlExpiries, key) {
+		return "", false, nil
+	}
+	v, e := s.shortToExtendedMap.Get(key)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetFollowers(userId int64) (map[int64]bool, bool, error) {
+	v, e := s.edges(s.useridToFollowersMap, userId)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetFollowees(userId int64) (map[int64]bool, bool, error) {
+	v, e := s.edges(s.useridToFolloweesMap, userId)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetRelations(userId int64, kind RelationKind) (map[int64]bool, bool, error) {
+	v, e := s.edges(s.relations[kind], userId)
+	return v, e, nil
+}
+
+func (s *memoryStorage) GetFollowCounts(userId int64) (int, int, error) {
+	return s.edgeCount(s.useridToFollowersMap, userId), s.edgeCount(s.useridToFolloweesMap, userId), nil
+}
+
+func (s *memoryStorage) GetFollowersPage(userId int64, after int64, limit int) ([]int64, error) {
+	return s.edgePage(s.useridToFollowersMap, userId, after, limit), nil
+}
+
+func (s *memoryStorage) GetFolloweesPage(userId int64, after int64, limit int) ([]int64, error) {
+	return s.edgePage(s.useridToFolloweesMap, userId, after, limit), nil
+}
+
+func (s *memoryStorage) HasFollowee(userId int64, followeeId int64) (bool, error) {
+	return s.hasEdge(s.useridToFolloweesMap, userId, followeeId), nil
+}
+
+// edges copies the set of userId in graph.
+func (s *memoryStorage) edges(graph *HashMap[int64, *userSet], userId int64) (map[int64]bool, bool) {
+	edges, err := ApplyWithReturn(graph, userId, func(k int64, v *userSet, args ...interface{}) map[int64]bool {
+		edges := make(map[int64]bool, v.Len())
+		v.Ascend(func(id int64) bool {
+			edges[id] = true
+			return true
+		})
+		return edges
+	})
+	return edges, err == nil
+}
+
+func (s *memoryStorage) edgeCount(graph *HashMap[int64, *userSet], userId int64) int {
+	count, _ := ApplyWithReturn(graph, userId, func(k int64, v *userSet, args ...interface{}) int {
+		return v.Len()
+	})
+	return count
+}
+
+// edgePage returns at most limit user ids of the set of userId in graph that
+// are greater than after, in increasing order.
+func (s *memoryStorage) edgePage(graph *HashMap[int64, *userSet], userId int64, after int64, limit int) []int64 {
+	page, _ := ApplyWithReturn(graph, userId, func(k int64, v *userSet, args ...interface{}) []int64 {
+		page := make([]int64, 0, min(limit, v.Len()))
+		v.AscendGreaterOrEqual(after, func(id int64) bool {
+			if id != after {
+				page = append(page, id)
+			}
+			return len(page) < limit
+		})
+		return page
+	})
+	if page == nil {
+		page = []int64{}
+	}
+	return page
+}
+
+func (s *memoryStorage) GetPostTimeline(userId int64, kind TimelineKind, cursor TimelineEntry, direction TimelineDirection, start int, stop int) ([]TimelineEntry, error) {
+	// A user without a timeline has an empty one, as with sqlite.
+	if _, exist := s.timelines(kind).Get(userId); !exist {
+		return []TimelineEntry{}, nil
+	}
+	return ApplyWithReturn(
+		s.timelines(kind),
+		userId,
+		func(k int64, v *btree.BTree, args ...interface{}) []TimelineEntry {
+			pivot := PostTimestampPair{cursor.Timestamp, cursor.PostId}
+			result := make([]TimelineEntry, 0)
+			// Entries are visited from the cursor outwards.
+			visit := func(item btree.Item) bool {
+				pair := item.(PostTimestampPair)
+				if pair == pivot {
+					return true
+				}
+				if start <= 0 {
+					result = append(result, TimelineEntry{Timestamp: pair.timestamp, PostId: pair.postId})
+				}
+				start--
+				stop--
+				return stop > 0
+			}
+			switch {
+			case stop <= start:
+			case direction == TIMELINE_NEWER && cursor.IsZero():
+				v.Ascend(visit)
+			case direction == TIMELINE_NEWER:
+				v.AscendGreaterOrEqual(pivot, visit)
+			case cursor.IsZero():
+				v.Descend(visit)
+			default:
+				v.DescendLessOrEqual(pivot, visit)
+			}
+			if direction == TIMELINE_NEWER {
+				reverseTimeline(result)
+			}
+			return result
+		},
+	)
+}
+
+func reverseTimeline(entries []TimelineEntry) {
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+}
+
+func (s *memoryStorage) GetTxnIntents(bucket int) ([]StorageIntent, error) {
+	intents := make([]StorageIntent, 0)
+	s.txnIntents.Range(func(_ string, intent StorageIntent) bool {
+		if intent.Bucket == bucket {
+			intents = append(intents, intent)
+		}
+		return true
+	})
+	return intents, nil
+}
+
+func (s *memoryStorage) hasEdge(graph *HashMap[int64, *userSet], userId int64, otherId int64) bool {
+	found, _ := ApplyWithReturn(graph, userId, func(k int64, v *userSet, args ...interface{}) bool {
+		return v.Has(otherId)
+	})
+	return found
+}
+
+func (s *memoryStorage) hasTimelineEntry(kind TimelineKind, userId int64, postId int64, timestamp int64) bool {
+	found, _ := ApplyWithReturn(
+		s.timelines(kind),
+		userId,
+		func(k int64, v *btree.BTree, args ...interface{}) bool {
+			return v.Has(PostTimestampPair{timestamp, postId})
+		},
+	)
+	return found
+}
+
+// holds reports whether the precondition holds.
+func (s *memoryStorage) holds(p StoragePrecondition) (bool, error) {
+	exists, equal := false, false
+	switch p.Map {
+	case MAP_USER_PROFILES:
+		var profile UserProfile
+		profile, exists, _ = s.GetUserProfile(p.StrKey)
+		equal = exists && profile == p.Profile
+	case MAP_POSTS:
+		_, exists, _ = s.GetPost(p.IntKey)
+	case MAP_SESSIONS:
+		var session Session
+		session, exists, _ = s.GetSession(p.StrKey)
+		equal = exists && session == p.Session
+	case MAP_REVOCATIONS:
+		_, exists, _ = s.GetRevocation(p.StrKey)
+	case MAP_LOGIN_FAILURES:
+		var failures LoginFailures
+		failures, exists, _ = s.GetLoginFailures(p.StrKey)
+		equal = exists && failures == p.LoginFailures
+	case MAP_USER_IDS:
+		var username string
+		username, exists, _ = s.GetUsername(p.IntKey)
+		equal = exists && username == p.StrVal
+	case MAP_MEDIA, MAP_SHORT_URLS:
+		get := s.GetMediaData
+		if p.Map == MAP_SHORT_URLS {
+			get = s.GetShortenUrl
+		}
+		var value string
+		value, exists, _ = get(p.StrKey)
+		equal = exists && value == p.StrVal
+	case MAP_FOLLOWERS:
+		exists = s.hasEdge(s.useridToFollowersMap, p.IntKey, p.IntVal)
+	case MAP_FOLLOWEES:
+		exists = s.hasEdge(s.useridToFolloweesMap, p.IntKey, p.IntVal)
+	case MAP_BLOCKED, MAP_BLOCKERS, MAP_MUTED, MAP_MUTERS, MAP_REQUESTED, MAP_REQUESTERS:
+		exists = s.hasEdge(s.relations[mapRelation(p.Map)], p.IntKey, p.IntVal)
+	case MAP_USER_TIMELINES:
+		exists = s.hasTimelineEntry(USER_TIMELINE, p.IntKey, p.IntVal, p.Timestamp)
+	case MAP_HOME_TIMELINES:
+		exists = s.hasTimelineEntry(HOME_TIMELINE, p.IntKey, p.IntVal, p.Timestamp)
+	}
+	switch p.Cond {
+	case COND_EXISTS:
+		return exists, nil
+	case COND_ABSENT:
+		return !exists, nil
+	case COND_EQUALS:
+		return equal, nil
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) applyTransaction(txn StorageTransaction) (bool, error) {
+	buckets := make(map[int]bool)
+	for _, p := range txn.Preconditions {
+		buckets[p.bucket()] = true
+	}
+	for _, m := range txn.Mutations {
+		buckets[mutationBucket(m)] = true
+	}
+	locked := make([]int, 0, len(buckets))
+	for bucket := range buckets {
+		locked = append(locked, bucket)
+	}
+	sort.Ints(locked)
+	for _, bucket := range locked {
+		s.bucketLocks[bucket].Lock()
+		defer s.bucketLocks[bucket].Unlock()
+	}
+
+	pending, _ := s.GetTxnIntents(txn.homeBucket())
+	if txn.conflicts(pending) {
+		return false, nil
+	}
+	for _, p := range txn.Preconditions {
+		if holds, _ := s.holds(p); !holds {
+			return false, nil
+		}
+	}
+	for _, m := range txn.Mutations {
+		if _, err := s.applyMutation(m); err != nil {
+			return false, err
+		}
+	}
+	if txn.Intent.Id != "" {
+		s.txnIntents.Put(txn.Intent.Id, txn.Intent)
+	}
+	return true, nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+// apply performs the mutation on the maps and updates their sizes. It
+// returns whether the mutation changed anything, which is only meaningful for
+// removals.
+func (s *memoryStorage) apply(m StorageMutation) (bool, error) {
+	lock := &s.bucketLocks[mutationBucket(m)]
+	lock.RLock()
+	defer lock.RUnlock()
+	return s.applyMutation(m)
+}
+
+// applyMutation is apply without the bucket lock.
+func (s *memoryStorage) applyMutation(m StorageMutation) (bool, error) {
+	switch m.Op {
+	case OP_PUT_USER_PROFILE:
+		old, loaded := s.usernameToUserProfileMap.Swap(m.StrKey, m.Profile)
+		s.sizes.add(MAP_USER_PROFILES, 1, 1, profileEntrySize(m.StrKey, m.Profile))
+		if loaded {
+			s.sizes.add(MAP_USER_PROFILES, -1, -1, -profileEntrySize(m.StrKey, old))
+		}
+	case OP_REMOVE_USER_PROFILE:
+		old, loaded := s.usernameToUserProfileMap.LoadAndDelete(m.StrKey)
+		if !loaded {
+			return false, nil
+		}
+		s.sizes.add(MAP_USER_PROFILES, -1, -1, -profileEntrySize(m.StrKey, old))
+	case OP_PUT_USER_ID:
+		old, loaded := s.userIdToUsernameMap.Swap(m.IntKey, m.StrKey)
+		s.sizes.add(MAP_USER_IDS, 1, 1, userIdEntrySize(m.StrKey))
+		if loaded {
+			s.sizes.add(MAP_USER_IDS, -1, -1, -userIdEntrySize(old))
+		}
+	case OP_REMOVE_USER_ID:
+		old, loaded := s.userIdToUsernameMap.LoadAndDelete(m.IntKey)
+		if !loaded {
+			return false, nil
+		}
+		s.sizes.add(MAP_USER_IDS, -1, -1, -userIdEntrySize(old))
+	case OP_PUT_POST:
+		setExpiry(s.postExpiries, m.IntKey, m.ExpiresAt)
+		old, loaded := s.postIdToPostMap.Swap(m.IntKey, m.Post)
+		s.sizes.add(MAP_POSTS, 1, 1, postEntrySize(m.Post))
+		if loaded {
+			s.sizes.add(MAP_POSTS, -1, -1, -postEntrySize(old))
+		}
+	case OP_REMOVE_POST:
+		s.postExpiries.Delete(m.IntKey)
+		old, loaded := s.postIdToPostMap.LoadAndDelete(m.IntKey)
+		if !loaded {
+			return false, nil
+		}
+		s.sizes.add(MAP_POSTS, -1, -1, -postEntrySize(old))
+	case OP_PUT_MEDIA_DATA:
+		setExpiry(s.mediaExpiries, m.StrKey, m.ExpiresAt)
+		s.putString(MAP_MEDIA, s.filenameToMediaDataMap, m.StrKey, m.StrVal)
+	case OP_REMOVE_MEDIA_DATA:
+		s.mediaExpiries.Delete(m.StrKey)
+		return s.removeString(MAP_MEDIA, s.filenameToMediaDataMap, m.StrKey), nil
+	case OP_PUT_SHORTEN_URL:
+		setExpiry(s.shortUrlExpiries, m.StrKey, m.ExpiresAt)
+		s.putString(MAP_SHORT_URLS, s.shortToExtendedMap, m.StrKey, m.StrVal)
+	case OP_REMOVE_SHORTEN_URL:
+		s.shortUrlExpiries.Delete(m.StrKey)
+		return s.removeString(MAP_SHORT_URLS, s.shortToExtendedMap, m.StrKey), nil
+	case OP_PUT_FOLLOWEE:
+		s.putEdge(MAP_FOLLOWEES, s.useridToFolloweesMap, m.IntKey, m.IntVal)
+	case OP_REMOVE_FOLLOWEE:
+		return s.removeEdge(MAP_FOLLOWEES, s.useridToFolloweesMap, m.IntKey, m.IntVal), nil
+	case OP_PUT_FOLLOWER:
+		s.putEdge(MAP_FOLLOWERS, s.useridToFollowersMap, m.IntKey, m.IntVal)
+	case OP_REMOVE_FOLLOWER:
+		return s.removeEdge(MAP_FOLLOWERS, s.useridToFollowersMap, m.IntKey, m.IntVal), nil
+	case OP_PUT_RELATION:
+		s.putEdge(relationMap(m.Relation), s.relations[m.Relation], m.IntKey, m.IntVal)
+	case OP_REMOVE_RELATION:
+		return s.removeEdge(relationMap(m.Relation), s.relations[m.Relation], m.IntKey, m.IntVal), nil
+	case OP_PUT_POST_TIMELINE:
+		added, trimmed := 0, 0
+		s.timelines(m.Kind).ApplyWithDefault(
+			m.IntKey,
+			func(k int64, v *btree.BTree, args ...interface{}) {
+				timestamp := args[0].(int64)
+				postId := args[1].(int64)
+				maxLen := args[2].(int)
+				if v.ReplaceOrInsert(PostTimestampPair{timestamp, postId}) == nil {
+					added++
+				}
+				for maxLen > 0 && v.Len() > maxLen {
+					v.DeleteMin()
+					trimmed++
+				}
+			},
+			func(k int64) *btree.BTree {
+				s.sizes.add(timelineMap(m.Kind), 1, 0, MAP_ENTRY_OVERHEAD+USER_SET_SIZE)
+				return btree.New(2)
+			},
+			m.Timestamp, m.IntVal, m.MaxLen,
+		)
+		s.sizes.add(timelineMap(m.Kind), 0, int64(added-trimmed), int64((added-trimmed)*TIMELINE_ENTRY_SIZE))
+		if trimmed > 0 {
+			timelineTrimmedEntries.Get(timelineLabels{Kind: m.Kind.String()}).Add(float64(trimmed))
+		}
+	case OP_REMOVE_POST_TIMELINE:
+		s.timelines(m.Kind).Apply(
+			m.IntKey,
+			func(k int64, v *btree.BTree, args ...interface{}) {
+				timestamp := args[0].(int64)
+				postId := args[1].(int64)
+				if v.Delete(PostTimestampPair{timestamp, postId}) != nil {
+					s.sizes.add(timelineMap(m.Kind), 0, -1, -TIMELINE_ENTRY_SIZE)
+				}
+			},
+			m.Timestamp, m.IntVal,
+		)
+	case OP_PUT_SESSION:
+		setExpiry(s.sessionExpiries, m.StrKey, m.ExpiresAt)
+		old, loaded := s.sessionIdToSessionMap.Swap(m.StrKey, m.Session)
+		s.sizes.add(MAP_SESSIONS, 1, 1, sessionEntrySize(m.StrKey, m.Session))
+		if loaded {
+			s.sizes.add(MAP_SESSIONS, -1, -1, -sessionEntrySize(m.StrKey, old))
+		}
+	case OP_REMOVE_SESSION:
+		s.sessionExpiries.Delete(m.StrKey)
+		old, loaded := s.sessionIdToSessionMap.LoadAndDelete(m.StrKey)
+		if !loaded {
+			return false, nil
+		}
+		s.sizes.add(MAP_SESSIONS, -1, -1, -sessionEntrySize(m.StrKey, old))
+	case OP_PUT_REVOCATION:
+		setExpiry(s.revocationExpiries, m.StrKey, m.ExpiresAt)
+		if _, loaded := s.revocationMap.Swap(m.StrKey, m.IntVal); !loaded {
+			s.sizes.add(MAP_REVOCATIONS, 1, 1, revocationEntrySize(m.StrKey))
+		}
+	case OP_REMOVE_REVOCATION:
+		s.revocationExpiries.Delete(m.StrKey)
+		if _, loaded := s.revocationMap.LoadAndDelete(m.StrKey); !loaded {
+			return false, nil
+		}
+		s.sizes.add(MAP_REVOCATIONS, -1, -1, -revocationEntrySize(m.StrKey))
+	case OP_PUT_LOGIN_FAILURES:
+		setExpiry(s.loginFailureExpiries, m.StrKey, m.ExpiresAt)
+		if _, loaded := s.loginFailuresMap.Swap(m.StrKey, m.LoginFailures); !loaded {
+			s.sizes.add(MAP_LOGIN_FAILURES, 1, 1, loginFailuresEntrySize(m.StrKey))
+		}
+	case OP_REMOVE_LOGIN_FAILURES:
+		s.loginFailureExpiries.Delete(m.StrKey)
+		if _, loaded := s.loginFailuresMap.LoadAndDelete(m.StrKey); !loaded {
+			return false, nil
+		}
+		s.sizes.add(MAP_LOGIN_FAILURES, -1, -1, -loginFailuresEntrySize(m.StrKey))
+	case OP_REMOVE_TXN_INTENT:
+		_, removed := s.txnIntents.LoadAndDelete(m.StrKey)
+		return removed, nil
+	default:
+		return false, fmt.Errorf("unknown storage op %d", m.Op)
+	}
+	return true, nil
+}
+
+func (s *memoryStorage) putString(sized storageMap, values *HashMap[string, string], key string, value string) {
+	old, loaded := values.Swap(key, value)
+	s.sizes.add(sized, 1, 1, stringEntrySize(key, value))
+	if loaded {
+		s.sizes.add(sized, -1, -1, -stringEntrySize(key, old))
+	}
+}
+
+func (s *memoryStorage) removeString(sized storageMap, values *HashMap[string, string], key string) bool {
+	old, loaded := values.LoadAndDelete(key)
+	if loaded {
+		s.sizes.add(sized, -1, -1, -stringEntrySize(key, old))
+	}
+	return loaded
+}
+
+// putEdge adds otherId to a follower, followee or relation set of userId.
+func (s *memoryStorage) putEdge(sized storageMap, graph *HashMap[int64, *userSet], userId int64, otherId int64) {
+	graph.ApplyWithDefault(
+		userId,
+		func(k int64, v *userSet, args ...interface{}) {
+			if _, loaded := v.ReplaceOrInsert(args[0].(int64)); !loaded {
+				s.sizes.add(sized, 0, 1, EDGE_SIZE)
+			}
+		},
+		func(k int64) *userSet {
+			s.sizes.add(sized, 1, 0, MAP_ENTRY_OVERHEAD+USER_SET_SIZE)
+			return newUserSet()
+		},
+		otherId,
+	)
+}
+
+// removeEdge removes otherId from a follower, followee or relation set of
+// userId and reports whether it was there.
+func (s *memoryStorage) removeEdge(sized storageMap, graph *HashMap[int64, *userSet], userId int64, otherId int64) bool {
+	removed, _ := ApplyWithReturn(
+		graph,
+		userId,
+		func(k int64, v *userSet, args ...interface{}) bool {
+			_, loaded := v.Delete(args[0].(int64))
+			return loaded
+		},
+		otherId,
+	)
+	if removed {
+		s.sizes.add(sized, 0, -1, -EDGE_SIZE)
+	}
+	return removed
+}
+
+// snapshot copies all maps. Callers make sure that no mutation runs
+// concurrently.
+func (s *memoryStorage) snapshot() (*storageSnapshot, error) {
+	pos, _ := s.position()
+	snap := &storageSnapshot{
+		Position:      pos,
+		MediaData:     s.filenameToMediaDataMap.Clone(),
+		UserProfiles:  s.usernameToUserProfileMap.Clone(),
+		Posts:         s.postIdToPostMap.Clone(),
+		ShortUrls:     s.shortToExtendedMap.Clone(),
+		Followers:     make(map[int64][]int64),
+		Followees:     make(map[int64][]int64),
+		Timelines:     snapshotTimelines(s.useridToTimelineMap),
+		HomeTimelines: snapshotTimelines(s.useridToHomeTimelineMap),
+
+		PostExpiries:     s.postExpiries.Clone(),
+		MediaExpiries:    s.mediaExpiries.Clone(),
+		ShortUrlExpiries: s.shortUrlExpiries.Clone(),
+		Intents:          s.txnIntents.Clone(),
+		UserIds:          s.userIdToUsernameMap.Clone(),
+
+		Sessions:           s.sessionIdToSessionMap.Clone(),
+		SessionExpiries:    s.sessionExpiries.Clone(),
+		Revocations:        s.revocationMap.Clone(),
+		RevocationExpiries: s.revocationExpiries.Clone(),
+
+		LoginFailures:        s.loginFailuresMap.Clone(),
+		LoginFailureExpiries: s.loginFailureExpiries.Clone(),
+	}
+	s.useridToFollowersMap.Range(func(userId int64, followers *userSet) bool {
+		snap.Followers[userId] = userSetList(followers)
+		return true
+	})
+	s.useridToFolloweesMap.Range(func(userId int64, followees *userSet) bool {
+		snap.Followees[userId] = userSetList(followees)
+		return true
+	})
+	for kind, graph := range s.relations {
+		edges := make(map[int64][]int64)
+		graph.Range(func(userId int64, ids *userSet) bool {
+			edges[userId] = userSetList(ids)
+			return true
+		})
+		*snap.relations(RelationKind(kind)) = edges
+	}
+	return snap, nil
+}
+
+func snapshotTimelines(timelines *HashMap[int64, *btree.BTree]) map[int64][]TimelineEntry {
+	snap := make(map[int64][]TimelineEntry)
+	timelines.Range(func(userId int64, timeline *btree.BTree) bool {
+		entries := make([]TimelineEntry, 0, timeline.Len())
+		timeline.Ascend(func(item btree.Item) bool {
+			pair := item.(PostTimestampPair)
+			entries = append(entries, TimelineEntry{Timestamp: pair.timestamp, PostId: pair.postId})
+			return true
+		})
+		snap[userId] = entries
+		return true
+	})
+	return snap
+}
+
+// restore replaces the contents of all maps with the snapshot.
+func (s *memoryStorage) restore(snap *storageSnapshot) error {
+	s.filenameToMediaDataMap.Clear()
+	s.usernameToUserProfileMap.Clear()
+	s.userIdToUsernameMap.Clear()
+	s.postIdToPostMap.Clear()
+	s.shortToExtendedMap.Clear()
+	s.useridToFollowersMap.Clear()
+	s.useridToFolloweesMap.Clear()
+	for _, graph := range s.relations {
+		graph.Clear()
+	}
+	s.useridToTimelineMap.Clear()
+	s.useridToHomeTimelineMap.Clear()
+	s.postExpiries.Clear()
+	s.mediaExpiries.Clear()
+	s.shortUrlExpiries.Clear()
+	s.txnIntents.Clear()
+	s.sessionIdToSessionMap.Clear()
+	s.sessionExpiries.Clear()
+	s.revocationMap.Clear()
+	s.revocationExpiries.Clear()
+	s.loginFailuresMap.Clear()
+	s.loginFailureExpiries.Clear()
+
+	for k, v := range snap.MediaData {
+		s.filenameToMediaDataMap.Put(k, v)
+	}
+	for k, v := range snap.UserProfiles {
+		s.usernameToUserProfileMap.Put(k, v)
+	}
+	for k, v := range snap.Posts {
+		s.postIdToPostMap.Put(k, v)
+	}
+	for k, v := range snap.ShortUrls {
+		s.shortToExtendedMap.Put(k, v)
+	}
+	restoreUserSets(s.useridToFollowersMap, snap.Followers)
+	restoreUserSets(s.useridToFolloweesMap, snap.Followees)
+	for kind, graph := range s.relations {
+		restoreUserSets(graph, *snap.relations(RelationKind(kind)))
+	}
+	restoreTimelines(s.useridToTimelineMap, snap.Timelines)
+	restoreTimelines(s.useridToHomeTimelineMap, snap.HomeTimelines)
+	for k, v := range snap.PostExpiries {
+		s.postExpiries.Put(k, v)
+	}
+	for k, v := range snap.MediaExpiries {
+		s.mediaExpiries.Put(k, v)
+	}
+	for k, v := range snap.ShortUrlExpiries {
+		s.shortUrlExpiries.Put(k, v)
+	}
+	for k, v := range snap.Intents {
+		s.txnIntents.Put(k, v)
+	}
+	for k, v := range snap.UserIds {
+		s.userIdToUsernameMap.Put(k, v)
+	}
+	for k, v := range snap.Sessions {
+		s.sessionIdToSessionMap.Put(k, v)
+	}
+	for k, v := range snap.SessionExpiries {
+		s.sessionExpiries.Put(k, v)
+	}
+	for k, v := range snap.Revocations {
+		s.revocationMap.Put(k, v)
+	}
+	for k, v := range snap.RevocationExpiries {
+		s.revocationExpiries.Put(k, v)
+	}
+	for k, v := range snap.LoginFailures {
+		s.loginFailuresMap.Put(k, v)
+	}
+	for k, v := range snap.LoginFailureExpiries {
+		s.loginFailureExpiries.Put(k, v)
+	}
+	s.resetSizes(snap)
+	return s.setPosition(snap.Position)
+}
+
+func (s *memoryStorage) position() (replicationPosition, error) {
+	s.posMu.Lock()
+	defer s.posMu.Unlock()
+	return s.pos, nil
+}
+
+func (s *memoryStorage) setPosition(pos replicationPosition) error {
+	s.posMu.Lock()
+	defer s.posMu.Unlock()
+	s.pos = pos
+	return nil
+}
+
+func (s *memoryStorage) expired(now int64) (expiredEntries, error) {
+	expired := expiredEntries{
+		Posts:     make(map[int64]Post),
+		Media:     expiredKeys(s.mediaExpiries, now),
+		ShortUrls: expiredKeys(s.shortUrlExpiries, now),
+
+		Sessions:      expiredKeys(s.sessionExpiries, now),
+		Revocations:   expiredKeys(s.revocationExpiries, now),
+		LoginFailures: expiredKeys(s.loginFailureExpiries, now),
+	}
+	for _, postId := range expiredKeys(s.postExpiries, now) {
+		if post, ok := s.postIdToPostMap.Get(postId); ok {
+			expired.Posts[postId] = post
+		}
+	}
+	return expired, nil
+}
+
+// resetSizes sets the sizes of the maps to those of the snapshot.
+func (s *memoryStorage) resetSizes(snap *storageSnapshot) {
+	s.sizes.reset()
+	for k, v := range snap.UserProfiles {
+		s.sizes.add(MAP_USER_PROFILES, 1, 1, profileEntrySize(k, v))
+	}
+	for _, v := range snap.Posts {
+		s.sizes.add(MAP_POSTS, 1, 1, postEntrySize(v))
+	}
+	for k, v := range snap.MediaData {
+		s.sizes.add(MAP_MEDIA, 1, 1, stringEntrySize(k, v))
+	}
+	for k, v := range snap.ShortUrls {
+		s.sizes.add(MAP_SHORT_URLS, 1, 1, stringEntrySize(k, v))
+	}
+	for _, ids := range snap.Followers {
+		s.sizes.add(MAP_FOLLOWERS, 1, int64(len(ids)), int64(MAP_ENTRY_OVERHEAD+USER_SET_SIZE+len(ids)*EDGE_SIZE))
+	}
+	for _, ids := range snap.Followees {
+		s.sizes.add(MAP_FOLLOWEES, 1, int64(len(ids)), int64(MAP_ENTRY_OVERHEAD+USER_SET_SIZE+len(ids)*EDGE_SIZE))
+	}
+	for kind := RelationKind(0); kind < RELATION_KIND_COUNT; kind++ {
+		for _, ids := range *snap.relations(kind) {
+			s.sizes.add(relationMap(kind), 1, int64(len(ids)), int64(MAP_ENTRY_OVERHEAD+USER_SET_SIZE+len(ids)*EDGE_SIZE))
+		}
+	}
+	for _, entries := range snap.Timelines {
+		s.sizes.add(MAP_USER_TIMELINES, 1, int64(len(entries)), int64(MAP_ENTRY_OVERHEAD+USER_SET_SIZE+len(entries)*TIMELINE_ENTRY_SIZE))
+	}
+	for _, entries := range snap.HomeTimelines {
+		s.sizes.add(MAP_HOME_TIMELINES, 1, int64(len(entries)), int64(MAP_ENTRY_OVERHEAD+USER_SET_SIZE+len(entries)*TIMELINE_ENTRY_SIZE))
+	}
+	for _, v := range snap.UserIds {
+		s.sizes.add(MAP_USER_IDS, 1, 1, userIdEntrySize(v))
+	}
+	for k, v := range snap.Sessions {
+		s.sizes.add(MAP_SESSIONS, 1, 1, sessionEntrySize(k, v))
+	}
+	for k := range snap.Revocations {
+		s.sizes.add(MAP_REVOCATIONS, 1, 1, revocationEntrySize(k))
+	}
+	for k := range snap.LoginFailures {
+		s.sizes.add(MAP_LOGIN_FAILURES, 1, 1, loginFailuresEntrySize(k))
+	}
+}
+
+func (s *memoryStorage) stats() ([]StorageMapStats, error) {
+	return s.sizes.stats(), nil
+}
+
+func restoreTimelines(timelines *HashMap[int64, *btree.BTree], snap map[int64][]TimelineEntry) {
+	for userId, entries := range snap {
+		timeline := btree.New(2)
+		for _, entry := range entries {
+			timeline.ReplaceOrInsert(PostTimestampPair{entry.Timestamp, entry.PostId})
+		}
+		timelines.Put(userId, timeline)
+	}
+}
+
+func restoreUserSets(graph *HashMap[int64, *userSet], snap map[int64][]int64) {
+	for userId, ids := range snap {
+		set := newUserSet()
+		for _, id := range ids {
+			set.ReplaceOrInsert(id)
+		}
+		graph.Put(userId, set)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func timelineIds(t *testing.T, s *Storage, userId int64, kind TimelineKind) []int64 {
+	t.Helper()
+	entries, err := s.GetPostTimeline(context.Background(), userId, kind, TimelineEntry{}, TIMELINE_OLDER, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postIds := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		postIds = append(postIds, e.PostId)
+	}
+	return postIds
+}
+
+// Each timeline kind keeps its newest entries up to its own maximum length.
+func TestTimelineTrimming(t *testing.T) {
+	ctx := context.Background()
+	configure := func(cfg *storageConfig) {
+		cfg.MaxUserTimelineLen = 3
+		cfg.MaxHomeTimelineLen = 5
+	}
+	testEachBackend(t, configure, func(t *testing.T, s *Storage) {
+		for postId := int64(1); postId <= 6; postId++ {
+			if err := s.PutPostTimeline(ctx, 1, USER_TIMELINE, postId, 100+postId); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.PutPostTimeline(ctx, 1, HOME_TIMELINE, postId, 100+postId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// An entry older than a full timeline is evicted right away, and one
+		// between its entries evicts the oldest.
+		if err := s.PutPostTimeline(ctx, 1, USER_TIMELINE, 10, 50); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutPostTimeline(ctx, 1, HOME_TIMELINE, 11, 104); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := timelineIds(t, s, 1, USER_TIMELINE), []int64{6, 5, 4}; !reflect.DeepEqual(got, want) {
+			t.Errorf("user timeline = %v, want %v", got, want)
+		}
+		if got, want := timelineIds(t, s, 1, HOME_TIMELINE), []int64{6, 5, 11, 4, 3}; !reflect.DeepEqual(got, want) {
+			t.Errorf("home timeline = %v, want %v", got, want)
+		}
+		stats, err := s.GetStorageStats(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stats.Maps[MAP_USER_TIMELINES].Items; got != 3 {
+			t.Errorf("user timelines hold %d items, want 3", got)
+		}
+		if got := stats.Maps[MAP_HOME_TIMELINES].Items; got != 5 {
+			t.Errorf("home timelines hold %d items, want 5", got)
+		}
+	})
+}
+
+// Entries trimmed under one maximum length stay trimmed after a restart with
+// another, which applies to the entries put from then on.
+func TestTimelineTrimmingSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range []string{MEMORY_BACKEND, SQLITE_BACKEND} {
+		t.Run(backend, func(t *testing.T) {
+			dataDir := t.TempDir()
+			open := func(maxLen int) *Storage {
+				s := &Storage{}
+				s.Config().Backend = backend
+				s.Config().DataDir = dataDir
+				s.Config().FsyncPolicy = FSYNC_ALWAYS
+				s.Config().MaxUserTimelineLen = maxLen
+				if err := s.Init(ctx); err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}
+			s := open(2)
+			for postId := int64(1); postId <= 4; postId++ {
+				if err := s.PutPostTimeline(ctx, 1, USER_TIMELINE, postId, 100+postId); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.Shutdown(ctx)
+
+			s = open(0)
+			defer s.Shutdown(ctx)
+			if got, want := timelineIds(t, s, 1, USER_TIMELINE), []int64{4, 3}; !reflect.DeepEqual(got, want) {
+				t.Errorf("user timeline after a restart = %v, want %v", got, want)
+			}
+			if err := s.PutPostTimeline(ctx, 1, USER_TIMELINE, 5, 105); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := timelineIds(t, s, 1, USER_TIMELINE), []int64{5, 4, 3}; !reflect.DeepEqual(got, want) {
+				t.Errorf("unbounded user timeline = %v, want %v", got, want)
+			}
+		})
+	}
+}
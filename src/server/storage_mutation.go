@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/ServiceWeaver/weaver"
+)
+
+type StorageOp int
+
+const (
+	OP_PUT_USER_PROFILE StorageOp = iota + 1
+	OP_PUT_POST
+	OP_REMOVE_POST
+	OP_PUT_MEDIA_DATA
+	OP_PUT_SHORTEN_URL
+	OP_REMOVE_SHORTEN_URL
+	OP_PUT_POST_TIMELINE
+	OP_REMOVE_POST_TIMELINE
+	OP_PUT_FOLLOWEE
+	OP_REMOVE_FOLLOWEE
+	OP_PUT_FOLLOWER
+	OP_REMOVE_FOLLOWER
+	OP_REMOVE_MEDIA_DATA
+	OP_REMOVE_TXN_INTENT
+	OP_PUT_USER_ID
+	OP_PUT_SESSION
+	OP_REMOVE_SESSION
+	OP_PUT_REVOCATION
+	OP_REMOVE_REVOCATION
+	OP_REMOVE_USER_ID
+	OP_REMOVE_USER_PROFILE
+	OP_PUT_LOGIN_FAILURES
+	OP_REMOVE_LOGIN_FAILURES
+	OP_PUT_RELATION
+	OP_REMOVE_RELATION
+)
+
+func (op StorageOp) String() string {
+	return [...]string{
+		"PUT_USER_PROFILE", "PUT_POST", "REMOVE_POST", "PUT_MEDIA_DATA",
+		"PUT_SHORTEN_URL", "REMOVE_SHORTEN_URL", "PUT_POST_TIMELINE", "REMOVE_POST_TIMELINE",
+		"PUT_FOLLOWEE", "REMOVE_FOLLOWEE", "PUT_FOLLOWER", "REMOVE_FOLLOWER",
+		"REMOVE_MEDIA_DATA", "REMOVE_TXN_INTENT", "PUT_USER_ID", "PUT_SESSION",
+		"REMOVE_SESSION", "PUT_REVOCATION", "REMOVE_REVOCATION", "REMOVE_USER_ID",
+		"REMOVE_USER_PROFILE", "PUT_LOGIN_FAILURES", "REMOVE_LOGIN_FAILURES", "PUT_RELATION",
+		"REMOVE_RELATION",
+	}[op-1]
+}
+
+// StorageMutation describes a single mutating call on Storage. Only the
+// fields used by Op are set.
+// MaxLen is the timeline length limit in effect when the mutation was made;
+// it is logged so that replicas and replays trim timelines the same way.
+// ExpiresAt is likewise the unix time in milliseconds at which a put entry
+// expires, or zero if it does not.
+//
+//	PUT_USER_PROFILE                         StrKey (username), Profile
+//	REMOVE_USER_PROFILE                      StrKey (username)
+//	PUT_POST                                 IntKey (post id), Post, ExpiresAt
+//	REMOVE_POST                              IntKey (post id)
+//	PUT_MEDIA_DATA                           StrKey (filename), StrVal, ExpiresAt
+//	REMOVE_MEDIA_DATA                        StrKey (filename)
+//	PUT_SHORTEN_URL                          StrKey (short url), StrVal, ExpiresAt
+//	REMOVE_SHORTEN_URL                       StrKey (short url)
+//	PUT_FOLLOWEE, REMOVE_FOLLOWEE            IntKey (user id), IntVal (followee id)
+//	PUT_FOLLOWER, REMOVE_FOLLOWER            IntKey (user id), IntVal (follower id)
+//	PUT_POST_TIMELINE                        IntKey (user id), IntVal (post id), Timestamp, Kind, MaxLen
+//	REMOVE_POST_TIMELINE                     IntKey (user id), IntVal (post id), Timestamp, Kind
+//	REMOVE_TXN_INTENT                        StrKey (transaction id), IntKey (home bucket)
+//	PUT_USER_ID                              IntKey (user id), StrKey (username)
+//	REMOVE_USER_ID                           IntKey (user id)
+//	PUT_SESSION                              StrKey (session id), Session, ExpiresAt
+//	REMOVE_SESSION                           StrKey (session id)
+//	PUT_REVOCATION                           StrKey (revocation key), IntVal (revocation time), ExpiresAt
+//	REMOVE_REVOCATION                        StrKey (revocation key)
+//	PUT_LOGIN_FAILURES                       StrKey (username), LoginFailures, ExpiresAt
+//	REMOVE_LOGIN_FAILURES                    StrKey (username)
+//	PUT_RELATION, REMOVE_RELATION            IntKey (user id), IntVal (other user id), Relation
+type StorageMutation struct {
+	weaver.AutoMarshal
+	Op            StorageOp
+	StrKey        string
+	IntKey        int64
+	StrVal        string
+	IntVal        int64
+	Timestamp     int64
+	Kind          TimelineKind
+	MaxLen        int
+	ExpiresAt     int64
+	Profile       UserProfile
+	Post          Post
+	Session       Session
+	LoginFailures LoginFailures
+	Relation      RelationKind
+}
@@ -0,0 +1,1202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+// Posts, user profiles, sessions and login failures are stored as json documents; everything else is
+// stored in plain columns so that it can be indexed. follow_counts is kept up to date with the follow
+// edges by triggers.
+const SQLITE_SCHEMA = `
+CREATE TABLE IF NOT EXISTS user_profiles (
+	username TEXT PRIMARY KEY,
+	user_id  INTEGER NOT NULL,
+	profile  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS user_ids (
+	user_id  INTEGER PRIMARY KEY,
+	username TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS posts (
+	post_id    INTEGER PRIMARY KEY,
+	post       TEXT NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS media (
+	filename   TEXT PRIMARY KEY,
+	data       TEXT NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS short_urls (
+	short_url    TEXT PRIMARY KEY,
+	extended_url TEXT NOT NULL,
+	expires_at   INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS followers (
+	user_id     INTEGER NOT NULL,
+	follower_id INTEGER NOT NULL,
+	PRIMARY KEY (user_id, follower_id)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS followees (
+	user_id     INTEGER NOT NULL,
+	followee_id INTEGER NOT NULL,
+	PRIMARY KEY (user_id, followee_id)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS follow_counts (
+	user_id   INTEGER PRIMARY KEY,
+	followers INTEGER NOT NULL DEFAULT 0,
+	followees INTEGER NOT NULL DEFAULT 0
+);
+CREATE TRIGGER IF NOT EXISTS followers_insert AFTER INSERT ON followers BEGIN
+	INSERT INTO follow_counts (user_id, followers) VALUES (NEW.user_id, 1)
+		ON CONFLICT (user_id) DO UPDATE SET followers = followers + 1;
+END;
+CREATE TRIGGER IF NOT EXISTS followers_delete AFTER DELETE ON followers BEGIN
+	UPDATE follow_counts SET followers = followers - 1 WHERE user_id = OLD.user_id;
+END;
+CREATE TRIGGER IF NOT EXISTS followees_insert AFTER INSERT ON followees BEGIN
+	INSERT INTO follow_counts (user_id, followees) VALUES (NEW.user_id, 1)
+		ON CONFLICT (user_id) DO UPDATE SET followees = followees + 1;
+END;
+CREATE TRIGGER IF NOT EXISTS followees_delete AFTER DELETE ON followees BEGIN
+	UPDATE follow_counts SET followees = followees - 1 WHERE user_id = OLD.user_id;
+END;
+CREATE TABLE IF NOT EXISTS relations (
+	kind     INTEGER NOT NULL,
+	user_id  INTEGER NOT NULL,
+	other_id INTEGER NOT NULL,
+	PRIMARY KEY (kind, user_id, other_id)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS timelines (
+	user_id   INTEGER NOT NULL,
+	timestamp INTEGER NOT NULL,
+	post_id   INTEGER NOT NULL,
+	PRIMARY KEY (user_id, timestamp, post_id)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS home_timelines (
+	user_id   INTEGER NOT NULL,
+	timestamp INTEGER NOT NULL,
+	post_id   INTEGER NOT NULL,
+	PRIMARY KEY (user_id, timestamp, post_id)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS sessions (
+	session_id TEXT PRIMARY KEY,
+	session    TEXT NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS revocations (
+	key        TEXT PRIMARY KEY,
+	revoked_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS login_failures (
+	username   TEXT PRIMARY KEY,
+	failures   TEXT NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS txn_intents (
+	txn_id TEXT PRIMARY KEY,
+	bucket INTEGER NOT NULL,
+	intent TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS replication_position (
+	id    INTEGER PRIMARY KEY CHECK (id = 0),
+	epoch INTEGER NOT NULL,
+	seq   INTEGER NOT NULL
+);
+`
+
+// SQLITE_EXPIRY_TABLES have an expires_at column, which is zero for entries
+// that do not expire and is added to databases created before it existed.
+var SQLITE_EXPIRY_TABLES = []string{"posts", "media", "short_urls", "sessions", "revocations", "login_failures"}
+
+// notExpired is the condition on expires_at of the entries that have not
+// expired at the time given as its argument.
+const notExpired = `(expires_at = 0 OR expires_at > ?)`
+
+// sqliteStorage keeps all data in an embedded sqlite database.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+// timelineTable returns the table holding timelines of the kind. User
+// timelines keep the original table name.
+func timelineTable(kind TimelineKind) string {
+	if kind == HOME_TIMELINE {
+		return "home_timelines"
+	}
+	return "timelines"
+}
+
+func openSqliteStorage(path string, fsyncPolicy string) (*sqliteStorage, error) {
+	synchronous := "NORMAL"
+	switch fsyncPolicy {
+	case FSYNC_ALWAYS:
+		synchronous = "FULL"
+	case "", FSYNC_INTERVAL:
+	case FSYNC_NEVER:
+		synchronous = "OFF"
+	default:
+		return nil, fmt.Errorf("unknown fsync_policy %q", fsyncPolicy)
+	}
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(%s)", path, synchronous)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := createSqliteSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, table := range SQLITE_EXPIRY_TABLES {
+		if err := addExpiryColumn(db, table); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStorage{db: db}, nil
+}
+
+// createSqliteSchema creates the missing tables, and counts the follow edges
+// of databases created before follow_counts existed.
+func createSqliteSchema(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var count int
+	err = tx.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'follow_counts'`).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(SQLITE_SCHEMA); err != nil {
+		return err
+	}
+	if count == 0 {
+		_, err := tx.Exec(`
+INSERT INTO follow_counts (user_id, followers)
+	SELECT user_id, count(*) FROM followers GROUP BY user_id;
+INSERT INTO follow_counts (user_id, followees)
+	SELECT user_id, count(*) FROM followees WHERE true GROUP BY user_id
+	ON CONFLICT (user_id) DO UPDATE SET followees = excluded.followees;
+`)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// addExpiryColumn adds the expires_at column to table if it is missing, and
+// indexes the entries that expire.
+func addExpiryColumn(db *sql.DB, table string) error {
+	var count int
+	err := db.QueryRow(`SELECT count(*) FROM pragma_table_info(?) WHERE name = 'expires_at'`, table).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		if _, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS ` + table + `_expires_at ON ` + table + ` (expires_at) WHERE expires_at != 0`)
+	return err
+}
+
+func (s *sqliteStorage) apply(m StorageMutation) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	changed, err := applySqliteMutation(tx, m)
+	if err != nil {
+		return false, err
+	}
+	return changed, tx.Commit()
+}
+
+func applySqliteMutation(tx *sql.Tx, m StorageMutation) (bool, error) {
+	var res sql.Result
+	var err error
+	switch m.Op {
+	case OP_PUT_USER_PROFILE:
+		var profile []byte
+		if profile, err = json.Marshal(m.Profile); err != nil {
+			return false, err
+		}
+		res, err = tx.Exec(`INSERT OR REPLACE INTO user_profiles (username, user_id, profile) VALUES (?, ?, ?)`,
+			m.StrKey, m.Profile.UserId, string(profile))
+	case OP_REMOVE_USER_PROFILE:
+		res, err = tx.Exec(`DELETE FROM user_profiles WHERE username = ?`, m.StrKey)
+	case OP_PUT_USER_ID:
+		res, err = tx.Exec(`INSERT OR REPLACE INTO user_ids (user_id, username) VALUES (?, ?)`, m.IntKey, m.StrKey)
+	case OP_REMOVE_USER_ID:
+		res, err = tx.Exec(`DELETE FROM user_ids WHERE user_id = ?`, m.IntKey)
+	case OP_PUT_POST:
+		var post []byte
+		if post, err = json.Marshal(m.Post); err != nil {
+			return false, err
+		}
+		res, err = tx.Exec(`INSERT OR REPLACE INTO posts (post_id, post, expires_at) VALUES (?, ?, ?)`,
+			m.IntKey, string(post), m.ExpiresAt)
+	case OP_REMOVE_POST:
+		res, err = tx.Exec(`DELETE FROM posts WHERE post_id = ?`, m.IntKey)
+	case OP_PUT_MEDIA_DATA:
+		res, err = tx.Exec(`INSERT OR REPLACE INTO media (filename, data, expires_at) VALUES (?, ?, ?)`,
+			m.StrKey, m.StrVal, m.ExpiresAt)
+	case OP_REMOVE_MEDIA_DATA:
+		res, err = tx.Exec(`DELETE FROM media WHERE filename = ?`, m.StrKey)
+	case OP_PUT_SHORTEN_URL:
+		res, err = tx.Exec(`INSERT OR REPLACE INTO short_urls (short_url, extended_url, expires_at) VALUES (?, ?, ?)`,
+			m.StrKey, m.StrVal, m.ExpiresAt)
+	case OP_REMOVE_SHORTEN_URL:
+		res, err = tx.Exec(`DELETE FROM short_urls WHERE short_url = ?`, m.StrKey)
+	case OP_PUT_FOLLOWEE:
+		res, err = tx.Exec(`INSERT OR IGNORE INTO followees (user_id, followee_id) VALUES (?, ?)`, m.IntKey, m.IntVal)
+	case OP_REMOVE_FOLLOWEE:
+		res, err = tx.Exec(`DELETE FROM followees WHERE user_id = ? AND followee_id = ?`, m.IntKey, m.IntVal)
+	case OP_PUT_FOLLOWER:
+		res, err = tx.Exec(`INSERT OR IGNORE INTO followers (user_id, follower_id) VALUES (?, ?)`, m.IntKey, m.IntVal)
+	case OP_REMOVE_FOLLOWER:
+		res, err = tx.Exec(`DELETE FROM followers WHERE user_id = ? AND follower_id = ?`, m.IntKey, m.IntVal)
+	case OP_PUT_RELATION:
+		res, err = tx.Exec(`INSERT OR IGNORE INTO relations (kind, user_id, other_id) VALUES (?, ?, ?)`, m.Relation, m.IntKey, m.IntVal)
+	case OP_REMOVE_RELATION:
+		res, err = tx.Exec(`DELETE FROM relations WHERE kind = ? AND user_id = ? AND other_id = ?`, m.Relation, m.IntKey, m.IntVal)
+	case OP_PUT_POST_TIMELINE:
+		return putSqlitePostTimeline(tx, m)
+	case OP_REMOVE_POST_TIMELINE:
+		res, err = tx.Exec(`DELETE FROM `+timelineTable(m.Kind)+` WHERE user_id = ? AND timestamp = ? AND post_id = ?`,
+			m.IntKey, m.Timestamp, m.IntVal)
+	case OP_PUT_SESSION:
+		var session []byte
+		if session, err = json.Marshal(m.Session); err != nil {
+			return false, err
+		}
+		res, err = tx.Exec(`INSERT OR REPLACE INTO sessions (session_id, session, expires_at) VALUES (?, ?, ?)`,
+			m.StrKey, string(session), m.ExpiresAt)
+	case OP_REMOVE_SESSION:
+		res, err = tx.Exec(`DELETE FROM sessions WHERE session_id = ?`, m.StrKey)
+	case OP_PUT_REVOCATION:
+		res, err = tx.Exec(`INSERT OR REPLACE INTO revocations (key, revoked_at, expires_at) VALUES (?, ?, ?)`,
+			m.StrKey, m.IntVal, m.ExpiresAt)
+	case OP_REMOVE_REVOCATION:
+		res, err = tx.Exec(`DELETE FROM revocations WHERE key = ?`, m.StrKey)
+	case OP_PUT_LOGIN_FAILURES:
+		var failures []byte
+		if failures, err = json.Marshal(m.LoginFailures); err != nil {
+			return false, err
+		}
+		res, err = tx.Exec(`INSERT OR REPLACE INTO login_failures (username, failures, expires_at) VALUES (?, ?, ?)`,
+			m.StrKey, string(failures), m.ExpiresAt)
+	case OP_REMOVE_LOGIN_FAILURES:
+		res, err = tx.Exec(`DELETE FROM login_failures WHERE username = ?`, m.StrKey)
+	case OP_REMOVE_TXN_INTENT:
+		res, err = tx.Exec(`DELETE FROM txn_intents WHERE txn_id = ?`, m.StrKey)
+	default:
+		return false, fmt.Errorf("unknown storage op %d", m.Op)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteStorage) applyTransaction(txn StorageTransaction) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	pending, err := querySqliteIntents(tx, txn.homeBucket())
+	if err != nil || txn.conflicts(pending) {
+		return false, err
+	}
+	for _, p := range txn.Preconditions {
+		holds, err := sqliteHolds(tx, p)
+		if err != nil || !holds {
+			return false, err
+		}
+	}
+	for _, m := range txn.Mutations {
+		if _, err := applySqliteMutation(tx, m); err != nil {
+			return false, err
+		}
+	}
+	if txn.Intent.Id != "" {
+		intent, err := json.Marshal(txn.Intent)
+		if err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(`INSERT OR REPLACE INTO txn_intents (txn_id, bucket, intent) VALUES (?, ?, ?)`,
+			txn.Intent.Id, txn.Intent.Bucket, string(intent))
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqliteStorage) holds(p StoragePrecondition) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	return sqliteHolds(tx, p)
+}
+
+// sqliteHolds reports whether the precondition holds.
+func sqliteHolds(tx *sql.Tx, p StoragePrecondition) (bool, error) {
+	var query string
+	var args []interface{}
+	switch p.Map {
+	case MAP_USER_PROFILES:
+		query, args = `SELECT profile FROM user_profiles WHERE username = ?`, []interface{}{p.StrKey}
+	case MAP_USER_IDS:
+		query, args = `SELECT username FROM user_ids WHERE user_id = ?`, []interface{}{p.IntKey}
+	case MAP_POSTS:
+		query, args = `SELECT '' FROM posts WHERE post_id = ? AND `+notExpired, []interface{}{p.IntKey, nowMillis()}
+	case MAP_MEDIA:
+		query, args = `SELECT data FROM media WHERE filename = ? AND `+notExpired, []interface{}{p.StrKey, nowMillis()}
+	case MAP_SHORT_URLS:
+		query, args = `SELECT extended_url FROM short_urls WHERE short_url = ? AND `+notExpired, []interface{}{p.StrKey, nowMillis()}
+	case MAP_SESSIONS:
+		query, args = `SELECT session FROM sessions WHERE session_id = ? AND `+notExpired, []interface{}{p.StrKey, nowMillis()}
+	case MAP_REVOCATIONS:
+		query, args = `SELECT '' FROM revocations WHERE key = ? AND `+notExpired, []interface{}{p.StrKey, nowMillis()}
+	case MAP_LOGIN_FAILURES:
+		query, args = `SELECT failures FROM login_failures WHERE username = ? AND `+notExpired, []interface{}{p.StrKey, nowMillis()}
+	case MAP_FOLLOWERS:
+		query, args = `SELECT '' FROM followers WHERE user_id = ? AND follower_id = ?`, []interface{}{p.IntKey, p.IntVal}
+	case MAP_FOLLOWEES:
+		query, args = `SELECT '' FROM followees WHERE user_id = ? AND followee_id = ?`, []interface{}{p.IntKey, p.IntVal}
+	case MAP_BLOCKED, MAP_BLOCKERS, MAP_MUTED, MAP_MUTERS, MAP_REQUESTED, MAP_REQUESTERS:
+		query, args = `SELECT '' FROM relations WHERE kind = ? AND user_id = ? AND other_id = ?`, []interface{}{mapRelation(p.Map), p.IntKey, p.IntVal}
+	case MAP_USER_TIMELINES, MAP_HOME_TIMELINES:
+		kind := USER_TIMELINE
+		if p.Map == MAP_HOME_TIMELINES {
+			kind = HOME_TIMELINE
+		}
+		query = `SELECT '' FROM ` + timelineTable(kind) + ` WHERE user_id = ? AND timestamp = ? AND post_id = ?`
+		args = []interface{}{p.IntKey, p.Timestamp, p.IntVal}
+	default:
+		return false, fmt.Errorf("unknown storage map %d", p.Map)
+	}
+
+	var value string
+	err := tx.QueryRow(query, args...).Scan(&value)
+	exists := err == nil
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	if err != nil {
+		return false, err
+	}
+	equal := exists && value == p.StrVal
+	if exists && p.Map == MAP_USER_PROFILES {
+		var profile UserProfile
+		if err := json.Unmarshal([]byte(value), &profile); err != nil {
+			return false, err
+		}
+		equal = profile == p.Profile
+	}
+	if exists && p.Map == MAP_SESSIONS {
+		var session Session
+		if err := json.Unmarshal([]byte(value), &session); err != nil {
+			return false, err
+		}
+		equal = session == p.Session
+	}
+	if exists && p.Map == MAP_LOGIN_FAILURES {
+		var failures LoginFailures
+		if err := json.Unmarshal([]byte(value), &failures); err != nil {
+			return false, err
+		}
+		equal = failures == p.LoginFailures
+	}
+	if p.Map == MAP_REVOCATIONS {
+		equal = false
+	}
+	switch p.Cond {
+	case COND_EXISTS:
+		return exists, nil
+	case COND_ABSENT:
+		return !exists, nil
+	case COND_EQUALS:
+		return equal, nil
+	}
+	return false, nil
+}
+
+// putSqlitePostTimeline inserts the entry and evicts the oldest entries
+// beyond the maximum length of the timeline.
+func putSqlitePostTimeline(tx *sql.Tx, m StorageMutation) (bool, error) {
+	table := timelineTable(m.Kind)
+	res, err := tx.Exec(`INSERT OR IGNORE INTO `+table+` (user_id, timestamp, post_id) VALUES (?, ?, ?)`,
+		m.IntKey, m.Timestamp, m.IntVal)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	var trimmed int64
+	if m.MaxLen > 0 && inserted > 0 {
+		res, err = tx.Exec(`DELETE FROM `+table+` WHERE user_id = ? AND (timestamp, post_id) <= (
+			SELECT timestamp, post_id FROM `+table+` WHERE user_id = ?
+			ORDER BY timestamp DESC, post_id DESC LIMIT 1 OFFSET ?)`,
+			m.IntKey, m.IntKey, m.MaxLen)
+		if err != nil {
+			return false, err
+		}
+		if trimmed, err = res.RowsAffected(); err != nil {
+			return false, err
+		}
+	}
+	if trimmed > 0 {
+		timelineTrimmedEntries.Get(timelineLabels{Kind: m.Kind.String()}).Add(float64(trimmed))
+	}
+	return inserted > 0, nil
+}
+
+func (s *sqliteStorage) GetUserProfile(key string) (UserProfile, bool, error) {
+	var profile UserProfile
+	var data string
+	err := s.db.QueryRow(`SELECT profile FROM user_profiles WHERE username = ?`, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return profile, false, nil
+	} else if err != nil {
+		return profile, false, err
+	}
+	err = json.Unmarshal([]byte(data), &profile)
+	return profile, err == nil, err
+}
+
+// GetBucketProfiles scans every profile, since the table is not indexed by
+// routing bucket; it is only called when the search index loads a bucket.
+func (s *sqliteStorage) GetBucketProfiles(bucket int) ([]UserInfo, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	users := make([]UserInfo, 0)
+	err = scanRows(tx, `SELECT username, profile FROM user_profiles`, func(rows *sql.Rows) error {
+		var username, data string
+		var profile UserProfile
+		if err := rows.Scan(&username, &data); err != nil {
+			return err
+		}
+		if stringRoutingBucket(username) != bucket {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(data), &profile); err != nil {
+			return err
+		}
+		users = append(users, userInfo(username, profile))
+		return nil
+	})
+	return users, err
+}
+
+func (s *sqliteStorage) GetUsername(key int64) (string, bool, error) {
+	return s.queryString(`SELECT username FROM user_ids WHERE user_id = ?`, key)
+}
+
+func (s *sqliteStorage) GetSession(key string) (Session, bool, error) {
+	var session Session
+	var data string
+	err := s.db.QueryRow(`SELECT session FROM sessions WHERE session_id = ? AND `+notExpired, key, nowMillis()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, false, nil
+	} else if err != nil {
+		return session, false, err
+	}
+	err = json.Unmarshal([]byte(data), &session)
+	return session, err == nil, err
+}
+
+func (s *sqliteStorage) GetRevocation(key string) (int64, bool, error) {
+	var revokedAt int64
+	err := s.db.QueryRow(`SELECT revoked_at FROM revocations WHERE key = ? AND `+notExpired, key, nowMillis()).Scan(&revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return revokedAt, err == nil, err
+}
+
+func (s *sqliteStorage) GetLoginFailures(key string) (LoginFailures, bool, error) {
+	var failures LoginFailures
+	var data string
+	err := s.db.QueryRow(`SELECT failures FROM login_failures WHERE username = ? AND `+notExpired, key, nowMillis()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return failures, false, nil
+	} else if err != nil {
+		return failures, false, err
+	}
+	err = json.Unmarshal([]byte(data), &failures)
+	return failures, err == nil, err
+}
+
+func (s *sqliteStorage) GetPost(key int64) (Post, bool, error) {
+	var post Post
+	var data string
+	err := s.db.QueryRow(`SELECT post FROM posts WHERE post_id = ? AND `+notExpired, key, nowMillis()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return post, false, nil
+	} else if err != nil {
+		return post, false, err
+	}
+	err = json.Unmarshal([]byte(data), &post)
+	return post, err == nil, err
+}
+
+func (s *sqliteStorage) GetMediaData(key string) (string, bool, error) {
+	return s.queryString(`SELECT data FROM media WHERE filename = ? AND `+notExpired, key, nowMillis())
+}
+
+func (s *sqliteStorage) GetShortenUrl(key string) (string, bool, error) {
+	return s.queryString(`SELECT extended_url FROM short_urls WHERE short_url = ? AND `+notExpired, key, nowMillis())
+}
+
+func (s *sqliteStorage) GetFollowers(userId int64) (map[int64]bool, bool, error) {
+	return s.queryIdSet(`SELECT follower_id FROM followers WHERE user_id = ?`, userId)
+}
+
+func (s *sqliteStorage) GetFollowees(userId int64) (map[int64]bool, bool, error) {
+	return s.queryIdSet(`SELECT followee_id FROM followees WHERE user_id = ?`, userId)
+}
+
+func (s *sqliteStorage) GetRelations(userId int64, kind RelationKind) (map[int64]bool, bool, error) {
+	return s.queryIdSet(`SELECT other_id FROM relations WHERE kind = ? AND user_id = ?`, kind, userId)
+}
+
+func (s *sqliteStorage) GetFollowCounts(userId int64) (int, int, error) {
+	var followers, followees int
+	err := s.db.QueryRow(`SELECT followers, followees FROM follow_counts WHERE user_id = ?`, userId).Scan(&followers, &followees)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	}
+	return followers, followees, err
+}
+
+func (s *sqliteStorage) GetFollowersPage(userId int64, after int64, limit int) ([]int64, error) {
+	return s.queryIdList(`SELECT follower_id FROM followers WHERE user_id = ? AND follower_id > ? ORDER BY follower_id LIMIT ?`, userId, after, limit)
+}
+
+func (s *sqliteStorage) GetFolloweesPage(userId int64, after int64, limit int) ([]int64, error) {
+	return s.queryIdList(`SELECT followee_id FROM followees WHERE user_id = ? AND followee_id > ? ORDER BY followee_id LIMIT ?`, userId, after, limit)
+}
+
+func (s *sqliteStorage) HasFollowee(userId int64, followeeId int64) (bool, error) {
+	_, found, err := s.queryString(`SELECT '' FROM followees WHERE user_id = ? AND followee_id = ?`, userId, followeeId)
+	return found, err
+}
+
+func (s *sqliteStorage) GetPostTimeline(userId int64, kind TimelineKind, cursor TimelineEntry, direction TimelineDirection, start int, stop int) ([]TimelineEntry, error) {
+	result := make([]TimelineEntry, 0)
+	if stop <= start {
+		return result, nil
+	}
+	// Entries are read from the cursor outwards.
+	query := `SELECT timestamp, post_id FROM ` + timelineTable(kind) + ` WHERE user_id = ?`
+	args := []interface{}{userId}
+	order := ` ORDER BY timestamp DESC, post_id DESC`
+	if direction == TIMELINE_NEWER {
+		if !cursor.IsZero() {
+			query += ` AND (timestamp, post_id) > (?, ?)`
+			args = append(args, cursor.Timestamp, cursor.PostId)
+		}
+		order = ` ORDER BY timestamp, post_id`
+	} else if !cursor.IsZero() {
+		query += ` AND (timestamp, post_id) < (?, ?)`
+		args = append(args, cursor.Timestamp, cursor.PostId)
+	}
+	rows, err := s.db.Query(query+order+` LIMIT ? OFFSET ?`, append(args, stop-start, start)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry TimelineEntry
+		if err := rows.Scan(&entry.Timestamp, &entry.PostId); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	if direction == TIMELINE_NEWER {
+		reverseTimeline(result)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqliteStorage) GetTxnIntents(bucket int) ([]StorageIntent, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return querySqliteIntents(tx, bucket)
+}
+
+func querySqliteIntents(tx *sql.Tx, bucket int) ([]StorageIntent, error) {
+	intents := make([]StorageIntent, 0)
+	rows, err := tx.Query(`SELECT intent FROM txn_intents WHERE bucket = ?`, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		var intent StorageIntent
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &intent); err != nil {
+			return nil, err
+		}
+		intents = append(intents, intent)
+	}
+	return intents, rows.Err()
+}
+
+func (s *sqliteStorage) snapshot() (*storageSnapshot, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	snap := &storageSnapshot{
+		MediaData:     make(map[string]string),
+		UserProfiles:  make(map[string]UserProfile),
+		Posts:         make(map[int64]Post),
+		ShortUrls:     make(map[string]string),
+		Followers:     make(map[int64][]int64),
+		Followees:     make(map[int64][]int64),
+		Timelines:     make(map[int64][]TimelineEntry),
+		HomeTimelines: make(map[int64][]TimelineEntry),
+
+		PostExpiries:     make(map[int64]int64),
+		MediaExpiries:    make(map[string]int64),
+		ShortUrlExpiries: make(map[string]int64),
+		Intents:          make(map[string]StorageIntent),
+		UserIds:          make(map[int64]string),
+
+		Sessions:           make(map[string]Session),
+		SessionExpiries:    make(map[string]int64),
+		Revocations:        make(map[string]int64),
+		RevocationExpiries: make(map[string]int64),
+
+		LoginFailures:        make(map[string]LoginFailures),
+		LoginFailureExpiries: make(map[string]int64),
+
+		Blocked:    make(map[int64][]int64),
+		Blockers:   make(map[int64][]int64),
+		Muted:      make(map[int64][]int64),
+		Muters:     make(map[int64][]int64),
+		Requested:  make(map[int64][]int64),
+		Requesters: make(map[int64][]int64),
+	}
+	err = scanRows(tx, `SELECT username, profile FROM user_profiles`, func(rows *sql.Rows) error {
+		var username, data string
+		var profile UserProfile
+		if err := rows.Scan(&username, &data); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(data), &profile); err != nil {
+			return err
+		}
+		snap.UserProfiles[username] = profile
+		return nil
+	})
+	if err == nil {
+		err = scanRows(tx, `SELECT user_id, username FROM user_ids`, func(rows *sql.Rows) error {
+			var userId int64
+			var username string
+			err := rows.Scan(&userId, &username)
+			snap.UserIds[userId] = username
+			return err
+		})
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT post_id, post, expires_at FROM posts`, func(rows *sql.Rows) error {
+			var postId, expiresAt int64
+			var data string
+			var post Post
+			if err := rows.Scan(&postId, &data, &expiresAt); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(data), &post); err != nil {
+				return err
+			}
+			snap.Posts[postId] = post
+			if expiresAt != 0 {
+				snap.PostExpiries[postId] = expiresAt
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT filename, data, expires_at FROM media`, func(rows *sql.Rows) error {
+			var k, v string
+			var expiresAt int64
+			err := rows.Scan(&k, &v, &expiresAt)
+			snap.MediaData[k] = v
+			if expiresAt != 0 {
+				snap.MediaExpiries[k] = expiresAt
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT short_url, extended_url, expires_at FROM short_urls`, func(rows *sql.Rows) error {
+			var k, v string
+			var expiresAt int64
+			err := rows.Scan(&k, &v, &expiresAt)
+			snap.ShortUrls[k] = v
+			if expiresAt != 0 {
+				snap.ShortUrlExpiries[k] = expiresAt
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT user_id, follower_id FROM followers`, func(rows *sql.Rows) error {
+			var userId, followerId int64
+			err := rows.Scan(&userId, &followerId)
+			snap.Followers[userId] = append(snap.Followers[userId], followerId)
+			return err
+		})
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT user_id, followee_id FROM followees`, func(rows *sql.Rows) error {
+			var userId, followeeId int64
+			err := rows.Scan(&userId, &followeeId)
+			snap.Followees[userId] = append(snap.Followees[userId], followeeId)
+			return err
+		})
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT kind, user_id, other_id FROM relations`, func(rows *sql.Rows) error {
+			var kind RelationKind
+			var userId, otherId int64
+			if err := rows.Scan(&kind, &userId, &otherId); err != nil {
+				return err
+			}
+			if kind < 0 || kind >= RELATION_KIND_COUNT {
+				return fmt.Errorf("unknown relation kind %d", kind)
+			}
+			edges := snap.relations(kind)
+			(*edges)[userId] = append((*edges)[userId], otherId)
+			return nil
+		})
+	}
+	if err == nil {
+		err = scanTimelines(tx, USER_TIMELINE, snap.Timelines)
+	}
+	if err == nil {
+		err = scanTimelines(tx, HOME_TIMELINE, snap.HomeTimelines)
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT session_id, session, expires_at FROM sessions`, func(rows *sql.Rows) error {
+			var sessionId, data string
+			var expiresAt int64
+			var session Session
+			if err := rows.Scan(&sessionId, &data, &expiresAt); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(data), &session); err != nil {
+				return err
+			}
+			snap.Sessions[sessionId] = session
+			if expiresAt != 0 {
+				snap.SessionExpiries[sessionId] = expiresAt
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT key, revoked_at, expires_at FROM revocations`, func(rows *sql.Rows) error {
+			var k string
+			var revokedAt, expiresAt int64
+			err := rows.Scan(&k, &revokedAt, &expiresAt)
+			snap.Revocations[k] = revokedAt
+			if expiresAt != 0 {
+				snap.RevocationExpiries[k] = expiresAt
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT username, failures, expires_at FROM login_failures`, func(rows *sql.Rows) error {
+			var username, data string
+			var expiresAt int64
+			var failures LoginFailures
+			if err := rows.Scan(&username, &data, &expiresAt); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(data), &failures); err != nil {
+				return err
+			}
+			snap.LoginFailures[username] = failures
+			if expiresAt != 0 {
+				snap.LoginFailureExpiries[username] = expiresAt
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = scanRows(tx, `SELECT intent FROM txn_intents`, func(rows *sql.Rows) error {
+			var data string
+			var intent StorageIntent
+			if err := rows.Scan(&data); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(data), &intent); err != nil {
+				return err
+			}
+			snap.Intents[intent.Id] = intent
+			return nil
+		})
+	}
+	if err == nil {
+		snap.Position, err = queryPosition(tx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *sqliteStorage) position() (replicationPosition, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return replicationPosition{}, err
+	}
+	defer tx.Rollback()
+	return queryPosition(tx)
+}
+
+func (s *sqliteStorage) setPosition(pos replicationPosition) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO replication_position (id, epoch, seq) VALUES (0, ?, ?)`, pos.Epoch, pos.Seq)
+	return err
+}
+
+func queryPosition(tx *sql.Tx) (replicationPosition, error) {
+	var pos replicationPosition
+	err := tx.QueryRow(`SELECT epoch, seq FROM replication_position WHERE id = 0`).Scan(&pos.Epoch, &pos.Seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return pos, nil
+	}
+	return pos, err
+}
+
+// restore replaces the contents of all tables with the snapshot in a single
+// transaction.
+func (s *sqliteStorage) restore(snap *storageSnapshot) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"user_profiles", "user_ids", "posts", "media", "short_urls", "followers", "followees", "follow_counts", "relations", "timelines", "home_timelines", "sessions", "revocations", "login_failures", "txn_intents", "replication_position"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+	for username, profile := range snap.UserProfiles {
+		data, err := json.Marshal(profile)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO user_profiles (username, user_id, profile) VALUES (?, ?, ?)`, username, profile.UserId, string(data)); err != nil {
+			return err
+		}
+	}
+	for userId, username := range snap.UserIds {
+		if _, err := tx.Exec(`INSERT INTO user_ids (user_id, username) VALUES (?, ?)`, userId, username); err != nil {
+			return err
+		}
+	}
+	for postId, post := range snap.Posts {
+		data, err := json.Marshal(post)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO posts (post_id, post, expires_at) VALUES (?, ?, ?)`, postId, string(data), snap.PostExpiries[postId]); err != nil {
+			return err
+		}
+	}
+	for k, v := range snap.MediaData {
+		if _, err := tx.Exec(`INSERT INTO media (filename, data, expires_at) VALUES (?, ?, ?)`, k, v, snap.MediaExpiries[k]); err != nil {
+			return err
+		}
+	}
+	for k, v := range snap.ShortUrls {
+		if _, err := tx.Exec(`INSERT INTO short_urls (short_url, extended_url, expires_at) VALUES (?, ?, ?)`, k, v, snap.ShortUrlExpiries[k]); err != nil {
+			return err
+		}
+	}
+	for userId, ids := range snap.Followers {
+		for _, id := range ids {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO followers (user_id, follower_id) VALUES (?, ?)`, userId, id); err != nil {
+				return err
+			}
+		}
+	}
+	for userId, ids := range snap.Followees {
+		for _, id := range ids {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO followees (user_id, followee_id) VALUES (?, ?)`, userId, id); err != nil {
+				return err
+			}
+		}
+	}
+	for kind := RelationKind(0); kind < RELATION_KIND_COUNT; kind++ {
+		for userId, ids := range *snap.relations(kind) {
+			for _, id := range ids {
+				if _, err := tx.Exec(`INSERT OR IGNORE INTO relations (kind, user_id, other_id) VALUES (?, ?, ?)`, kind, userId, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for kind, timelines := range map[TimelineKind]map[int64][]TimelineEntry{USER_TIMELINE: snap.Timelines, HOME_TIMELINE: snap.HomeTimelines} {
+		for userId, entries := range timelines {
+			for _, entry := range entries {
+				if _, err := tx.Exec(`INSERT OR IGNORE INTO `+timelineTable(kind)+` (user_id, timestamp, post_id) VALUES (?, ?, ?)`, userId, entry.Timestamp, entry.PostId); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for sessionId, session := range snap.Sessions {
+		data, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO sessions (session_id, session, expires_at) VALUES (?, ?, ?)`, sessionId, string(data), snap.SessionExpiries[sessionId]); err != nil {
+			return err
+		}
+	}
+	for k, v := range snap.Revocations {
+		if _, err := tx.Exec(`INSERT INTO revocations (key, revoked_at, expires_at) VALUES (?, ?, ?)`, k, v, snap.RevocationExpiries[k]); err != nil {
+			return err
+		}
+	}
+	for username, failures := range snap.LoginFailures {
+		data, err := json.Marshal(failures)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO login_failures (username, failures, expires_at) VALUES (?, ?, ?)`, username, string(data), snap.LoginFailureExpiries[username]); err != nil {
+			return err
+		}
+	}
+	for id, intent := range snap.Intents {
+		data, err := json.Marshal(intent)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO txn_intents (txn_id, bucket, intent) VALUES (?, ?, ?)`, id, intent.Bucket, string(data)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO replication_position (id, epoch, seq) VALUES (0, ?, ?)`, snap.Position.Epoch, snap.Position.Seq); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func scanTimelines(tx *sql.Tx, kind TimelineKind, timelines map[int64][]TimelineEntry) error {
+	query := `SELECT user_id, timestamp, post_id FROM ` + timelineTable(kind) + ` ORDER BY user_id, timestamp, post_id`
+	return scanRows(tx, query, func(rows *sql.Rows) error {
+		var userId int64
+		var entry TimelineEntry
+		err := rows.Scan(&userId, &entry.Timestamp, &entry.PostId)
+		timelines[userId] = append(timelines[userId], entry)
+		return err
+	})
+}
+
+func (s *sqliteStorage) expired(now int64) (expiredEntries, error) {
+	expired := expiredEntries{Posts: make(map[int64]Post)}
+	rows, err := s.db.Query(`SELECT post_id, post FROM posts WHERE expires_at != 0 AND expires_at <= ?`, now)
+	if err != nil {
+		return expired, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var postId int64
+		var data string
+		var post Post
+		if err := rows.Scan(&postId, &data); err != nil {
+			return expired, err
+		}
+		if err := json.Unmarshal([]byte(data), &post); err != nil {
+			return expired, err
+		}
+		expired.Posts[postId] = post
+	}
+	if err := rows.Err(); err != nil {
+		return expired, err
+	}
+	if expired.Media, err = s.queryKeys(`SELECT filename FROM media WHERE expires_at != 0 AND expires_at <= ?`, now); err != nil {
+		return expired, err
+	}
+	if expired.ShortUrls, err = s.queryKeys(`SELECT short_url FROM short_urls WHERE expires_at != 0 AND expires_at <= ?`, now); err != nil {
+		return expired, err
+	}
+	if expired.Sessions, err = s.queryKeys(`SELECT session_id FROM sessions WHERE expires_at != 0 AND expires_at <= ?`, now); err != nil {
+		return expired, err
+	}
+	if expired.Revocations, err = s.queryKeys(`SELECT key FROM revocations WHERE expires_at != 0 AND expires_at <= ?`, now); err != nil {
+		return expired, err
+	}
+	expired.LoginFailures, err = s.queryKeys(`SELECT username FROM login_failures WHERE expires_at != 0 AND expires_at <= ?`, now)
+	return expired, err
+}
+
+func (s *sqliteStorage) queryKeys(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// sqliteStatsQueries computes the entries, items and payload bytes of each
+// map, in storageMap order.
+var sqliteStatsQueries = [STORAGE_MAP_COUNT]string{
+	MAP_USER_PROFILES:  "SELECT count(*), count(*), coalesce(sum(length(username) + length(profile)), 0) FROM user_profiles",
+	MAP_POSTS:          "SELECT count(*), count(*), coalesce(sum(8 + length(post)), 0) FROM posts",
+	MAP_MEDIA:          "SELECT count(*), count(*), coalesce(sum(length(filename) + length(data)), 0) FROM media",
+	MAP_SHORT_URLS:     "SELECT count(*), count(*), coalesce(sum(length(short_url) + length(extended_url)), 0) FROM short_urls",
+	MAP_FOLLOWERS:      "SELECT count(DISTINCT user_id), count(*), 16 * count(*) FROM followers",
+	MAP_FOLLOWEES:      "SELECT count(DISTINCT user_id), count(*), 16 * count(*) FROM followees",
+	MAP_USER_TIMELINES: "SELECT count(DISTINCT user_id), count(*), 24 * count(*) FROM timelines",
+	MAP_HOME_TIMELINES: "SELECT count(DISTINCT user_id), count(*), 24 * count(*) FROM home_timelines",
+	MAP_USER_IDS:       "SELECT count(*), count(*), coalesce(sum(8 + length(username)), 0) FROM user_ids",
+	MAP_SESSIONS:       "SELECT count(*), count(*), coalesce(sum(length(session_id) + length(session)), 0) FROM sessions",
+	MAP_REVOCATIONS:    "SELECT count(*), count(*), coalesce(sum(8 + length(key)), 0) FROM revocations",
+	MAP_LOGIN_FAILURES: "SELECT count(*), count(*), coalesce(sum(length(username) + length(failures)), 0) FROM login_failures",
+	MAP_BLOCKED:        relationStatsQuery(RELATION_BLOCKED),
+	MAP_BLOCKERS:       relationStatsQuery(RELATION_BLOCKERS),
+	MAP_MUTED:          relationStatsQuery(RELATION_MUTED),
+	MAP_MUTERS:         relationStatsQuery(RELATION_MUTERS),
+	MAP_REQUESTED:      relationStatsQuery(RELATION_REQUESTED),
+	MAP_REQUESTERS:     relationStatsQuery(RELATION_REQUESTERS),
+}
+
+func relationStatsQuery(kind RelationKind) string {
+	return fmt.Sprintf("SELECT count(DISTINCT user_id), count(*), 16 * count(*) FROM relations WHERE kind = %d", kind)
+}
+
+// stats reports the size of the rows of each table, leaving out the indexes
+// and page overheads of sqlite.
+func (s *sqliteStorage) stats() ([]StorageMapStats, error) {
+	stats := make([]StorageMapStats, STORAGE_MAP_COUNT)
+	for m, query := range sqliteStatsQueries {
+		stats[m].Map = storageMap(m).String()
+		err := s.db.QueryRow(query).Scan(&stats[m].Entries, &stats[m].Items, &stats[m].Bytes)
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (s *sqliteStorage) Close() error {
+	return s.db.Close()
+}
+
+func scanRows(tx *sql.Tx, query string, scan func(*sql.Rows) error) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStorage) queryString(query string, args ...interface{}) (string, bool, error) {
+	var v string
+	err := s.db.QueryRow(query, args...).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+// queryIdSet collects the single id column returned by query into a set. The
+// set exists if at least one row was returned.
+func (s *sqliteStorage) queryIdSet(query string, args ...interface{}) (map[int64]bool, bool, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	ids := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, false, err
+		}
+		ids[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(ids) == 0 {
+		return nil, false, nil
+	}
+	return ids, true, nil
+}
+
+// queryIdList collects the single id column returned by query into a list,
+// in the order of the rows.
+func (s *sqliteStorage) queryIdList(query string, args ...interface{}) ([]int64, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
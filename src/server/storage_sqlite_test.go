@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testEachBackend runs test against a Storage of each backend: the memory
+// backend with and without persistence, and the sqlite backend. configure, if
+// not nil, sets the config of the Storage before it is initialized.
+func testEachBackend(t *testing.T, configure func(*storageConfig), test func(*testing.T, *Storage)) {
+	for _, tc := range []struct {
+		name    string
+		backend string
+		dataDir bool
+	}{
+		{"memory", MEMORY_BACKEND, false},
+		{"persisted memory", MEMORY_BACKEND, true},
+		{"sqlite", SQLITE_BACKEND, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Storage{}
+			s.Config().Backend = tc.backend
+			if tc.dataDir {
+				s.Config().DataDir = t.TempDir()
+			}
+			if configure != nil {
+				configure(s.Config())
+			}
+			if err := s.Init(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Shutdown(context.Background())
+			test(t, s)
+		})
+	}
+}
+
+// mustTransact applies each mutation in a transaction of its own bucket.
+func mustTransact(t *testing.T, s *Storage, mutations ...StorageMutation) {
+	t.Helper()
+	for _, m := range mutations {
+		if _, err := s.Transact(context.Background(), mutationBucket(m), StorageTransaction{Mutations: []StorageMutation{m}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func sortedIds(set map[int64]bool) []int64 {
+	ids := make([]int64, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestBackendPutsAndRemoves(t *testing.T) {
+	ctx := context.Background()
+	testEachBackend(t, nil, func(t *testing.T, s *Storage) {
+		profile := UserProfile{UserId: 1, FirstName: "Alice", PasswordHashed: "hash"}
+		if err := s.PutUserProfile(ctx, "alice", profile); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok, err := s.GetUserProfile(ctx, "alice"); err != nil || !ok || !reflect.DeepEqual(got, profile) {
+			t.Errorf("GetUserProfile = %+v, %v, %v; want %+v", got, ok, err, profile)
+		}
+		if got, err := s.GetUserProfiles(ctx, []string{"alice", "bob"}); err != nil || len(got) != 1 {
+			t.Errorf("GetUserProfiles = %v, %v; want alice only", got, err)
+		}
+		mustTransact(t, s, StorageMutation{Op: OP_PUT_USER_ID, IntKey: 1, StrKey: "alice"})
+		if got, ok, err := s.GetUsername(ctx, 1); err != nil || !ok || got != "alice" {
+			t.Errorf("GetUsername(1) = %q, %v, %v; want alice", got, ok, err)
+		}
+
+		post := Post{Post_id: 7, Creator: Creator{UserId: 1, Username: "alice"}, Text: "hello", Timestamp: 100}
+		if err := s.PutPost(ctx, 7, post, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetPosts(ctx, []int64{7, 8}); err != nil || len(got) != 1 || !reflect.DeepEqual(got[7], post) {
+			t.Errorf("GetPosts = %v, %v; want post 7 only", got, err)
+		}
+		if err := s.PutMediaData(ctx, "a.png", "data", 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok, err := s.GetMediaData(ctx, "a.png"); err != nil || !ok || got != "data" {
+			t.Errorf("GetMediaData = %q, %v, %v", got, ok, err)
+		}
+		if err := s.PutShortenUrl(ctx, "short", "long", 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok, err := s.GetShortenUrl(ctx, "short"); err != nil || !ok || got != "long" {
+			t.Errorf("GetShortenUrl = %q, %v, %v", got, ok, err)
+		}
+
+		for _, followeeId := range []int64{2, 3, 4} {
+			if err := s.PutFollowee(ctx, 1, followeeId); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.PutFollower(ctx, followeeId, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if followees, _, err := s.GetFollowees(ctx, 1); err != nil || !reflect.DeepEqual(sortedIds(followees), []int64{2, 3, 4}) {
+			t.Errorf("GetFollowees = %v, %v", followees, err)
+		}
+		if page, err := s.GetFolloweesPage(ctx, 1, 2, 1); err != nil || !reflect.DeepEqual(page, []int64{3}) {
+			t.Errorf("GetFolloweesPage(after 2, limit 1) = %v, %v; want [3]", page, err)
+		}
+		if followers, followees, err := s.GetFollowCounts(ctx, 1); err != nil || followers != 0 || followees != 3 {
+			t.Errorf("GetFollowCounts = %d, %d, %v; want 0, 3", followers, followees, err)
+		}
+		mustTransact(t, s, relationMutations(true, RELATION_BLOCKED, 1, 5)...)
+		if blockers, _, err := s.GetRelations(ctx, 5, RELATION_BLOCKERS); err != nil || !blockers[1] {
+			t.Errorf("GetRelations(5, blockers) = %v, %v; want user 1", blockers, err)
+		}
+
+		// Removes report whether the entry existed.
+		for i, want := range []bool{true, false} {
+			if removed, err := s.RemovePost(ctx, 7); err != nil || removed != want {
+				t.Errorf("RemovePost #%d = %v, %v; want %v", i+1, removed, err, want)
+			}
+		}
+		if err := s.RemoveShortenUrl(ctx, "short"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemoveFollowee(ctx, 1, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemoveFollower(ctx, 3, 1); err != nil {
+			t.Fatal(err)
+		}
+		mustTransact(t, s,
+			StorageMutation{Op: OP_REMOVE_USER_PROFILE, StrKey: "alice"},
+			StorageMutation{Op: OP_REMOVE_USER_ID, IntKey: 1},
+		)
+		mustTransact(t, s, relationMutations(false, RELATION_BLOCKED, 1, 5)...)
+
+		if _, ok, _ := s.GetUserProfile(ctx, "alice"); ok {
+			t.Error("the removed profile is still there")
+		}
+		if _, ok, _ := s.GetUsername(ctx, 1); ok {
+			t.Error("the removed user id is still indexed")
+		}
+		if _, ok, _ := s.GetPost(ctx, 7); ok {
+			t.Error("the removed post is still there")
+		}
+		if _, ok, _ := s.GetShortenUrl(ctx, "short"); ok {
+			t.Error("the removed short url is still there")
+		}
+		if following, err := s.HasFollowee(ctx, 1, 3); err != nil || following {
+			t.Errorf("HasFollowee(1, 3) = %v, %v after the unfollow", following, err)
+		}
+		if followers, _, err := s.GetFollowers(ctx, 3); err != nil || len(followers) != 0 {
+			t.Errorf("GetFollowers(3) = %v, %v after the unfollow", followers, err)
+		}
+		if blocked, _, err := s.GetRelations(ctx, 1, RELATION_BLOCKED); err != nil || len(blocked) != 0 {
+			t.Errorf("GetRelations(1, blocked) = %v, %v after the unblock", blocked, err)
+		}
+	})
+}
+
+func TestBackendTimelinePages(t *testing.T) {
+	ctx := context.Background()
+	testEachBackend(t, nil, func(t *testing.T, s *Storage) {
+		for postId := int64(1); postId <= 10; postId++ {
+			if err := s.PutPostTimeline(ctx, 1, USER_TIMELINE, postId, 100+postId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The other timeline of the user and the timeline of another user
+		// are left alone.
+		if err := s.PutPostTimeline(ctx, 1, HOME_TIMELINE, 20, 500); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutPostTimeline(ctx, 2, USER_TIMELINE, 30, 500); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemovePostTimeline(ctx, 1, USER_TIMELINE, 5, 105); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			name        string
+			cursor      TimelineEntry
+			direction   TimelineDirection
+			start, stop int
+			want        []int64
+		}{
+			{"newest", TimelineEntry{}, TIMELINE_OLDER, 0, 3, []int64{10, 9, 8}},
+			{"skipped", TimelineEntry{}, TIMELINE_OLDER, 2, 5, []int64{8, 7, 6}},
+			{"past the removed entry", TimelineEntry{}, TIMELINE_OLDER, 5, 7, []int64{4, 3}},
+			{"older than a cursor", TimelineEntry{Timestamp: 107, PostId: 7}, TIMELINE_OLDER, 0, 2, []int64{6, 4}},
+			{"newer than a cursor", TimelineEntry{Timestamp: 107, PostId: 7}, TIMELINE_NEWER, 0, 2, []int64{9, 8}},
+			{"oldest", TimelineEntry{}, TIMELINE_NEWER, 0, 2, []int64{2, 1}},
+			{"past the end", TimelineEntry{}, TIMELINE_OLDER, 9, 12, []int64{}},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				entries, err := s.GetPostTimeline(ctx, 1, USER_TIMELINE, tc.cursor, tc.direction, tc.start, tc.stop)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := make([]int64, 0, len(entries))
+				for _, e := range entries {
+					got = append(got, e.PostId)
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("GetPostTimeline = %v, want %v", got, tc.want)
+				}
+			})
+		}
+	})
+}
+
+func TestBackendTransactions(t *testing.T) {
+	ctx := context.Background()
+	testEachBackend(t, nil, func(t *testing.T, s *Storage) {
+		bucket := stringRoutingBucket("alice")
+		profile := UserProfile{UserId: 1, FirstName: "Alice"}
+		put := StorageMutation{Op: OP_PUT_USER_PROFILE, StrKey: "alice", Profile: profile}
+		absent := StoragePrecondition{Cond: COND_ABSENT, Map: MAP_USER_PROFILES, StrKey: "alice"}
+		for i, want := range []bool{true, false} {
+			applied, err := s.Transact(ctx, bucket, StorageTransaction{
+				Preconditions: []StoragePrecondition{absent},
+				Mutations:     []StorageMutation{put},
+			})
+			if err != nil || applied != want {
+				t.Fatalf("Transact #%d = %v, %v; want %v", i+1, applied, err, want)
+			}
+		}
+
+		// A transaction is applied whole or not at all.
+		renamed := profile
+		renamed.FirstName = "Alicia"
+		for _, tc := range []struct {
+			name string
+			cond StoragePrecondition
+			want bool
+		}{
+			{"stale value", StoragePrecondition{Cond: COND_EQUALS, Map: MAP_USER_PROFILES, StrKey: "alice", Profile: renamed}, false},
+			{"current value", StoragePrecondition{Cond: COND_EQUALS, Map: MAP_USER_PROFILES, StrKey: "alice", Profile: profile}, true},
+		} {
+			applied, err := s.Transact(ctx, bucket, StorageTransaction{
+				Preconditions: []StoragePrecondition{tc.cond},
+				Mutations: []StorageMutation{
+					{Op: OP_PUT_USER_PROFILE, StrKey: "alice", Profile: renamed},
+					{Op: OP_PUT_LOGIN_FAILURES, StrKey: "alice", LoginFailures: LoginFailures{Count: 1}},
+				},
+			})
+			if err != nil || applied != tc.want {
+				t.Fatalf("%s: Transact = %v, %v; want %v", tc.name, applied, err, tc.want)
+			}
+			got, _, _ := s.GetUserProfile(ctx, "alice")
+			_, failed, _ := s.GetLoginFailures(ctx, "alice")
+			if (got.FirstName == "Alicia") != tc.want || failed != tc.want {
+				t.Errorf("%s: got first name %q and failures %v after applied = %v", tc.name, got.FirstName, failed, applied)
+			}
+		}
+
+		// A pending intent is returned until it is removed.
+		intent := StorageIntent{Id: "txn", Bucket: bucket, CreatedAt: nowMillis(), Mutations: []StorageMutation{putUserId(2, "bob")}}
+		if _, err := s.Transact(ctx, bucket, StorageTransaction{Intent: intent}); err != nil {
+			t.Fatal(err)
+		}
+		if intents, err := s.GetTxnIntents(ctx, bucket); err != nil || len(intents) != 1 || intents[0].Id != "txn" {
+			t.Fatalf("GetTxnIntents = %v, %v; want txn", intents, err)
+		}
+		mustTransact(t, s, StorageMutation{Op: OP_REMOVE_TXN_INTENT, StrKey: "txn", IntKey: int64(bucket)})
+		if intents, err := s.GetTxnIntents(ctx, bucket); err != nil || len(intents) != 0 {
+			t.Errorf("GetTxnIntents after the removal = %v, %v", intents, err)
+		}
+
+		// Mutations of another bucket are refused.
+		otherId := int64(1)
+		for intRoutingBucket(otherId) == bucket {
+			otherId++
+		}
+		if _, err := s.Transact(ctx, bucket, StorageTransaction{
+			Mutations: []StorageMutation{putUserId(otherId, "bob")},
+		}); err == nil {
+			t.Error("Transact applied a mutation of another bucket")
+		}
+	})
+}
+
+func TestBackendExpiry(t *testing.T) {
+	ctx := context.Background()
+	testEachBackend(t, nil, func(t *testing.T, s *Storage) {
+		if err := s.PutPost(ctx, 7, Post{Post_id: 7}, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutMediaData(ctx, "a.png", "data", time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutShortenUrl(ctx, "short", "long", time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		mustTransact(t, s, StorageMutation{Op: OP_PUT_SESSION, StrKey: "session", Session: Session{UserId: 1}, ExpiresAt: nowMillis() + 1})
+		if err := s.PutShortenUrl(ctx, "kept", "long", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		if _, ok, _ := s.GetPost(ctx, 7); ok {
+			t.Error("GetPost returned an expired post")
+		}
+		if _, ok, _ := s.GetMediaData(ctx, "a.png"); ok {
+			t.Error("GetMediaData returned expired media")
+		}
+		if _, ok, _ := s.GetShortenUrl(ctx, "short"); ok {
+			t.Error("GetShortenUrl returned an expired url")
+		}
+		if _, ok, _ := s.GetSession(ctx, "session"); ok {
+			t.Error("GetSession returned an expired session")
+		}
+
+		var expired []Post
+		for bucket := 0; bucket < STORAGE_ROUTING_BUCKETS; bucket++ {
+			posts, err := s.ExpireBucket(ctx, bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired = append(expired, posts...)
+		}
+		if len(expired) != 1 || expired[0].Post_id != 7 {
+			t.Errorf("ExpireBucket returned %v, want post 7", expired)
+		}
+		stats, err := s.GetStorageStats(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []struct {
+			sized   storageMap
+			entries int64
+		}{{MAP_MEDIA, 0}, {MAP_SHORT_URLS, 1}, {MAP_SESSIONS, 0}} {
+			if got := stats.Maps[want.sized]; got.Map != want.sized.String() || got.Entries != want.entries {
+				t.Errorf("%s has %d entries after the sweep, want %d", got.Map, got.Entries, want.entries)
+			}
+		}
+		if got, ok, _ := s.GetShortenUrl(ctx, "kept"); !ok || got != "long" {
+			t.Error("the url that did not expire is gone")
+		}
+	})
+}
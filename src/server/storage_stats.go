@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ServiceWeaver/weaver/metrics"
+)
+
+// Storage reports the number of keys and the approximate size of each of its
+// maps through the metrics below and GetStorageStats, so that latency changes
+// can be related to data growth. The memory backend keeps the sizes up to
+// date on every mutation; the sqlite backend computes them when asked.
+
+// storageMap names one of the maps of Storage.
+type storageMap int
+
+const (
+	MAP_USER_PROFILES storageMap = iota
+	MAP_POSTS
+	MAP_MEDIA
+	MAP_SHORT_URLS
+	MAP_FOLLOWERS
+	MAP_FOLLOWEES
+	MAP_USER_TIMELINES
+	MAP_HOME_TIMELINES
+	MAP_USER_IDS
+	MAP_SESSIONS
+	MAP_REVOCATIONS
+	MAP_LOGIN_FAILURES
+	MAP_BLOCKED
+	MAP_BLOCKERS
+	MAP_MUTED
+	MAP_MUTERS
+	MAP_REQUESTED
+	MAP_REQUESTERS
+
+	STORAGE_MAP_COUNT = iota
+)
+
+func (m storageMap) String() string {
+	return [...]string{
+		"user_profiles", "posts", "media", "short_urls",
+		"followers", "followees", "user_timelines", "home_timelines",
+		"user_ids", "sessions", "revocations", "login_failures",
+		"blocked", "blockers", "muted", "muters", "requested", "requesters",
+	}[m]
+}
+
+func timelineMap(kind TimelineKind) storageMap {
+	if kind == HOME_TIMELINE {
+		return MAP_HOME_TIMELINES
+	}
+	return MAP_USER_TIMELINES
+}
+
+// relationMap returns the map holding the edges of the kind, and mapRelation
+// the kind of the edges held by such a map.
+func relationMap(kind RelationKind) storageMap {
+	return MAP_BLOCKED + storageMap(kind)
+}
+
+func mapRelation(m storageMap) RelationKind {
+	return RelationKind(m - MAP_BLOCKED)
+}
+
+// Approximate memory overheads of the memory backend, in bytes: a key-value
+// slot of a map, a follow edge in the set of a user, a timeline entry in a
+// btree, and the empty set or btree created for a new user.
+const (
+	MAP_ENTRY_OVERHEAD  = 64
+	EDGE_SIZE           = 24
+	TIMELINE_ENTRY_SIZE = 40
+	USER_SET_SIZE       = 256
+
+	DEFAULT_STATS_INTERVAL_SEC = 10
+)
+
+type storageMapLabels struct {
+	Map string
+}
+
+var (
+	storageMapEntries = metrics.NewGaugeMap[storageMapLabels](
+		"sn_storage_map_entries",
+		"Number of keys of each Storage map",
+	)
+	storageMapItems = metrics.NewGaugeMap[storageMapLabels](
+		"sn_storage_map_items",
+		"Number of follow edges or timeline entries of each Storage map, and of keys of the others",
+	)
+	storageMapBytes = metrics.NewGaugeMap[storageMapLabels](
+		"sn_storage_map_bytes",
+		"Approximate size in bytes of each Storage map",
+	)
+)
+
+func stringEntrySize(key, value string) int64 {
+	return int64(MAP_ENTRY_OVERHEAD + len(key) + len(value))
+}
+
+func profileEntrySize(username string, profile UserProfile) int64 {
+	return int64(MAP_ENTRY_OVERHEAD + 16 + len(username) + len(profile.FirstName) +
+		len(profile.LastName) + len(profile.Salt) + len(profile.PasswordHashed) +
+		len(profile.Bio) + len(profile.Avatar))
+}
+
+func userIdEntrySize(username string) int64 {
+	return int64(MAP_ENTRY_OVERHEAD + 8 + len(username))
+}
+
+func sessionEntrySize(sessionId string, session Session) int64 {
+	return int64(MAP_ENTRY_OVERHEAD + 24 + len(sessionId) + len(session.Username) + len(session.RefreshHash))
+}
+
+func revocationEntrySize(key string) int64 {
+	return int64(MAP_ENTRY_OVERHEAD + 8 + len(key))
+}
+
+func loginFailuresEntrySize(username string) int64 {
+	return int64(MAP_ENTRY_OVERHEAD + 32 + len(username))
+}
+
+func postEntrySize(post Post) int64 {
+	size := MAP_ENTRY_OVERHEAD + 64 + len(post.Creator.Username) + len(post.Text)
+	for _, mention := range post.User_mentions {
+		size += 24 + len(mention.Username)
+	}
+	for _, media := range post.Media {
+		size += 24 + len(media.MediaType)
+	}
+	for _, url := range post.Urls {
+		size += 32 + len(url.ShortenedUrl) + len(url.ExpandedUrl)
+	}
+	return int64(size)
+}
+
+// mapSize holds the running totals of one map.
+type mapSize struct {
+	entries atomic.Int64
+	items   atomic.Int64
+	bytes   atomic.Int64
+}
+
+// storageSizes holds the running totals of every map of the memory backend.
+type storageSizes [STORAGE_MAP_COUNT]mapSize
+
+func (s *storageSizes) add(m storageMap, entries, items, bytes int64) {
+	s[m].entries.Add(entries)
+	s[m].items.Add(items)
+	s[m].bytes.Add(bytes)
+}
+
+func (s *storageSizes) reset() {
+	for m := range s {
+		s[m].entries.Store(0)
+		s[m].items.Store(0)
+		s[m].bytes.Store(0)
+	}
+}
+
+func (s *storageSizes) stats() []StorageMapStats {
+	stats := make([]StorageMapStats, STORAGE_MAP_COUNT)
+	for m := range s {
+		stats[m] = StorageMapStats{
+			Map:     storageMap(m).String(),
+			Entries: s[m].entries.Load(),
+			Items:   s[m].items.Load(),
+			Bytes:   s[m].bytes.Load(),
+		}
+	}
+	return stats
+}
+
+// statsLoop publishes the map sizes as metrics until done is closed.
+func (s *Storage) statsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stats, err := s.backend.stats()
+		if err != nil {
+			fmt.Printf("[Storage] cannot compute map sizes: %v\n", err)
+		}
+		for _, m := range stats {
+			labels := storageMapLabels{Map: m.Map}
+			storageMapEntries.Get(labels).Set(float64(m.Entries))
+			storageMapItems.Get(labels).Set(float64(m.Items))
+			storageMapBytes.Get(labels).Set(float64(m.Bytes))
+		}
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replicaName identifies the process a Storage replica runs in.
+func replicaName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+func (StorageRouter) GetStorageStats(_ context.Context, bucket int) string {
+	return strconv.Itoa(bucket)
+}
+
+func (s *Storage) GetStorageStats(context.Context, int) (StorageStats, error) {
+	role := ROLE_STANDALONE
+	if s.replicator != nil {
+		role = s.replicator.status().Role
+	}
+	maps, err := s.backend.stats()
+	return StorageStats{Replica: s.name, Role: role.String(), Maps: maps}, err
+}
+
+// collectStorageStats asks the replica owning each routing bucket for its
+// statistics. Replicas that own no bucket are missed. The total leaves out
+// backups, which hold a copy of the primary.
+func collectStorageStats(ctx context.Context, storage IStorage) (StorageStatsReport, error) {
+	var mu sync.Mutex
+	replicas := make(map[string]StorageStats)
+	err := forEachRoutingBucket(func(bucket int) error {
+		stats, err := storage.GetStorageStats(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		replicas[stats.Replica] = stats
+		return nil
+	})
+
+	report := StorageStatsReport{
+		Replicas: make([]StorageStats, 0, len(replicas)),
+		Total:    make([]StorageMapStats, STORAGE_MAP_COUNT),
+	}
+	for m := range report.Total {
+		report.Total[m].Map = storageMap(m).String()
+	}
+	for _, stats := range replicas {
+		report.Replicas = append(report.Replicas, stats)
+		if stats.Role == ROLE_BACKUP.String() {
+			continue
+		}
+		for m, size := range stats.Maps {
+			report.Total[m].Entries += size.Entries
+			report.Total[m].Items += size.Items
+			report.Total[m].Bytes += size.Bytes
+		}
+	}
+	sort.Slice(report.Replicas, func(i, j int) bool {
+		return report.Replicas[i].Replica < report.Replicas[j].Replica
+	})
+	return report, err
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/ServiceWeaver/weaver"
+)
+
+// Transactions.
+//
+// Storage.Transact applies a StorageTransaction on the replica owning a
+// routing bucket: either all of its mutations are applied, or none of them
+// are because one of its preconditions does not hold. A transaction is logged
+// and replicated as a single entry, so replays and backups apply it whole as
+// well. Reads are not isolated from transactions and may see one half
+// applied.
+//
+// The keys of a transaction given to Transact must belong to one bucket.
+// TransactionService runs transactions spanning several buckets: it applies
+// the part in the bucket of the first mutation, the home bucket, together
+// with an intent listing the mutations of the other buckets, and then rolls
+// these forward. A transaction with preconditions or an intent is not applied
+// while a pending intent of the same home bucket touches one of its keys, so
+// that transactions on the same keys do not overtake each other on the other
+// buckets. Transactions on the same keys should therefore start with the same
+// key.
+
+type StorageCondition int
+
+const (
+	COND_EXISTS StorageCondition = iota + 1
+	COND_ABSENT
+	COND_EQUALS
+)
+
+// StoragePrecondition must hold for a transaction to be applied. It names an
+// entry of Map by the same fields as StorageMutation: StrKey for user
+// profiles, media, short urls, sessions, revocations and login failures,
+// IntKey for posts and user ids, IntKey and IntVal for follow, block, mute
+// and follow request edges, and IntKey, IntVal (post id) and Timestamp for
+// timeline entries. COND_EQUALS compares user profiles with Profile, sessions
+// with Session, login failures with LoginFailures, and media, short urls and
+// user ids (usernames) with StrVal. Expired entries do not exist.
+type StoragePrecondition struct {
+	weaver.AutoMarshal
+	Cond          StorageCondition
+	Map           storageMap
+	StrKey        string
+	IntKey        int64
+	IntVal        int64
+	Timestamp     int64
+	StrVal        string
+	Profile       UserProfile
+	Session       Session
+	LoginFailures LoginFailures
+}
+
+// StorageIntent records the mutations of a cross-bucket transaction that are
+// still to be applied on buckets other than its home bucket.
+type StorageIntent struct {
+	weaver.AutoMarshal
+	Id     string
+	Bucket int
+	// CreatedAt is in unix milliseconds.
+	CreatedAt int64
+	Mutations []StorageMutation
+}
+
+type StorageTransaction struct {
+	weaver.AutoMarshal
+	Preconditions []StoragePrecondition
+	Mutations     []StorageMutation
+	// Intent is recorded along with the mutations if its Id is set, and is
+	// removed by a REMOVE_TXN_INTENT mutation once it is rolled forward.
+	Intent StorageIntent
+}
+
+// storageCommit is the unit that is logged, replicated and applied
+// atomically: a single mutation, or a transaction if Txn is set.
+type storageCommit struct {
+	Mutation StorageMutation
+	Txn      *StorageTransaction `json:",omitempty"`
+	// Position is set on the commits that the primary orders when
+	// replication is enabled; see replication.go.
+	Position *replicationPosition `json:",omitempty"`
+}
+
+// applyTo applies the commit to state and records its replication position.
+// The sqlite backend records the position after the commit, so a crash in
+// between leaves it one commit behind and the commit is pulled again; since
+// mutations set entries to a value rather than change it, applying a commit
+// twice leaves the same contents.
+func (c storageCommit) applyTo(state persistentState) (bool, error) {
+	var changed bool
+	var err error
+	if c.Txn != nil {
+		changed, err = state.applyTransaction(*c.Txn)
+	} else {
+		changed, err = state.apply(c.Mutation)
+	}
+	if err == nil && c.Position != nil {
+		err = state.setPosition(*c.Position)
+	}
+	return changed, err
+}
+
+// mutationMap returns the map that m changes, if it changes a single one.
+func mutationMap(m StorageMutation) (storageMap, bool) {
+	switch m.Op {
+	case OP_PUT_USER_PROFILE, OP_REMOVE_USER_PROFILE:
+		return MAP_USER_PROFILES, true
+	case OP_PUT_POST, OP_REMOVE_POST:
+		return MAP_POSTS, true
+	case OP_PUT_MEDIA_DATA, OP_REMOVE_MEDIA_DATA:
+		return MAP_MEDIA, true
+	case OP_PUT_SHORTEN_URL, OP_REMOVE_SHORTEN_URL:
+		return MAP_SHORT_URLS, true
+	case OP_PUT_FOLLOWEE, OP_REMOVE_FOLLOWEE:
+		return MAP_FOLLOWEES, true
+	case OP_PUT_FOLLOWER, OP_REMOVE_FOLLOWER:
+		return MAP_FOLLOWERS, true
+	case OP_PUT_POST_TIMELINE, OP_REMOVE_POST_TIMELINE:
+		return timelineMap(m.Kind), true
+	case OP_PUT_USER_ID, OP_REMOVE_USER_ID:
+		return MAP_USER_IDS, true
+	case OP_PUT_SESSION, OP_REMOVE_SESSION:
+		return MAP_SESSIONS, true
+	case OP_PUT_REVOCATION, OP_REMOVE_REVOCATION:
+		return MAP_REVOCATIONS, true
+	case OP_PUT_LOGIN_FAILURES, OP_REMOVE_LOGIN_FAILURES:
+		return MAP_LOGIN_FAILURES, true
+	case OP_PUT_RELATION, OP_REMOVE_RELATION:
+		return relationMap(m.Relation), true
+	}
+	return 0, false
+}
+
+// storageItem identifies an entry of a map, a follow edge or a timeline
+// entry.
+func storageItem(m storageMap, strKey string, intKey, intVal int64) string {
+	switch m {
+	case MAP_USER_PROFILES, MAP_MEDIA, MAP_SHORT_URLS, MAP_SESSIONS, MAP_REVOCATIONS, MAP_LOGIN_FAILURES:
+		return fmt.Sprintf("%s/%s", m, strKey)
+	case MAP_POSTS, MAP_USER_IDS:
+		return fmt.Sprintf("%s/%d", m, intKey)
+	}
+	return fmt.Sprintf("%s/%d/%d", m, intKey, intVal)
+}
+
+func mapRoutingBucket(m storageMap, strKey string, intKey int64) int {
+	switch m {
+	case MAP_USER_PROFILES, MAP_MEDIA, MAP_SHORT_URLS, MAP_SESSIONS, MAP_REVOCATIONS, MAP_LOGIN_FAILURES:
+		return stringRoutingBucket(strKey)
+	}
+	return intRoutingBucket(intKey)
+}
+
+// mutationBucket returns the routing bucket of the key m changes.
+func mutationBucket(m StorageMutation) int {
+	if m.Op == OP_REMOVE_TXN_INTENT {
+		return int(m.IntKey)
+	}
+	if sized, ok := mutationMap(m); ok {
+		return mapRoutingBucket(sized, m.StrKey, m.IntKey)
+	}
+	return intRoutingBucket(m.IntKey)
+}
+
+func (p StoragePrecondition) bucket() int {
+	return mapRoutingBucket(p.Map, p.StrKey, p.IntKey)
+}
+
+func (p StoragePrecondition) item() string {
+	return storageItem(p.Map, p.StrKey, p.IntKey, p.IntVal)
+}
+
+// items returns the entries the transaction reads or changes.
+func (txn *StorageTransaction) items() map[string]bool {
+	items := make(map[string]bool)
+	for _, p := range txn.Preconditions {
+		items[p.item()] = true
+	}
+	for _, m := range txn.Mutations {
+		if sized, ok := mutationMap(m); ok {
+			items[storageItem(sized, m.StrKey, m.IntKey, m.IntVal)] = true
+		}
+	}
+	for _, m := range txn.Intent.Mutations {
+		if sized, ok := mutationMap(m); ok {
+			items[storageItem(sized, m.StrKey, m.IntKey, m.IntVal)] = true
+		}
+	}
+	return items
+}
+
+// conflicts reports whether the transaction must wait for one of the
+// pending intents of its home bucket to be rolled forward.
+func (txn *StorageTransaction) conflicts(pending []StorageIntent) bool {
+	if len(txn.Preconditions) == 0 && txn.Intent.Id == "" {
+		return false
+	}
+	items := txn.items()
+	for _, intent := range pending {
+		for _, m := range intent.Mutations {
+			sized, ok := mutationMap(m)
+			if ok && items[storageItem(sized, m.StrKey, m.IntKey, m.IntVal)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// homeBucket returns the bucket of the first mutation of the transaction, of
+// its first precondition if it has no mutation, or of its intent if it has
+// neither.
+func (txn *StorageTransaction) homeBucket() int {
+	switch {
+	case len(txn.Mutations) > 0:
+		return mutationBucket(txn.Mutations[0])
+	case len(txn.Preconditions) > 0:
+		return txn.Preconditions[0].bucket()
+	}
+	return txn.Intent.Bucket
+}
+
+func (StorageRouter) Transact(_ context.Context, bucket int, _ StorageTransaction) string {
+	return strconv.Itoa(bucket)
+}
+
+func (StorageRouter) GetTxnIntents(_ context.Context, bucket int) string {
+	return strconv.Itoa(bucket)
+}
+
+func (s *Storage) Transact(_ context.Context, bucket int, txn StorageTransaction) (bool, error) {
+	for _, p := range txn.Preconditions {
+		if p.bucket() != bucket {
+			return false, fmt.Errorf("storage: precondition on %s is not in bucket %d", p.item(), bucket)
+		}
+	}
+	for _, m := range append(txn.Mutations, txn.Intent.Mutations...) {
+		if _, ok := mutationMap(m); !ok && m.Op != OP_REMOVE_TXN_INTENT {
+			return false, fmt.Errorf("storage: %s mutations cannot be part of a transaction", m.Op)
+		}
+	}
+	for _, m := range txn.Mutations {
+		if mutationBucket(m) != bucket {
+			return false, fmt.Errorf("storage: %s mutation is not in bucket %d", m.Op, bucket)
+		}
+	}
+	if txn.Intent.Id != "" && txn.Intent.Bucket != bucket {
+		return false, fmt.Errorf("storage: intent %s is not in bucket %d", txn.Intent.Id, bucket)
+	}
+	return s.commitEntry(storageCommit{Txn: &txn})
+}
+
+func (s *Storage) GetTxnIntents(_ context.Context, bucket int) ([]StorageIntent, error) {
+	return s.reader().GetTxnIntents(bucket)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ServiceWeaver/weaver/weavertest"
+)
+
+// otherBucketUserId returns a user id whose routing bucket differs from that
+// of userId.
+func otherBucketUserId(userId int64) int64 {
+	other := userId + 1
+	for intRoutingBucket(other) == intRoutingBucket(userId) {
+		other++
+	}
+	return other
+}
+
+func putUserId(userId int64, username string) StorageMutation {
+	return StorageMutation{Op: OP_PUT_USER_ID, IntKey: userId, StrKey: username}
+}
+
+func userIdAbsent(userId int64) StoragePrecondition {
+	return StoragePrecondition{Cond: COND_ABSENT, Map: MAP_USER_IDS, IntKey: userId}
+}
+
+func TestTransactionConflicts(t *testing.T) {
+	pending := []StorageIntent{{
+		Id:        "pending",
+		Mutations: []StorageMutation{putUserId(1, "alice")},
+	}}
+	for _, tc := range []struct {
+		name string
+		txn  StorageTransaction
+		want bool
+	}{
+		{
+			name: "plain mutations never wait",
+			txn:  StorageTransaction{Mutations: []StorageMutation{putUserId(1, "bob")}},
+		},
+		{
+			name: "precondition on a pending key",
+			txn:  StorageTransaction{Preconditions: []StoragePrecondition{userIdAbsent(1)}},
+			want: true,
+		},
+		{
+			name: "precondition on another key",
+			txn:  StorageTransaction{Preconditions: []StoragePrecondition{userIdAbsent(2)}},
+		},
+		{
+			name: "mutation on a pending key with a precondition elsewhere",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{userIdAbsent(2)},
+				Mutations:     []StorageMutation{putUserId(1, "bob")},
+			},
+			want: true,
+		},
+		{
+			name: "intent on a pending key",
+			txn: StorageTransaction{
+				Intent: StorageIntent{Id: "new", Mutations: []StorageMutation{putUserId(1, "bob")}},
+			},
+			want: true,
+		},
+		{
+			name: "same id in another map",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{{Cond: COND_ABSENT, Map: MAP_POSTS, IntKey: 1}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.txn.conflicts(pending); got != tc.want {
+				t.Errorf("conflicts = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTransactionHomeBucket(t *testing.T) {
+	other := otherBucketUserId(1)
+	for _, tc := range []struct {
+		name string
+		txn  StorageTransaction
+		want int
+	}{
+		{
+			name: "first mutation",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{userIdAbsent(other)},
+				Mutations:     []StorageMutation{putUserId(1, "alice"), putUserId(other, "bob")},
+			},
+			want: intRoutingBucket(1),
+		},
+		{
+			name: "first precondition without mutations",
+			txn:  StorageTransaction{Preconditions: []StoragePrecondition{userIdAbsent(other), userIdAbsent(1)}},
+			want: intRoutingBucket(other),
+		},
+		{
+			name: "string key",
+			txn: StorageTransaction{
+				Mutations: []StorageMutation{{Op: OP_PUT_USER_PROFILE, StrKey: "alice"}},
+			},
+			want: stringRoutingBucket("alice"),
+		},
+		{
+			name: "intent removal",
+			txn: StorageTransaction{
+				Mutations: []StorageMutation{{Op: OP_REMOVE_TXN_INTENT, StrKey: "id", IntKey: 7}},
+			},
+			want: 7,
+		},
+		{
+			name: "intent only",
+			txn:  StorageTransaction{Intent: StorageIntent{Id: "id", Bucket: 7}},
+			want: 7,
+		},
+		{
+			name: "empty",
+			want: 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.txn.homeBucket(); got != tc.want {
+				t.Errorf("homeBucket = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// Transact applies none of the mutations of a transaction whose precondition
+// does not hold or that conflicts with a pending intent of its bucket.
+func TestTransactRefused(t *testing.T) {
+	ctx := context.Background()
+	const taken, free, pendingId = int64(1), int64(2), int64(3)
+	for _, tc := range []struct {
+		name string
+		txn  StorageTransaction
+		want bool
+	}{
+		{
+			name: "absent precondition on a taken key",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{userIdAbsent(taken)},
+				Mutations:     []StorageMutation{putUserId(taken, "bob")},
+			},
+		},
+		{
+			name: "equals precondition on another value",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{{Cond: COND_EQUALS, Map: MAP_USER_IDS, IntKey: taken, StrVal: "bob"}},
+				Mutations:     []StorageMutation{{Op: OP_REMOVE_USER_ID, IntKey: taken}},
+			},
+		},
+		{
+			name: "exists precondition on a free key",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{{Cond: COND_EXISTS, Map: MAP_USER_IDS, IntKey: free}},
+				Mutations:     []StorageMutation{putUserId(free, "bob")},
+			},
+		},
+		{
+			name: "key of a pending intent",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{userIdAbsent(pendingId)},
+				Mutations:     []StorageMutation{putUserId(pendingId, "bob")},
+			},
+		},
+		{
+			name: "preconditions hold",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{userIdAbsent(free)},
+				Mutations:     []StorageMutation{putUserId(free, "bob")},
+			},
+			want: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Each bucket is persisted on its own, so an intent is only seen
+			// by transactions of its bucket.
+			s := &Storage{}
+			s.Config().DataDir = t.TempDir()
+			if err := s.Init(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Shutdown(ctx)
+			if _, err := s.Transact(ctx, intRoutingBucket(taken), StorageTransaction{
+				Mutations: []StorageMutation{putUserId(taken, "alice")},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			bucket := tc.txn.homeBucket()
+			intent := StorageIntent{
+				Id:        "pending",
+				Bucket:    bucket,
+				CreatedAt: nowMillis(),
+				Mutations: []StorageMutation{putUserId(pendingId, "carol")},
+			}
+			if _, err := s.Transact(ctx, bucket, StorageTransaction{Intent: intent}); err != nil {
+				t.Fatal(err)
+			}
+
+			applied, err := s.Transact(ctx, bucket, tc.txn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied != tc.want {
+				t.Fatalf("applied = %v, want %v", applied, tc.want)
+			}
+			username, _, err := s.GetUsername(ctx, tc.txn.Mutations[0].IntKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotBob := username == "bob"; gotBob != tc.want {
+				t.Errorf("user id %d maps to %q after applied = %v", tc.txn.Mutations[0].IntKey, username, applied)
+			}
+		})
+	}
+}
+
+// Commit applies none of the buckets of a transaction whose precondition does
+// not hold, and rolls forward a stale conflicting intent before applying one.
+func TestCommit(t *testing.T) {
+	ctx := context.Background()
+	taken := int64(1)
+	other := otherBucketUserId(taken)
+	for _, tc := range []struct {
+		name      string
+		staleOn   int64 // user id of a stale pending intent, if not zero
+		txn       StorageTransaction
+		want      bool
+		wantOther string
+	}{
+		{
+			name: "failed precondition",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{userIdAbsent(taken)},
+				Mutations:     []StorageMutation{putUserId(taken, "bob"), putUserId(other, "bob")},
+			},
+		},
+		{
+			name: "preconditions hold",
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{{Cond: COND_EQUALS, Map: MAP_USER_IDS, IntKey: taken, StrVal: "alice"}},
+				Mutations:     []StorageMutation{putUserId(taken, "bob"), putUserId(other, "bob")},
+			},
+			want:      true,
+			wantOther: "bob",
+		},
+		{
+			name:    "stale conflicting intent",
+			staleOn: other,
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{{Cond: COND_EQUALS, Map: MAP_USER_IDS, IntKey: taken, StrVal: "alice"}},
+				Mutations:     []StorageMutation{putUserId(taken, "bob"), putUserId(other, "bob")},
+			},
+			want:      true,
+			wantOther: "bob",
+		},
+		{
+			name:    "precondition broken by a stale intent",
+			staleOn: taken,
+			txn: StorageTransaction{
+				Preconditions: []StoragePrecondition{{Cond: COND_EQUALS, Map: MAP_USER_IDS, IntKey: taken, StrVal: "alice"}},
+				Mutations:     []StorageMutation{putUserId(taken, "bob"), putUserId(other, "bob")},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			weavertest.Local.Test(t, func(t *testing.T, ts ITransactionService, storage IStorage) {
+				home := tc.txn.homeBucket()
+				if _, err := storage.Transact(ctx, home, StorageTransaction{
+					Mutations: []StorageMutation{putUserId(taken, "alice")},
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if tc.staleOn != 0 {
+					// An intent left pending by a caller that failed long ago.
+					intent := StorageIntent{
+						Id:        "stale",
+						Bucket:    home,
+						CreatedAt: nowMillis() - 2*TXN_RESOLVE_AFTER.Milliseconds(),
+						Mutations: []StorageMutation{putUserId(tc.staleOn, "carol")},
+					}
+					if _, err := storage.Transact(ctx, home, StorageTransaction{Intent: intent}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				applied, err := ts.Commit(ctx, tc.txn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if applied != tc.want {
+					t.Fatalf("applied = %v, want %v", applied, tc.want)
+				}
+				wantOther := tc.wantOther
+				if wantOther == "" && tc.staleOn == other {
+					wantOther = "carol"
+				}
+				if username, _, _ := storage.GetUsername(ctx, other); username != wantOther {
+					t.Errorf("user id %d maps to %q, want %q", other, username, wantOther)
+				}
+				if pending, _ := storage.GetTxnIntents(ctx, home); len(pending) != 0 && tc.want {
+					t.Errorf("%d intents are still pending", len(pending))
+				}
+			})
+		})
+	}
+}
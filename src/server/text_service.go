@@ -8,7 +8,9 @@ import (
 )
 
 type ITextService interface {
-	ComposeText(context.Context, string) (TextServiceReturn, error)
+	// ComposeText shortens the urls of the text of a post by the user and
+	// resolves its mentions.
+	ComposeText(context.Context, int64, string) (TextServiceReturn, error)
 }
 
 type TextService struct {
@@ -35,7 +37,7 @@ func iterative_search(text string, pattern string) []string {
 	return res
 }
 
-func (s *TextService) ComposeText(ctx context.Context, text string) (TextServiceReturn, error) {
+func (s *TextService) ComposeText(ctx context.Context, userId int64, text string) (TextServiceReturn, error) {
 	url_pattern := "(http://|https://)([a-zA-Z0-9_!~*'().&=+$%-]+)"
 	mention_pattern := "@[a-zA-Z0-9-_]+"
 
@@ -51,7 +53,7 @@ func (s *TextService) ComposeText(ctx context.Context, text string) (TextService
 
 	// convert mentions to UserMention type
 	user_mention_service := s.user_mention_service.Get()
-	mentions, _ := user_mention_service.ComposeUserMentions(ctx, mentions_str)
+	mentions, _ := user_mention_service.ComposeUserMentions(ctx, userId, mentions_str)
 
 	ret := TextServiceReturn{
 		Text:          text,
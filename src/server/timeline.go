@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ServiceWeaver/weaver"
+	"github.com/ServiceWeaver/weaver/metrics"
+)
+
+// TimelineKind selects one of the two timelines of a user: the posts of the
+// user, or the posts of the users they follow.
+type TimelineKind int
+
+const (
+	USER_TIMELINE TimelineKind = iota
+	HOME_TIMELINE
+)
+
+func (k TimelineKind) String() string {
+	return [...]string{"user", "home"}[k]
+}
+
+type timelineLabels struct {
+	Kind string
+}
+
+var timelineTrimmedEntries = metrics.NewCounterMap[timelineLabels](
+	"sn_timeline_trimmed_entries",
+	"Number of oldest timeline entries evicted to keep timelines within their maximum length",
+)
+
+// IsZero reports whether e is the zero entry, which stands for the newest end
+// of a timeline when reading older posts and for the oldest end when reading
+// newer posts.
+func (e TimelineEntry) IsZero() bool {
+	return e.Timestamp == 0 && e.PostId == 0
+}
+
+func (e TimelineEntry) Less(other TimelineEntry) bool {
+	if e.Timestamp != other.Timestamp {
+		return e.Timestamp < other.Timestamp
+	}
+	return e.PostId < other.PostId
+}
+
+// Cursor encodes e as an opaque string handed out to clients. The zero entry
+// encodes as the empty string.
+func (e TimelineEntry) Cursor() string {
+	if e.IsZero() {
+		return ""
+	}
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], uint64(e.Timestamp))
+	binary.BigEndian.PutUint64(buf[8:], uint64(e.PostId))
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// ParseTimelineCursor decodes a cursor returned by TimelineEntry.Cursor.
+func ParseTimelineCursor(cursor string) (TimelineEntry, error) {
+	if cursor == "" {
+		return TimelineEntry{}, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) != 16 {
+		return TimelineEntry{}, fmt.Errorf("invalid timeline cursor %q", cursor)
+	}
+	return TimelineEntry{
+		Timestamp: int64(binary.BigEndian.Uint64(buf[:8])),
+		PostId:    int64(binary.BigEndian.Uint64(buf[8:])),
+	}, nil
+}
+
+// TimelinePage is a page of a timeline, newest post first. Older and Newer
+// are the cursors to pass to read the next page in either direction; both
+// are the requested cursor when the page is empty.
+type TimelinePage struct {
+	weaver.AutoMarshal
+	Posts []Post
+	Older string
+	Newer string
+}
+
+// readTimelinePage reads the entries of a timeline on the direction side of
+// cursor, skipping the start entries closest to it, and resolves them into
+// posts.
+func readTimelinePage(
+	ctx context.Context,
+	storage IStorage,
+	postStorageService PostStorageServicer,
+	userId int64,
+	kind TimelineKind,
+	cursor string,
+	direction TimelineDirection,
+	start, stop int,
+) (TimelinePage, error) {
+	page := TimelinePage{Posts: make([]Post, 0), Older: cursor, Newer: cursor}
+	entry, err := ParseTimelineCursor(cursor)
+	if err != nil {
+		return page, err
+	}
+	if stop <= start || start < 0 {
+		return page, nil
+	}
+	entries, err := storage.GetPostTimeline(ctx, userId, kind, entry, direction, start, stop)
+	if err != nil || len(entries) == 0 {
+		return page, err
+	}
+
+	postIds := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		postIds = append(postIds, e.PostId)
+	}
+	posts, err := postStorageService.ReadPosts(ctx, postIds)
+	if err != nil {
+		return page, err
+	}
+	// Posts that expired but are not swept from the timeline yet are missing.
+	for _, post := range posts {
+		if post.Post_id != 0 {
+			page.Posts = append(page.Posts, post)
+		}
+	}
+	page.Newer = entries[0].Cursor()
+	page.Older = entries[len(entries)-1].Cursor()
+	return page, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ServiceWeaver/weaver/weavertest"
+)
+
+func TestParseTimelineCursor(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cursor  string
+		want    TimelineEntry
+		wantErr bool
+	}{
+		{name: "empty", cursor: ""},
+		{name: "entry", cursor: TimelineEntry{Timestamp: 1700000000000, PostId: 42}.Cursor(), want: TimelineEntry{Timestamp: 1700000000000, PostId: 42}},
+		{name: "not base64", cursor: "not a cursor!", wantErr: true},
+		{name: "too short", cursor: "AAAA", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseTimelineCursor(tc.cursor)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseTimelineCursor(%q) error = %v, want error %v", tc.cursor, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("ParseTimelineCursor(%q) = %+v, want %+v", tc.cursor, got, tc.want)
+			}
+		})
+	}
+}
+
+// timelineRunner runs the timeline services on Storage with the backend.
+func timelineRunner(t *testing.T, backend string) weavertest.Runner {
+	config := fmt.Sprintf(`
+["SocialNetwork/server/IStorage"]
+backend = %q
+`, backend)
+	if backend == SQLITE_BACKEND {
+		config += fmt.Sprintf("data_dir = %q\n", t.TempDir())
+	}
+	return userServiceRunner(config)
+}
+
+func pagePostIds(page TimelinePage) []int64 {
+	postIds := make([]int64, 0, len(page.Posts))
+	for _, post := range page.Posts {
+		postIds = append(postIds, post.Post_id)
+	}
+	return postIds
+}
+
+// Pages are newest first, and the cursors of a page keep reading from the
+// same place while newer and older posts are added.
+func TestTimelinePagesWhilePosting(t *testing.T) {
+	ctx := context.Background()
+	const userId = 1
+	for _, backend := range []string{MEMORY_BACKEND, SQLITE_BACKEND} {
+		t.Run(backend, func(t *testing.T) {
+			timelineRunner(t, backend).Test(t, func(t *testing.T, uts IUserTimelineService, posts PostStorageServicer) {
+				post := func(postId, timestamp int64) {
+					t.Helper()
+					if err := posts.StorePost(ctx, Post{Post_id: postId, Creator: Creator{UserId: userId}, Timestamp: timestamp}); err != nil {
+						t.Fatal(err)
+					}
+					if err := uts.WriteUserTimeline(ctx, postId, userId, timestamp); err != nil {
+						t.Fatal(err)
+					}
+				}
+				// Posts 2n-1 and 2n share a timestamp; the post id orders them.
+				for postId := int64(1); postId <= 6; postId++ {
+					post(postId, 100+(postId+1)/2)
+				}
+				read := func(cursor string, direction TimelineDirection, start, stop int) TimelinePage {
+					t.Helper()
+					page, err := uts.ReadUserTimelinePage(ctx, userId, userId, cursor, direction, start, stop)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return page
+				}
+
+				first := read("", TIMELINE_OLDER, 0, 3)
+				if got, want := pagePostIds(first), []int64{6, 5, 4}; !reflect.DeepEqual(got, want) {
+					t.Fatalf("first page = %v, want %v", got, want)
+				}
+				// Newer posts, a post between older ones and an older post are
+				// added after the first page was read.
+				post(7, 200)
+				post(8, 201)
+				post(9, 101)
+				post(10, 50)
+
+				for _, tc := range []struct {
+					name        string
+					cursor      string
+					direction   TimelineDirection
+					start, stop int
+					want        []int64
+				}{
+					{"older", first.Older, TIMELINE_OLDER, 0, 3, []int64{3, 9, 2}},
+					{"older skipped", first.Older, TIMELINE_OLDER, 3, 6, []int64{1, 10}},
+					{"newer", first.Newer, TIMELINE_NEWER, 0, 3, []int64{8, 7}},
+					{"newer skipped", first.Newer, TIMELINE_NEWER, 1, 3, []int64{8}},
+					{"from the oldest", "", TIMELINE_NEWER, 0, 2, []int64{1, 10}},
+					{"newest", "", TIMELINE_OLDER, 0, 2, []int64{8, 7}},
+				} {
+					t.Run(tc.name, func(t *testing.T) {
+						page := read(tc.cursor, tc.direction, tc.start, tc.stop)
+						if got := pagePostIds(page); !reflect.DeepEqual(got, tc.want) {
+							t.Errorf("page = %v, want %v", got, tc.want)
+						}
+					})
+				}
+
+				// Following the cursors covers every post once, newest first.
+				var all []int64
+				for cursor := ""; ; {
+					page := read(cursor, TIMELINE_OLDER, 0, 4)
+					if len(page.Posts) == 0 {
+						if page.Older != cursor || page.Newer != cursor {
+							t.Errorf("empty page moved the cursors to %q and %q", page.Older, page.Newer)
+						}
+						break
+					}
+					all = append(all, pagePostIds(page)...)
+					cursor = page.Older
+				}
+				if want := []int64{8, 7, 6, 5, 4, 3, 9, 2, 1, 10}; !reflect.DeepEqual(all, want) {
+					t.Errorf("paged through %v, want %v", all, want)
+				}
+				if _, err := uts.ReadUserTimelinePage(ctx, userId, userId, "bad cursor", TIMELINE_OLDER, 0, 3); err == nil {
+					t.Error("ReadUserTimelinePage accepted an invalid cursor")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Access tokens are HS256 tokens whose claims are all strings: the user_id
+// and username of the user, the session_id and session_created (in unix
+// milliseconds) of its session, the unix timestamp in seconds at which the
+// token was issued, and its ttl in seconds. A token is
+// valid from its timestamp, give or take TOKEN_CLOCK_SKEW, until ttl seconds
+// later, unless its session was revoked; see session.go. Tokens are signed
+// with the current secret and verified with it or any of the previous secrets,
+// so that the secret can be rotated without logging everyone out.
+
+const TOKEN_CLOCK_SKEW = time.Minute
+
+var errInvalidToken = errors.New("token: invalid")
+
+// tokenClaims are the claims of an access token besides its validity period.
+type tokenClaims struct {
+	Creator
+	SessionId string
+	// SessionCreated is in unix milliseconds.
+	SessionCreated int64
+}
+
+func signToken(claims tokenClaims, issued time.Time, ttl time.Duration, secret []byte) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id":         strconv.FormatInt(claims.UserId, 10),
+		"username":        claims.Username,
+		"session_id":      claims.SessionId,
+		"session_created": strconv.FormatInt(claims.SessionCreated, 10),
+		"timestamp":       strconv.FormatInt(issued.Unix(), 10),
+		"ttl":             strconv.FormatInt(int64(ttl/time.Second), 10),
+	})
+	return token.SignedString(secret)
+}
+
+// parseToken checks the signature of the token against each of the secrets
+// and its validity period, and returns its claims. It does not check whether
+// the session was revoked.
+func parseToken(tokenString string, now time.Time, secrets [][]byte) (tokenClaims, error) {
+	var token *jwt.Token
+	err := errInvalidToken
+	for _, secret := range secrets {
+		token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			if token.Method != jwt.SigningMethodHS256 {
+				return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+			}
+			return secret, nil
+		})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return tokenClaims{}, errInvalidToken
+	}
+	claim := func(name string) (string, error) {
+		value, ok := mapClaims[name].(string)
+		if !ok {
+			return "", fmt.Errorf("%w: missing %s claim", errInvalidToken, name)
+		}
+		return value, nil
+	}
+	intClaim := func(name string) (int64, error) {
+		value, err := claim(name)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: malformed %s claim", errInvalidToken, name)
+		}
+		return n, nil
+	}
+
+	var claims tokenClaims
+	if claims.UserId, err = intClaim("user_id"); err != nil {
+		return tokenClaims{}, err
+	}
+	if claims.Username, err = claim("username"); err != nil {
+		return tokenClaims{}, err
+	}
+	if claims.SessionId, err = claim("session_id"); err != nil {
+		return tokenClaims{}, err
+	}
+	if claims.SessionCreated, err = intClaim("session_created"); err != nil {
+		return tokenClaims{}, err
+	}
+	timestamp, err := intClaim("timestamp")
+	if err != nil {
+		return tokenClaims{}, err
+	}
+	ttl, err := intClaim("ttl")
+	if err != nil {
+		return tokenClaims{}, err
+	}
+	issued := time.Unix(timestamp, 0)
+	if ttl <= 0 || now.Add(TOKEN_CLOCK_SKEW).Before(issued) {
+		return tokenClaims{}, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	if !now.Before(issued.Add(time.Duration(ttl) * time.Second)) {
+		return tokenClaims{}, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	return claims, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseToken does not check revocations; see TestVerifyRevokedToken.
+func TestParseToken(t *testing.T) {
+	current := []byte(strings.Repeat("c", MIN_TOKEN_SECRET_LEN))
+	previous := []byte(strings.Repeat("p", MIN_TOKEN_SECRET_LEN))
+	now := time.Unix(1700000000, 0)
+	const ttl = 15 * time.Minute
+	claims := tokenClaims{
+		Creator:        Creator{UserId: 42, Username: "alice"},
+		SessionId:      "session",
+		SessionCreated: now.Add(-time.Hour).UnixMilli(),
+	}
+	for _, tc := range []struct {
+		name     string
+		signedBy []byte
+		issued   time.Time
+		secrets  [][]byte
+		wantErr  string
+	}{
+		{
+			name:     "current secret",
+			signedBy: current,
+			issued:   now.Add(-time.Minute),
+			secrets:  [][]byte{current, previous},
+		},
+		{
+			name:     "rotated secret",
+			signedBy: previous,
+			issued:   now.Add(-time.Minute),
+			secrets:  [][]byte{current, previous},
+		},
+		{
+			name:     "retired secret",
+			signedBy: previous,
+			issued:   now.Add(-time.Minute),
+			secrets:  [][]byte{current},
+			wantErr:  "signature is invalid",
+		},
+		{
+			name:     "expired",
+			signedBy: current,
+			issued:   now.Add(-ttl - time.Second),
+			secrets:  [][]byte{current},
+			wantErr:  "expired",
+		},
+		{
+			name:     "expires after exactly ttl",
+			signedBy: current,
+			issued:   now.Add(-ttl),
+			secrets:  [][]byte{current},
+			wantErr:  "expired",
+		},
+		{
+			name:     "issued within the clock skew",
+			signedBy: current,
+			issued:   now.Add(TOKEN_CLOCK_SKEW / 2),
+			secrets:  [][]byte{current},
+		},
+		{
+			name:     "issued in the future",
+			signedBy: current,
+			issued:   now.Add(2 * TOKEN_CLOCK_SKEW),
+			secrets:  [][]byte{current},
+			wantErr:  "not valid yet",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := signToken(claims, tc.issued, ttl, tc.signedBy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseToken(token, now, tc.secrets)
+			if tc.wantErr != "" {
+				if !errors.Is(err, errInvalidToken) || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("parseToken: got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != claims {
+				t.Errorf("parseToken = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	secret := strings.Repeat("s", MIN_TOKEN_SECRET_LEN)
+	for _, tc := range []struct {
+		name     string
+		current  string
+		previous []string
+		wantErr  string
+	}{
+		{name: "current only", current: secret},
+		{name: "with previous", current: secret, previous: []string{strings.Repeat("p", MIN_TOKEN_SECRET_LEN)}},
+		{name: "unset", wantErr: "token_secret must be set"},
+		{name: "too short", current: secret[1:], wantErr: "token_secret is"},
+		{name: "short previous", current: secret, previous: []string{"p"}, wantErr: "previous_token_secrets[0] is"},
+		{name: "repeated", current: secret, previous: []string{secret}, wantErr: "repeats"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			us := &UserService{}
+			us.Config().TokenSecret = tc.current
+			us.Config().PreviousTokenSecrets = tc.previous
+			err := us.LoadSecrets()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(us.secrets) != 1+len(tc.previous) {
+					t.Errorf("got %d secrets, want %d", len(us.secrets), 1+len(tc.previous))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("LoadSecrets: got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
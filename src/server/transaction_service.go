@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ServiceWeaver/weaver"
+)
+
+const (
+	DEFAULT_RESOLVE_INTERVAL_SEC = 10
+	// TXN_RESOLVE_AFTER is how old a pending intent must be before anyone but
+	// the caller that committed it rolls it forward. Rolling forward an
+	// intent whose own caller is still applying it could otherwise redo a
+	// mutation after a later transaction on the same keys.
+	TXN_RESOLVE_AFTER = 5 * time.Second
+	// TXN_CONFLICT_WAIT is how long Commit waits for conflicting pending
+	// intents to be rolled forward before giving up.
+	TXN_CONFLICT_WAIT  = 2 * TXN_RESOLVE_AFTER
+	TXN_CONFLICT_RETRY = 50 * time.Millisecond
+)
+
+type transactionConfig struct {
+	// ResolveIntervalSec is how often the intents left pending by failed
+	// callers are rolled forward.
+	ResolveIntervalSec int `toml:"resolve_interval_sec"`
+}
+
+type ITransactionService interface {
+	// Commit applies the transaction, whose keys may belong to several
+	// routing buckets, if its preconditions hold, and reports whether they
+	// did. The preconditions must be in the bucket of the first mutation.
+	Commit(context.Context, StorageTransaction) (bool, error)
+	// ResolvePending rolls forward the intents that their callers left
+	// pending, and returns their number.
+	ResolvePending(context.Context) (int, error)
+}
+
+// TransactionService runs the transactions of Storage that span several
+// routing buckets; see storage_txn.go. Once the part in the home bucket is
+// applied the transaction is committed, and the rest is rolled forward,
+// if need be by ResolvePending after the caller failed.
+type TransactionService struct {
+	weaver.Implements[ITransactionService]
+	weaver.WithConfig[transactionConfig]
+
+	storage weaver.Ref[IStorage]
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (ts *TransactionService) Init(context.Context) error {
+	interval := time.Duration(ts.Config().ResolveIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = DEFAULT_RESOLVE_INTERVAL_SEC * time.Second
+	}
+	ts.done = make(chan struct{})
+	ts.wg.Add(1)
+	go func() {
+		defer ts.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ts.done:
+				return
+			case <-ticker.C:
+			}
+			if _, err := ts.ResolvePending(context.Background()); err != nil {
+				fmt.Printf("[TransactionService] cannot resolve pending transactions: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (ts *TransactionService) Shutdown(context.Context) error {
+	close(ts.done)
+	ts.wg.Wait()
+	return nil
+}
+
+func (ts *TransactionService) Commit(ctx context.Context, txn StorageTransaction) (bool, error) {
+	storage := ts.storage.Get()
+	home := txn.homeBucket()
+	local := StorageTransaction{Preconditions: txn.Preconditions}
+	remote := make([]StorageMutation, 0)
+	for _, m := range txn.Mutations {
+		if mutationBucket(m) == home {
+			local.Mutations = append(local.Mutations, m)
+		} else {
+			remote = append(remote, m)
+		}
+	}
+	if len(remote) > 0 {
+		local.Intent = StorageIntent{Id: newTxnId(), Bucket: home, CreatedAt: nowMillis(), Mutations: remote}
+	}
+
+	deadline := time.Now().Add(TXN_CONFLICT_WAIT)
+	retried := false
+	for {
+		applied, err := storage.Transact(ctx, home, local)
+		if err != nil || applied {
+			if err == nil && local.Intent.Id != "" {
+				if err := ts.rollForward(ctx, local.Intent); err != nil {
+					fmt.Printf("[TransactionService] transaction %s is left pending: %v\n", local.Intent.Id, err)
+				}
+			}
+			return applied, err
+		}
+
+		// The transaction was not applied because a precondition does not
+		// hold or because it conflicts with a pending intent.
+		pending, err := storage.GetTxnIntents(ctx, home)
+		if err != nil {
+			return false, err
+		}
+		if time.Now().After(deadline) {
+			return false, fmt.Errorf("transaction: conflicting transactions are still pending in bucket %d", home)
+		}
+		if !local.conflicts(pending) {
+			// The conflicting intents may have been rolled forward since.
+			// Without preconditions, the transaction can only have failed
+			// because of one.
+			if len(local.Preconditions) > 0 && retried {
+				return false, nil
+			}
+			retried = true
+			continue
+		}
+		if _, err := ts.resolve(ctx, pending); err != nil {
+			return false, err
+		}
+		time.Sleep(TXN_CONFLICT_RETRY)
+	}
+}
+
+func (ts *TransactionService) ResolvePending(ctx context.Context) (int, error) {
+	storage := ts.storage.Get()
+	var mu sync.Mutex
+	resolved := 0
+	err := forEachRoutingBucket(func(bucket int) error {
+		pending, err := storage.GetTxnIntents(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		n, err := ts.resolve(ctx, pending)
+		mu.Lock()
+		defer mu.Unlock()
+		resolved += n
+		return err
+	})
+	return resolved, err
+}
+
+// resolve rolls forward the intents older than TXN_RESOLVE_AFTER.
+func (ts *TransactionService) resolve(ctx context.Context, pending []StorageIntent) (int, error) {
+	resolved := 0
+	for _, intent := range pending {
+		if nowMillis()-intent.CreatedAt < TXN_RESOLVE_AFTER.Milliseconds() {
+			continue
+		}
+		if err := ts.rollForward(ctx, intent); err != nil {
+			return resolved, err
+		}
+		fmt.Printf("[TransactionService] rolled forward pending transaction %s\n", intent.Id)
+		resolved++
+	}
+	return resolved, nil
+}
+
+// rollForward applies the mutations of the intent, bucket by bucket, and
+// then removes the intent.
+func (ts *TransactionService) rollForward(ctx context.Context, intent StorageIntent) error {
+	storage := ts.storage.Get()
+	buckets := make(map[int][]StorageMutation)
+	for _, m := range intent.Mutations {
+		bucket := mutationBucket(m)
+		buckets[bucket] = append(buckets[bucket], m)
+	}
+	errs := make(chan error, len(buckets))
+	for bucket, mutations := range buckets {
+		go func(bucket int, mutations []StorageMutation) {
+			_, err := storage.Transact(ctx, bucket, StorageTransaction{Mutations: mutations})
+			errs <- err
+		}(bucket, mutations)
+	}
+	var first error
+	for range buckets {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return first
+	}
+
+	_, err := storage.Transact(ctx, intent.Bucket, StorageTransaction{
+		Mutations: []StorageMutation{{Op: OP_REMOVE_TXN_INTENT, StrKey: intent.Id, IntKey: int64(intent.Bucket)}},
+	})
+	return err
+}
+
+func newTxnId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -14,18 +14,32 @@ import (
 	"github.com/ServiceWeaver/weaver"
 )
 
+// MACHINE_ID_DIGITS is the number of hex digits of machine ids.
+const MACHINE_ID_DIGITS = 3
+
+type uniqueIdConfig struct {
+	// MachineId is the machine id, of up to MACHINE_ID_DIGITS hex digits, in
+	// the ids composed by every replica. Replicas that share a machine id may
+	// compose the same ids, so deployments with several replicas set
+	// MachineIdNetif instead, and each replica derives its machine id from
+	// the MAC address of that network interface and its process id. Without
+	// either the machine id is 0.
+	MachineId      string `toml:"machine_id"`
+	MachineIdNetif string `toml:"machine_id_netif"`
+}
+
 type IUniqueIdService interface {
 	ComposeUniqueId(context.Context, PostType) (int64, error)
 }
 
 type UniqueIdService struct {
 	weaver.Implements[IUniqueIdService]
+	weaver.WithConfig[uniqueIdConfig]
 
 	mu               sync.Mutex
 	currentTimestamp int64
 	counter          int
-	// TODO: How to obtain the machine id?
-	machineId string
+	machineId        string
 }
 
 // // Custom Epoch (January 1, 2018 Midnight GMT = 2018-01-01T00:00:00Z)
@@ -34,10 +48,32 @@ type UniqueIdService struct {
 func (s *UniqueIdService) Init(context.Context) error {
 	s.currentTimestamp = -1
 	s.counter = 0
-	s.machineId = "0000000000000000"
+	machineId, err := s.loadMachineId()
+	if err != nil {
+		return err
+	}
+	s.machineId = machineId
+	fmt.Printf("[UniqueIdService] machine id: %s\n", machineId)
 	return nil
 }
 
+func (s *UniqueIdService) loadMachineId() (string, error) {
+	cfg := s.Config()
+	switch {
+	case cfg.MachineId != "" && cfg.MachineIdNetif != "":
+		return "", fmt.Errorf("unique id service: set either machine_id or machine_id_netif, not both")
+	case cfg.MachineIdNetif != "":
+		return GetMachineId(cfg.MachineIdNetif)
+	case cfg.MachineId == "":
+		return strings.Repeat("0", MACHINE_ID_DIGITS), nil
+	}
+	if _, err := strconv.ParseUint(cfg.MachineId, 16, 64); err != nil || len(cfg.MachineId) > MACHINE_ID_DIGITS {
+		return "", fmt.Errorf("unique id service: machine_id %q is not a hex number of up to %d digits",
+			cfg.MachineId, MACHINE_ID_DIGITS)
+	}
+	return strings.Repeat("0", MACHINE_ID_DIGITS-len(cfg.MachineId)) + strings.ToLower(cfg.MachineId), nil
+}
+
 func (s *UniqueIdService) ComposeUniqueId(_ context.Context, postType PostType) (int64, error) {
 	timestamp := time.Now().UnixNano()/int64(time.Millisecond) - int64(CUSTOM_EPOCH)
 	idx := s.GetCounter(timestamp)
@@ -65,13 +101,12 @@ func (s *UniqueIdService) ComposeUniqueId(_ context.Context, postType PostType)
 	return postID, nil
 }
 
-func GetMachineId(netif string) string {
+func GetMachineId(netif string) (string, error) {
 	macAddrFilename := "/sys/class/net/" + netif + "/address"
 
 	macAddrFile, err := os.Open(macAddrFilename)
 	if err != nil {
-		log.Fatalf("Cannot read MAC address from net interface %s: %v", netif, err)
-		return ""
+		return "", fmt.Errorf("cannot read MAC address from net interface %s: %w", netif, err)
 	}
 	defer macAddrFile.Close()
 
@@ -79,21 +114,20 @@ func GetMachineId(netif string) string {
 	scanner.Scan()
 	mac := scanner.Text()
 	if mac == "" {
-		log.Fatalf("Cannot read MAC address from net interface %s", netif)
-		return ""
+		return "", fmt.Errorf("cannot read MAC address from net interface %s", netif)
 	}
 
 	log.Printf("MAC address = %s", mac)
 
 	macHash := fmt.Sprintf("%x", HashMacAddressPid(mac))
 
-	if len(macHash) > 3 {
-		macHash = macHash[len(macHash)-3:]
-	} else if len(macHash) < 3 {
-		macHash = strings.Repeat("0", 3-len(macHash)) + macHash
+	if len(macHash) > MACHINE_ID_DIGITS {
+		macHash = macHash[len(macHash)-MACHINE_ID_DIGITS:]
+	} else if len(macHash) < MACHINE_ID_DIGITS {
+		macHash = strings.Repeat("0", MACHINE_ID_DIGITS-len(macHash)) + macHash
 	}
 
-	return macHash
+	return macHash, nil
 }
 
 func HashMacAddressPid(mac string) uint16 {
@@ -102,9 +136,7 @@ func HashMacAddressPid(mac string) uint16 {
 	macPid := mac + strconv.Itoa(pid)
 
 	for i, char := range macPid {
-		if i < len(mac) { // Ensure we only consider the MAC address length for the hash calculation
-			hash += uint16(char) << ((i & 1) * 8)
-		}
+		hash += uint16(char) << ((i & 1) * 8)
 	}
 	return hash
 }
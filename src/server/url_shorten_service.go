@@ -16,6 +16,7 @@ type IUrlShortenService interface {
 
 type UrlShortenService struct {
 	weaver.Implements[IUrlShortenService]
+	weaver.WithConfig[ttlConfig]
 
 	storage weaver.Ref[IStorage]
 }
@@ -31,11 +32,12 @@ func (us *UrlShortenService) ComposeUrl(ctx context.Context, urls []string) ([]U
 	}
 	var wg sync.WaitGroup
 	storage := us.storage.Get()
+	ttl := us.Config().ttl()
 	for _, url := range targetUrls {
 		wg.Add(1)
 		go func(url Url) {
 			defer wg.Done()
-			storage.PutShortenUrl(ctx, url.ShortenedUrl, url.ExpandedUrl)
+			storage.PutShortenUrl(ctx, url.ShortenedUrl, url.ExpandedUrl, ttl)
 		}(url)
 	}
 	wg.Wait()
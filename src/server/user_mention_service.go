@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
-  "strings"
+	"strings"
 
 	"github.com/ServiceWeaver/weaver"
 )
 
 type IUserMentionService interface {
-	ComposeUserMentions(context.Context, []string) ([]UserMention, error)
+	// ComposeUserMentions resolves the usernames mentioned by the user,
+	// leaving out those that do not exist and those that the user blocks or
+	// is blocked by.
+	ComposeUserMentions(context.Context, int64, []string) ([]UserMention, error)
 }
 
 type UserMentionService struct {
@@ -20,21 +23,32 @@ type UserMentionService struct {
 
 // trimUsername checks if the username starts with "@" and trims it
 func trimUsername(username string) string {
-    if strings.HasPrefix(username, "@") {
-        return strings.TrimPrefix(username, "@")
-    }
-    return username
+	if strings.HasPrefix(username, "@") {
+		return strings.TrimPrefix(username, "@")
+	}
+	return username
 }
 
-func (s *UserMentionService) ComposeUserMentions(ctx context.Context, usernames []string) ([]UserMention, error) {
+func (s *UserMentionService) ComposeUserMentions(ctx context.Context, userId int64, usernames []string) ([]UserMention, error) {
 	storage := s.storage.Get()
+	trimmed := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		trimmed = append(trimmed, trimUsername(username))
+	}
+	profiles, err := getUserProfilesBatched(ctx, storage, trimmed)
+	if err != nil {
+		return make([]UserMention, 0), err
+	}
+	blocked, err := relatedUsers(ctx, storage, userId, RELATION_BLOCKED, RELATION_BLOCKERS)
+	if err != nil {
+		return make([]UserMention, 0), err
+	}
 	user_mentions := make([]UserMention, 0)
-	for i, username := range usernames {
-    username = trimUsername(username)
-		user_profile, exist, _ := storage.GetUserProfile(ctx, username)
+	for i, username := range trimmed {
+		user_profile, exist := profiles[username]
 		if !exist {
 			fmt.Printf("[ComposeUserMentions] User profile not found for username: %s\n", username)
-		} else {
+		} else if !blocked[user_profile.UserId] {
 			user_mentions = append(user_mentions, UserMention{
 				UserId:   user_profile.UserId,
 				Username: usernames[i],
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ServiceWeaver/weaver"
+	"github.com/google/btree"
+)
+
+// User search.
+//
+// Every UserService replica keeps an index of the user profiles in memory,
+// which it builds from Storage without any change to the services that write
+// profiles. It loads each routing bucket with GetBucketProfiles, which reads
+// only the public part of its profiles, and then follows
+// the change feed of the bucket, reloading the bucket whenever it falls
+// behind; see storage_changes.go. Searches are therefore eventually
+// consistent, and fail with SEARCH_NOT_READY until every bucket is loaded.
+//
+// Queries are matched case-insensitively against the username, the first and
+// last names and the full name. SEARCH_PREFIX matches the users of which one
+// of them starts with the query, and SEARCH_SUBSTRING those of which one of
+// them contains it. Results are ranked by how well they match, as listed by
+// the SEARCH_RANK constants, then shorter usernames first, and are paginated
+// with a cursor that stays valid as users come and go.
+
+type UserSearchErrorCode int
+
+const (
+	INVALID_SEARCH UserSearchErrorCode = iota + 1
+	SEARCH_NOT_READY
+)
+
+func (sec UserSearchErrorCode) String() string {
+	return [...]string{"INVALID SEARCH", "SEARCH NOT READY"}[sec-1]
+}
+
+// UserSearchError is returned when a search cannot be served. Its fields are
+// exported so that it keeps its code across components.
+type UserSearchError struct {
+	weaver.AutoMarshal
+	Code   UserSearchErrorCode
+	Detail string
+}
+
+func NewUserSearchError(code UserSearchErrorCode, detail string) *UserSearchError {
+	return &UserSearchError{Code: code, Detail: detail}
+}
+
+func (se *UserSearchError) Error() string {
+	return fmt.Sprintf("User search error. code: %d, err: %v: %s", se.Code, se.Code, se.Detail)
+}
+
+const (
+	// SEARCH_QUERY_MAX_LEN is in bytes.
+	SEARCH_QUERY_MAX_LEN = 64
+	DEFAULT_SEARCH_LIMIT = 20
+	MAX_SEARCH_LIMIT     = 100
+
+	// SEARCH_FEED_BATCH is the number of changes read from a change feed at
+	// a time.
+	SEARCH_FEED_BATCH = 1000
+	// SEARCH_RETRY_INTERVAL is how long an index waits after it failed to
+	// load or follow a bucket.
+	SEARCH_RETRY_INTERVAL = 500 * time.Millisecond
+)
+
+// The ranks of the matches of a query, best first.
+const (
+	SEARCH_RANK_USERNAME = iota
+	SEARCH_RANK_USERNAME_PREFIX
+	SEARCH_RANK_NAME_PREFIX
+	SEARCH_RANK_USERNAME_SUBSTRING
+	SEARCH_RANK_NAME_SUBSTRING
+	// SEARCH_RANK_NONE is the rank of users that do not match.
+	SEARCH_RANK_NONE
+)
+
+// UserSearchPage is a page of search results. Next is the cursor to pass to
+// read the next page, or empty if this is the last one.
+type UserSearchPage struct {
+	weaver.AutoMarshal
+	Users []UserInfo
+	Next  string
+}
+
+// userInfo returns the public part of the profile of username.
+func userInfo(username string, profile UserProfile) UserInfo {
+	return UserInfo{
+		UserId:    profile.UserId,
+		Username:  username,
+		FirstName: profile.FirstName,
+		LastName:  profile.LastName,
+		Bio:       profile.Bio,
+		Avatar:    profile.Avatar,
+		CreatedAt: profile.CreatedAt,
+		Private:   profile.Private,
+	}
+}
+
+// searchEntry is a user of the index, with the lower case forms of the
+// fields that queries are matched against.
+type searchEntry struct {
+	info     UserInfo
+	username string
+	first    string
+	last     string
+	full     string
+}
+
+func newSearchEntry(info UserInfo) *searchEntry {
+	first, last := strings.ToLower(info.FirstName), strings.ToLower(info.LastName)
+	return &searchEntry{
+		info:     info,
+		username: strings.ToLower(info.Username),
+		first:    first,
+		last:     last,
+		full:     strings.TrimSpace(first + " " + last),
+	}
+}
+
+// terms returns the forms of e that prefix queries are looked up by.
+func (e *searchEntry) terms() []searchTerm {
+	terms := make([]searchTerm, 0, 4)
+	for _, term := range []string{e.username, e.first, e.last, e.full} {
+		if term != "" {
+			terms = append(terms, searchTerm{term: term, username: e.info.Username})
+		}
+	}
+	return terms
+}
+
+// rank returns how well e matches the lower case query.
+func (e *searchEntry) rank(query string, mode UserSearchMode) int {
+	switch {
+	case e.username == query:
+		return SEARCH_RANK_USERNAME
+	case strings.HasPrefix(e.username, query):
+		return SEARCH_RANK_USERNAME_PREFIX
+	case strings.HasPrefix(e.first, query) || strings.HasPrefix(e.last, query) || strings.HasPrefix(e.full, query):
+		return SEARCH_RANK_NAME_PREFIX
+	case mode != SEARCH_SUBSTRING:
+		return SEARCH_RANK_NONE
+	case strings.Contains(e.username, query):
+		return SEARCH_RANK_USERNAME_SUBSTRING
+	case strings.Contains(e.full, query):
+		return SEARCH_RANK_NAME_SUBSTRING
+	}
+	return SEARCH_RANK_NONE
+}
+
+type searchTerm struct {
+	term     string
+	username string
+}
+
+func (t searchTerm) Less(other searchTerm) bool {
+	if t.term != other.term {
+		return t.term < other.term
+	}
+	return t.username < other.username
+}
+
+// searchHit is a user that matches a query, and its position in the results.
+type searchHit struct {
+	rank     int
+	username string
+}
+
+func (h searchHit) Less(other searchHit) bool {
+	if h.rank != other.rank {
+		return h.rank < other.rank
+	}
+	if len(h.username) != len(other.username) {
+		return len(h.username) < len(other.username)
+	}
+	return h.username < other.username
+}
+
+// Cursor encodes h as an opaque string handed out to clients.
+func (h searchHit) Cursor() string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte{byte(h.rank)}, h.username...))
+}
+
+// parseSearchCursor decodes a cursor returned by searchHit.Cursor. The empty
+// cursor stands for the start of the results.
+func parseSearchCursor(cursor string) (searchHit, bool, error) {
+	if cursor == "" {
+		return searchHit{}, false, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) < 2 || buf[0] >= SEARCH_RANK_NONE {
+		return searchHit{}, false, NewUserSearchError(INVALID_SEARCH, fmt.Sprintf("invalid cursor %q", cursor))
+	}
+	return searchHit{rank: int(buf[0]), username: string(buf[1:])}, true, nil
+}
+
+// searchIndex holds the users of every routing bucket that it loaded.
+type searchIndex struct {
+	mu     sync.RWMutex
+	users  map[string]*searchEntry
+	terms  *btree.BTreeG[searchTerm]
+	loaded [STORAGE_ROUTING_BUCKETS]bool
+	// unloaded is the number of buckets that were never loaded.
+	unloaded int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		users:    make(map[string]*searchEntry),
+		terms:    btree.NewG(32, searchTerm.Less),
+		unloaded: STORAGE_ROUTING_BUCKETS,
+		done:     make(chan struct{}),
+	}
+}
+
+// put adds or replaces a user. The caller holds mu.
+func (idx *searchIndex) put(info UserInfo) {
+	idx.remove(info.Username)
+	e := newSearchEntry(info)
+	idx.users[info.Username] = e
+	for _, term := range e.terms() {
+		idx.terms.ReplaceOrInsert(term)
+	}
+}
+
+// remove removes a user if it is there. The caller holds mu.
+func (idx *searchIndex) remove(username string) {
+	e, ok := idx.users[username]
+	if !ok {
+		return
+	}
+	for _, term := range e.terms() {
+		idx.terms.Delete(term)
+	}
+	delete(idx.users, username)
+}
+
+// load replaces the users of the bucket with the given ones.
+func (idx *searchIndex) load(bucket int, users []UserInfo) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	present := make(map[string]bool, len(users))
+	for _, info := range users {
+		present[info.Username] = true
+	}
+	for username := range idx.users {
+		if !present[username] && stringRoutingBucket(username) == bucket {
+			idx.remove(username)
+		}
+	}
+	for _, info := range users {
+		idx.put(info)
+	}
+	if !idx.loaded[bucket] {
+		idx.loaded[bucket] = true
+		idx.unloaded--
+	}
+}
+
+// apply applies the changes of user profiles.
+func (idx *searchIndex) apply(changes []StorageChange) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, c := range changes {
+		if c.Entity != MAP_USER_PROFILES.String() {
+			continue
+		}
+		if c.After.Exists {
+			idx.put(userInfo(c.Key, c.After.Profile))
+		} else {
+			idx.remove(c.Key)
+		}
+	}
+}
+
+// follow keeps the users of the bucket up to date until the index is
+// stopped.
+func (idx *searchIndex) follow(storage IStorage, bucket int) {
+	defer idx.wg.Done()
+	ctx := context.Background()
+	var feedId string
+	var next uint64
+	loaded := false
+	for {
+		select {
+		case <-idx.done:
+			return
+		default:
+		}
+		changes, err := storage.ReadChanges(ctx, bucket, feedId, next, SEARCH_FEED_BATCH)
+		if err == nil && (!loaded || changes.FellBehind) {
+			// The profiles read hold at least the changes up to Last, and
+			// those after it are applied again, which leaves the users as
+			// they are.
+			feedId, next = changes.FeedId, changes.Last+1
+			err = idx.reload(ctx, storage, bucket)
+			loaded = err == nil
+		} else if err == nil {
+			idx.apply(changes.Changes)
+			if n := len(changes.Changes); n > 0 {
+				next = changes.Changes[n-1].Seq + 1
+			}
+		}
+		if err != nil {
+			fmt.Printf("[UserService] cannot index the users of bucket %d: %v\n", bucket, err)
+			select {
+			case <-idx.done:
+				return
+			case <-time.After(SEARCH_RETRY_INTERVAL):
+			}
+		}
+	}
+}
+
+func (idx *searchIndex) reload(ctx context.Context, storage IStorage, bucket int) error {
+	users, err := storage.GetBucketProfiles(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	idx.load(bucket, users)
+	return nil
+}
+
+func (idx *searchIndex) start(storage IStorage) {
+	for bucket := 0; bucket < STORAGE_ROUTING_BUCKETS; bucket++ {
+		idx.wg.Add(1)
+		go idx.follow(storage, bucket)
+	}
+}
+
+func (idx *searchIndex) stop() {
+	close(idx.done)
+	idx.wg.Wait()
+}
+
+// search returns the users that match the lower case query after the
+// cursor, best first, and whether there are more.
+func (idx *searchIndex) search(query string, mode UserSearchMode, after searchHit, hasCursor bool, limit int) ([]UserInfo, searchHit, bool, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if idx.unloaded > 0 {
+		return nil, searchHit{}, false, NewUserSearchError(SEARCH_NOT_READY,
+			fmt.Sprintf("%d routing buckets are not indexed yet", idx.unloaded))
+	}
+
+	hits := make([]searchHit, 0)
+	consider := func(e *searchEntry) {
+		hit := searchHit{rank: e.rank(query, mode), username: e.info.Username}
+		if hit.rank != SEARCH_RANK_NONE && (!hasCursor || after.Less(hit)) {
+			hits = append(hits, hit)
+		}
+	}
+	if mode == SEARCH_SUBSTRING {
+		for _, e := range idx.users {
+			consider(e)
+		}
+	} else {
+		seen := make(map[string]bool)
+		idx.terms.AscendGreaterOrEqual(searchTerm{term: query}, func(t searchTerm) bool {
+			if !strings.HasPrefix(t.term, query) {
+				return false
+			}
+			if !seen[t.username] {
+				seen[t.username] = true
+				consider(idx.users[t.username])
+			}
+			return true
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Less(hits[j]) })
+
+	more := len(hits) > limit
+	if more {
+		hits = hits[:limit]
+	}
+	users := make([]UserInfo, 0, len(hits))
+	for _, hit := range hits {
+		users = append(users, idx.users[hit.username].info)
+	}
+	var last searchHit
+	if len(hits) > 0 {
+		last = hits[len(hits)-1]
+	}
+	return users, last, more, nil
+}
+
+func (us *UserService) SearchUsers(_ context.Context, query string, mode UserSearchMode, cursor string, limit int) (UserSearchPage, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" || len(query) > SEARCH_QUERY_MAX_LEN {
+		return UserSearchPage{}, NewUserSearchError(INVALID_SEARCH,
+			fmt.Sprintf("the query must be 1 to %d bytes long", SEARCH_QUERY_MAX_LEN))
+	}
+	if mode != SEARCH_PREFIX && mode != SEARCH_SUBSTRING {
+		return UserSearchPage{}, NewUserSearchError(INVALID_SEARCH, fmt.Sprintf("unknown mode %d", mode))
+	}
+	if limit <= 0 {
+		limit = DEFAULT_SEARCH_LIMIT
+	} else if limit > MAX_SEARCH_LIMIT {
+		limit = MAX_SEARCH_LIMIT
+	}
+	after, hasCursor, err := parseSearchCursor(cursor)
+	if err != nil {
+		return UserSearchPage{}, err
+	}
+	users, last, more, err := us.searchIndex.search(query, mode, after, hasCursor, limit)
+	if err != nil {
+		return UserSearchPage{}, err
+	}
+	page := UserSearchPage{Users: users}
+	if more {
+		page.Next = last.Cursor()
+	}
+	return page, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// GetBucketProfiles returns the users of one bucket only, without their
+// password hashes, whatever the backend.
+func TestGetBucketProfiles(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		backend string
+		dataDir bool
+	}{
+		{"memory", "memory", false},
+		{"persisted memory", "memory", true},
+		{"sqlite", "sqlite", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := &Storage{}
+			s.Config().Backend = tc.backend
+			if tc.dataDir {
+				s.Config().DataDir = t.TempDir()
+			}
+			if err := s.Init(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Shutdown(ctx)
+
+			want := make(map[int][]string)
+			for i := 0; i < 200; i++ {
+				username := fmt.Sprintf("user%d", i)
+				profile := UserProfile{UserId: int64(i), FirstName: "First", PasswordHashed: "secret"}
+				if err := s.PutUserProfile(ctx, username, profile); err != nil {
+					t.Fatal(err)
+				}
+				bucket := stringRoutingBucket(username)
+				want[bucket] = append(want[bucket], username)
+			}
+
+			for bucket := 0; bucket < STORAGE_ROUTING_BUCKETS; bucket++ {
+				users, err := s.GetBucketProfiles(ctx, bucket)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(users) != len(want[bucket]) {
+					t.Fatalf("bucket %d: got %d users, want %d", bucket, len(users), len(want[bucket]))
+				}
+				for _, info := range users {
+					if stringRoutingBucket(info.Username) != bucket {
+						t.Errorf("bucket %d: got %s of bucket %d", bucket, info.Username, stringRoutingBucket(info.Username))
+					}
+					if info.FirstName != "First" {
+						t.Errorf("%s: got first name %q", info.Username, info.FirstName)
+					}
+				}
+			}
+		})
+	}
+}
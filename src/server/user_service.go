@@ -2,15 +2,13 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
 	"strconv"
 	"time"
 
 	"github.com/ServiceWeaver/weaver"
-	"github.com/golang-jwt/jwt"
 )
 
 type LogErrorCode int
@@ -18,37 +16,192 @@ type LogErrorCode int
 const (
 	NOT_REGISTERED LogErrorCode = iota + 1
 	WRONG_PASSWORD
+	// PASSWORD_RESET_REQUIRED is returned for profiles whose password hash
+	// cannot be verified; see password.go.
+	PASSWORD_RESET_REQUIRED
+	// ACCOUNT_LOCKED and LOGIN_THROTTLED are returned when too many logins
+	// failed; see login_lockout.go.
+	ACCOUNT_LOCKED
+	LOGIN_THROTTLED
 )
 
 func (lec LogErrorCode) String() string {
-	return [...]string{"NOT REGISTERED", "WRONG PASSWORD"}[lec-1]
+	return [...]string{"NOT REGISTERED", "WRONG PASSWORD", "PASSWORD RESET REQUIRED", "ACCOUNT LOCKED", "LOGIN THROTTLED"}[lec-1]
 }
 
+// LogError is returned when a login fails. Its fields are exported so that it
+// keeps its code across components.
 type LogError struct {
-	err_code int
-	err_msg  string
+	weaver.AutoMarshal
+	Code LogErrorCode
+	// RetryAfterSec is the number of seconds until the next attempt is
+	// allowed, for ACCOUNT_LOCKED and LOGIN_THROTTLED.
+	RetryAfterSec int64
 }
 
-func NewLogError(err_code LogErrorCode) LogError {
-	return LogError{
-		err_code: int(err_code),
-		err_msg:  err_code.String(),
-	}
+func NewLogError(code LogErrorCode, retryAfterSec int64) *LogError {
+	return &LogError{Code: code, RetryAfterSec: retryAfterSec}
 }
 
 func (le *LogError) Error() string {
-	return fmt.Sprintf("Log error. code: %d, err: %v", le.err_code, le.err_msg)
+	return fmt.Sprintf("Log error. code: %d, err: %v", le.Code, le.Code)
+}
+
+type RegisterErrorCode int
+
+const (
+	USERNAME_TAKEN RegisterErrorCode = iota + 1
+	USER_ID_TAKEN
+	INVALID_USERNAME
+	INVALID_PASSWORD
+)
+
+func (rec RegisterErrorCode) String() string {
+	return [...]string{"USERNAME TAKEN", "USER ID TAKEN", "INVALID USERNAME", "INVALID PASSWORD"}[rec-1]
+}
+
+// RegisterError is returned when a user cannot be registered as asked. Its
+// fields are exported so that it keeps its code across components.
+type RegisterError struct {
+	weaver.AutoMarshal
+	Code   RegisterErrorCode
+	Detail string
+}
+
+func NewRegisterError(code RegisterErrorCode, detail string) *RegisterError {
+	return &RegisterError{Code: code, Detail: detail}
+}
+
+func (re *RegisterError) Error() string {
+	return fmt.Sprintf("Register error. code: %d, err: %v: %s", re.Code, re.Code, re.Detail)
+}
+
+const (
+	USERNAME_MIN_LEN = 3
+	USERNAME_MAX_LEN = 32
+	// REGISTER_USER_ATTEMPTS bounds the user ids that RegisterUser generates
+	// when one is taken.
+	REGISTER_USER_ATTEMPTS = 3
+)
+
+// validateUsername accepts USERNAME_MIN_LEN to USERNAME_MAX_LEN ascii
+// letters, digits, '_', '.' and '-', starting with a letter or a digit.
+func validateUsername(username string) error {
+	if len(username) < USERNAME_MIN_LEN || len(username) > USERNAME_MAX_LEN {
+		return NewRegisterError(INVALID_USERNAME,
+			fmt.Sprintf("must be %d to %d characters long", USERNAME_MIN_LEN, USERNAME_MAX_LEN))
+	}
+	for i, c := range username {
+		alnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if !alnum && (i == 0 || c != '_' && c != '.' && c != '-') {
+			return NewRegisterError(INVALID_USERNAME,
+				"must hold only letters, digits, '_', '.' and '-', and start with a letter or a digit")
+		}
+	}
+	return nil
+}
+
+type userConfig struct {
+	// The argon2id cost of new password hashes; 0 means the default. Stored
+	// hashes of another cost are rehashed on the next successful login.
+	Argon2Time      int `toml:"argon2_time"`
+	Argon2MemoryKiB int `toml:"argon2_memory_kib"`
+	Argon2Threads   int `toml:"argon2_threads"`
+	// After each failed login the next attempt of the username is refused
+	// for LoginDelayBaseMs, doubled with every failure up to LoginDelayMaxMs.
+	// LockoutThreshold failures within LockoutWindowSec lock the username for
+	// LockoutDurationSec. 0 means the default; see login_lockout.go.
+	LockoutThreshold   int `toml:"lockout_threshold"`
+	LockoutWindowSec   int `toml:"lockout_window_sec"`
+	LockoutDurationSec int `toml:"lockout_duration_sec"`
+	LoginDelayBaseMs   int `toml:"login_delay_base_ms"`
+	LoginDelayMaxMs    int `toml:"login_delay_max_ms"`
+	// BenchmarkMode replaces the cost above with a minimal one, so that load
+	// tests are not dominated by hashing.
+	BenchmarkMode bool `toml:"benchmark_mode"`
+	// TokenSecret signs the tokens issued by Login. Tokens signed with one of
+	// the PreviousTokenSecrets are still accepted, so that the secret can be
+	// rotated by moving it there.
+	TokenSecret          string   `toml:"token_secret"`
+	PreviousTokenSecrets []string `toml:"previous_token_secrets"`
+	// Access tokens are valid for AccessTokenTtlSec, and sessions expire
+	// RefreshTokenTtlSec after they were last refreshed; 0 means the default.
+	AccessTokenTtlSec  int `toml:"access_token_ttl_sec"`
+	RefreshTokenTtlSec int `toml:"refresh_token_ttl_sec"`
+}
+
+func (c *userConfig) passwordCost() passwordCost {
+	if c.BenchmarkMode {
+		return passwordCost{
+			Time:      BENCHMARK_ARGON2_TIME,
+			MemoryKiB: BENCHMARK_ARGON2_MEMORY_KIB,
+			Threads:   BENCHMARK_ARGON2_THREADS,
+		}
+	}
+	cost := passwordCost{
+		Time:      DEFAULT_ARGON2_TIME,
+		MemoryKiB: DEFAULT_ARGON2_MEMORY_KIB,
+		Threads:   DEFAULT_ARGON2_THREADS,
+	}
+	if c.Argon2Time > 0 {
+		cost.Time = uint32(c.Argon2Time)
+	}
+	if c.Argon2MemoryKiB > 0 {
+		cost.MemoryKiB = uint32(c.Argon2MemoryKiB)
+	}
+	if c.Argon2Threads > 0 && c.Argon2Threads <= 255 {
+		cost.Threads = uint8(c.Argon2Threads)
+	}
+	return cost
 }
 
 type UserServicer interface {
+	// RegisterUserWithId and RegisterUser return a RegisterError if the
+	// username or password is invalid or the username or user id is taken.
 	RegisterUserWithId(context.Context, string, string, string, string, int64) error
 	RegisterUser(context.Context, string, string, string, string) error
 	// TODO: Figure out what is Creator return type
 	ComposeCreatorWithUsername(context.Context, string) (Creator, error)
 	ComposeCreatorWithUserId(context.Context, int64, string) (Creator, error)
 
-	Login(context.Context, string, string) (string, error)
+	// Login starts a session and returns its tokens; see session.go.
+	Login(context.Context, string, string) (AuthTokens, error)
+	// VerifyToken returns the user of an access token, or an error if the
+	// token is not valid or was revoked.
+	VerifyToken(context.Context, string) (Creator, error)
+	// Refresh exchanges a refresh token for new tokens of its session.
+	Refresh(context.Context, string) (AuthTokens, error)
+	// Logout ends the session of an access token, or all the sessions of its
+	// user.
+	Logout(context.Context, string, bool) error
+	// UnlockUser clears the failed logins of the username, which lifts its
+	// lockout.
+	UnlockUser(context.Context, string) error
 	GetUserId(context.Context, string) (int64, error)
+	// GetUserInfo and GetUserInfos look profiles up by user id, through the
+	// user id index of Storage.
+	GetUserInfo(context.Context, int64) (UserInfo, bool, error)
+	// GetUserInfos returns the profiles of the user ids that exist.
+	GetUserInfos(context.Context, []int64) (map[int64]UserInfo, error)
+
+	// UpdateProfile, ChangePassword and DeleteUser return a ProfileError if
+	// the user id has no profile or the change is refused; see profile.go.
+	// UpdateProfile replaces the first and last name, bio and avatar.
+	UpdateProfile(context.Context, int64, string, string, string, string) error
+	// ChangePassword checks the old password, and ends all the sessions of
+	// the user.
+	ChangePassword(context.Context, int64, string, string) error
+	// DeleteUser removes the user with their posts, follow edges and
+	// timelines.
+	DeleteUser(context.Context, int64) error
+	// SetPrivate sets whether follows of the user must be approved; see
+	// follow_requests.go.
+	SetPrivate(context.Context, int64, bool) error
+
+	// SearchUsers returns a page of the users that match a query, from a
+	// cursor, at most limit of them; see user_search.go. It returns a
+	// UserSearchError if the query is invalid or the index is still loading.
+	SearchUsers(context.Context, string, UserSearchMode, string, int) (UserSearchPage, error)
 }
 
 func GenRandomString(length int) string {
@@ -63,17 +216,6 @@ func GenRandomString(length int) string {
 	return s
 }
 
-func HashPassowrd(password, salt string) string {
-	combined := salt
-
-	hasher := sha256.New()
-	hasher.Write([]byte(combined))
-	hashBytes := hasher.Sum(nil)
-
-	hashHex := hex.EncodeToString(hashBytes)
-	return hashHex
-}
-
 func GenerateUniqueId() int64 {
 	// Get the current Unix timestamp in milliseconds
 	// This reduces the chance of collision for IDs generated in quick succession
@@ -93,21 +235,62 @@ func GenerateUniqueId() int64 {
 	return uniqueID
 }
 
+// MIN_TOKEN_SECRET_LEN, in bytes, is the output size of HS256.
+const MIN_TOKEN_SECRET_LEN = 32
+
 type UserService struct {
 	weaver.Implements[UserServicer]
-	storage weaver.Ref[IStorage]
+	weaver.WithConfig[userConfig]
 
-	_machineId string
-	_secret    string
+	storage            weaver.Ref[IStorage]
+	transactionService weaver.Ref[ITransactionService]
+
+	// secrets holds the current token secret followed by the previous ones.
+	secrets [][]byte
+	// searchIndex serves SearchUsers; see user_search.go.
+	searchIndex *searchIndex
 }
 
 func (us *UserService) Init(context.Context) error {
-	us.LoadSecretAndMachineId()
+	if err := us.LoadSecrets(); err != nil {
+		return err
+	}
+	us.searchIndex = newSearchIndex()
+	us.searchIndex.start(us.storage.Get())
+	return nil
+}
+
+func (us *UserService) Shutdown(context.Context) error {
+	us.searchIndex.stop()
 	return nil
 }
 
-func (us *UserService) LoadSecretAndMachineId() {
-	// figure out how to load data from local config file
+// LoadSecrets reads the token secrets from the config, and fails if one is
+// too short or repeated.
+func (us *UserService) LoadSecrets() error {
+	cfg := us.Config()
+	if cfg.TokenSecret == "" {
+		return fmt.Errorf("user service: token_secret must be set")
+	}
+	seen := make(map[string]bool)
+	secrets := make([][]byte, 0, 1+len(cfg.PreviousTokenSecrets))
+	for i, secret := range append([]string{cfg.TokenSecret}, cfg.PreviousTokenSecrets...) {
+		name := "token_secret"
+		if i > 0 {
+			name = fmt.Sprintf("previous_token_secrets[%d]", i-1)
+		}
+		if len(secret) < MIN_TOKEN_SECRET_LEN {
+			return fmt.Errorf("user service: %s is %d bytes long, it must be at least %d",
+				name, len(secret), MIN_TOKEN_SECRET_LEN)
+		}
+		if seen[secret] {
+			return fmt.Errorf("user service: %s repeats another token secret", name)
+		}
+		seen[secret] = true
+		secrets = append(secrets, []byte(secret))
+	}
+	us.secrets = secrets
+	return nil
 }
 
 func (us *UserService) ComposeCreatorWithUsername(ctx context.Context, username string) (Creator, error) {
@@ -132,67 +315,158 @@ func (us *UserService) ComposeCreatorWithUserId(ctx context.Context, userId int6
 	}, nil
 }
 
-func (us *UserService) Login(ctx context.Context, username, password string) (string, error) {
+func (us *UserService) Login(ctx context.Context, username, password string) (AuthTokens, error) {
 	storage := us.storage.Get()
 	profile, exist, _ := storage.GetUserProfile(ctx, username)
 	if !exist {
-		return "", &LogError{
-			err_code: int(NOT_REGISTERED),
-			err_msg:  NOT_REGISTERED.String(),
-		}
+		return AuthTokens{}, NewLogError(NOT_REGISTERED, 0)
+	}
+	// The attempt counts as a failure unless the password is right.
+	if err := us.reserveLoginAttempt(ctx, username); err != nil {
+		return AuthTokens{}, err
+	}
+	cost := us.Config().passwordCost()
+	auth, rehash, err := verifyPassword(password, profile.PasswordHashed, cost)
+	if errors.Is(err, errLegacyPasswordHash) {
+		return AuthTokens{}, NewLogError(PASSWORD_RESET_REQUIRED, 0)
+	} else if err != nil {
+		return AuthTokens{}, fmt.Errorf("user %s: %w", username, err)
 	}
-	var auth bool = HashPassowrd(password, profile.Salt) == profile.PasswordHashed
 	if !auth {
-		return "", &LogError{
-			err_code: int(WRONG_PASSWORD),
-			err_msg:  WRONG_PASSWORD.String(),
-		}
+		return AuthTokens{}, NewLogError(WRONG_PASSWORD, 0)
+	}
+	if err := us.clearLoginFailures(ctx, username); err != nil {
+		fmt.Printf("[UserService] cannot clear the failed logins of %s: %v\n", username, err)
+	}
+	if rehash {
+		us.rehashPassword(ctx, username, password, profile, cost)
 	}
 
-	userIdStr := strconv.FormatInt(profile.UserId, 10)
-	timestampStr := strconv.FormatInt(time.Now().Unix(), 10)
-
-	// Create a new JWT object
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id":   userIdStr,
-		"username":  username,
-		"timestamp": timestampStr,
-		"ttl":       "3600",
-	})
+	tokens, err := us.startSession(ctx, Creator{UserId: profile.UserId, Username: username})
+	if err != nil {
+		fmt.Println("Error starting session:", err)
+		return AuthTokens{}, err
+	}
 
-	secret := []byte("mysecret")
+	return tokens, nil
+}
 
-	// Sign and get the complete encoded token as a string
-	tokenString, err := token.SignedString(secret)
+// rehashPassword replaces the password hash of the profile with one of the
+// given cost, unless the profile changed since it was read. Failures are only
+// logged, as the login succeeded and the old hash still verifies.
+func (us *UserService) rehashPassword(ctx context.Context, username, password string, profile UserProfile, cost passwordCost) {
+	hashed, err := hashPassword(password, cost)
 	if err != nil {
-		fmt.Println("Error signing token:", err)
-		return "", err
+		fmt.Printf("[UserService] cannot rehash the password of %s: %v\n", username, err)
+		return
+	}
+	rehashed := profile
+	rehashed.PasswordHashed = hashed
+	_, err = us.storage.Get().Transact(ctx, stringRoutingBucket(username), StorageTransaction{
+		Preconditions: []StoragePrecondition{
+			{Cond: COND_EQUALS, Map: MAP_USER_PROFILES, StrKey: username, Profile: profile},
+		},
+		Mutations: []StorageMutation{
+			{Op: OP_PUT_USER_PROFILE, StrKey: username, Profile: rehashed},
+		},
+	})
+	if err != nil {
+		fmt.Printf("[UserService] cannot rehash the password of %s: %v\n", username, err)
 	}
-
-	return tokenString, nil
 }
 
+// RegisterUserWithId fails with a RegisterError if the username or the user
+// id is taken. The username is checked before the password is hashed, so
+// that taken usernames are refused cheaply; claimUser checks it again.
 func (us *UserService) RegisterUserWithId(ctx context.Context, firstName, lastName, username, password string, userId int64) error {
-	salt := GenRandomString(32)
-	userProfile := UserProfile{
-		UserId:         userId,
-		FirstName:      firstName,
-		LastName:       lastName,
-		Salt:           salt,
-		PasswordHashed: HashPassowrd(password, salt),
+	userProfile, err := us.newUserProfile(ctx, firstName, lastName, username, password)
+	if err != nil {
+		return err
 	}
-	// update the map
-	s := us.storage.Get()
-	s.PutUserProfile(ctx, username, userProfile)
-	return nil
+	userProfile.UserId = userId
+	return us.claimUser(ctx, username, userProfile)
 }
 
+// RegisterUser hashes the password once, then retries claimUser with new
+// user ids while the generated one is taken.
 func (us *UserService) RegisterUser(ctx context.Context, firstName, lastName, username, password string) error {
-	// Generate a user id
-	uid := GenerateUniqueId()
+	userProfile, err := us.newUserProfile(ctx, firstName, lastName, username, password)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < REGISTER_USER_ATTEMPTS; attempt++ {
+		userProfile.UserId = GenerateUniqueId()
+		err = us.claimUser(ctx, username, userProfile)
+		var registerErr *RegisterError
+		if !errors.As(err, &registerErr) || registerErr.Code != USER_ID_TAKEN {
+			break
+		}
+	}
+	return err
+}
+
+// newUserProfile validates a registration and returns the profile to put,
+// without a user id. It fails with USERNAME_TAKEN before hashing the password
+// if the username is already registered.
+func (us *UserService) newUserProfile(ctx context.Context, firstName, lastName, username, password string) (UserProfile, error) {
+	if err := validateUsername(username); err != nil {
+		return UserProfile{}, err
+	}
+	if err := validatePassword(password); err != nil {
+		return UserProfile{}, err
+	}
+	_, exist, err := us.storage.Get().GetUserProfile(ctx, username)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	if exist {
+		return UserProfile{}, NewRegisterError(USERNAME_TAKEN, username)
+	}
+	hashed, err := hashPassword(password, us.Config().passwordCost())
+	if err != nil {
+		return UserProfile{}, err
+	}
+	return UserProfile{
+		FirstName:      firstName,
+		LastName:       lastName,
+		PasswordHashed: hashed,
+		CreatedAt:      time.Now().Unix(),
+	}, nil
+}
 
-	// Call RegisterUserWithId
-	return us.RegisterUserWithId(ctx, firstName, lastName, username, password, uid)
+// claimUser registers the profile under username and its user id. The
+// preconditions of a transaction are all checked in one routing bucket, so
+// the user id is claimed first, by putting its index entry, and then the
+// username, by putting the profile; the claim is released if the username is
+// taken. A caller that fails in between leaves the user id claimed.
+func (us *UserService) claimUser(ctx context.Context, username string, userProfile UserProfile) error {
+	userId := userProfile.UserId
+	ts := us.transactionService.Get()
+	claimed, err := ts.Commit(ctx, StorageTransaction{
+		Preconditions: []StoragePrecondition{{Cond: COND_ABSENT, Map: MAP_USER_IDS, IntKey: userId}},
+		Mutations:     []StorageMutation{{Op: OP_PUT_USER_ID, IntKey: userId, StrKey: username}},
+	})
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return NewRegisterError(USER_ID_TAKEN, strconv.FormatInt(userId, 10))
+	}
+	registered, err := ts.Commit(ctx, StorageTransaction{
+		Preconditions: []StoragePrecondition{{Cond: COND_ABSENT, Map: MAP_USER_PROFILES, StrKey: username}},
+		Mutations:     []StorageMutation{{Op: OP_PUT_USER_PROFILE, StrKey: username, Profile: userProfile}},
+	})
+	if err != nil || registered {
+		return err
+	}
+	_, err = ts.Commit(ctx, StorageTransaction{
+		Preconditions: []StoragePrecondition{{Cond: COND_EQUALS, Map: MAP_USER_IDS, IntKey: userId, StrVal: username}},
+		Mutations:     []StorageMutation{{Op: OP_REMOVE_USER_ID, IntKey: userId}},
+	})
+	if err != nil {
+		fmt.Printf("[UserService] cannot release user id %d: %v\n", userId, err)
+	}
+	return NewRegisterError(USERNAME_TAKEN, username)
 }
 
 func (us *UserService) GetUserId(ctx context.Context, username string) (int64, error) {
@@ -213,3 +487,36 @@ func (us *UserService) GetUserId(ctx context.Context, username string) (int64, e
 	}
 	return profile.UserId, nil
 }
+
+func (us *UserService) GetUserInfo(ctx context.Context, userId int64) (UserInfo, bool, error) {
+	infos, err := us.GetUserInfos(ctx, []int64{userId})
+	info, exist := infos[userId]
+	return info, exist, err
+}
+
+// GetUserInfos skips the index entries whose profile has since been replaced
+// by the profile of another user id, or is not there.
+func (us *UserService) GetUserInfos(ctx context.Context, userIds []int64) (map[int64]UserInfo, error) {
+	storage := us.storage.Get()
+	usernames, err := getUsernamesBatched(ctx, storage, userIds)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		names = append(names, username)
+	}
+	profiles, err := getUserProfilesBatched(ctx, storage, names)
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[int64]UserInfo, len(usernames))
+	for userId, username := range usernames {
+		profile, exist := profiles[username]
+		if !exist || profile.UserId != userId {
+			continue
+		}
+		infos[userId] = userInfo(username, profile)
+	}
+	return infos, nil
+}
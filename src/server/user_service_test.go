@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The user id index resolves registered users to their public profile and
+// skips the ids that are not registered.
+func TestGetUserInfos(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer, storage IStorage) {
+		// carol's index entry is in another bucket than bob's.
+		carolId := otherBucketUserId(2)
+		for _, u := range []struct {
+			username string
+			userId   int64
+		}{{"alice", 1}, {"bob", 2}, {"carol", carolId}} {
+			if err := us.RegisterUserWithId(ctx, "First", "Last", u.username, "password1", u.userId); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		info, exist, err := us.GetUserInfo(ctx, 2)
+		if err != nil || !exist {
+			t.Fatalf("GetUserInfo(2) = %v, %v", exist, err)
+		}
+		if info.UserId != 2 || info.Username != "bob" || info.FirstName != "First" {
+			t.Errorf("GetUserInfo(2) = %+v", info)
+		}
+		if _, exist, err := us.GetUserInfo(ctx, -1); err != nil || exist {
+			t.Errorf("GetUserInfo(-1) = %v, %v; want no user", exist, err)
+		}
+
+		infos, err := us.GetUserInfos(ctx, []int64{1, 2, carolId, -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		usernames := make(map[int64]string, len(infos))
+		for userId, info := range infos {
+			usernames[userId] = info.Username
+		}
+		want := map[int64]string{1: "alice", 2: "bob", carolId: "carol"}
+		if !reflect.DeepEqual(usernames, want) {
+			t.Errorf("GetUserInfos = %v, want %v", usernames, want)
+		}
+		if username, exist, err := storage.GetUsername(ctx, carolId); err != nil || !exist || username != "carol" {
+			t.Errorf("GetUsername(%d) = %q, %v, %v; want carol", carolId, username, exist, err)
+		}
+	})
+}
+
+// A dump written before the index existed has it rebuilt from the profiles.
+func TestImportRebuildsUserIds(t *testing.T) {
+	ctx := context.Background()
+	testEachBackend(t, nil, func(t *testing.T, s *Storage) {
+		dump := StorageDump{UserProfiles: map[string]UserProfile{
+			"alice": {UserId: 1},
+			"bob":   {UserId: 2},
+		}}
+		if err := importStorage(ctx, s, dump); err != nil {
+			t.Fatal(err)
+		}
+		got, err := getUsernamesBatched(ctx, s, []int64{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[int64]string{1: "alice", 2: "bob"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("usernames = %v, want %v", got, want)
+		}
+	})
+}
+
+func registerErrorCode(err error) RegisterErrorCode {
+	var registerErr *RegisterError
+	if errors.As(err, &registerErr) {
+		return registerErr.Code
+	}
+	return 0
+}
+
+func TestRegisterErrors(t *testing.T) {
+	ctx := context.Background()
+	userServiceRunner("").Test(t, func(t *testing.T, us UserServicer, storage IStorage) {
+		registerAndLogin(t, us)
+		for _, tc := range []struct {
+			name     string
+			username string
+			password string
+			userId   int64
+			want     RegisterErrorCode
+			status   int
+		}{
+			{"username taken", "alice", "password2", 2, USERNAME_TAKEN, http.StatusConflict},
+			{"user id taken", "bob", "password2", 1, USER_ID_TAKEN, http.StatusConflict},
+			{"username too short", "bo", "password2", 2, INVALID_USERNAME, http.StatusBadRequest},
+			{"username too long", strings.Repeat("b", USERNAME_MAX_LEN+1), "password2", 2, INVALID_USERNAME, http.StatusBadRequest},
+			{"username with a space", "bo b", "password2", 2, INVALID_USERNAME, http.StatusBadRequest},
+			{"username starting with a dot", ".bob", "password2", 2, INVALID_USERNAME, http.StatusBadRequest},
+			{"password too short", "bob", "short", 2, INVALID_PASSWORD, http.StatusBadRequest},
+			{"password too long", "bob", strings.Repeat("p", PASSWORD_MAX_LEN+1), 2, INVALID_PASSWORD, http.StatusBadRequest},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				err := us.RegisterUserWithId(ctx, "Bob", "B", tc.username, tc.password, tc.userId)
+				if got := registerErrorCode(err); got != tc.want {
+					t.Fatalf("RegisterUserWithId error = %v, want %v", err, tc.want)
+				}
+				if got := register_error_status(err); got != tc.status {
+					t.Errorf("status = %d, want %d", got, tc.status)
+				}
+			})
+		}
+
+		// The failed registrations left neither bob nor user id 2 behind.
+		if _, exist, err := storage.GetUserProfile(ctx, "bob"); err != nil || exist {
+			t.Errorf("GetUserProfile(bob) = %v, %v; want no profile", exist, err)
+		}
+		if _, exist, err := storage.GetUsername(ctx, 2); err != nil || exist {
+			t.Errorf("GetUsername(2) = %v, %v; want no username", exist, err)
+		}
+		if err := us.RegisterUserWithId(ctx, "Bob", "B", "b_o.b-2", "password2", 2); err != nil {
+			t.Errorf("registering user id 2 after the failures: %v", err)
+		}
+		if alice, _, err := storage.GetUserProfile(ctx, "alice"); err != nil || alice.UserId != 1 {
+			t.Errorf("alice is user %d, %v; want 1", alice.UserId, err)
+		}
+		if got := register_error_status(errors.New("storage down")); got != http.StatusInternalServerError {
+			t.Errorf("status of another error = %d, want %d", got, http.StatusInternalServerError)
+		}
+	})
+}
@@ -8,7 +8,12 @@ import (
 
 type IUserTimelineService interface {
 	WriteUserTimeline(context.Context, int64, int64, int64) error
-	ReadUserTimeline(context.Context, int64, int, int) ([]Post, error)
+	// ReadUserTimeline and ReadUserTimelinePage take the id of the reader
+	// before the id of the user, and return a PRIVATE_ACCOUNT error if the
+	// user is private and the reader does not follow them; see
+	// follow_requests.go.
+	ReadUserTimeline(context.Context, int64, int64, int, int) ([]Post, error)
+	ReadUserTimelinePage(context.Context, int64, int64, string, TimelineDirection, int, int) (TimelinePage, error)
 	RemovePost(context.Context, int64, int64, int64) error
 }
 
@@ -16,26 +21,36 @@ type UserTimelineService struct {
 	weaver.Implements[IUserTimelineService]
 	storage            weaver.Ref[IStorage]
 	postStorageService weaver.Ref[PostStorageServicer]
+	userService        weaver.Ref[UserServicer]
 }
 
 func (uts *UserTimelineService) WriteUserTimeline(ctx context.Context, postId, userId, timestamp int64) error {
 	storage := uts.storage.Get()
-	storage.PutPostTimeline(ctx, userId, postId, timestamp)
+	storage.PutPostTimeline(ctx, userId, USER_TIMELINE, postId, timestamp)
 	return nil
 }
 
-func (uts *UserTimelineService) ReadUserTimeline(ctx context.Context, userId int64, start int, stop int) ([]Post, error) {
+// ReadUserTimeline returns the posts from start to stop counted from the
+// newest one.
+func (uts *UserTimelineService) ReadUserTimeline(ctx context.Context, readerId int64, userId int64, start int, stop int) ([]Post, error) {
+	page, err := uts.ReadUserTimelinePage(ctx, readerId, userId, "", TIMELINE_OLDER, start, stop)
+	return page.Posts, err
+}
+
+// ReadUserTimelinePage returns the posts older or newer than cursor, from
+// start to stop counted from the cursor. An empty cursor starts at the newest
+// post when going older and at the oldest post when going newer.
+func (uts *UserTimelineService) ReadUserTimelinePage(ctx context.Context, readerId int64, userId int64, cursor string, direction TimelineDirection, start int, stop int) (TimelinePage, error) {
+	if err := uts.checkReader(ctx, readerId, userId); err != nil {
+		return TimelinePage{}, err
+	}
 	storage := uts.storage.Get()
 	postStorageService := uts.postStorageService.Get()
-	postIds, err := storage.GetPostTimeline(ctx, userId, start, stop)
-	if err != nil {
-		return make([]Post, 0), err
-	}
-	return postStorageService.ReadPosts(ctx, postIds)
+	return readTimelinePage(ctx, storage, postStorageService, userId, USER_TIMELINE, cursor, direction, start, stop)
 }
 
 func (uts *UserTimelineService) RemovePost(ctx context.Context, userId int64, postId int64, timestamp int64) error {
 	storage := uts.storage.Get()
-	storage.RemovePostTimeline(ctx, userId, postId, timestamp)
+	storage.RemovePostTimeline(ctx, userId, USER_TIMELINE, postId, timestamp)
 	return nil
 }
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// On-disk layout of a data directory, where <dir> is bucket-<n> for the data
+// of routing bucket n, or replica-<n> for all the data of a replica with
+// replication; see storage_buckets.go:
+//
+//	<dir>/LOCK             held by the replica persisting into <dir>
+//	<dir>/snapshot.json    latest complete snapshot of all maps
+//	<dir>/wal-<seq>.log    log segment whose first record has sequence <seq>
+//
+// Each log record is framed as [4 byte length][4 byte crc32][json walRecord].
+// A torn or corrupt record ends its segment: recovery truncates the segment
+// before it, and fails if a later segment does not continue the sequence.
+
+const (
+	FSYNC_ALWAYS   = "always"
+	FSYNC_INTERVAL = "interval"
+	FSYNC_NEVER    = "never"
+
+	REPLICA_DIR_PREFIX  = "replica-"
+	REPLICA_LOCK_FILE   = "LOCK"
+	MAX_REPLICA_DIRS    = 1024
+	SNAPSHOT_FILENAME   = "snapshot.json"
+	WAL_SEGMENT_PREFIX  = "wal-"
+	WAL_SEGMENT_SUFFIX  = ".log"
+	WAL_RECORD_HDR_SIZE = 8
+
+	DEFAULT_FSYNC_INTERVAL_MS     = 100
+	DEFAULT_SNAPSHOT_INTERVAL_SEC = 300
+
+	// WAL_MAX_BATCH is the largest number of commits written, and synced
+	// with FSYNC_ALWAYS, at once.
+	WAL_MAX_BATCH = 256
+)
+
+var errWalClosed = errors.New("write-ahead log closed")
+
+// persistentState is the in-memory state that a WriteAheadLog protects.
+type persistentState interface {
+	apply(StorageMutation) (bool, error)
+	applyTransaction(StorageTransaction) (bool, error)
+	// setPosition records the replication position of the contents.
+	setPosition(replicationPosition) error
+	snapshot() (*storageSnapshot, error)
+	restore(*storageSnapshot) error
+}
+
+type walRecord struct {
+	Seq uint64
+	storageCommit
+}
+
+type storageSnapshot struct {
+	Seq uint64
+	// Position is the replication position of the contents; see
+	// replication.go.
+	Position     replicationPosition
+	MediaData    map[string]string
+	UserProfiles map[string]UserProfile
+	Posts        map[int64]Post
+	ShortUrls    map[string]string
+	Followers    map[int64][]int64
+	Followees    map[int64][]int64
+
+	// Timelines holds the user timelines.
+	Timelines     map[int64][]TimelineEntry
+	HomeTimelines map[int64][]TimelineEntry
+
+	// The expiries hold the expiry time of the entries that have one.
+	PostExpiries     map[int64]int64
+	MediaExpiries    map[string]int64
+	ShortUrlExpiries map[string]int64
+
+	// Intents holds the pending intents of cross-bucket transactions by id.
+	Intents map[string]StorageIntent
+	// UserIds maps user ids to usernames.
+	UserIds map[int64]string
+
+	// Sessions and Revocations are keyed by session id and revocation key;
+	// see user_service.go.
+	Sessions           map[string]Session
+	SessionExpiries    map[string]int64
+	Revocations        map[string]int64
+	RevocationExpiries map[string]int64
+
+	// LoginFailures is keyed by username; see login_lockout.go.
+	LoginFailures        map[string]LoginFailures
+	LoginFailureExpiries map[string]int64
+
+	// The block, mute and follow request edges of each RelationKind; see
+	// block_mute.go.
+	Blocked    map[int64][]int64
+	Blockers   map[int64][]int64
+	Muted      map[int64][]int64
+	Muters     map[int64][]int64
+	Requested  map[int64][]int64
+	Requesters map[int64][]int64
+}
+
+// relations returns the field holding the edges of the kind.
+func (snap *storageSnapshot) relations(kind RelationKind) *map[int64][]int64 {
+	return [...]*map[int64][]int64{
+		&snap.Blocked, &snap.Blockers, &snap.Muted, &snap.Muters, &snap.Requested, &snap.Requesters,
+	}[kind]
+}
+
+// WriteAheadLog appends commits from a single goroutine, which writes all the
+// commits queued while it wrote the previous ones with one write, and syncs
+// them at once with FSYNC_ALWAYS. Callers encode their commits beforehand.
+type WriteAheadLog struct {
+	mu      sync.Mutex
+	dir     string
+	policy  string
+	state   persistentState
+	seq     uint64
+	segment *os.File
+	dirty   bool
+	// buf holds the records of the batch being written. Only the appender
+	// uses it.
+	buf []byte
+
+	requests chan *walRequest
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// walRequest is a commit waiting for the appender, with its json encoding.
+type walRequest struct {
+	c      storageCommit
+	body   []byte
+	result chan walResult
+}
+
+type walResult struct {
+	changed bool
+	err     error
+}
+
+// OpenWriteAheadLog restores state from the snapshot and log segments found in
+// cfg.DataDir and starts a new log segment for subsequent mutations.
+func OpenWriteAheadLog(cfg *storageConfig, state persistentState) (*WriteAheadLog, error) {
+	policy := cfg.FsyncPolicy
+	if policy == "" {
+		policy = FSYNC_INTERVAL
+	}
+	if policy != FSYNC_ALWAYS && policy != FSYNC_INTERVAL && policy != FSYNC_NEVER {
+		return nil, fmt.Errorf("unknown fsync_policy %q", cfg.FsyncPolicy)
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	w := &WriteAheadLog{
+		dir:      cfg.DataDir,
+		policy:   policy,
+		state:    state,
+		requests: make(chan *walRequest),
+		done:     make(chan struct{}),
+	}
+	if err := w.recover(); err != nil {
+		return nil, err
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+
+	fsyncInterval := time.Duration(cfg.FsyncIntervalMs) * time.Millisecond
+	if fsyncInterval <= 0 {
+		fsyncInterval = DEFAULT_FSYNC_INTERVAL_MS * time.Millisecond
+	}
+	snapshotInterval := time.Duration(cfg.SnapshotIntervalSec) * time.Second
+	if snapshotInterval <= 0 {
+		snapshotInterval = DEFAULT_SNAPSHOT_INTERVAL_SEC * time.Second
+	}
+	if policy == FSYNC_INTERVAL {
+		w.every(fsyncInterval, w.sync)
+	}
+	w.every(snapshotInterval, w.Snapshot)
+	w.wg.Add(1)
+	go w.appendLoop()
+	return w, nil
+}
+
+// Commit appends c to the log and then applies it to the state. Commits are
+// applied by the appender in log order.
+func (w *WriteAheadLog) Commit(c storageCommit) (bool, error) {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return false, err
+	}
+	req := &walRequest{c: c, body: body, result: make(chan walResult, 1)}
+	select {
+	case w.requests <- req:
+	case <-w.done:
+		return false, errWalClosed
+	}
+	res := <-req.result
+	return res.changed, res.err
+}
+
+// appendLoop writes the queued commits in batches until the log is closed.
+func (w *WriteAheadLog) appendLoop() {
+	defer w.wg.Done()
+	batch := make([]*walRequest, 0, WAL_MAX_BATCH)
+	for {
+		select {
+		case <-w.done:
+			return
+		case req := <-w.requests:
+			batch = append(batch[:0], req)
+		}
+	collect:
+		for len(batch) < WAL_MAX_BATCH {
+			select {
+			case req := <-w.requests:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+		w.commitBatch(batch)
+	}
+}
+
+// commitBatch writes the records of the batch and then applies them in order.
+// If the write fails, none of them is applied.
+func (w *WriteAheadLog) commitBatch(batch []*walRequest) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = w.buf[:0]
+	for i, req := range batch {
+		w.buf = appendWalRecord(w.buf, w.seq+1+uint64(i), req.body)
+	}
+	err := w.write(w.buf)
+	for _, req := range batch {
+		if err != nil {
+			req.result <- walResult{err: err}
+			continue
+		}
+		w.seq++
+		changed, err := req.c.applyTo(w.state)
+		req.result <- walResult{changed, err}
+	}
+}
+
+// Snapshot writes all maps to disk and drops the log segments it covers.
+func (w *WriteAheadLog) Snapshot() error {
+	w.mu.Lock()
+	snap, err := w.state.snapshot()
+	var covered []walSegment
+	if err == nil {
+		snap.Seq = w.seq
+		covered, err = w.coveredSegments(w.seq)
+	}
+	if err == nil {
+		err = w.rotate()
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := w.writeSnapshot(snap); err != nil {
+		return err
+	}
+	for _, segment := range covered {
+		os.Remove(filepath.Join(w.dir, segment.name))
+	}
+	return nil
+}
+
+// Close stops the background loops, flushes the current segment and
+// releases it.
+func (w *WriteAheadLog) Close() error {
+	close(w.done)
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.segment.Sync(); err != nil {
+		return err
+	}
+	return w.segment.Close()
+}
+
+func (w *WriteAheadLog) every(interval time.Duration, fn func() error) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+				if err := fn(); err != nil {
+					fmt.Printf("[WriteAheadLog] %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+func (w *WriteAheadLog) sync() error {
+	w.mu.Lock()
+	segment, dirty := w.segment, w.dirty
+	w.dirty = false
+	w.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	if err := segment.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// appendWalRecord appends the framed walRecord of the commit encoded as body
+// to buf. The record is spliced from body so that it is not encoded again.
+func appendWalRecord(buf []byte, seq uint64, body []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, WAL_RECORD_HDR_SIZE)...)
+	buf = append(buf, `{"Seq":`...)
+	buf = strconv.AppendUint(buf, seq, 10)
+	if len(body) > len("{}") {
+		buf = append(buf, ',')
+	}
+	buf = append(buf, body[1:]...)
+	payload := buf[start+WAL_RECORD_HDR_SIZE:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+// write appends framed records to the current segment. Callers hold w.mu.
+func (w *WriteAheadLog) write(buf []byte) error {
+	if _, err := w.segment.Write(buf); err != nil {
+		return err
+	}
+	if w.policy == FSYNC_ALWAYS {
+		return w.segment.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// rotate closes the current segment, if any, and opens a new one starting
+// after the last committed sequence. Callers hold w.mu.
+func (w *WriteAheadLog) rotate() error {
+	name := WAL_SEGMENT_PREFIX + strconv.FormatUint(w.seq+1, 10) + WAL_SEGMENT_SUFFIX
+	segment, err := os.OpenFile(filepath.Join(w.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		segment.Close()
+		return err
+	}
+	if w.segment != nil {
+		w.segment.Sync()
+		w.segment.Close()
+	}
+	w.segment = segment
+	w.dirty = false
+	return nil
+}
+
+type walSegment struct {
+	name  string
+	start uint64
+}
+
+// segments lists the log segments in the data directory ordered by their
+// first sequence number.
+func (w *WriteAheadLog) segments() ([]walSegment, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]walSegment, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, WAL_SEGMENT_PREFIX) || !strings.HasSuffix(name, WAL_SEGMENT_SUFFIX) {
+			continue
+		}
+		start, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, WAL_SEGMENT_PREFIX), WAL_SEGMENT_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, walSegment{name, start})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start < segments[j].start })
+	return segments, nil
+}
+
+// coveredSegments lists the log segments that hold no record after seq. The
+// segment starting after seq is not one of them: rotate reopens it when
+// nothing was committed since it was created.
+func (w *WriteAheadLog) coveredSegments(seq uint64) ([]walSegment, error) {
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	covered := segments[:0]
+	for _, segment := range segments {
+		if segment.start <= seq {
+			covered = append(covered, segment)
+		}
+	}
+	return covered, nil
+}
+
+// recover loads the latest snapshot and replays every logged mutation that
+// came after it.
+func (w *WriteAheadLog) recover() error {
+	snap, err := w.readSnapshot()
+	if err != nil {
+		return err
+	}
+	if snap != nil {
+		if err := w.state.restore(snap); err != nil {
+			return err
+		}
+		w.seq = snap.Seq
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	replayed := 0
+	for _, segment := range segments {
+		n, err := w.replay(segment.name)
+		if err != nil {
+			return err
+		}
+		replayed += n
+	}
+	fmt.Printf("[WriteAheadLog] recovered %s up to seq %d (%d mutations replayed)\n", w.dir, w.seq, replayed)
+	return nil
+}
+
+// replay applies the records of the segment that come after w.seq. A torn or
+// corrupt record is truncated away along with everything after it, so that a
+// crash in the middle of a write does not hide the records appended to the
+// segment later. A record that does not follow w.seq fails the replay, as the
+// records in between were lost.
+func (w *WriteAheadLog) replay(name string) (int, error) {
+	path := filepath.Join(w.dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	replayed := 0
+	var offset int64
+	hdr := make([]byte, WAL_RECORD_HDR_SIZE)
+	for {
+		if _, err := io.ReadFull(f, hdr); err != nil {
+			if err != io.EOF {
+				return replayed, truncateSegment(path, offset, fmt.Sprintf("truncated record header after seq %d", w.seq))
+			}
+			return replayed, nil
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(hdr[0:4]))
+		if _, err := io.ReadFull(f, payload); err != nil {
+			return replayed, truncateSegment(path, offset, fmt.Sprintf("truncated record after seq %d", w.seq))
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[4:8]) {
+			return replayed, truncateSegment(path, offset, fmt.Sprintf("corrupt record after seq %d", w.seq))
+		}
+		offset += int64(WAL_RECORD_HDR_SIZE + len(payload))
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return replayed, fmt.Errorf("%s: %w", name, err)
+		}
+		if rec.Seq <= w.seq {
+			continue
+		}
+		if rec.Seq != w.seq+1 {
+			return replayed, fmt.Errorf("%s: seq %d follows seq %d, the records in between are lost", name, rec.Seq, w.seq)
+		}
+		if _, err := rec.applyTo(w.state); err != nil {
+			return replayed, fmt.Errorf("%s: seq %d: %w", name, rec.Seq, err)
+		}
+		w.seq = rec.Seq
+		replayed++
+	}
+}
+
+// truncateSegment cuts the segment at path before the bad record at offset.
+func truncateSegment(path string, offset int64, reason string) error {
+	fmt.Printf("[WriteAheadLog] %s: %s, truncating at offset %d\n", filepath.Base(path), reason, offset)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (w *WriteAheadLog) readSnapshot() (*storageSnapshot, error) {
+	f, err := os.Open(filepath.Join(w.dir, SNAPSHOT_FILENAME))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var snap storageSnapshot
+	if err := json.NewDecoder(f).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("%s: %w", SNAPSHOT_FILENAME, err)
+	}
+	return &snap, nil
+}
+
+// writeSnapshot atomically replaces the snapshot file.
+func (w *WriteAheadLog) writeSnapshot(snap *storageSnapshot) error {
+	tmp := filepath.Join(w.dir, SNAPSHOT_FILENAME+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(snap); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(w.dir, SNAPSHOT_FILENAME)); err != nil {
+		return err
+	}
+	return syncDir(w.dir)
+}
+
+// claimReplicaDir locks the first replica-<n> subdirectory of dataDir that no
+// other running replica holds. The returned file keeps the lock until closed.
+func claimReplicaDir(dataDir string) (string, *os.File, error) {
+	for i := 0; i < MAX_REPLICA_DIRS; i++ {
+		dir := filepath.Join(dataDir, REPLICA_DIR_PREFIX+strconv.Itoa(i))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", nil, err
+		}
+		lock, err := lockDir(dir)
+		if err == nil {
+			return dir, lock, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return "", nil, err
+		}
+	}
+	return "", nil, fmt.Errorf("all %d replica directories are in use", MAX_REPLICA_DIRS)
+}
+
+// lockDir locks dir without waiting, and fails with EWOULDBLOCK if another
+// process holds it. The returned file keeps the lock until closed.
+func lockDir(dir string) (*os.File, error) {
+	lock, err := os.OpenFile(filepath.Join(dir, REPLICA_LOCK_FILE), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
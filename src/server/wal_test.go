@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openTestWal(t *testing.T, dir string) (*WriteAheadLog, *memoryStorage) {
+	t.Helper()
+	mem := newMemoryStorage()
+	w, err := OpenWriteAheadLog(&storageConfig{DataDir: dir, FsyncPolicy: FSYNC_ALWAYS}, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, mem
+}
+
+func putPost(t *testing.T, w *WriteAheadLog, postId int64) {
+	t.Helper()
+	m := StorageMutation{Op: OP_PUT_POST, IntKey: postId, Post: Post{Post_id: postId}}
+	if _, err := w.Commit(storageCommit{Mutation: m}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalConcurrentCommitsRecover(t *testing.T) {
+	const writers, commits = 16, 50
+	dir := t.TempDir()
+	w, _ := openTestWal(t, dir)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < commits; j++ {
+				postId := int64(i*commits + j + 1)
+				m := StorageMutation{Op: OP_PUT_POST, IntKey: postId, Post: Post{Post_id: postId}}
+				if _, err := w.Commit(storageCommit{Mutation: m}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, mem := openTestWal(t, dir)
+	defer w.Close()
+	if w.seq != writers*commits {
+		t.Fatalf("recovered up to seq %d, want %d", w.seq, writers*commits)
+	}
+	for postId := int64(1); postId <= writers*commits; postId++ {
+		if _, ok, _ := mem.GetPost(postId); !ok {
+			t.Fatalf("post %d was not recovered", postId)
+		}
+	}
+}
+
+// A snapshot taken when nothing was committed since the last one keeps the
+// segment that the following commits are appended to.
+func TestWalSnapshotWithoutCommits(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := openTestWal(t, dir)
+	for i := 0; i < 2; i++ {
+		if err := w.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putPost(t, w, 1)
+	if err := w.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	putPost(t, w, 2)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, mem := openTestWal(t, dir)
+	defer w.Close()
+	for postId := int64(1); postId <= 2; postId++ {
+		if _, ok, _ := mem.GetPost(postId); !ok {
+			t.Fatalf("post %d was not recovered", postId)
+		}
+	}
+}
+
+func TestWalCommitAfterClose(t *testing.T) {
+	w, _ := openTestWal(t, t.TempDir())
+	w.Close()
+	if _, err := w.Commit(storageCommit{Mutation: StorageMutation{Op: OP_PUT_POST, IntKey: 1}}); err != errWalClosed {
+		t.Fatalf("commit after close: %v", err)
+	}
+}
+
+// A torn record at the start of a segment is truncated, so that the segment
+// that reuses its name after recovery is replayed in full.
+func TestWalTornRecordIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+	segment := filepath.Join(dir, WAL_SEGMENT_PREFIX+"1"+WAL_SEGMENT_SUFFIX)
+	if err := os.WriteFile(segment, []byte{42, 0, 0}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, _ := openTestWal(t, dir)
+	putPost(t, w, 1)
+	putPost(t, w, 2)
+	w.Close()
+
+	w, mem := openTestWal(t, dir)
+	defer w.Close()
+	for _, postId := range []int64{1, 2} {
+		if _, ok, _ := mem.GetPost(postId); !ok {
+			t.Fatalf("post %d was not recovered", postId)
+		}
+	}
+}
+
+// A corrupt record followed by later segments fails recovery rather than
+// skipping the records lost with it.
+func TestWalGapFailsRecovery(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := openTestWal(t, dir)
+	putPost(t, w, 1)
+	putPost(t, w, 2)
+	putPost(t, w, 3)
+	w.Close()
+	w, _ = openTestWal(t, dir)
+	putPost(t, w, 4)
+	w.Close()
+
+	segment := filepath.Join(dir, WAL_SEGMENT_PREFIX+"1"+WAL_SEGMENT_SUFFIX)
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in the payload of the second record.
+	second := WAL_RECORD_HDR_SIZE + int(binary.LittleEndian.Uint32(data))
+	data[second+WAL_RECORD_HDR_SIZE+2] ^= 0xff
+	if err := os.WriteFile(segment, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWriteAheadLog(&storageConfig{DataDir: dir}, newMemoryStorage()); err == nil {
+		t.Fatal("recovered over a lost record")
+	}
+}
@@ -24,6 +24,22 @@ type ClientResponse interface {
 	DecodableResponse
 }
 
+// Auth carries the access token returned by Login or Refresh. The requests
+// that act on behalf of a user embed it, and send the token in the
+// Authorization header.
+type Auth struct {
+	Token string
+}
+
+func (a *Auth) AuthToken() string {
+	return a.Token
+}
+
+type AuthenticatedRequest interface {
+	EncodableRequest
+	AuthToken() string
+}
+
 type RegisterUserRequest struct {
 	FirstName string
 	LastName  string
@@ -56,33 +72,145 @@ func (req *RegisterUserWithIdRequest) Encode(enc *codegen.Encoder) []byte {
 	return enc.Data()
 }
 
-type ReadHomeTimelineRequest struct {
+type GetProfileRequest struct {
+	UserId int64
+}
+
+func (req *GetProfileRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	return enc.Data()
+}
+
+// SearchUsersRequest looks users up by Query, matched case-insensitively
+// against their username and names as selected by Mode. Cursor is empty for
+// the first page and the Next cursor of the previous page otherwise; Limit is
+// the page size, 0 for the default. The response carries the id, username,
+// first and last name and avatar of each user, followed by the Next cursor.
+type SearchUsersRequest struct {
+	Query  string
+	Mode   common.UserSearchMode
+	Cursor string
+	Limit  int
+}
+
+func (req *SearchUsersRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.String(req.Query)
+	enc.Int(int(req.Mode))
+	enc.String(req.Cursor)
+	enc.Int(req.Limit)
+	return enc.Data()
+}
+
+// UpdateProfileRequest replaces the first and last name, bio and avatar of
+// the user. Avatar is the filename of an uploaded media, or empty.
+type UpdateProfileRequest struct {
+	Auth
+	UserId    int64
+	FirstName string
+	LastName  string
+	Bio       string
+	Avatar    string
+}
+
+func (req *UpdateProfileRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.String(req.FirstName)
+	enc.String(req.LastName)
+	enc.String(req.Bio)
+	enc.String(req.Avatar)
+	return enc.Data()
+}
+
+// ChangePasswordRequest ends all the sessions of the user once the password
+// is changed.
+type ChangePasswordRequest struct {
+	Auth
+	UserId      int64
+	OldPassword string
+	NewPassword string
+}
+
+func (req *ChangePasswordRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.String(req.OldPassword)
+	enc.String(req.NewPassword)
+	return enc.Data()
+}
+
+// DeleteUserRequest deletes the user with their posts, follow edges and
+// timelines.
+type DeleteUserRequest struct {
+	Auth
 	UserId int64
-	Start  int
-	Stop   int
+}
+
+func (req *DeleteUserRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	return enc.Data()
+}
+
+// SetPrivateRequest sets whether follows of the user must be approved.
+// Setting it to false approves the pending follow requests.
+type SetPrivateRequest struct {
+	Auth
+	UserId  int64
+	Private bool
+}
+
+func (req *SetPrivateRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Bool(req.Private)
+	return enc.Data()
+}
+
+// ReadHomeTimelineRequest reads the posts from Start to Stop, newest first,
+// counted from Cursor in Direction. An empty Cursor starts at the newest post
+// when going older and at the oldest post when going newer. The response
+// carries the cursors of the next older and newer pages after the posts.
+type ReadHomeTimelineRequest struct {
+	Auth
+	UserId    int64
+	Start     int
+	Stop      int
+	Cursor    string
+	Direction common.TimelineDirection
 }
 
 func (rhtr *ReadHomeTimelineRequest) Encode(enc *codegen.Encoder) []byte {
 	enc.Int64(rhtr.UserId)
 	enc.Int(rhtr.Start)
 	enc.Int(rhtr.Stop)
+	enc.String(rhtr.Cursor)
+	enc.Int((int)(rhtr.Direction))
 	return enc.Data()
 }
 
+// ReadUserTimelineRequest reads the posts from Start to Stop, newest first,
+// counted from Cursor in Direction. An empty Cursor starts at the newest post
+// when going older and at the oldest post when going newer. The response
+// carries the cursors of the next older and newer pages after the posts. The
+// timeline of a private user is only read with the token of the user or of a
+// follower of them.
 type ReadUserTimelineRequest struct {
-	UserId int64
-	Start  int
-	Stop   int
+	Auth
+	UserId    int64
+	Start     int
+	Stop      int
+	Cursor    string
+	Direction common.TimelineDirection
 }
 
 func (rutr *ReadUserTimelineRequest) Encode(enc *codegen.Encoder) []byte {
 	enc.Int64(rutr.UserId)
 	enc.Int(rutr.Start)
 	enc.Int(rutr.Stop)
+	enc.String(rutr.Cursor)
+	enc.Int((int)(rutr.Direction))
 	return enc.Data()
 }
 
 type ComposePostRequest struct {
+	Auth
 	Username   string
 	UserId     int64
 	Text       string
@@ -102,6 +230,7 @@ func (cpr *ComposePostRequest) Encode(enc *codegen.Encoder) []byte {
 }
 
 type RemovePostsRequest struct {
+	Auth
 	UserId int64
 	Start  int
 	Stop   int
@@ -125,7 +254,40 @@ func (req *LoginRequest) Encode(enc *codegen.Encoder) []byte {
 	return enc.Data()
 }
 
+// Tokens are returned by Login and Refresh. Token is the access token to set
+// in the Auth of later requests until it expires. RefreshToken is exchanged
+// for new Tokens with Refresh, and can only be used once.
+type Tokens struct {
+	Token        string
+	RefreshToken string
+}
+
+type RefreshRequest struct {
+	RefreshToken string
+}
+
+func (req *RefreshRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.String(req.RefreshToken)
+	return enc.Data()
+}
+
+// LogoutRequest ends the session of its token, or every session of its user
+// if AllSessions is set.
+type LogoutRequest struct {
+	Auth
+	AllSessions bool
+}
+
+func (req *LogoutRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Bool(req.AllSessions)
+	return enc.Data()
+}
+
+// FollowRequest and FollowWithUsernameRequest are answered with 202 Accepted
+// if the followee is private, in which case the follow waits for their
+// approval.
 type FollowRequest struct {
+	Auth
 	UserId     int64
 	FolloweeId int64
 }
@@ -137,6 +299,7 @@ func (fr *FollowRequest) Encode(enc *codegen.Encoder) []byte {
 }
 
 type FollowWithUsernameRequest struct {
+	Auth
 	Username         string
 	FolloweeUsername string
 }
@@ -148,6 +311,7 @@ func (req *FollowWithUsernameRequest) Encode(enc *codegen.Encoder) []byte {
 }
 
 type UnfollowRequest struct {
+	Auth
 	UserId     int64
 	FolloweeId int64
 }
@@ -159,6 +323,7 @@ func (ufr *UnfollowRequest) Encode(enc *codegen.Encoder) []byte {
 }
 
 type UnfollowWithUsernameRequest struct {
+	Auth
 	Username         string
 	FolloweeUsername string
 }
@@ -169,25 +334,206 @@ func (req *UnfollowWithUsernameRequest) Encode(enc *codegen.Encoder) []byte {
 	return enc.Data()
 }
 
+// GetFollowersRequest lists the followers of the user, with their usernames if
+// WithUsernames is set.
 type GetFollowersRequest struct {
-	UserId int64
+	UserId        int64
+	WithUsernames bool
 }
 
 func (gfr *GetFollowersRequest) Encode(enc *codegen.Encoder) []byte {
 	enc.Int64(gfr.UserId)
+	enc.Bool(gfr.WithUsernames)
 	return enc.Data()
 }
 
+// GetFolloweesRequest lists the followees of the user, with their usernames if
+// WithUsernames is set.
 type GetFolloweesRequest struct {
-	UserId int64
+	UserId        int64
+	WithUsernames bool
 }
 
 func (req *GetFolloweesRequest) Encode(enc *codegen.Encoder) []byte {
 	enc.Int64(req.UserId)
+	enc.Bool(req.WithUsernames)
+	return enc.Data()
+}
+
+// GetFollowCountsRequest asks for the number of followers and followees of
+// the user.
+type GetFollowCountsRequest struct {
+	UserId int64
+}
+
+func (req *GetFollowCountsRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	return enc.Data()
+}
+
+// GetFollowersPageRequest and GetFolloweesPageRequest list a page of the
+// followers or followees of the user in increasing user id order, with their
+// usernames if WithUsernames is set. Cursor is empty for the first page and
+// the Next cursor of the previous page otherwise; Limit is the page size, 0
+// for the default.
+type GetFollowersPageRequest struct {
+	UserId        int64
+	Cursor        string
+	Limit         int
+	WithUsernames bool
+}
+
+func (req *GetFollowersPageRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.String(req.Cursor)
+	enc.Int(req.Limit)
+	enc.Bool(req.WithUsernames)
+	return enc.Data()
+}
+
+type GetFolloweesPageRequest struct {
+	UserId        int64
+	Cursor        string
+	Limit         int
+	WithUsernames bool
+}
+
+func (req *GetFolloweesPageRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.String(req.Cursor)
+	enc.Int(req.Limit)
+	enc.Bool(req.WithUsernames)
+	return enc.Data()
+}
+
+// IsFollowingRequest asks whether the user follows FolloweeId.
+type IsFollowingRequest struct {
+	UserId     int64
+	FolloweeId int64
+}
+
+func (req *IsFollowingRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Int64(req.FolloweeId)
+	return enc.Data()
+}
+
+type BlockRequest struct {
+	Auth
+	UserId    int64
+	BlockedId int64
+}
+
+func (req *BlockRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Int64(req.BlockedId)
+	return enc.Data()
+}
+
+type UnblockRequest struct {
+	Auth
+	UserId    int64
+	BlockedId int64
+}
+
+func (req *UnblockRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Int64(req.BlockedId)
+	return enc.Data()
+}
+
+type MuteRequest struct {
+	Auth
+	UserId  int64
+	MutedId int64
+}
+
+func (req *MuteRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Int64(req.MutedId)
+	return enc.Data()
+}
+
+type UnmuteRequest struct {
+	Auth
+	UserId  int64
+	MutedId int64
+}
+
+func (req *UnmuteRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Int64(req.MutedId)
+	return enc.Data()
+}
+
+// GetBlockedRequest lists the users that the user blocks, with their usernames
+// if WithUsernames is set.
+type GetBlockedRequest struct {
+	Auth
+	UserId        int64
+	WithUsernames bool
+}
+
+func (req *GetBlockedRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Bool(req.WithUsernames)
+	return enc.Data()
+}
+
+// GetMutedRequest lists the users that the user mutes, with their usernames
+// if WithUsernames is set.
+type GetMutedRequest struct {
+	Auth
+	UserId        int64
+	WithUsernames bool
+}
+
+func (req *GetMutedRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Bool(req.WithUsernames)
+	return enc.Data()
+}
+
+// GetFollowRequestsRequest lists the users with a pending request to follow
+// the user, with their usernames if WithUsernames is set.
+type GetFollowRequestsRequest struct {
+	Auth
+	UserId        int64
+	WithUsernames bool
+}
+
+func (req *GetFollowRequestsRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Bool(req.WithUsernames)
+	return enc.Data()
+}
+
+type ApproveFollowerRequest struct {
+	Auth
+	UserId     int64
+	FollowerId int64
+}
+
+func (req *ApproveFollowerRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Int64(req.FollowerId)
+	return enc.Data()
+}
+
+type RejectFollowerRequest struct {
+	Auth
+	UserId     int64
+	FollowerId int64
+}
+
+func (req *RejectFollowerRequest) Encode(enc *codegen.Encoder) []byte {
+	enc.Int64(req.UserId)
+	enc.Int64(req.FollowerId)
 	return enc.Data()
 }
 
 type UploadMediaRequest struct {
+	Auth
 	Filename string
 	Data     string
 }
@@ -27,13 +27,19 @@ func releaseClient(client *http.Client) {
 }
 
 const (
-	BASE_PORT = "49555"
-	BASE_URL  = "http://10.10.1.1:" + BASE_PORT
+	BASE_PORT  = "49555"
+	BASE_URL   = "http://10.10.1.1:" + BASE_PORT
+	ADMIN_PORT = "49556"
 )
 
 // var client = &http.Client{}
 
 func SendRequest(address string, data []byte) (*http.Response, error) {
+	return SendAuthRequest(address, "", data)
+}
+
+// SendAuthRequest sends the token, if any, as a bearer token.
+func SendAuthRequest(address string, token string, data []byte) (*http.Response, error) {
 	// fmt.Println("Sending to addr:", address)
 	req, err := http.NewRequest("POST", address, bytes.NewBuffer(data))
 	if err != nil {
@@ -41,6 +47,9 @@ func SendRequest(address string, data []byte) (*http.Response, error) {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/custom")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 	client := getClient()
 	defer releaseClient(client)
 
@@ -84,25 +93,125 @@ func DecodeData(response *http.Response, action func(*codegen.Decoder)) {
 }
 
 func send_request_wrapper(full_addr string, req EncodableRequest) (*http.Response, error) {
-	return SendRequest(full_addr, req.Encode(codegen.NewEncoder()))
+	var token string
+	if auth, ok := req.(AuthenticatedRequest); ok {
+		token = auth.AuthToken()
+	}
+	return SendAuthRequest(full_addr, token, req.Encode(codegen.NewEncoder()))
+}
+
+// RegisterUser and RegisterUserWithId return an error with the status of the
+// response if the user was not registered: 409 Conflict if the username or
+// user id is taken, and 400 Bad Request if the username or password is
+// invalid.
+func RegisterUser(addr string, req *RegisterUserRequest) error {
+	return request_status("RegisterUser", addr+common.REGISTER_USER_ENDPOINT, req)
 }
 
-func RegisterUser(addr string, req *RegisterUserRequest) {
-	resp, err := send_request_wrapper(addr+common.REGISTER_USER_ENDPOINT, req)
+func RegisterUserWithId(addr string, req *RegisterUserWithIdRequest) error {
+	return request_status("RegisterUserWithId", addr+common.REGISTER_USER_WITH_ID_ENDPOINT, req)
+}
+
+// request_status sends the request and returns an error if it fails or its
+// response is not 200 OK.
+func request_status(name string, url string, req EncodableRequest) error {
+	resp, err := send_request_wrapper(url, req)
 	if err != nil {
-		fmt.Println("[RegisterUser] Error:", err)
-		return
+		fmt.Printf("[%s] Error: %v\n", name, err)
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("[%s] %s: %s", name, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
 }
 
-func RegisterUserWithId(addr string, req *RegisterUserWithIdRequest) {
-	resp, err := send_request_wrapper(addr+common.REGISTER_USER_WITH_ID_ENDPOINT, req)
+// GetProfile returns the public part of the profile of the user.
+func GetProfile(addr string, req *GetProfileRequest) (common.UserInfo, error) {
+	resp, err := send_request_wrapper(addr+common.GET_PROFILE_ENDPOINT, req)
 	if err != nil {
-		fmt.Println("[RegisterUserWithId] Error:", err)
-		return
+		fmt.Println("[GetProfile] Error:", err)
+		return common.UserInfo{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return common.UserInfo{}, fmt.Errorf("[GetProfile] %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var info common.UserInfo
+	DecodeData(resp, func(dec *codegen.Decoder) {
+		info.UserId = dec.Int64()
+		info.Username = dec.String()
+		info.FirstName = dec.String()
+		info.LastName = dec.String()
+		info.Bio = dec.String()
+		info.Avatar = dec.String()
+		info.CreatedAt = dec.Int64()
+		info.Private = dec.Bool()
+	})
+	return info, nil
+}
+
+// UserSearchPage is a page of the users found by SearchUsers. Next is the
+// cursor of the next page, or empty if this is the last one.
+type UserSearchPage struct {
+	Users []common.UserInfo
+	Next  string
+}
+
+// SearchUsers returns a page of the users that match the query. It returns an
+// error with the status of the response if it fails: 400 Bad Request if the
+// request is invalid, 503 Service Unavailable if the search index is still
+// loading.
+func SearchUsers(addr string, req *SearchUsersRequest) (UserSearchPage, error) {
+	resp, err := send_request_wrapper(addr+common.SEARCH_USERS_ENDPOINT, req)
+	if err != nil {
+		fmt.Println("[SearchUsers] Error:", err)
+		return UserSearchPage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return UserSearchPage{}, fmt.Errorf("[SearchUsers] %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var page UserSearchPage
+	DecodeData(resp, func(dec *codegen.Decoder) {
+		n := dec.Int()
+		page.Users = make([]common.UserInfo, n)
+		for i := range page.Users {
+			page.Users[i].UserId = dec.Int64()
+			page.Users[i].Username = dec.String()
+			page.Users[i].FirstName = dec.String()
+			page.Users[i].LastName = dec.String()
+			page.Users[i].Avatar = dec.String()
+		}
+		page.Next = dec.String()
+	})
+	return page, nil
+}
+
+// UpdateProfile, ChangePassword and DeleteUser return an error with the
+// status of the response if they fail: 404 Not Found if the user has no
+// profile, 403 Forbidden if the old password does not match, 409 Conflict if
+// the profile kept changing, and 400 Bad Request if the request is invalid.
+func UpdateProfile(addr string, req *UpdateProfileRequest) error {
+	return request_status("UpdateProfile", addr+common.UPDATE_PROFILE_ENDPOINT, req)
+}
+
+func ChangePassword(addr string, req *ChangePasswordRequest) error {
+	return request_status("ChangePassword", addr+common.CHANGE_PASSWORD_ENDPOINT, req)
+}
+
+func DeleteUser(addr string, req *DeleteUserRequest) error {
+	return request_status("DeleteUser", addr+common.DELETE_USER_ENDPOINT, req)
+}
+
+// SetPrivate returns an error with the status of the response if it fails,
+// as UpdateProfile.
+func SetPrivate(addr string, req *SetPrivateRequest) error {
+	return request_status("SetPrivate", addr+common.SET_PRIVATE_ENDPOINT, req)
 }
 
 func ReadHomeTimeline(addr string, req *ReadHomeTimelineRequest) {
@@ -141,13 +250,37 @@ func ComposePost(addr string, req *ComposePostRequest) {
 	defer resp.Body.Close()
 }
 
-func Login(addr string, req *LoginRequest) {
-	resp, err := send_request_wrapper(addr+common.LOGIN_ENDPOINT, req)
+// Login starts a session and returns its tokens.
+func Login(addr string, req *LoginRequest) (Tokens, error) {
+	return request_tokens("Login", addr+common.LOGIN_ENDPOINT, req)
+}
+
+// Refresh returns new tokens of the session of the refresh token.
+func Refresh(addr string, req *RefreshRequest) (Tokens, error) {
+	return request_tokens("Refresh", addr+common.REFRESH_ENDPOINT, req)
+}
+
+func request_tokens(name string, url string, req EncodableRequest) (Tokens, error) {
+	resp, err := send_request_wrapper(url, req)
 	if err != nil {
-		fmt.Println("[Login] Error:", err)
-		return
+		fmt.Printf("[%s] Error: %v\n", name, err)
+		return Tokens{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return Tokens{}, fmt.Errorf("[%s] %s: %s", name, resp.Status, bytes.TrimSpace(body))
+	}
+	var tokens Tokens
+	DecodeData(resp, func(dec *codegen.Decoder) {
+		tokens.Token = dec.String()
+		tokens.RefreshToken = dec.String()
+	})
+	return tokens, nil
+}
+
+func Logout(addr string, req *LogoutRequest) error {
+	return request_status("Logout", addr+common.LOGOUT_ENDPOINT, req)
 }
 
 func Follow(addr string, req *FollowRequest) {
@@ -204,6 +337,158 @@ func GetFollowees(addr string, req *GetFolloweesRequest) {
 	defer resp.Body.Close()
 }
 
+func GetFollowCounts(addr string, req *GetFollowCountsRequest) (int, int, error) {
+	resp, err := send_request_wrapper(addr+common.GET_FOLLOW_COUNTS_ENDPOINT, req)
+	if err != nil {
+		fmt.Println("[GetFollowCounts] Error:", err)
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, 0, fmt.Errorf("[GetFollowCounts] %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var followers, followees int
+	DecodeData(resp, func(dec *codegen.Decoder) {
+		followers = dec.Int()
+		followees = dec.Int()
+	})
+	return followers, followees, nil
+}
+
+// FollowPage is a page of the users listed by GetFollowersPage or
+// GetFolloweesPage. Next is the cursor of the next page, or empty if this is
+// the last one.
+type FollowPage struct {
+	Users []common.UserInfo
+	Next  string
+}
+
+// GetFollowersPage and GetFolloweesPage return a page of the followers or
+// followees of the user, with their usernames if they were asked for. They
+// return an error with the status of the response if they fail: 400 Bad
+// Request if the cursor is invalid.
+func GetFollowersPage(addr string, req *GetFollowersPageRequest) (FollowPage, error) {
+	return request_follow_page("GetFollowersPage", addr+common.GET_FOLLOWERS_PAGE_ENDPOINT, req, req.WithUsernames)
+}
+
+func GetFolloweesPage(addr string, req *GetFolloweesPageRequest) (FollowPage, error) {
+	return request_follow_page("GetFolloweesPage", addr+common.GET_FOLLOWEES_PAGE_ENDPOINT, req, req.WithUsernames)
+}
+
+func request_follow_page(name string, url string, req EncodableRequest, with_usernames bool) (FollowPage, error) {
+	resp, err := send_request_wrapper(url, req)
+	if err != nil {
+		fmt.Printf("[%s] Error: %v\n", name, err)
+		return FollowPage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return FollowPage{}, fmt.Errorf("[%s] %s: %s", name, resp.Status, bytes.TrimSpace(body))
+	}
+	var page FollowPage
+	DecodeData(resp, func(dec *codegen.Decoder) {
+		page.Users = decode_user_ids(dec, with_usernames)
+		page.Next = dec.String()
+	})
+	return page, nil
+}
+
+func IsFollowing(addr string, req *IsFollowingRequest) (bool, error) {
+	resp, err := send_request_wrapper(addr+common.IS_FOLLOWING_ENDPOINT, req)
+	if err != nil {
+		fmt.Println("[IsFollowing] Error:", err)
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("[IsFollowing] %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var following bool
+	DecodeData(resp, func(dec *codegen.Decoder) {
+		following = dec.Bool()
+	})
+	return following, nil
+}
+
+// Block, Unblock, Mute and Unmute return an error with the status of the
+// response if they fail: 404 Not Found if the other user does not exist, and
+// 400 Bad Request if it is the user themselves.
+func Block(addr string, req *BlockRequest) error {
+	return request_status("Block", addr+common.BLOCK_ENDPOINT, req)
+}
+
+func Unblock(addr string, req *UnblockRequest) error {
+	return request_status("Unblock", addr+common.UNBLOCK_ENDPOINT, req)
+}
+
+func Mute(addr string, req *MuteRequest) error {
+	return request_status("Mute", addr+common.MUTE_ENDPOINT, req)
+}
+
+func Unmute(addr string, req *UnmuteRequest) error {
+	return request_status("Unmute", addr+common.UNMUTE_ENDPOINT, req)
+}
+
+// GetBlocked and GetMuted return the users that the user blocks or mutes,
+// with their usernames if they were asked for.
+func GetBlocked(addr string, req *GetBlockedRequest) ([]common.UserInfo, error) {
+	return request_user_ids("GetBlocked", addr+common.GET_BLOCKED_ENDPOINT, req, req.WithUsernames)
+}
+
+func GetMuted(addr string, req *GetMutedRequest) ([]common.UserInfo, error) {
+	return request_user_ids("GetMuted", addr+common.GET_MUTED_ENDPOINT, req, req.WithUsernames)
+}
+
+// GetFollowRequests returns the users with a pending request to follow the
+// user, with their usernames if they were asked for.
+func GetFollowRequests(addr string, req *GetFollowRequestsRequest) ([]common.UserInfo, error) {
+	return request_user_ids("GetFollowRequests", addr+common.GET_FOLLOW_REQUESTS_ENDPOINT, req, req.WithUsernames)
+}
+
+// ApproveFollower and RejectFollower return an error with the status of the
+// response if they fail: 404 Not Found if the follower has no pending request
+// to follow the user.
+func ApproveFollower(addr string, req *ApproveFollowerRequest) error {
+	return request_status("ApproveFollower", addr+common.APPROVE_FOLLOWER_ENDPOINT, req)
+}
+
+func RejectFollower(addr string, req *RejectFollowerRequest) error {
+	return request_status("RejectFollower", addr+common.REJECT_FOLLOWER_ENDPOINT, req)
+}
+
+func request_user_ids(name string, url string, req EncodableRequest, with_usernames bool) ([]common.UserInfo, error) {
+	resp, err := send_request_wrapper(url, req)
+	if err != nil {
+		fmt.Printf("[%s] Error: %v\n", name, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("[%s] %s: %s", name, resp.Status, bytes.TrimSpace(body))
+	}
+	var users []common.UserInfo
+	DecodeData(resp, func(dec *codegen.Decoder) {
+		users = decode_user_ids(dec, with_usernames)
+	})
+	return users, nil
+}
+
+// decode_user_ids reads the user ids written by encode_user_ids on the server.
+func decode_user_ids(dec *codegen.Decoder, with_usernames bool) []common.UserInfo {
+	users := make([]common.UserInfo, dec.Int())
+	for i := range users {
+		users[i].UserId = dec.Int64()
+		if with_usernames {
+			users[i].Username = dec.String()
+		}
+	}
+	return users
+}
+
 func UploadMedia(addr string, req *UploadMediaRequest) {
 	resp, err := send_request_wrapper(common.UPLOAD_MEDIA_ENDPOINT, req)
 	if err != nil {
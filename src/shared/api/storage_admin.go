@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"SocialNetwork/shared/common"
+)
+
+// The admin endpoints exchange JSON and report failures with an error status
+// and message, which the calls below return as errors. They are served on the
+// admin listener and need the admin token of the deployment, except the storage
+// stats, which are served on the api listener.
+
+// ExportStorage downloads the contents of the storage of a deployment.
+func ExportStorage(addr, token string) (common.StorageDump, error) {
+	var dump common.StorageDump
+	err := getJson(addr+common.EXPORT_STORAGE_ENDPOINT, token, &dump)
+	return dump, err
+}
+
+// ImportStorage loads dump into the storage of a deployment, on top of its
+// current contents.
+func ImportStorage(addr, token string, dump *common.StorageDump) error {
+	return postJson(addr+common.IMPORT_STORAGE_ENDPOINT, token, dump)
+}
+
+// GetStorageStats returns the size of the storage maps of a deployment, from
+// the address of its api listener.
+func GetStorageStats(addr string) (common.StorageStatsReport, error) {
+	var report common.StorageStatsReport
+	err := getJson(addr+common.STORAGE_STATS_ENDPOINT, "", &report)
+	return report, err
+}
+
+// UnlockUser lifts the lockout of a username after too many failed logins.
+func UnlockUser(addr, token, username string) error {
+	return postJson(addr+common.UNLOCK_USER_ENDPOINT, token, struct{ Username string }{username})
+}
+
+// sendJson sends req with the token, if any, as a bearer token.
+func sendJson(req *http.Request, token string) (*http.Response, error) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func getJson(url, token string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := sendJson(req, token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func postJson(url, token string, in interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sendJson(req, token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"SocialNetwork/shared/common"
+)
+
+// A storage dump file is a gzipped JSON StorageDumpFile. The version is
+// bumped whenever a change to StorageDump cannot be read by older tools.
+const (
+	STORAGE_DUMP_FORMAT  = "socialnet-storage-dump"
+	STORAGE_DUMP_VERSION = 1
+)
+
+type StorageDumpFile struct {
+	Format  string
+	Version int
+	// CreatedAt is in unix milliseconds.
+	CreatedAt int64
+	Dump      common.StorageDump
+}
+
+func WriteStorageDump(w io.Writer, file *StorageDumpFile) error {
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(file); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func ReadStorageDump(r io.Reader) (*StorageDumpFile, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a storage dump: %w", err)
+	}
+	defer zr.Close()
+	var file StorageDumpFile
+	if err := json.NewDecoder(zr).Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.Format != STORAGE_DUMP_FORMAT {
+		return nil, fmt.Errorf("not a storage dump: format %q", file.Format)
+	}
+	if file.Version < 1 || file.Version > STORAGE_DUMP_VERSION {
+		return nil, fmt.Errorf("unsupported storage dump version %d, expected at most %d", file.Version, STORAGE_DUMP_VERSION)
+	}
+	return &file, nil
+}
+
+// CheckStorageDump returns the inconsistencies of dump: timeline entries of
+// posts that do not exist or whose timestamp differs from the post, user
+// timeline entries of posts by other users, follow, block, mute and follow
+// request relationships that have only one of their two edges, and user id
+// index entries that do not match a profile.
+func CheckStorageDump(dump *common.StorageDump) []string {
+	problems := make([]string, 0)
+	checkTimelines := func(kind string, timelines map[int64][]common.TimelineEntry) {
+		for _, userId := range sortedKeys(timelines) {
+			for _, entry := range timelines[userId] {
+				post, exist := dump.Posts[entry.PostId]
+				switch {
+				case !exist:
+					problems = append(problems, fmt.Sprintf("%s timeline of user %d: post %d does not exist", kind, userId, entry.PostId))
+				case post.Timestamp != entry.Timestamp:
+					problems = append(problems, fmt.Sprintf("%s timeline of user %d: post %d has timestamp %d, not %d", kind, userId, entry.PostId, post.Timestamp, entry.Timestamp))
+				case kind == "user" && post.Creator.UserId != userId:
+					problems = append(problems, fmt.Sprintf("user timeline of user %d: post %d is by user %d", userId, entry.PostId, post.Creator.UserId))
+				}
+			}
+		}
+	}
+	checkTimelines("user", dump.UserTimelines)
+	checkTimelines("home", dump.HomeTimelines)
+
+	checkEdges := func(edges, reverse map[int64][]int64, format string) {
+		for _, userId := range sortedKeys(edges) {
+			for _, otherId := range edges[userId] {
+				if !containsInt64(reverse[otherId], userId) {
+					problems = append(problems, fmt.Sprintf(format, userId, otherId))
+				}
+			}
+		}
+	}
+	checkEdges(dump.Followees, dump.Followers, "user %d follows user %d but is not among its followers")
+	checkEdges(dump.Followers, dump.Followees, "user %d has follower %d but is not among its followees")
+	checkEdges(dump.Blocked, dump.Blockers, "user %d blocks user %d but is not among its blockers")
+	checkEdges(dump.Blockers, dump.Blocked, "user %d is blocked by user %d but is not among its blocked users")
+	checkEdges(dump.Muted, dump.Muters, "user %d mutes user %d but is not among its muters")
+	checkEdges(dump.Muters, dump.Muted, "user %d is muted by user %d but is not among its muted users")
+	checkEdges(dump.Requested, dump.Requesters, "user %d asked to follow user %d but is not among its requesters")
+	checkEdges(dump.Requesters, dump.Requested, "user %d has follow request from %d but is not among its requests")
+
+	// Dumps written before the user id index existed lack it altogether.
+	if dump.UserIds != nil {
+		for _, userId := range sortedKeys(dump.UserIds) {
+			username := dump.UserIds[userId]
+			profile, exist := dump.UserProfiles[username]
+			switch {
+			case !exist:
+				problems = append(problems, fmt.Sprintf("user id %d is indexed as %q, which has no profile", userId, username))
+			case profile.UserId != userId:
+				problems = append(problems, fmt.Sprintf("user id %d is indexed as %q, whose profile has user id %d", userId, username, profile.UserId))
+			}
+		}
+		for _, username := range sortedStrings(dump.UserProfiles) {
+			userId := dump.UserProfiles[username].UserId
+			if _, exist := dump.UserIds[userId]; !exist {
+				problems = append(problems, fmt.Sprintf("user %q has user id %d, which is not indexed", username, userId))
+			}
+		}
+	}
+	return problems
+}
+
+func sortedKeys[V any](m map[int64]V) []int64 {
+	keys := make([]int64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func sortedStrings[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsInt64(list []int64, x int64) bool {
+	for _, y := range list {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
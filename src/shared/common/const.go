@@ -4,8 +4,15 @@ const (
 	REMOVE_POSTS_ENDPOINT           = "/remove_posts"
 	COMPOSE_POST_ENDPOINT           = "/compose_post"
 	LOGIN_ENDPOINT                  = "/login"
+	REFRESH_ENDPOINT                = "/refresh"
+	LOGOUT_ENDPOINT                 = "/logout"
 	REGISTER_USER_ENDPOINT          = "/register_user"
 	REGISTER_USER_WITH_ID_ENDPOINT  = "/register_user_with_id"
+	GET_PROFILE_ENDPOINT            = "/get_profile"
+	UPDATE_PROFILE_ENDPOINT         = "/update_profile"
+	CHANGE_PASSWORD_ENDPOINT        = "/change_password"
+	DELETE_USER_ENDPOINT            = "/delete_user"
+	SET_PRIVATE_ENDPOINT            = "/set_private"
 	READ_USER_TIMELINE_ENDPOINT     = "/read_user_timeline"
 	GET_FOLLOWERS_ENDPOINT          = "/get_followers"
 	UNFOLLOW_ENDPOINT               = "/unfollow"
@@ -13,7 +20,26 @@ const (
 	FOLLOW_ENDPOINT                 = "/follow"
 	FOLLOW_WITH_USERNAME_ENDPOINT   = "/follow_with_username"
 	GET_FOLLOWEES_ENDPOINT          = "/get_followees"
+	GET_FOLLOW_COUNTS_ENDPOINT      = "/get_follow_counts"
+	GET_FOLLOWERS_PAGE_ENDPOINT     = "/get_followers_page"
+	GET_FOLLOWEES_PAGE_ENDPOINT     = "/get_followees_page"
+	IS_FOLLOWING_ENDPOINT           = "/is_following"
+	BLOCK_ENDPOINT                  = "/block"
+	UNBLOCK_ENDPOINT                = "/unblock"
+	MUTE_ENDPOINT                   = "/mute"
+	UNMUTE_ENDPOINT                 = "/unmute"
+	GET_BLOCKED_ENDPOINT            = "/get_blocked"
+	GET_MUTED_ENDPOINT              = "/get_muted"
+	GET_FOLLOW_REQUESTS_ENDPOINT    = "/get_follow_requests"
+	APPROVE_FOLLOWER_ENDPOINT       = "/approve_follower"
+	REJECT_FOLLOWER_ENDPOINT        = "/reject_follower"
 	READ_HOME_TIMELINE_ENDPOINT     = "/read_home_timeline"
 	UPLOAD_MEDIA_ENDPOINT           = "/upload_media"
 	GET_MEDIA_ENDPOINT              = "/get_media"
+	SEARCH_USERS_ENDPOINT           = "/search_users"
+	EXPORT_STORAGE_ENDPOINT         = "/admin/export_storage"
+	IMPORT_STORAGE_ENDPOINT         = "/admin/import_storage"
+	STORAGE_STATS_ENDPOINT          = "/admin/storage_stats"
+	SWEEP_EXPIRED_ENDPOINT          = "/admin/sweep_expired"
+	UNLOCK_USER_ENDPOINT            = "/admin/unlock_user"
 )
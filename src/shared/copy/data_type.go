@@ -13,8 +13,30 @@ type UserProfile struct {
 	UserId         int64
 	FirstName      string
 	LastName       string
-	Salt           string
+	Salt           string // only set by legacy hashes; see server/password.go
 	PasswordHashed string
+	Bio            string
+	// Avatar is the filename of an uploaded media, or empty.
+	Avatar string
+	// CreatedAt is the unix time in seconds at which the user registered,
+	// or zero for users registered before it was recorded.
+	CreatedAt int64
+	// Private is set if follows of the user must be approved; see
+	// server/follow_requests.go.
+	Private bool
+}
+
+// UserInfo is the part of a user profile that is shown to other users.
+type UserInfo struct {
+	weaver.AutoMarshal
+	UserId    int64
+	Username  string
+	FirstName string
+	LastName  string
+	Bio       string
+	Avatar    string
+	CreatedAt int64
+	Private   bool
 }
 
 type PostType int
@@ -26,6 +48,32 @@ const (
 	DM     PostType = 3
 )
 
+// TimelineDirection selects on which side of a cursor a timeline is read.
+type TimelineDirection int
+
+const (
+	TIMELINE_OLDER TimelineDirection = 0
+	TIMELINE_NEWER TimelineDirection = 1
+)
+
+// UserSearchMode selects how a user search query is matched: against the
+// start of the username and names, or anywhere in them.
+type UserSearchMode int
+
+const (
+	SEARCH_PREFIX    UserSearchMode = 0
+	SEARCH_SUBSTRING UserSearchMode = 1
+)
+
+// TimelineEntry is the position of a post in a timeline. Timelines are
+// ordered by timestamp and then by post id, so that posts created in the same
+// second keep a stable order.
+type TimelineEntry struct {
+	weaver.AutoMarshal
+	Timestamp int64
+	PostId    int64
+}
+
 type Post struct {
 	weaver.AutoMarshal
 	Post_id       int64
@@ -63,3 +111,64 @@ type TextServiceReturn struct {
 	User_mentions []UserMention
 	Urls          []Url
 }
+
+// StorageDump holds the contents of Storage, or of some of its routing
+// buckets. Timelines are listed oldest entry first.
+type StorageDump struct {
+	weaver.AutoMarshal
+	UserProfiles  map[string]UserProfile
+	Posts         map[int64]Post
+	MediaData     map[string]string
+	ShortUrls     map[string]string
+	Followers     map[int64][]int64
+	Followees     map[int64][]int64
+	UserTimelines map[int64][]TimelineEntry
+	HomeTimelines map[int64][]TimelineEntry
+	// UserIds indexes the usernames by user id. Dumps written before the
+	// index existed lack it, and it is rebuilt from UserProfiles on import.
+	UserIds map[int64]string
+	// Blocked and Muted hold the users that each user blocks or mutes, and
+	// Blockers and Muters the reverse edges. Dumps written before blocks and
+	// mutes existed lack them.
+	Blocked  map[int64][]int64
+	Blockers map[int64][]int64
+	Muted    map[int64][]int64
+	Muters   map[int64][]int64
+	// Requested holds the pending follow requests of each user and
+	// Requesters the reverse edges.
+	Requested  map[int64][]int64
+	Requesters map[int64][]int64
+
+	// The expiries hold the expiry time, in unix milliseconds, of the posts,
+	// media and short urls that were put with a time to live.
+	PostExpiries     map[int64]int64
+	MediaExpiries    map[string]int64
+	ShortUrlExpiries map[string]int64
+}
+
+// StorageMapStats is the size of one map of Storage. Items is the number of
+// edges or timeline entries for the follow, block, mute and follow request
+// graphs and the timelines, and the number of keys for the other maps. Bytes is approximate.
+type StorageMapStats struct {
+	weaver.AutoMarshal
+	Map     string
+	Entries int64
+	Items   int64
+	Bytes   int64
+}
+
+// StorageStats is the size of the maps of one Storage replica.
+type StorageStats struct {
+	weaver.AutoMarshal
+	Replica string
+	Role    string
+	Maps    []StorageMapStats
+}
+
+// StorageStatsReport is the size of the maps of every Storage replica and of
+// the whole deployment.
+type StorageStatsReport struct {
+	weaver.AutoMarshal
+	Replicas []StorageStats
+	Total    []StorageMapStats
+}